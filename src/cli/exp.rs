@@ -1,12 +1,13 @@
 //! `exp` CLI sub-command.
 
-use crate::{initrd, util};
+use crate::{initrd, metadata, util};
 use anyhow::{anyhow, bail, Result};
 use clap::ArgMatches;
 
 /// Experimental subcommands.
 #[derive(Debug)]
 pub enum CliExp {
+    ListProviders,
     RdNetworkKargs(CliRdNetworkKargs),
 }
 
@@ -18,6 +19,7 @@ impl CliExp {
         }
 
         let cfg = match app_matches.subcommand() {
+            ("list-providers", Some(_)) => CliExp::ListProviders,
             ("rd-network-kargs", Some(matches)) => CliRdNetworkKargs::parse(matches)?,
             (x, _) => unreachable!("unrecognized subcommand for 'exp': '{}'", x),
         };
@@ -28,6 +30,11 @@ impl CliExp {
     // Run sub-command.
     pub(crate) fn run(&self) -> Result<()> {
         match self {
+            CliExp::ListProviders => {
+                for id in metadata::provider_ids() {
+                    println!("{}", id);
+                }
+            }
             CliExp::RdNetworkKargs(cmd) => cmd.run()?,
         };
         Ok(())
@@ -1,5 +1,7 @@
 //! Command-line arguments parsing.
 
+use crate::redact;
+use crate::report;
 use anyhow::{bail, Result};
 use clap::{self, crate_version, App, AppSettings, Arg, ArgMatches, SubCommand};
 use slog_scope::trace;
@@ -10,6 +12,9 @@ mod multi;
 /// Path to kernel command-line (requires procfs mount).
 const CMDLINE_PATH: &str = "/proc/cmdline";
 
+/// Environment variable which can provide the provider ID.
+const PROVIDER_ENV: &str = "AFTERBURN_PROVIDER";
+
 /// CLI sub-commands configuration.
 #[derive(Debug)]
 pub(crate) enum CliConfig {
@@ -29,11 +34,11 @@ impl CliConfig {
         Ok(cfg)
     }
 
-    /// Run the relevant CLI sub-command.
-    pub fn run(self) -> Result<()> {
+    /// Run the relevant CLI sub-command, returning the process exit code.
+    pub fn run(self, warnings: report::Warnings, redactions: redact::Redactions) -> Result<i32> {
         match self {
-            CliConfig::Multi(cmd) => cmd.run(),
-            CliConfig::Exp(cmd) => cmd.run(),
+            CliConfig::Multi(cmd) => cmd.run(warnings, redactions),
+            CliConfig::Exp(cmd) => cmd.run().map(|_| 0),
         }
     }
 }
@@ -52,13 +57,43 @@ pub(crate) fn parse_args(argv: impl IntoIterator<Item = String>) -> Result<CliCo
     Ok(cfg)
 }
 
-/// Parse provider ID from flag or kargs.
+/// Parse provider ID from flag, environment, kargs, or Ignition platform-id file.
 fn parse_provider(matches: &clap::ArgMatches) -> Result<String> {
-    let provider = match (matches.value_of("provider"), matches.is_present("cmdline")) {
-        (Some(provider), false) => String::from(provider),
-        (None, true) => crate::util::get_platform(CMDLINE_PATH)?,
-        (None, false) => bail!("must set either --provider or --cmdline"),
-        (Some(_), true) => bail!("cannot process both --provider and --cmdline"),
+    let env_provider = std::env::var(PROVIDER_ENV).ok();
+    provider_from_sources(matches, env_provider, CMDLINE_PATH)
+}
+
+/// Pick the provider ID, with `--provider` taking precedence over
+/// `--cmdline`, which takes precedence over the environment.
+fn provider_from_sources(
+    matches: &clap::ArgMatches,
+    env_provider: Option<String>,
+    cmdline_path: &str,
+) -> Result<String> {
+    if let Some(path) = matches.value_of("platform-file") {
+        if matches.is_present("provider") || matches.is_present("cmdline") {
+            bail!("cannot process --platform-file together with --provider or --cmdline");
+        }
+        return crate::util::get_ignition_platform(path);
+    }
+
+    let env_provider = env_provider.filter(|p| !p.is_empty());
+    let provider = match (
+        matches.value_of("provider"),
+        env_provider,
+        matches.is_present("cmdline"),
+    ) {
+        (Some(_), _, true) => bail!("cannot process both --provider and --cmdline"),
+        (Some(provider), _, false) => String::from(provider),
+        (None, _, true) => crate::util::get_platform(cmdline_path)?,
+        (None, Some(provider), false) => {
+            trace!("using provider '{}' from {}", provider, PROVIDER_ENV);
+            provider
+        }
+        (None, None, false) => bail!(
+            "must set either --provider or --cmdline, or {} in the environment",
+            PROVIDER_ENV
+        ),
     };
 
     Ok(provider)
@@ -93,39 +128,263 @@ fn cli_setup<'a, 'b>() -> App<'a, 'b> {
                         .global(true)
                         .help("Read the cloud provider from the kernel cmdline"),
                 )
+                .arg(
+                    Arg::with_name("platform-file")
+                        .long("platform-file")
+                        .help("Read the cloud provider from an Ignition platform-id file")
+                        .takes_value(true),
+                )
                 .arg(
                     Arg::with_name("attributes")
                         .long("attributes")
                         .help("The file into which the metadata attributes are written")
                         .takes_value(true),
                 )
+                .arg(
+                    Arg::with_name("attributes-mode")
+                        .long("attributes-mode")
+                        .help("Octal permissions of the attributes file [default: 0644]")
+                        .takes_value(true),
+                )
+                .arg(
+                    Arg::with_name("attributes-format")
+                        .long("attributes-format")
+                        .help("Format of the attributes file [default: env]")
+                        .possible_values(&["env", "json"])
+                        .requires("attributes")
+                        .takes_value(true),
+                )
+                .arg(
+                    Arg::with_name("attributes-filter")
+                        .long("attributes-filter")
+                        .help("Comma-separated glob patterns of attributes to write")
+                        .requires("attributes")
+                        .takes_value(true),
+                )
                 .arg(
                     Arg::with_name("check-in")
                         .long("check-in")
                         .help("Check-in this instance boot with the cloud provider"),
                 )
+                .arg(
+                    Arg::with_name("config-drive-read-retries")
+                        .long("config-drive-read-retries")
+                        .help("Number of retries for failed reads from config-drives")
+                        .default_value("0")
+                        .takes_value(true),
+                )
+                .arg(
+                    Arg::with_name("config-drive-read-interval")
+                        .long("config-drive-read-interval")
+                        .help("Delay in milliseconds between retries of config-drive reads")
+                        .default_value("500")
+                        .takes_value(true),
+                )
+                .arg(
+                    Arg::with_name("default-dns")
+                        .long("default-dns")
+                        .help("Comma-separated DNS servers to use when the provider reports none")
+                        .takes_value(true),
+                )
+                .arg(
+                    Arg::with_name("exec")
+                        .long("exec")
+                        .help("Run the command given after '--' with the attributes in its environment")
+                        .requires("command"),
+                )
+                .arg(
+                    Arg::with_name("fail-on-empty")
+                        .long("fail-on-empty")
+                        .help("Fail if the provider returns no metadata at all"),
+                )
+                .arg(
+                    Arg::with_name("fetch-concurrency")
+                        .long("fetch-concurrency")
+                        .help("Maximum number of parallel requests when enumerating metadata")
+                        .default_value("1")
+                        .takes_value(true),
+                )
+                .arg(
+                    Arg::with_name("header")
+                        .long("header")
+                        .help("Additional HTTP header for metadata requests, as 'Name: value'")
+                        .multiple(true)
+                        .number_of_values(1)
+                        .takes_value(true),
+                )
                 .arg(
                     Arg::with_name("hostname")
                         .long("hostname")
                         .help("The file into which the hostname should be written")
                         .takes_value(true),
                 )
+                .arg(
+                    Arg::with_name("hostname-applied-marker")
+                        .long("hostname-applied-marker")
+                        .help("The file written once the hostname is applied")
+                        .requires("hostname")
+                        .takes_value(true),
+                )
+                .arg(
+                    Arg::with_name("journal")
+                        .long("journal")
+                        .help("Log a summary of the applied metadata to the journal"),
+                )
+                .arg(
+                    Arg::with_name("max-runtime")
+                        .long("max-runtime")
+                        .help("Maximum runtime in seconds, after which only outputs fetched so far are written")
+                        .conflicts_with("exec")
+                        .takes_value(true),
+                )
                 .arg(
                     Arg::with_name("network-units")
                         .long("network-units")
                         .help("The directory into which network units are written")
                         .takes_value(true),
                 )
+                .arg(
+                    Arg::with_name("network-units-only-present")
+                        .long("network-units-only-present")
+                        .help("Only write network units for interfaces present on this host")
+                        .requires("network-units"),
+                )
+                .arg(
+                    Arg::with_name("aws-api-version")
+                        .long("aws-api-version")
+                        .help("Override the AWS instance metadata API version")
+                        .takes_value(true),
+                )
+                .arg(
+                    Arg::with_name("aws-credentials")
+                        .long("aws-credentials")
+                        .help("The file into which AWS IAM role credentials are written")
+                        .takes_value(true),
+                )
+                .arg(
+                    Arg::with_name("azure-fabric-version")
+                        .long("azure-fabric-version")
+                        .help("Override the Azure WireServer fabric API version")
+                        .takes_value(true),
+                )
+                .arg(
+                    Arg::with_name("azure-managed-identity-token")
+                        .long("azure-managed-identity-token")
+                        .help("The file into which the Azure managed identity token is written")
+                        .takes_value(true),
+                )
+                .arg(
+                    Arg::with_name("azure-managed-identity-resource")
+                        .long("azure-managed-identity-resource")
+                        .help("The resource to request an Azure managed identity token for")
+                        .default_value("https://management.azure.com/")
+                        .takes_value(true),
+                )
+                .arg(
+                    Arg::with_name("hostname-source")
+                        .long("hostname-source")
+                        .help("Where to take the hostname from, among provider metadata")
+                        .possible_values(&["provider-default", "fqdn", "short", "instance-id"])
+                        .takes_value(true),
+                )
+                .arg(
+                    Arg::with_name("ip-preference")
+                        .long("ip-preference")
+                        .help("Address family of the derived PRIMARY_IP attribute")
+                        .possible_values(&["ipv4", "ipv6"])
+                        .takes_value(true),
+                )
+                .arg(
+                    Arg::with_name("metadata-base-url")
+                        .long("metadata-base-url")
+                        .help("Base URL of the metadata server, e.g. http://127.0.0.1:8080")
+                        .takes_value(true),
+                )
+                .arg(
+                    Arg::with_name("openstack-ssh-keys-meta-key")
+                        .long("openstack-ssh-keys-meta-key")
+                        .help("Also read SSH keys from this OpenStack metadata key")
+                        .takes_value(true),
+                )
+                .arg(
+                    Arg::with_name("packet-bond-name")
+                        .long("packet-bond-name")
+                        .help("Override the name of the bond device on Packet")
+                        .takes_value(true),
+                )
+                .arg(
+                    Arg::with_name("report")
+                        .long("report")
+                        .help("The file into which a JSON report of the run is written")
+                        .takes_value(true),
+                )
+                .arg(
+                    Arg::with_name("root")
+                        .long("root")
+                        .help("Directory under which all output paths are written")
+                        .takes_value(true),
+                )
+                .arg(
+                    Arg::with_name("quiet")
+                        .long("quiet")
+                        .short("q")
+                        .help("Only log warnings and errors"),
+                )
+                .arg(
+                    Arg::with_name("stats")
+                        .long("stats")
+                        .help("Log metadata request counters at the end of the run"),
+                )
+                .arg(
+                    Arg::with_name("strict-network")
+                        .long("strict-network")
+                        .help("Fail on inconsistent or unusable network configuration, instead of warning"),
+                )
                 .arg(
                     Arg::with_name("ssh-keys")
                         .long("ssh-keys")
                         .help("Update SSH keys for the given user")
                         .takes_value(true),
+                )
+                .arg(
+                    Arg::with_name("selinux-relabel")
+                        .long("selinux-relabel")
+                        .help("Restore the SELinux context of written SSH keys")
+                        .requires("ssh-keys"),
+                )
+                .arg(
+                    Arg::with_name("sensitive-attributes")
+                        .long("sensitive-attributes")
+                        .help("Comma-separated glob patterns of attributes to redact from logs")
+                        .takes_value(true),
+                )
+                .arg(
+                    Arg::with_name("ssh-keys-name")
+                        .long("ssh-keys-name")
+                        .help("Name of the SSH authorized keys fragment to write")
+                        .takes_value(true),
+                )
+                .arg(
+                    Arg::with_name("user-data")
+                        .long("user-data")
+                        .help("The file into which the instance user data is written")
+                        .takes_value(true),
+                )
+                .arg(
+                    Arg::with_name("command")
+                        .help("Command to run with --exec")
+                        .multiple(true)
+                        .last(true)
+                        .requires("exec"),
                 ),
         )
         .subcommand(
             SubCommand::with_name("exp")
                 .about("experimental subcommands")
+                .subcommand(
+                    SubCommand::with_name("list-providers")
+                        .about("List the supported cloud providers"),
+                )
                 .subcommand(
                     SubCommand::with_name("rd-network-kargs")
                         .about("Supplement initrd with network configuration kargs")
@@ -135,6 +394,13 @@ fn cli_setup<'a, 'b>() -> App<'a, 'b> {
                                 .global(true)
                                 .help("Read the cloud provider from the kernel cmdline"),
                         )
+                        .arg(
+                            Arg::with_name("platform-file")
+                                .long("platform-file")
+                                .global(true)
+                                .help("Read the cloud provider from an Ignition platform-id file")
+                                .takes_value(true),
+                        )
                         .arg(
                             Arg::with_name("provider")
                                 .long("provider")
@@ -194,6 +460,7 @@ fn translate_legacy_args(cli: impl IntoIterator<Item = String>) -> impl Iterator
 #[cfg(test)]
 mod tests {
     use super::*;
+    use std::io::Write;
 
     #[test]
     fn test_translate_legacy_args() {
@@ -258,6 +525,125 @@ mod tests {
         };
     }
 
+    #[test]
+    fn test_list_providers() {
+        let args: Vec<_> = ["afterburn", "exp", "list-providers"]
+            .iter()
+            .map(ToString::to_string)
+            .collect();
+
+        let cmd = parse_args(args).unwrap();
+        match cmd {
+            CliConfig::Exp(exp::CliExp::ListProviders) => {}
+            x => panic!("unexpected cmd: {:?}", x),
+        };
+    }
+
+    #[test]
+    fn test_multi_args() {
+        let mut file = tempfile::NamedTempFile::new().unwrap();
+        writeln!(file, "PLATFORM_ID=gcp").unwrap();
+        let fpath = file.path().to_str().unwrap();
+
+        let tests = vec![
+            (
+                vec!["--provider", "packet", "--packet-bond-name", "uplink0"],
+                true,
+            ),
+            (
+                vec!["--provider", "packet", "--packet-bond-name", ""],
+                false,
+            ),
+            (
+                vec!["--provider", "packet", "--packet-bond-name", "bond/0"],
+                false,
+            ),
+            (
+                vec![
+                    "--provider",
+                    "packet",
+                    "--packet-bond-name",
+                    "averyverylongbondname",
+                ],
+                false,
+            ),
+            (
+                vec![
+                    "--provider",
+                    "aws",
+                    "--aws-api-version",
+                    "2021-03-23",
+                    "--azure-fabric-version",
+                    "2012-11-30",
+                ],
+                true,
+            ),
+            (
+                vec!["--provider", "aws", "--aws-api-version", "latest"],
+                false,
+            ),
+            (
+                vec!["--provider", "aws", "--azure-fabric-version", "latest"],
+                false,
+            ),
+            (
+                vec![
+                    "--provider",
+                    "gcp",
+                    "--header",
+                    "X-Debug: 1",
+                    "--header",
+                    "Authorization: Bearer abc",
+                ],
+                true,
+            ),
+            (vec!["--provider", "gcp", "--header", "X-Debug"], false),
+            (vec!["--platform-file", fpath], true),
+            (vec!["--provider", "gcp", "--platform-file", fpath], false),
+        ];
+        for (flags, valid) in tests {
+            let args = ["afterburn", "multi"]
+                .iter()
+                .chain(flags.iter())
+                .map(ToString::to_string);
+            match parse_args(args) {
+                Ok(CliConfig::Multi(_)) if valid => {}
+                Err(_) if !valid => {}
+                x => panic!("unexpected result for {:?}: {:?}", flags, x),
+            }
+        }
+    }
+
+    #[test]
+    fn test_provider_precedence() {
+        let mut cmdline = tempfile::NamedTempFile::new().unwrap();
+        writeln!(cmdline, "root=/dev/vda ignition.platform.id=openstack").unwrap();
+        let cmdline_path = cmdline.path().to_str().unwrap();
+
+        let tests = vec![
+            // flags win over the environment
+            (vec!["--provider", "aws"], Some("gcp"), "aws"),
+            (vec!["--cmdline"], Some("gcp"), "openstack"),
+            (vec!["--cmdline"], None, "openstack"),
+            // environment as a last resort
+            (vec![], Some("gcp"), "gcp"),
+        ];
+        for (flags, env_provider, expected) in tests {
+            let args = ["afterburn", "multi"].iter().chain(flags.iter());
+            let matches = cli_setup().get_matches_from(args);
+            let matches = matches.subcommand_matches("multi").unwrap();
+            let provider =
+                provider_from_sources(matches, env_provider.map(String::from), cmdline_path)
+                    .unwrap();
+            assert_eq!(provider, expected, "{:?} {:?}", flags, env_provider);
+        }
+
+        let matches = cli_setup().get_matches_from(&["afterburn", "multi"]);
+        let matches = matches.subcommand_matches("multi").unwrap();
+        provider_from_sources(matches, None, cmdline_path).unwrap_err();
+        provider_from_sources(matches, Some(String::new()), cmdline_path).unwrap_err();
+    }
+
     #[test]
     fn test_exp_cmd() {
         let args: Vec<_> = [
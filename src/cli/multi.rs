@@ -1,16 +1,68 @@
 //! `multi` CLI sub-command.
 
+use crate::logging;
 use crate::metadata;
-use anyhow::{Context, Result};
+use crate::network;
+use crate::providers::aws::AwsProvider;
+use crate::providers::microsoft::azure::Azure;
+use crate::providers::{self, MetadataProvider, MetadataSummary};
+use crate::redact;
+use crate::report::{self, OutputReport, RunReport};
+use crate::retry;
+use crate::util;
+use anyhow::{bail, Context, Result};
+use nix::sys::signal::{self, Signal};
+use nix::unistd::Pid;
+use openssh_keys::PublicKey;
+use slog_scope::warn;
+use std::collections::HashMap;
+use std::net::IpAddr;
+use std::path::{Component, Path, PathBuf};
+use std::process::{Child, Command, ExitStatus};
+use std::thread;
+use std::time::{Duration, Instant};
 
 #[derive(Debug)]
 pub struct CliMulti {
     attributes_file: Option<String>,
+    attributes_filter: Vec<String>,
+    attributes_format: providers::AttributesFormat,
+    attributes_mode: u32,
+    aws_api_version: Option<String>,
+    aws_credentials_file: Option<String>,
+    azure_fabric_version: Option<String>,
+    azure_identity_resource: String,
+    azure_identity_token_file: Option<String>,
     check_in: bool,
+    config_drive_read_interval: Duration,
+    config_drive_read_retries: u8,
+    default_dns: Vec<IpAddr>,
+    exec: Option<Vec<String>>,
+    fail_on_empty: bool,
+    fetch_concurrency: usize,
+    headers: reqwest::header::HeaderMap,
     hostname_file: Option<String>,
+    hostname_marker_file: Option<String>,
+    hostname_source: providers::HostnameSource,
+    ip_preference: Option<providers::IpPreference>,
+    journal: bool,
+    max_runtime: Option<Duration>,
+    metadata_base_url: Option<String>,
     network_units_dir: Option<String>,
+    network_units_only_present: bool,
+    openstack_ssh_keys_meta_key: Option<String>,
+    packet_bond_name: Option<String>,
     provider: String,
+    quiet: bool,
+    report_file: Option<String>,
+    root: Option<PathBuf>,
+    selinux_relabel: bool,
+    sensitive_attributes: Vec<String>,
+    ssh_keys_name: String,
     ssh_keys_user: Option<String>,
+    stats: bool,
+    strict_network: bool,
+    user_data_file: Option<String>,
 }
 
 impl CliMulti {
@@ -18,21 +70,195 @@ impl CliMulti {
     pub(crate) fn parse(matches: &clap::ArgMatches) -> Result<super::CliConfig> {
         let provider = super::parse_provider(matches)?;
 
+        let aws_api_version = matches.value_of("aws-api-version").map(String::from);
+        if let Some(ref version) = aws_api_version {
+            util::validate_api_version(version).context("invalid AWS API version")?;
+        }
+        let azure_fabric_version = matches.value_of("azure-fabric-version").map(String::from);
+        if let Some(ref version) = azure_fabric_version {
+            util::validate_api_version(version).context("invalid Azure fabric version")?;
+        }
+
+        let attributes_mode = match matches.value_of("attributes-mode") {
+            Some(mode) => util::parse_file_mode(mode).context("invalid attributes file mode")?,
+            None => providers::ATTRIBUTES_FILE_MODE,
+        };
+
+        let attributes_filter = parse_patterns(matches.value_of("attributes-filter"));
+        let attributes_format = match matches.value_of("attributes-format") {
+            Some(format) => format.parse().context("invalid attributes format")?,
+            None => providers::AttributesFormat::default(),
+        };
+        let sensitive_attributes = parse_patterns(matches.value_of("sensitive-attributes"));
+
+        let fetch_concurrency: usize = matches
+            .value_of("fetch-concurrency")
+            .unwrap_or("1")
+            .parse()
+            .context("invalid fetch concurrency")?;
+        if fetch_concurrency == 0 {
+            bail!("invalid fetch concurrency: must be at least 1");
+        }
+
+        let config_drive_read_retries: u8 = matches
+            .value_of("config-drive-read-retries")
+            .unwrap_or("0")
+            .parse()
+            .context("invalid config-drive read retries")?;
+        let config_drive_read_interval = matches
+            .value_of("config-drive-read-interval")
+            .unwrap_or("500")
+            .parse()
+            .map(Duration::from_millis)
+            .context("invalid config-drive read interval")?;
+
+        let mut default_dns = Vec::new();
+        let servers = matches.value_of("default-dns").unwrap_or_default();
+        for server in servers.split(',').map(str::trim).filter(|s| !s.is_empty()) {
+            let addr = server
+                .parse()
+                .with_context(|| format!("invalid default DNS server '{}'", server))?;
+            default_dns.push(addr);
+        }
+
+        let mut headers = reqwest::header::HeaderMap::new();
+        for input in matches.values_of("header").into_iter().flatten() {
+            let (name, value) = retry::parse_header(input).context("invalid custom header")?;
+            headers.append(name, value);
+        }
+
+        let hostname_source = match matches.value_of("hostname-source") {
+            Some(source) => source.parse().context("invalid hostname source")?,
+            None => providers::HostnameSource::default(),
+        };
+
+        let max_runtime = match matches.value_of("max-runtime") {
+            Some(secs) => Some(Duration::from_secs(
+                secs.parse().context("invalid maximum runtime")?,
+            )),
+            None => None,
+        };
+
+        let ip_preference = match matches.value_of("ip-preference") {
+            Some(preference) => Some(preference.parse().context("invalid IP preference")?),
+            None => None,
+        };
+
+        let metadata_base_url = matches.value_of("metadata-base-url").map(String::from);
+        if let Some(ref url) = metadata_base_url {
+            providers::validate_metadata_base_url(url).context("invalid metadata base URL")?;
+            if !metadata::BASE_URL_PROVIDERS.contains(&provider.as_str()) {
+                bail!(
+                    "metadata base URL is not supported for provider {}",
+                    provider
+                );
+            }
+        }
+
+        let openstack_ssh_keys_meta_key = matches
+            .value_of("openstack-ssh-keys-meta-key")
+            .map(String::from);
+        if let Some(ref key) = openstack_ssh_keys_meta_key {
+            if key.is_empty() {
+                bail!("invalid OpenStack SSH keys metadata key: empty key");
+            }
+            if !metadata::OPENSTACK_PROVIDERS.contains(&provider.as_str()) {
+                bail!(
+                    "OpenStack SSH keys metadata key is not supported for provider {}",
+                    provider
+                );
+            }
+        }
+
+        let packet_bond_name = matches.value_of("packet-bond-name").map(String::from);
+        if let Some(ref name) = packet_bond_name {
+            network::validate_interface_name(name).context("invalid Packet bond name")?;
+        }
+
+        let ssh_keys_name = matches
+            .value_of("ssh-keys-name")
+            .unwrap_or(providers::SSH_KEYS_FRAGMENT_NAME)
+            .to_string();
+        providers::validate_ssh_keys_fragment_name(&ssh_keys_name)
+            .context("invalid SSH keys fragment name")?;
+
+        // prefix all output paths with the root directory, if any
+        let root = matches.value_of("root").map(PathBuf::from);
+        let output_path = |name| {
+            matches.value_of(name).map(|path| match root {
+                Some(ref root) => util::join_root(root, Path::new(path))
+                    .to_string_lossy()
+                    .into_owned(),
+                None => path.to_string(),
+            })
+        };
+
+        // computed ahead, as `root` is moved into the struct below
+        let user_data_file = output_path("user-data");
+
         let multi = Self {
-            attributes_file: matches.value_of("attributes").map(String::from),
+            attributes_file: output_path("attributes"),
+            attributes_filter,
+            attributes_format,
+            attributes_mode,
+            aws_api_version,
+            aws_credentials_file: output_path("aws-credentials"),
+            azure_fabric_version,
+            azure_identity_resource: matches
+                .value_of("azure-managed-identity-resource")
+                .unwrap_or_default()
+                .to_string(),
+            azure_identity_token_file: output_path("azure-managed-identity-token"),
             check_in: matches.is_present("check-in"),
-            hostname_file: matches.value_of("hostname").map(String::from),
-            network_units_dir: matches.value_of("network-units").map(String::from),
+            config_drive_read_interval,
+            config_drive_read_retries,
+            default_dns,
+            exec: matches
+                .values_of("command")
+                .map(|args| args.map(String::from).collect()),
+            fail_on_empty: matches.is_present("fail-on-empty"),
+            fetch_concurrency,
+            headers,
+            hostname_file: output_path("hostname"),
+            hostname_marker_file: output_path("hostname-applied-marker"),
+            hostname_source,
+            ip_preference,
+            journal: matches.is_present("journal"),
+            max_runtime,
+            metadata_base_url,
+            network_units_dir: output_path("network-units"),
+            network_units_only_present: matches.is_present("network-units-only-present"),
+            openstack_ssh_keys_meta_key,
+            packet_bond_name,
             provider,
+            quiet: matches.is_present("quiet"),
+            report_file: output_path("report"),
+            root,
+            selinux_relabel: matches.is_present("selinux-relabel"),
+            sensitive_attributes,
+            ssh_keys_name,
             ssh_keys_user: matches.value_of("ssh-keys").map(String::from),
+            stats: matches.is_present("stats"),
+            strict_network: matches.is_present("strict-network"),
+            user_data_file,
         };
 
+        multi.check_output_paths()?;
+
+        if multi.aws_credentials_file.is_some() && multi.provider != "aws" {
+            bail!("AWS credentials requested, but provider is not AWS");
+        }
+        if multi.azure_identity_token_file.is_some() && multi.provider != "azure" {
+            bail!("Azure managed identity token requested, but provider is not Azure");
+        }
+
         if multi.attributes_file.is_none()
             && multi.network_units_dir.is_none()
             && !multi.check_in
             && multi.ssh_keys_user.is_none()
             && multi.hostname_file.is_none()
             && multi.network_units_dir.is_none()
+            && multi.user_data_file.is_none()
         {
             slog_scope::warn!("multi: no action specified");
         }
@@ -40,39 +266,828 @@ impl CliMulti {
         Ok(super::CliConfig::Multi(multi))
     }
 
-    /// Run the `multi` sub-command.
-    pub(crate) fn run(self) -> Result<()> {
-        // fetch the metadata from the configured provider
-        let metadata =
-            metadata::fetch_metadata(&self.provider).context("fetching metadata from provider")?;
+    /// Check that all configured output paths are distinct.
+    ///
+    /// Paths are compared after lexical normalization, without resolving
+    /// symlinks.
+    fn check_output_paths(&self) -> Result<()> {
+        let outputs = [
+            ("--attributes", &self.attributes_file),
+            ("--hostname", &self.hostname_file),
+            ("--hostname-applied-marker", &self.hostname_marker_file),
+            ("--network-units", &self.network_units_dir),
+            ("--report", &self.report_file),
+            ("--user-data", &self.user_data_file),
+            ("--aws-credentials", &self.aws_credentials_file),
+            (
+                "--azure-managed-identity-token",
+                &self.azure_identity_token_file,
+            ),
+        ];
+        for (i, (flag, path)) in outputs.iter().enumerate() {
+            let path = match path {
+                Some(path) => normalize_path(Path::new(path)),
+                None => continue,
+            };
+            for (other_flag, other_path) in &outputs[i + 1..] {
+                let other_path = other_path.as_ref().map(|p| normalize_path(Path::new(p)));
+                if other_path.as_ref() == Some(&path) {
+                    bail!(
+                        "{} and {} point to the same path {:?}",
+                        flag,
+                        other_flag,
+                        path
+                    );
+                }
+            }
+        }
+        Ok(())
+    }
+
+    /// Run the `multi` sub-command, returning the process exit code.
+    ///
+    /// Warnings logged meanwhile are collected from `warnings`, for the
+    /// run report, and sensitive attributes are registered in `redactions`.
+    pub(crate) fn run(
+        self,
+        warnings: report::Warnings,
+        redactions: redact::Redactions,
+    ) -> Result<i32> {
+        logging::set_quiet(self.quiet);
+
+        let opts = metadata::FetchOptions {
+            aws_api_version: self.aws_api_version.clone(),
+            azure_fabric_version: self.azure_fabric_version,
+            config_drive_read_retry: util::drive::ReadRetry {
+                retries: self.config_drive_read_retries,
+                interval: self.config_drive_read_interval,
+            },
+            default_dns: self.default_dns,
+            extra_headers: self.headers,
+            hostname_source: self.hostname_source,
+            ip_preference: self.ip_preference,
+            metadata_base_url: self.metadata_base_url,
+            openstack_ssh_keys_meta_key: self.openstack_ssh_keys_meta_key,
+            packet_bond_name: self.packet_bond_name,
+            redactions,
+            strict_network: self.strict_network,
+        };
+
+        // stop retrying once the maximum runtime is exceeded
+        retry::set_deadline(self.max_runtime.map(|max| Instant::now() + max));
+
+        // give up promptly when asked to terminate
+        util::signal::cancel_retries_on_sigterm()?;
+
+        // keep sensitive attribute values out of logs
+        opts.redactions
+            .set_sensitive_patterns(self.sensitive_attributes);
+
+        // bound parallel requests within a provider
+        retry::set_fetch_concurrency(self.fetch_concurrency);
+
+        // count metadata requests if configured to do so
+        if self.stats {
+            retry::enable_stats();
+        }
+
+        // fetch the metadata from the configured provider; past the maximum
+        // runtime, all outputs depending on it are skipped
+        let metadata = match metadata::fetch_metadata(&self.provider, &opts) {
+            Ok(metadata) => metadata,
+            Err(e) => match e.downcast_ref::<retry::DeadlineExceeded>() {
+                Some(deadline) => {
+                    warn!("failed to fetch metadata from provider: {:#}", e);
+                    Box::new(Unavailable(deadline.clone()))
+                }
+                None => return Err(e).context("fetching metadata from provider"),
+            },
+        };
+
+        if self.fail_on_empty {
+            match metadata.is_empty() {
+                Ok(true) => bail!("no metadata available from provider {}", self.provider),
+                Ok(false) => {}
+                // outputs are skipped below
+                Err(e) if retry::is_deadline_exceeded(&e) => {}
+                Err(e) => return Err(e),
+            }
+        }
+
+        // record what was applied, for the journal summary and run report
+        let mut summary = MetadataSummary {
+            provider: self.provider.clone(),
+            ..MetadataSummary::default()
+        };
+        let mut report = RunReport::new(&self.provider);
+        let mut skipped = SkippedOutputs::default();
 
         // write attributes if configured to do so
-        self.attributes_file
-            .map_or(Ok(()), |x| metadata.write_attributes(x))
-            .context("writing metadata attributes")?;
+        let attributes_mode = self.attributes_mode;
+        let attributes_filter = &self.attributes_filter;
+        let attributes_format = self.attributes_format;
+        let res = self
+            .attributes_file
+            .map(|x| match attributes_format {
+                providers::AttributesFormat::Env => {
+                    metadata.write_attributes(x, attributes_mode, attributes_filter)
+                }
+                providers::AttributesFormat::Json => {
+                    metadata.write_attributes_json(x, attributes_mode, attributes_filter)
+                }
+            })
+            .transpose()
+            .context("writing metadata attributes");
+        if let Some(count) = skipped.check(ATTRIBUTES, res)?.flatten() {
+            report.attributes = OutputReport::with_count(count);
+        }
 
         // write ssh keys if configured to do so
-        self.ssh_keys_user
-            .map_or(Ok(()), |x| metadata.write_ssh_keys(x))
-            .context("writing ssh keys")?;
+        let root = self.root;
+        let ssh_keys_name = self.ssh_keys_name;
+        let selinux_relabel = self.selinux_relabel;
+        let res = self
+            .ssh_keys_user
+            .map(|x| metadata.write_ssh_keys(x, &ssh_keys_name, root.as_deref(), selinux_relabel))
+            .transpose()
+            .context("writing ssh keys");
+        if let Some(count) = skipped.check(SSH_KEYS, res)?.flatten() {
+            summary.ssh_keys = Some(count);
+            report.ssh_keys = OutputReport::with_count(count);
+        }
 
         // write hostname if configured to do so
-        self.hostname_file
-            .map_or(Ok(()), |x| metadata.write_hostname(x))
-            .context("writing hostname")?;
+        let hostname_marker_file = self.hostname_marker_file;
+        let res = self
+            .hostname_file
+            .map(|x| metadata.write_hostname(x, hostname_marker_file.as_deref().map(Path::new)))
+            .transpose()
+            .context("writing hostname");
+        if let Some(hostname) = skipped.check(HOSTNAME, res)?.flatten() {
+            report.hostname = OutputReport::with_count(hostname.iter().count());
+            summary.hostname = hostname;
+        }
+
+        // write user data if configured to do so
+        let res = self
+            .user_data_file
+            .map_or(Ok(()), |x| metadata.write_user_data(x))
+            .context("writing user data");
+        skipped.check(USER_DATA, res)?;
 
         // write network units if configured to do so
-        self.network_units_dir
-            .map_or(Ok(()), |x| metadata.write_network_units(x))
-            .context("writing network units")?;
+        let strict_network = self.strict_network;
+        let local_macs = if self.network_units_only_present {
+            Some(network::local_mac_addresses())
+        } else {
+            None
+        };
+        let res = self
+            .network_units_dir
+            .map(|x| metadata.write_network_units(x, strict_network, local_macs.as_deref()))
+            .transpose()
+            .context("writing network units");
+        if let Some(count) = skipped.check(NETWORK_UNITS, res)?.flatten() {
+            summary.network_interfaces = Some(count);
+            report.network_units = OutputReport::with_count(count);
+        }
+
+        // write Azure managed identity token if configured to do so
+        if let Some(path) = self.azure_identity_token_file {
+            let res = Azure::write_managed_identity_token(
+                opts.client()?,
+                &self.azure_identity_resource,
+                Path::new(&path),
+            )
+            .context("writing Azure managed identity token");
+            skipped.check(AZURE_TOKEN, res)?;
+        }
+
+        // write AWS credentials if configured to do so
+        if let Some(path) = self.aws_credentials_file {
+            let aws_api_version = self.aws_api_version;
+            let res = AwsProvider::with_client(opts.client()?)
+                .and_then(|provider| {
+                    provider
+                        .api_version(aws_api_version)
+                        .write_credentials(Path::new(&path))
+                })
+                .context("writing AWS credentials");
+            skipped.check(AWS_CREDENTIALS, res)?;
+        }
 
         // perform boot check-in.
         if self.check_in {
-            metadata
+            let res = metadata
                 .boot_checkin()
-                .context("checking-in instance boot to cloud provider")?;
+                .context("checking-in instance boot to cloud provider");
+            skipped.check(CHECK_IN, res)?;
         }
 
-        Ok(())
+        if !skipped.is_empty() {
+            warn!(
+                "maximum runtime exceeded, skipped: {}",
+                skipped.0.join(", ")
+            );
+        }
+
+        // summarize applied metadata in the journal if configured to do so
+        if self.journal {
+            summary.write_journal_entry();
+        }
+
+        // write the run report if configured to do so
+        if let Some(path) = self.report_file {
+            report
+                .finish(Path::new(&path), &warnings)
+                .context("writing run report")?;
+        }
+
+        // log request counters if configured to do so
+        if let Some(stats) = retry::stats() {
+            slog_scope::info!(
+                "metadata requests: {} sent, {} retries, {} failures, {} bytes read",
+                stats.requests,
+                stats.retries,
+                stats.failures,
+                stats.bytes_read
+            );
+        }
+
+        // only some outputs were written
+        if !skipped.is_empty() {
+            return Ok(PARTIAL_EXIT_CODE);
+        }
+
+        // hand over to the given command if configured to do so,
+        // exiting with its exit code
+        if let Some(args) = self.exec {
+            if util::signal::is_terminated() {
+                bail!("terminated, not running command {:?}", args[0]);
+            }
+            let child = exec_command(&args, &metadata.attributes()?)
+                .spawn()
+                .with_context(|| format!("failed to run command {:?}", args[0]))?;
+            let status = wait_command(child)
+                .with_context(|| format!("failed to wait for command {:?}", args[0]))?;
+            match status.code() {
+                Some(code) => return Ok(code),
+                None => bail!("command {:?} terminated by signal", args[0]),
+            }
+        }
+
+        Ok(0)
+    }
+}
+
+/// How often to check for termination while waiting for `--exec` commands.
+const EXEC_POLL_INTERVAL: Duration = Duration::from_millis(50);
+
+/// Exit code of runs cut short by `--max-runtime`, where only some outputs
+/// were written (`EX_TEMPFAIL`).
+const PARTIAL_EXIT_CODE: i32 = 75;
+
+// Outputs which may be skipped when the maximum runtime is exceeded.
+const ATTRIBUTES: &str = "attributes";
+const AWS_CREDENTIALS: &str = "AWS credentials";
+const AZURE_TOKEN: &str = "Azure managed identity token";
+const CHECK_IN: &str = "boot check-in";
+const HOSTNAME: &str = "hostname";
+const NETWORK_UNITS: &str = "network units";
+const SSH_KEYS: &str = "SSH keys";
+const USER_DATA: &str = "user data";
+
+/// Stand-in for a provider whose metadata couldn't be fetched within the
+/// maximum runtime, failing all outputs so that they are skipped.
+struct Unavailable(retry::DeadlineExceeded);
+
+impl Unavailable {
+    fn fail<T>(&self) -> Result<T> {
+        Err(self.0.clone().into())
+    }
+}
+
+impl MetadataProvider for Unavailable {
+    fn attributes(&self) -> Result<HashMap<String, String>> {
+        self.fail()
+    }
+
+    fn hostname(&self) -> Result<Option<String>> {
+        self.fail()
+    }
+
+    fn ssh_keys(&self) -> Result<Vec<PublicKey>> {
+        self.fail()
+    }
+
+    fn networks(&self) -> Result<Vec<network::Interface>> {
+        self.fail()
+    }
+
+    fn boot_checkin(&self) -> Result<()> {
+        self.fail()
+    }
+
+    fn virtual_network_devices(&self) -> Result<Vec<network::VirtualNetDev>> {
+        self.fail()
+    }
+
+    fn rd_network_kargs(&self) -> Result<Option<String>> {
+        self.fail()
+    }
+
+    fn user_data(&self) -> Result<Option<String>> {
+        self.fail()
+    }
+}
+
+/// Outputs skipped because the maximum runtime was exceeded.
+#[derive(Debug, Default)]
+struct SkippedOutputs(Vec<&'static str>);
+
+impl SkippedOutputs {
+    /// Pass through the result of fetching or writing an output, unless it
+    /// failed because the maximum runtime was exceeded, in which case the
+    /// output is recorded as skipped.
+    fn check<T>(&mut self, output: &'static str, res: Result<T>) -> Result<Option<T>> {
+        match res {
+            Ok(v) => Ok(Some(v)),
+            Err(e) if retry::is_deadline_exceeded(&e) => {
+                warn!("skipping {}: {:#}", output, e);
+                if !self.contains(output) {
+                    self.0.push(output);
+                }
+                Ok(None)
+            }
+            Err(e) => Err(e),
+        }
+    }
+
+    fn contains(&self, output: &str) -> bool {
+        self.0.iter().any(|o| *o == output)
+    }
+
+    fn is_empty(&self) -> bool {
+        self.0.is_empty()
+    }
+}
+
+/// Build a command which gets the metadata attributes as
+/// `AFTERBURN_`-prefixed environment variables.
+fn exec_command(args: &[String], attributes: &HashMap<String, String>) -> Command {
+    let mut cmd = Command::new(&args[0]);
+    cmd.args(&args[1..]);
+    for (k, v) in attributes {
+        cmd.env(format!("AFTERBURN_{}", k), v);
+    }
+    cmd
+}
+
+/// Wait for a command to exit, passing SIGTERM on to it if received in the
+/// meantime.
+fn wait_command(mut child: Child) -> Result<ExitStatus> {
+    let mut terminated = false;
+    loop {
+        if let Some(status) = child.try_wait()? {
+            return Ok(status);
+        }
+        if !terminated && util::signal::is_terminated() {
+            terminated = true;
+            let pid = Pid::from_raw(child.id() as i32);
+            if let Err(e) = signal::kill(pid, Signal::SIGTERM) {
+                warn!("failed to terminate command: {}", e);
+            }
+        }
+        thread::sleep(EXEC_POLL_INTERVAL);
+    }
+}
+
+/// Lexically normalize a path, dropping `.` components and resolving `..`
+/// ones against their parent.
+fn normalize_path(path: &Path) -> PathBuf {
+    let mut out = PathBuf::new();
+    for component in path.components() {
+        match component {
+            Component::CurDir => {}
+            Component::ParentDir => match out.components().next_back() {
+                Some(Component::Normal(_)) => {
+                    out.pop();
+                }
+                Some(Component::RootDir) => {}
+                _ => out.push(component),
+            },
+            _ => out.push(component),
+        }
+    }
+    out
+}
+
+/// Parse a comma-separated list of glob patterns.
+fn parse_patterns(patterns: Option<&str>) -> Vec<String> {
+    patterns
+        .unwrap_or_default()
+        .split(',')
+        .map(str::trim)
+        .filter(|s| !s.is_empty())
+        .map(String::from)
+        .collect()
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    /// Parse a `multi` command line for the given provider, with extra
+    /// arguments.
+    fn parse(provider: &str, extra: &[&str]) -> Result<CliMulti> {
+        let mut args = vec!["afterburn", "multi", "--provider", provider];
+        args.extend_from_slice(extra);
+        match super::super::parse_args(args.iter().map(ToString::to_string))? {
+            super::super::CliConfig::Multi(v) => Ok(v),
+            x => panic!("unexpected cmd: {:?}", x),
+        }
+    }
+
+    #[test]
+    fn test_invalid_args() {
+        let tests = vec![
+            ("aws", vec!["--ssh-keys-name", "../authorized_keys"]),
+            ("packet", vec!["--default-dns", "1.1.1.1,dns.example.com"]),
+            (
+                "aws",
+                vec![
+                    "--attributes",
+                    "/run/metadata/afterburn",
+                    "--hostname",
+                    "/run/metadata//afterburn",
+                ],
+            ),
+            (
+                "aws",
+                vec![
+                    "--hostname",
+                    "/run/afterburn",
+                    "--network-units",
+                    "/run/afterburn/",
+                ],
+            ),
+            (
+                "aws",
+                vec![
+                    "--azure-managed-identity-token",
+                    "/run/afterburn/azure-token",
+                ],
+            ),
+            // the marker is meaningless without a hostname
+            (
+                "aws",
+                vec![
+                    "--hostname-applied-marker",
+                    "/run/afterburn/hostname-applied",
+                ],
+            ),
+            ("gcp", vec!["--fetch-concurrency", "0"]),
+            ("gcp", vec!["--fetch-concurrency", "many"]),
+            // a filter is only meaningful when writing attributes
+            ("aws", vec!["--attributes-filter", "AWS_*"]),
+            // only meaningful when writing network units
+            ("openstack", vec!["--network-units-only-present"]),
+            ("aws", vec!["--max-runtime", "soon"]),
+            ("aws", vec!["--max-runtime", "30", "--exec", "--", "true"]),
+            ("openstack", vec!["--config-drive-read-retries", "1000"]),
+            ("openstack", vec!["--config-drive-read-interval", "soon"]),
+            (
+                "gcp",
+                vec!["--aws-credentials", "/run/afterburn/aws-credentials"],
+            ),
+            ("gcp", vec!["--metadata-base-url", "127.0.0.1:8080"]),
+            (
+                "azure",
+                vec!["--metadata-base-url", "http://127.0.0.1:8080"],
+            ),
+            (
+                "openstack-metadata",
+                vec!["--openstack-ssh-keys-meta-key", ""],
+            ),
+            ("aws", vec!["--openstack-ssh-keys-meta-key", "heat-keys"]),
+            // --exec and the command require each other
+            ("aws", vec!["--exec"]),
+            ("aws", vec!["--", "env"]),
+        ];
+        for (provider, extra) in tests {
+            parse(provider, &extra).expect_err(&format!("{} {:?}", provider, extra));
+        }
+    }
+
+    #[test]
+    fn test_output_root() {
+        let multi = parse(
+            "gcp",
+            &[
+                "--root",
+                "/tmp/root",
+                "--attributes",
+                "/run/metadata/afterburn",
+                "--hostname",
+                "/etc/hostname",
+                "--network-units",
+                "/run/systemd/network",
+            ],
+        )
+        .unwrap();
+        assert_eq!(multi.root, Some(PathBuf::from("/tmp/root")));
+        assert_eq!(
+            multi.attributes_file.unwrap(),
+            "/tmp/root/run/metadata/afterburn"
+        );
+        assert_eq!(multi.hostname_file.unwrap(), "/tmp/root/etc/hostname");
+        assert_eq!(
+            multi.network_units_dir.unwrap(),
+            "/tmp/root/run/systemd/network"
+        );
+    }
+
+    #[test]
+    fn test_defaults() {
+        let multi = parse("openstack", &[]).unwrap();
+        assert_eq!(multi.ssh_keys_name, "afterburn");
+        assert_eq!(multi.fetch_concurrency, 1);
+        assert!(multi.attributes_filter.is_empty());
+        assert!(multi.sensitive_attributes.is_empty());
+        assert!(!multi.network_units_only_present);
+        assert_eq!(multi.max_runtime, None);
+        assert_eq!(multi.config_drive_read_retries, 0);
+        assert_eq!(multi.config_drive_read_interval, Duration::from_millis(500));
+        assert_eq!(multi.exec, None);
+    }
+
+    #[test]
+    fn test_option_values() {
+        let multi = parse("aws", &["--ssh-keys-name", "afterburn-aws"]).unwrap();
+        assert_eq!(multi.ssh_keys_name, "afterburn-aws");
+
+        let multi = parse("packet", &["--default-dns", "1.1.1.1,8.8.8.8"]).unwrap();
+        let expected: Vec<IpAddr> = vec!["1.1.1.1".parse().unwrap(), "8.8.8.8".parse().unwrap()];
+        assert_eq!(multi.default_dns, expected);
+
+        let multi = parse(
+            "azure",
+            &[
+                "--azure-managed-identity-token",
+                "/run/afterburn/azure-token",
+            ],
+        )
+        .unwrap();
+        assert_eq!(
+            multi.azure_identity_token_file.unwrap(),
+            "/run/afterburn/azure-token"
+        );
+        assert_eq!(
+            multi.azure_identity_resource,
+            "https://management.azure.com/"
+        );
+
+        let multi = parse(
+            "aws",
+            &[
+                "--root",
+                "/tmp/root",
+                "--hostname",
+                "/etc/hostname",
+                "--hostname-applied-marker",
+                "/run/afterburn/hostname-applied",
+            ],
+        )
+        .unwrap();
+        assert_eq!(
+            multi.hostname_marker_file.unwrap(),
+            "/tmp/root/run/afterburn/hostname-applied"
+        );
+
+        let multi = parse("gcp", &["--fetch-concurrency", "4"]).unwrap();
+        assert_eq!(multi.fetch_concurrency, 4);
+
+        let multi = parse(
+            "aws",
+            &[
+                "--attributes",
+                "/run/metadata/afterburn",
+                "--attributes-filter",
+                "AWS_IPV4_*, AWS_REGION,",
+            ],
+        )
+        .unwrap();
+        assert_eq!(multi.attributes_filter, vec!["AWS_IPV4_*", "AWS_REGION"]);
+
+        let multi = parse("aws", &["--sensitive-attributes", "*_PASSWORD,AWS_VAULT_*"]).unwrap();
+        assert_eq!(
+            multi.sensitive_attributes,
+            vec!["*_PASSWORD", "AWS_VAULT_*"]
+        );
+
+        let multi = parse(
+            "openstack",
+            &[
+                "--network-units",
+                "/run/systemd/network",
+                "--network-units-only-present",
+            ],
+        )
+        .unwrap();
+        assert!(multi.network_units_only_present);
+
+        let multi = parse("aws", &["--max-runtime", "30"]).unwrap();
+        assert_eq!(multi.max_runtime, Some(Duration::from_secs(30)));
+
+        let multi = parse(
+            "openstack",
+            &[
+                "--config-drive-read-retries",
+                "5",
+                "--config-drive-read-interval",
+                "200",
+            ],
+        )
+        .unwrap();
+        assert_eq!(multi.config_drive_read_retries, 5);
+        assert_eq!(multi.config_drive_read_interval, Duration::from_millis(200));
+
+        let multi = parse(
+            "aws",
+            &["--aws-credentials", "/run/afterburn/aws-credentials"],
+        )
+        .unwrap();
+        assert_eq!(
+            multi.aws_credentials_file.unwrap(),
+            "/run/afterburn/aws-credentials"
+        );
+
+        let multi = parse("gcp", &["--metadata-base-url", "http://127.0.0.1:8080"]).unwrap();
+        assert_eq!(multi.metadata_base_url.unwrap(), "http://127.0.0.1:8080");
+
+        let multi = parse("openstack", &["--openstack-ssh-keys-meta-key", "heat-keys"]).unwrap();
+        assert_eq!(multi.openstack_ssh_keys_meta_key.unwrap(), "heat-keys");
+
+        let multi = parse("aws", &["--exec", "--", "env", "-0"]).unwrap();
+        assert_eq!(multi.exec.unwrap(), vec!["env", "-0"]);
+    }
+
+    #[test]
+    fn test_distinct_output_paths() {
+        parse(
+            "aws",
+            &[
+                "--attributes",
+                "/run/metadata/afterburn",
+                "--hostname",
+                "/etc/hostname",
+                "--network-units",
+                "/run/systemd/network",
+            ],
+        )
+        .unwrap();
+
+        let err = parse(
+            "aws",
+            &[
+                "--attributes",
+                "/run/metadata/afterburn",
+                "--hostname",
+                "/run/metadata//afterburn",
+            ],
+        )
+        .unwrap_err();
+        assert!(err.to_string().contains("--attributes and --hostname"));
+
+        for (a, b) in &[
+            ("./afterburn", "afterburn"),
+            ("/x/../afterburn", "/afterburn"),
+        ] {
+            let args = ["--attributes", a, "--hostname", b];
+            parse("aws", &args).expect_err(&format!("{:?}", args));
+        }
+    }
+
+    #[test]
+    fn test_normalize_path() {
+        let tests = vec![
+            ("/run/./metadata//afterburn", "/run/metadata/afterburn"),
+            ("/x/../y/../afterburn", "/afterburn"),
+            ("/../afterburn", "/afterburn"),
+            ("./a/b/..", "a"),
+            ("../a", "../a"),
+            ("a/../../b", "../b"),
+        ];
+        for (path, expected) in tests {
+            assert_eq!(normalize_path(Path::new(path)), PathBuf::from(expected));
+        }
+    }
+
+    #[test]
+    fn test_skipped_outputs() {
+        /// Provider with attributes at hand, but SSH keys behind a
+        /// failing endpoint.
+        struct SlowProvider;
+
+        impl MetadataProvider for SlowProvider {
+            fn attributes(&self) -> Result<HashMap<String, String>> {
+                Ok(maplit::hashmap! {
+                    "TEST_INSTANCE_ID".to_string() => "i-0123".to_string(),
+                })
+            }
+
+            fn ssh_keys(&self) -> Result<Vec<PublicKey>> {
+                retry::Retry::new()
+                    .initial_backoff(Duration::from_millis(100))
+                    .max_retries(10)
+                    .retry(|_| bail!("connection timed out"))
+            }
+
+            fn boot_checkin(&self) -> Result<()> {
+                bail!("check-in rejected")
+            }
+        }
+
+        retry::set_deadline(Some(Instant::now() + Duration::from_millis(50)));
+        let provider = SlowProvider;
+        let tempdir = tempfile::tempdir().unwrap();
+        let path = tempdir.path().join("attributes");
+        let mut skipped = SkippedOutputs::default();
+
+        // fetched before the deadline
+        let res = provider.write_attributes(path.to_string_lossy().to_string(), 0o644, &[]);
+        assert_eq!(skipped.check(ATTRIBUTES, res).unwrap(), Some(1));
+        assert_eq!(
+            std::fs::read_to_string(&path).unwrap(),
+            "AFTERBURN_TEST_INSTANCE_ID=i-0123\n"
+        );
+
+        // cut short by the deadline
+        assert!(skipped
+            .check(SSH_KEYS, provider.ssh_keys())
+            .unwrap()
+            .is_none());
+        assert!(skipped.contains(SSH_KEYS));
+        assert!(!skipped.contains(ATTRIBUTES));
+
+        // other failures are still errors
+        skipped
+            .check(CHECK_IN, provider.boot_checkin())
+            .unwrap_err();
+        assert_eq!(skipped.0, vec![SSH_KEYS]);
+
+        retry::set_deadline(None);
+    }
+
+    #[test]
+    fn test_skipped_provider() {
+        // metadata server failing until the deadline, while building the provider
+        let _m = mockito::mock("GET", "/skipped-provider/metadata/v1.json")
+            .with_status(503)
+            .create();
+        let base_url = format!("{}/skipped-provider", mockito::server_url());
+        let tempdir = tempfile::tempdir().unwrap();
+        let path = tempdir.path().join("attributes");
+
+        let multi = parse(
+            "digitalocean",
+            &[
+                "--metadata-base-url",
+                &base_url,
+                "--max-runtime",
+                "1",
+                "--attributes",
+                path.to_str().unwrap(),
+            ],
+        )
+        .unwrap();
+        let code = multi
+            .run(report::Warnings::default(), redact::Redactions::default())
+            .unwrap();
+        retry::set_deadline(None);
+        retry::set_cancel_token(None);
+
+        assert_eq!(code, PARTIAL_EXIT_CODE);
+        assert!(!path.exists());
+    }
+
+    #[test]
+    fn test_exec_command() {
+        let attributes = maplit::hashmap! {
+            "AWS_HOSTNAME".to_string() => "test-hostname".to_string(),
+            "AWS_REGION".to_string() => "us-east-1".to_string(),
+        };
+        let output = exec_command(&["env".to_string()], &attributes)
+            .output()
+            .unwrap();
+        assert!(output.status.success());
+        let stdout = String::from_utf8(output.stdout).unwrap();
+        let env: Vec<&str> = stdout.lines().collect();
+        assert!(env.contains(&"AFTERBURN_AWS_HOSTNAME=test-hostname"));
+        assert!(env.contains(&"AFTERBURN_AWS_REGION=us-east-1"));
+
+        let args: Vec<String> = vec!["sh".into(), "-c".into(), "exit 3".into()];
+        let status = exec_command(&args, &attributes).status().unwrap();
+        assert_eq!(status.code(), Some(3));
     }
 }
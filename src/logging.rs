@@ -0,0 +1,106 @@
+// Copyright 2021 Red Hat, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//! Log verbosity
+//!
+//! Logs go to stderr, so that they never mix with outputs written to
+//! stdout. With `--quiet`, only warnings and errors are logged.
+
+use slog::Drain;
+use std::sync::atomic::{AtomicBool, Ordering};
+
+/// Whether only warnings and errors are logged.
+static QUIET: AtomicBool = AtomicBool::new(false);
+
+/// Only log warnings and errors from now on, if `quiet`.
+pub fn set_quiet(quiet: bool) {
+    QUIET.store(quiet, Ordering::SeqCst);
+}
+
+/// Log drain dropping records below the configured verbosity.
+pub struct VerbosityFilter<D>(pub D);
+
+impl<D: Drain<Ok = ()>> Drain for VerbosityFilter<D> {
+    type Ok = ();
+    type Err = D::Err;
+
+    fn log(
+        &self,
+        record: &slog::Record,
+        values: &slog::OwnedKVList,
+    ) -> std::result::Result<Self::Ok, Self::Err> {
+        if QUIET.load(Ordering::SeqCst) && !record.level().is_at_least(slog::Level::Warning) {
+            return Ok(());
+        }
+        self.0.log(record, values)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::sync::{Arc, Mutex};
+
+    /// Drain capturing levels and messages.
+    #[derive(Clone, Default)]
+    struct Capture(Arc<Mutex<Vec<String>>>);
+
+    impl Drain for Capture {
+        type Ok = ();
+        type Err = slog::Never;
+
+        fn log(
+            &self,
+            record: &slog::Record,
+            _: &slog::OwnedKVList,
+        ) -> std::result::Result<(), slog::Never> {
+            self.0.lock().unwrap().push(format!(
+                "{} {}",
+                record.level().as_short_str(),
+                record.msg()
+            ));
+            Ok(())
+        }
+    }
+
+    #[test]
+    fn test_verbosity_filter() {
+        let capture = Capture::default();
+        let log = slog::Logger::root(VerbosityFilter(capture.clone()).fuse(), slog::o!());
+        let log_all = || {
+            slog::debug!(log, "fetching: attempt #1");
+            slog::info!(log, "fetch successful");
+            slog::warn!(log, "no SSH keys");
+            slog::error!(log, "failed to write");
+        };
+
+        log_all();
+        set_quiet(true);
+        log_all();
+        set_quiet(false);
+
+        let messages = capture.0.lock().unwrap().clone();
+        assert_eq!(
+            messages,
+            vec![
+                "DEBG fetching: attempt #1",
+                "INFO fetch successful",
+                "WARN no SSH keys",
+                "ERRO failed to write",
+                "WARN no SSH keys",
+                "ERRO failed to write",
+            ]
+        );
+    }
+}
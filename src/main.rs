@@ -14,9 +14,12 @@
 
 mod cli;
 mod initrd;
+mod logging;
 mod metadata;
 mod network;
 mod providers;
+mod redact;
+mod report;
 mod retry;
 mod util;
 
@@ -26,10 +29,26 @@ use slog_scope::debug;
 use std::env;
 
 fn main() -> Result<()> {
+    let code = run()?;
+    // Exit only once logging is torn down, so that pending records are
+    // flushed.
+    if code != 0 {
+        std::process::exit(code);
+    }
+    Ok(())
+}
+
+/// Run the command given on the command line, returning the process exit code.
+fn run() -> Result<i32> {
     // Setup logging.
-    let decorator = slog_term::TermDecorator::new().build();
+    let decorator = slog_term::TermDecorator::new().stderr().build();
     let drain = slog_term::FullFormat::new(decorator).build().fuse();
     let drain = slog_async::Async::new(drain).build().fuse();
+    let drain = logging::VerbosityFilter(drain);
+    let warnings = report::Warnings::default();
+    let drain = report::WarningRecorder::new(drain, warnings.clone());
+    let redactions = redact::Redactions::default();
+    let drain = redact::Redactor::new(drain, redactions.clone());
     let log = slog::Logger::root(drain, slog_o!());
     let _guard = slog_scope::set_global_logger(log);
     debug!("logging initialized");
@@ -39,8 +58,8 @@ fn main() -> Result<()> {
     debug!("command-line arguments parsed");
 
     // Run core logic.
-    cli_cmd.run().context("failed to run")?;
+    let code = cli_cmd.run(warnings, redactions).context("failed to run")?;
     debug!("all tasks completed");
 
-    Ok(())
+    Ok(code)
 }
@@ -12,11 +12,19 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-use anyhow::{bail, Result};
+use anyhow::{anyhow, bail, Result};
+use openssh_keys::PublicKey;
+use reqwest::header::HeaderMap;
+use slog_scope::warn;
+use std::collections::HashMap;
+use std::net::IpAddr;
+use std::sync::Mutex;
 
+use crate::network;
 use crate::providers;
 use crate::providers::aliyun::AliyunProvider;
 use crate::providers::aws::AwsProvider;
+use crate::providers::cloudstack;
 use crate::providers::cloudstack::configdrive::ConfigDrive;
 use crate::providers::cloudstack::network::CloudstackNetwork;
 use crate::providers::digitalocean::DigitalOceanProvider;
@@ -24,13 +32,21 @@ use crate::providers::exoscale::ExoscaleProvider;
 use crate::providers::gcp::GcpProvider;
 use crate::providers::ibmcloud::IBMGen2Provider;
 use crate::providers::ibmcloud_classic::IBMClassicProvider;
+use crate::providers::linode::LinodeProvider;
+use crate::providers::metal::MetalProvider;
 use crate::providers::microsoft::azure::Azure;
 use crate::providers::microsoft::azurestack::AzureStack;
 use crate::providers::openstack;
 use crate::providers::openstack::network::OpenstackProviderNetwork;
 use crate::providers::packet::PacketProvider;
+use crate::providers::qemu::QemuProvider;
+use crate::providers::scaleway::ScalewayProvider;
 use crate::providers::vmware::VmwareProvider;
 use crate::providers::vultr::VultrProvider;
+use crate::providers::{HostnameSource, IpPreference, MetadataProvider};
+use crate::redact;
+use crate::retry;
+use crate::util::drive;
 
 macro_rules! box_result {
     ($exp:expr) => {
@@ -38,31 +54,347 @@ macro_rules! box_result {
     };
 }
 
+/// Optional settings tweaking how metadata is fetched and processed.
+#[derive(Clone, Debug, Default)]
+pub struct FetchOptions {
+    /// AWS instance metadata API version.
+    pub aws_api_version: Option<String>,
+    /// Azure WireServer fabric API version.
+    pub azure_fabric_version: Option<String>,
+    /// Retries of failed config-drive reads.
+    pub config_drive_read_retry: drive::ReadRetry,
+    /// DNS servers to use when the provider reports none.
+    pub default_dns: Vec<IpAddr>,
+    /// Additional headers for all metadata requests.
+    pub extra_headers: HeaderMap,
+    /// Source of the hostname among the provider metadata.
+    pub hostname_source: HostnameSource,
+    /// Address family preferred for the derived `<PREFIX>_PRIMARY_IP` attribute.
+    pub ip_preference: Option<IpPreference>,
+    /// Base URL of the metadata server, overriding the link-local default.
+    pub metadata_base_url: Option<String>,
+    /// `meta` entry holding additional SSH keys on OpenStack.
+    pub openstack_ssh_keys_meta_key: Option<String>,
+    /// Name for the bond device on Packet, overriding the one in metadata.
+    pub packet_bond_name: Option<String>,
+    /// Sensitive attributes, whose values are redacted from logs.
+    pub redactions: redact::Redactions,
+    /// Fail on network metadata which can't be fully applied, instead of skipping it.
+    pub strict_network: bool,
+}
+
+impl FetchOptions {
+    /// Build a client for metadata requests, honoring these options.
+    pub fn client(&self) -> Result<retry::Client> {
+        Ok(retry::Client::try_new()?.extra_headers(self.extra_headers.clone()))
+    }
+}
+
+/// Providers which honor `FetchOptions::metadata_base_url`.
+pub const BASE_URL_PROVIDERS: &[&str] = &["digitalocean", "gcp", "openstack", "openstack-metadata"];
+
+/// Providers which honor `FetchOptions::openstack_ssh_keys_meta_key`.
+pub const OPENSTACK_PROVIDERS: &[&str] = &["openstack", "openstack-metadata"];
+
 /// Fetch metadata for the given provider.
 ///
 /// This is the generic, top-level function to fetch provider metadata.
 /// The configured provider is passed in and this function dispatches the call
 /// to the provider-specific fetch logic.
-pub fn fetch_metadata(provider: &str) -> Result<Box<dyn providers::MetadataProvider>> {
-    match provider {
-        "aliyun" => box_result!(AliyunProvider::try_new()?),
-        "aws" => box_result!(AwsProvider::try_new()?),
-        "azure" => box_result!(Azure::try_new()?),
-        "azurestack" => box_result!(AzureStack::try_new()?),
-        "cloudstack-metadata" => box_result!(CloudstackNetwork::try_new()?),
-        "cloudstack-configdrive" => box_result!(ConfigDrive::try_new()?),
-        "digitalocean" => box_result!(DigitalOceanProvider::try_new()?),
-        "exoscale" => box_result!(ExoscaleProvider::try_new()?),
-        "gcp" => box_result!(GcpProvider::try_new()?),
-        // IBM Cloud - VPC Generation 2.
-        "ibmcloud" => box_result!(IBMGen2Provider::try_new()?),
-        // IBM Cloud - Classic infrastructure.
-        "ibmcloud-classic" => box_result!(IBMClassicProvider::try_new()?),
-        "openstack" => openstack::try_config_drive_else_network(),
-        "openstack-metadata" => box_result!(OpenstackProviderNetwork::try_new()?),
-        "packet" => box_result!(PacketProvider::try_new()?),
-        "vmware" => box_result!(VmwareProvider::try_new()?),
-        "vultr" => box_result!(VultrProvider::try_new()?),
-        _ => bail!("unknown provider '{}'", provider),
+pub fn fetch_metadata(
+    provider: &str,
+    opts: &FetchOptions,
+) -> Result<Box<dyn providers::MetadataProvider>> {
+    let metadata = fetch_provider_metadata(provider, opts)?;
+    box_result!(PostProcessed {
+        metadata,
+        hostname_source: opts.hostname_source,
+        ip_preference: opts.ip_preference,
+        redactions: opts.redactions.clone(),
+        provider_attributes: Mutex::new(None),
+    })
+}
+
+/// Constructor of a metadata provider, given fetch options.
+type ProviderFactory = fn(&FetchOptions) -> Result<Box<dyn providers::MetadataProvider>>;
+
+/// Registry of providers, by platform ID.
+///
+/// New providers register here, keeping platform IDs sorted.
+const PROVIDERS: &[(&str, ProviderFactory)] = &[
+    ("aliyun", |opts| {
+        box_result!(AliyunProvider::with_client(opts.client()?)?)
+    }),
+    ("aws", |opts| {
+        box_result!(
+            AwsProvider::with_client(opts.client()?)?.api_version(opts.aws_api_version.clone())
+        )
+    }),
+    ("azure", |opts| {
+        box_result!(Azure::with_fabric_version(
+            Some(opts.client()?),
+            opts.azure_fabric_version.clone()
+        )?)
+    }),
+    ("azurestack", |opts| {
+        box_result!(AzureStack::with_client(Some(opts.client()?))?)
+    }),
+    ("cloudstack", |opts| {
+        cloudstack::try_config_drive_else_network(opts.client()?, opts.config_drive_read_retry)
+    }),
+    ("cloudstack-configdrive", |opts| {
+        box_result!(ConfigDrive::try_new()?.read_retry(opts.config_drive_read_retry))
+    }),
+    ("cloudstack-metadata", |opts| {
+        box_result!(CloudstackNetwork::with_client(opts.client()?)?)
+    }),
+    ("digitalocean", |opts| {
+        box_result!(DigitalOceanProvider::with_base_url(
+            opts.client()?,
+            opts.metadata_base_url.clone()
+        )?)
+    }),
+    ("exoscale", |opts| {
+        box_result!(ExoscaleProvider::with_client(opts.client()?)?)
+    }),
+    ("gcp", |opts| {
+        box_result!(
+            GcpProvider::with_client(opts.client()?)?.base_url(opts.metadata_base_url.clone())
+        )
+    }),
+    // IBM Cloud - VPC Generation 2.
+    ("ibmcloud", |opts| {
+        box_result!(IBMGen2Provider::try_new()?.read_retry(opts.config_drive_read_retry))
+    }),
+    // IBM Cloud - Classic infrastructure.
+    ("ibmcloud-classic", |opts| {
+        box_result!(IBMClassicProvider::try_new()?.read_retry(opts.config_drive_read_retry))
+    }),
+    ("linode", |opts| {
+        box_result!(LinodeProvider::with_client(opts.client()?)?)
+    }),
+    // Bare metal hosts provisioned by Metal3.
+    ("metal", |opts| {
+        box_result!(MetalProvider::try_new()?
+            .strict_network(opts.strict_network)
+            .read_retry(opts.config_drive_read_retry))
+    }),
+    ("openstack", |opts| {
+        openstack::try_config_drive_else_network(
+            opts.client()?,
+            opts.metadata_base_url.clone(),
+            opts.openstack_ssh_keys_meta_key.clone(),
+            opts.config_drive_read_retry,
+        )
+    }),
+    ("openstack-metadata", |opts| {
+        box_result!(OpenstackProviderNetwork::with_client(opts.client()?)?
+            .base_url(opts.metadata_base_url.clone())
+            .ssh_keys_meta_key(opts.openstack_ssh_keys_meta_key.clone()))
+    }),
+    ("packet", |opts| {
+        box_result!(PacketProvider::fetch_content(Some(opts.client()?))?
+            .bond_name(opts.packet_bond_name.clone())
+            .default_dns(opts.default_dns.clone())
+            .strict_network(opts.strict_network))
+    }),
+    // QEMU/KVM guests, with metadata passed via fw_cfg.
+    ("qemu", |_| box_result!(QemuProvider::try_new()?)),
+    ("scaleway", |opts| {
+        box_result!(ScalewayProvider::with_client(opts.client()?)?)
+    }),
+    ("vmware", |_| box_result!(VmwareProvider::try_new()?)),
+    ("vultr", |opts| {
+        box_result!(VultrProvider::with_client(opts.client()?)?)
+    }),
+];
+
+/// Platform IDs of all known providers.
+pub fn provider_ids() -> impl Iterator<Item = &'static str> {
+    PROVIDERS.iter().map(|(id, _)| *id)
+}
+
+/// Look up a provider in the registry.
+fn provider_factory(provider: &str) -> Result<ProviderFactory> {
+    match PROVIDERS.iter().find(|(id, _)| *id == provider) {
+        Some((_, factory)) => Ok(*factory),
+        None => bail!("unknown provider '{}'", provider),
+    }
+}
+
+fn fetch_provider_metadata(
+    provider: &str,
+    opts: &FetchOptions,
+) -> Result<Box<dyn providers::MetadataProvider>> {
+    provider_factory(provider)?(opts)
+}
+
+/// Provider metadata, with policies applied uniformly across providers.
+struct PostProcessed {
+    metadata: Box<dyn MetadataProvider>,
+    hostname_source: HostnameSource,
+    ip_preference: Option<IpPreference>,
+    redactions: redact::Redactions,
+    /// Attributes of the provider, once fetched.
+    provider_attributes: Mutex<Option<HashMap<String, String>>>,
+}
+
+impl PostProcessed {
+    /// Return the attributes of the provider, fetching them only once
+    /// across outputs.
+    fn provider_attributes(&self) -> Result<HashMap<String, String>> {
+        let mut cached = self
+            .provider_attributes
+            .lock()
+            .map_err(|_| anyhow!("attributes cache poisoned"))?;
+        if let Some(ref attributes) = *cached {
+            return Ok(attributes.clone());
+        }
+        let attributes = self.metadata.attributes()?;
+        *cached = Some(attributes.clone());
+        Ok(attributes)
+    }
+}
+
+impl MetadataProvider for PostProcessed {
+    fn attributes(&self) -> Result<HashMap<String, String>> {
+        let mut out = self.provider_attributes()?;
+        if let Some(preference) = self.ip_preference {
+            providers::insert_primary_ip(&mut out, preference);
+        }
+        self.redactions.register_attributes(&out);
+        Ok(out)
+    }
+
+    fn hostname(&self) -> Result<Option<String>> {
+        let hostname = self.metadata.hostname()?;
+        // only some sources look at attributes, avoid fetching them otherwise
+        let attributes = match self.hostname_source {
+            HostnameSource::Fqdn | HostnameSource::InstanceId => self.provider_attributes()?,
+            HostnameSource::ProviderDefault | HostnameSource::Short => HashMap::new(),
+        };
+        Ok(providers::select_hostname(
+            self.hostname_source,
+            hostname,
+            &attributes,
+        ))
+    }
+
+    fn ssh_keys(&self) -> Result<Vec<PublicKey>> {
+        let mut keys = self.metadata.ssh_keys()?;
+        // keys may be indirected through an `SSH_KEYS_URL` attribute, but
+        // keys from the provider are still worth writing without them
+        let attributes = match self.provider_attributes() {
+            Ok(attributes) => attributes,
+            Err(e) => {
+                warn!("failed to fetch attributes for SSH_KEYS_URL: {}", e);
+                return Ok(keys);
+            }
+        };
+        // keys URLs may point anywhere, so don't send them metadata headers
+        providers::append_url_ssh_keys(&mut keys, &attributes, None)?;
+        Ok(keys)
+    }
+
+    fn networks(&self) -> Result<Vec<network::Interface>> {
+        self.metadata.networks()
+    }
+
+    fn boot_checkin(&self) -> Result<()> {
+        self.metadata.boot_checkin()
+    }
+
+    fn virtual_network_devices(&self) -> Result<Vec<network::VirtualNetDev>> {
+        self.metadata.virtual_network_devices()
+    }
+
+    fn rd_network_kargs(&self) -> Result<Option<String>> {
+        self.metadata.rd_network_kargs()
+    }
+
+    fn user_data(&self) -> Result<Option<String>> {
+        self.metadata.user_data()
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::sync::Arc;
+
+    #[test]
+    fn test_provider_registry() {
+        let ids: Vec<_> = provider_ids().collect();
+        for id in &["aws", "azure", "gcp", "metal", "openstack", "vultr"] {
+            assert!(ids.contains(id), "{} not registered", id);
+            provider_factory(id).unwrap();
+        }
+
+        // sorted, without duplicates
+        let mut sorted = ids.clone();
+        sorted.sort_unstable();
+        sorted.dedup();
+        assert_eq!(ids, sorted);
+
+        let err = provider_factory("nonexistent").err().unwrap();
+        assert_eq!(err.to_string(), "unknown provider 'nonexistent'");
+        assert!(fetch_metadata("nonexistent", &FetchOptions::default()).is_err());
+    }
+
+    /// Provider counting attribute fetches, which fail if `attributes` is unset.
+    struct CountingProvider {
+        attributes: Option<HashMap<String, String>>,
+        fetches: Arc<Mutex<usize>>,
+    }
+
+    impl MetadataProvider for CountingProvider {
+        fn attributes(&self) -> Result<HashMap<String, String>> {
+            *self.fetches.lock().unwrap() += 1;
+            match self.attributes {
+                Some(ref attributes) => Ok(attributes.clone()),
+                None => bail!("attributes unavailable"),
+            }
+        }
+
+        fn ssh_keys(&self) -> Result<Vec<PublicKey>> {
+            Ok(vec![PublicKey::parse(
+                "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIE+7Ikf7Ot5lNN5lJN9ndRvyFeojyeh8W2VqdXc5BQaq",
+            )?])
+        }
+    }
+
+    fn post_processed(provider: CountingProvider) -> PostProcessed {
+        PostProcessed {
+            metadata: Box::new(provider),
+            hostname_source: HostnameSource::InstanceId,
+            ip_preference: None,
+            redactions: redact::Redactions::default(),
+            provider_attributes: Mutex::new(None),
+        }
+    }
+
+    #[test]
+    fn test_post_processed_attributes() {
+        // attributes are fetched once, across outputs
+        let fetches = Arc::new(Mutex::new(0));
+        let metadata = post_processed(CountingProvider {
+            attributes: Some(maplit::hashmap! {
+                "TEST_INSTANCE_ID".to_string() => "i-1234".to_string(),
+            }),
+            fetches: fetches.clone(),
+        });
+        assert_eq!(metadata.attributes().unwrap().len(), 1);
+        assert_eq!(metadata.hostname().unwrap(), Some("i-1234".to_string()));
+        assert_eq!(metadata.ssh_keys().unwrap().len(), 1);
+        assert_eq!(metadata.attributes().unwrap().len(), 1);
+        assert_eq!(*fetches.lock().unwrap(), 1);
+
+        // SSH keys don't depend on attributes being available
+        let failing = post_processed(CountingProvider {
+            attributes: None,
+            fetches: Arc::new(Mutex::new(0)),
+        });
+        assert_eq!(failing.ssh_keys().unwrap().len(), 1);
+        failing.attributes().unwrap_err();
     }
 }
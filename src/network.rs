@@ -19,6 +19,8 @@
 use anyhow::{anyhow, bail, Context, Result};
 use ipnetwork::IpNetwork;
 use pnet_base::MacAddr;
+use slog_scope::warn;
+use std::collections::HashMap;
 use std::net::IpAddr;
 use std::string::String;
 use std::string::ToString;
@@ -50,6 +52,63 @@ pub fn bonding_mode_to_string(mode: u32) -> Result<String> {
     Err(anyhow!("no such bonding mode: {}", mode))
 }
 
+/// Parse a bonding mode from its name, e.g. `802.3ad`.
+pub fn bonding_mode_from_string(mode: &str) -> Result<u32> {
+    for &(m, s) in &BONDING_MODES {
+        if s == mode {
+            return Ok(m);
+        }
+    }
+    Err(anyhow!("no such bonding mode: {}", mode))
+}
+
+/// Maximum length of a network interface name (`IFNAMSIZ` minus trailing NUL).
+const MAX_INTERFACE_NAME_LEN: usize = 15;
+
+/// Check whether a string is a valid network interface name.
+pub fn validate_interface_name(name: &str) -> Result<()> {
+    if name.is_empty() || name == "." || name == ".." {
+        bail!("invalid interface name '{}'", name);
+    }
+    if name.len() > MAX_INTERFACE_NAME_LEN {
+        bail!(
+            "interface name '{}' is longer than {} characters",
+            name,
+            MAX_INTERFACE_NAME_LEN
+        );
+    }
+    if name.contains(|c: char| c == '/' || c == ':' || c.is_whitespace()) {
+        bail!("interface name '{}' contains invalid characters", name);
+    }
+    Ok(())
+}
+
+/// Maximum length of a domain name, without the trailing dot.
+const MAX_DOMAIN_LEN: usize = 253;
+
+/// Maximum length of a label within a domain name.
+const MAX_DOMAIN_LABEL_LEN: usize = 63;
+
+/// Check whether a string is a valid DNS search domain, i.e. a hostname
+/// optionally ending with a dot.
+fn validate_search_domain(domain: &str) -> Result<()> {
+    let name = domain.strip_suffix('.').unwrap_or(domain);
+    if name.is_empty() || name.len() > MAX_DOMAIN_LEN {
+        bail!("invalid search domain '{}'", domain.escape_debug());
+    }
+    for label in name.split('.') {
+        if label.is_empty()
+            || label.len() > MAX_DOMAIN_LABEL_LEN
+            || label.starts_with('-')
+            || label.ends_with('-')
+            || !label.chars().all(|c| c.is_ascii_alphanumeric() || c == '-')
+        {
+            bail!("invalid search domain '{}'", domain.escape_debug());
+        }
+    }
+    Ok(())
+}
+
 /// Try to parse an IP+netmask pair into a CIDR network.
 pub fn try_parse_cidr(address: IpAddr, netmask: IpAddr) -> Result<IpNetwork> {
     let prefix = ipnetwork::ip_mask_to_prefix(netmask)?;
@@ -60,6 +119,8 @@ pub fn try_parse_cidr(address: IpAddr, netmask: IpAddr) -> Result<IpNetwork> {
 pub struct NetworkRoute {
     pub destination: IpNetwork,
     pub gateway: IpAddr,
+    /// Route priority (`Metric=`), lower values winning, if not the default.
+    pub metric: Option<u32>,
 }
 
 /// A network interface/link.
@@ -75,10 +136,22 @@ pub struct Interface {
     /// Relative priority for interface configuration.
     pub priority: u8,
     pub nameservers: Vec<IpAddr>,
+    /// DNS search domains, in order of preference.
+    pub search_domains: Vec<String>,
     pub ip_addresses: Vec<IpNetwork>,
     pub routes: Vec<NetworkRoute>,
     pub bond: Option<String>,
+    /// Names of VLAN devices to create on top of this interface.
+    pub vlans: Vec<String>,
+    /// Names of tunnel devices to attach to this interface.
+    pub tunnels: Vec<String>,
     pub unmanaged: bool,
+    /// Whether to also get addresses via DHCP.
+    ///
+    /// Static nameservers (if any) then take precedence over DHCP ones.
+    pub dhcp: bool,
+    /// Link MTU, if reported by the provider.
+    pub mtu: Option<u32>,
 }
 
 /// A virtual network interface.
@@ -98,6 +171,118 @@ pub struct SdSection {
     pub attributes: Vec<(String, String)>,
 }
 
+/// Bonding parameters for a bond device.
+///
+/// Unset parameters are left to systemd defaults.
+#[derive(Clone, Debug, Default, PartialEq, Eq)]
+pub struct BondConfig {
+    /// Bonding mode, one of the `BONDING_MODE_*` values.
+    pub mode: u32,
+    /// Hash policy for slave selection (`TransmitHashPolicy=`).
+    pub transmit_hash_policy: Option<String>,
+    /// Link monitoring interval (`MIIMonitorSec=`).
+    pub mii_monitor_sec: Option<String>,
+    /// Delay before enabling a slave after link up (`UpDelaySec=`).
+    pub up_delay_sec: Option<String>,
+    /// Delay before disabling a slave after link down (`DownDelaySec=`).
+    pub down_delay_sec: Option<String>,
+    /// Rate of LACPDUs requested from the link partner (`LACPTransmitRate=`).
+    pub lacp_transmit_rate: Option<String>,
+}
+
+impl BondConfig {
+    /// Return the `[Bond]` section of the `systemd.netdev` configuration.
+    pub fn sd_section(&self) -> Result<SdSection> {
+        let mut attributes = Vec::new();
+        let optional = [
+            ("TransmitHashPolicy", &self.transmit_hash_policy),
+            ("MIIMonitorSec", &self.mii_monitor_sec),
+            ("UpDelaySec", &self.up_delay_sec),
+            ("DownDelaySec", &self.down_delay_sec),
+        ];
+        for (key, value) in optional.iter() {
+            if let Some(value) = value {
+                attributes.push((key.to_string(), value.clone()));
+            }
+        }
+        attributes.push(("Mode".to_string(), bonding_mode_to_string(self.mode)?));
+        if let Some(ref rate) = self.lacp_transmit_rate {
+            attributes.push(("LACPTransmitRate".to_string(), rate.clone()));
+        }
+
+        Ok(SdSection {
+            name: "Bond".to_string(),
+            attributes,
+        })
+    }
+}
+
+/// Endpoints of a point-to-point tunnel device.
+///
+/// The tunnel is attached to an underlying link by listing it in the
+/// `tunnels` of that link's `Interface`. Both endpoints must be of the same
+/// address family, which also selects the netdev kind (`gre` or `ip6gre`).
+#[allow(dead_code)]
+#[derive(Clone, Debug, PartialEq, Eq)]
+pub struct TunnelConfig {
+    /// Local endpoint address (`Local=`), any local address if unset.
+    pub local: Option<IpAddr>,
+    /// Remote endpoint address (`Remote=`).
+    pub remote: IpAddr,
+    /// TTL of tunneled packets (`TTL=`), inherited from the inner packet if unset.
+    pub ttl: Option<u8>,
+}
+
+#[allow(dead_code)]
+impl TunnelConfig {
+    /// Return the netdev kind matching the address family of the endpoints.
+    pub fn kind(&self) -> NetDevKind {
+        if self.remote.is_ipv4() {
+            NetDevKind::Gre
+        } else {
+            NetDevKind::Ip6Gre
+        }
+    }
+
+    /// Return the `[Tunnel]` section of the `systemd.netdev` configuration.
+    pub fn sd_section(&self) -> Result<SdSection> {
+        if let Some(local) = self.local {
+            if local.is_ipv4() != self.remote.is_ipv4() {
+                bail!(
+                    "tunnel endpoints {} and {} of different address families",
+                    local,
+                    self.remote
+                );
+            }
+        }
+
+        let mut attributes = Vec::new();
+        if let Some(local) = self.local {
+            attributes.push(("Local".to_string(), local.to_string()));
+        }
+        attributes.push(("Remote".to_string(), self.remote.to_string()));
+        if let Some(ttl) = self.ttl {
+            attributes.push(("TTL".to_string(), ttl.to_string()));
+        }
+
+        Ok(SdSection {
+            name: "Tunnel".to_string(),
+            attributes,
+        })
+    }
+
+    /// Return the tunnel device with the given name.
+    pub fn netdev(&self, name: &str) -> Result<VirtualNetDev> {
+        Ok(VirtualNetDev {
+            name: name.to_string(),
+            kind: self.kind(),
+            mac_address: MacAddr::zero(),
+            priority: None,
+            sd_netdev_sections: vec![self.sd_section()?],
+        })
+    }
+}
+
 /// Supported virtual network device kinds.
 #[allow(dead_code)]
 #[derive(Clone, Debug, PartialEq, Eq)]
@@ -106,6 +291,10 @@ pub enum NetDevKind {
     Bond,
     /// VLAN child interface for a physical device with 802.1Q.
     Vlan,
+    /// Point-to-point GRE tunnel over IPv4.
+    Gre,
+    /// Point-to-point GRE tunnel over IPv6.
+    Ip6Gre,
 }
 
 impl NetDevKind {
@@ -118,15 +307,127 @@ impl NetDevKind {
         let kind = match *self {
             NetDevKind::Bond => "bond",
             NetDevKind::Vlan => "vlan",
+            NetDevKind::Gre => "gre",
+            NetDevKind::Ip6Gre => "ip6gre",
         };
         kind.to_string()
     }
+
+    /// Return whether devices of this kind have a link-layer address.
+    fn has_mac_address(&self) -> bool {
+        match *self {
+            NetDevKind::Bond | NetDevKind::Vlan => true,
+            NetDevKind::Gre | NetDevKind::Ip6Gre => false,
+        }
+    }
+}
+
+/// Role of a network interface, relative to other interfaces.
+///
+/// networkd applies the first unit, in lexical order, matching an interface.
+/// Bonds and VLANs inherit the MAC address of an underlying physical device,
+/// so their units (matching by name) must come before the ones of physical
+/// devices (matching by MAC address).
+#[allow(dead_code)]
+#[derive(Clone, Copy, Debug, PartialEq, Eq)]
+pub enum InterfaceRole {
+    /// Physical device, possibly member of a bond.
+    Physical,
+    /// Parent aggregation for physically bonded devices.
+    Bond,
+    /// VLAN child interface.
+    Vlan,
+}
+
+impl InterfaceRole {
+    /// Return the default unit priority for interfaces with this role.
+    ///
+    /// Providers can still set a different priority per interface.
+    pub fn priority(self) -> u8 {
+        match self {
+            InterfaceRole::Physical => 10,
+            InterfaceRole::Bond => 5,
+            InterfaceRole::Vlan => 6,
+        }
+    }
+}
+
+/// List the MAC addresses of network interfaces present on this host.
+pub fn local_mac_addresses() -> Vec<MacAddr> {
+    pnet_datalink::interfaces()
+        .into_iter()
+        .filter_map(|iface| iface.mac)
+        .filter(|mac| *mac != MacAddr::zero())
+        .collect()
+}
+
+/// Check that no IP address is assigned to more than one interface.
+///
+/// Interfaces without name nor MAC address can't be matched by a unit, so
+/// they are ignored here.
+pub fn check_address_conflicts(interfaces: &[Interface]) -> Result<()> {
+    let mut owners: HashMap<IpAddr, String> = HashMap::new();
+    for iface in interfaces {
+        let id = match iface.sd_network_unit_name() {
+            Ok(id) => id,
+            Err(_) => continue,
+        };
+        for addr in &iface.ip_addresses {
+            match owners.get(&addr.ip()) {
+                Some(owner) if owner != &id => bail!(
+                    "address {} assigned to multiple interfaces ({}, {})",
+                    addr.ip(),
+                    owner,
+                    id
+                ),
+                _ => {
+                    owners.insert(addr.ip(), id.clone());
+                }
+            }
+        }
+    }
+    Ok(())
+}
+
+/// Check that each route goes through a gateway of the same address family
+/// as its destination, which networkd requires.
+pub fn check_routes(interfaces: &[Interface]) -> Result<()> {
+    for iface in interfaces {
+        for route in &iface.routes {
+            if route.destination.is_ipv4() != route.gateway.is_ipv4() {
+                bail!(
+                    "route to {} through gateway {} of another address family ({})",
+                    route.destination,
+                    route.gateway,
+                    iface
+                        .sd_network_unit_name()
+                        .unwrap_or_else(|_| "unnamed interface".to_string())
+                );
+            }
+        }
+    }
+    Ok(())
 }
 
 impl Interface {
+    /// Return the MAC address to match on, ignoring unset (all-zeroes) ones.
+    fn match_mac_address(&self) -> Option<MacAddr> {
+        self.mac_address.filter(|mac| *mac != MacAddr::zero())
+    }
+
+    /// Check whether this interface is present on the host, given the MAC
+    /// addresses of local interfaces.
+    ///
+    /// Interfaces without a MAC address to match on (e.g. bonds, matched by
+    /// name) are assumed present.
+    pub fn is_present(&self, local_macs: &[MacAddr]) -> bool {
+        self.match_mac_address()
+            .map_or(true, |mac| local_macs.contains(&mac))
+    }
+
     /// Return a deterministic `systemd.network` unit name for this device.
     pub fn sd_network_unit_name(&self) -> Result<String> {
-        let iface_name = match (&self.name, &self.mac_address) {
+        let iface_name = match (&self.name, &self.match_mac_address()) {
             (Some(ref name), _) => name.clone(),
             (None, Some(ref addr)) => addr.to_string(),
             (None, None) => bail!("network interface without name nor MAC address"),
@@ -143,22 +444,58 @@ impl Interface {
         if let Some(name) = self.name.clone() {
             config.push_str(&format!("Name={}\n", name));
         }
-        if let Some(mac) = self.mac_address {
+        if let Some(mac) = self.match_mac_address() {
             config.push_str(&format!("MACAddress={}\n", mac));
         }
 
         // [Network] section
         config.push_str("\n[Network]\n");
+        if self.dhcp {
+            config.push_str("DHCP=yes\n");
+        }
         for ns in &self.nameservers {
             config.push_str(&format!("DNS={}\n", ns))
         }
+        let search_domains: Vec<&str> = self
+            .search_domains
+            .iter()
+            .map(String::as_str)
+            .filter(|domain| match validate_search_domain(domain) {
+                Ok(()) => true,
+                Err(e) => {
+                    warn!("skipping search domain: {}", e);
+                    false
+                }
+            })
+            .collect();
+        if !search_domains.is_empty() {
+            config.push_str(&format!("Domains={}\n", search_domains.join(" ")));
+        }
         if let Some(bond) = self.bond.clone() {
             config.push_str(&format!("Bond={}\n", bond));
         }
+        for vlan in &self.vlans {
+            config.push_str(&format!("VLAN={}\n", vlan));
+        }
+        for tunnel in &self.tunnels {
+            config.push_str(&format!("Tunnel={}\n", tunnel));
+        }
+
+        // [DHCPv4] and [DHCPv6] sections, so that static DNS wins
+        if self.dhcp && !self.nameservers.is_empty() {
+            config.push_str("\n[DHCPv4]\nUseDNS=no\n");
+            config.push_str("\n[DHCPv6]\nUseDNS=no\n");
+        }
 
         // [Link] section
-        if self.unmanaged {
-            config.push_str("\n[Link]\nUnmanaged=yes\n");
+        if self.unmanaged || self.mtu.is_some() {
+            config.push_str("\n[Link]\n");
+            if let Some(mtu) = self.mtu {
+                config.push_str(&format!("MTUBytes={}\n", mtu));
+            }
+            if self.unmanaged {
+                config.push_str("Unmanaged=yes\n");
+            }
         }
 
         // [Address] sections
@@ -172,6 +509,9 @@ impl Interface {
                 "\n[Route]\nDestination={}\nGateway={}\n",
                 route.destination, route.gateway
             ));
+            if let Some(metric) = route.metric {
+                config.push_str(&format!("Metric={}\n", metric));
+            }
         }
 
         config
@@ -192,7 +532,9 @@ impl VirtualNetDev {
         config.push_str("[NetDev]\n");
         config.push_str(&format!("Name={}\n", self.name));
         config.push_str(&format!("Kind={}\n", self.kind.sd_netdev_kind()));
-        config.push_str(&format!("MACAddress={}\n", self.mac_address));
+        if self.kind.has_mac_address() {
+            config.push_str(&format!("MACAddress={}\n", self.mac_address));
+        }
 
         // Custom sections.
         for section in &self.sd_netdev_sections {
@@ -230,7 +572,12 @@ mod tests {
                     ip_addresses: vec![],
                     routes: vec![],
                     bond: None,
+                    vlans: vec![],
+                    tunnels: vec![],
                     unmanaged: false,
+                    dhcp: false,
+                    mtu: None,
+                    search_domains: vec![],
                 },
                 "20-lo.network",
             ),
@@ -243,22 +590,32 @@ mod tests {
                     ip_addresses: vec![],
                     routes: vec![],
                     bond: None,
+                    vlans: vec![],
+                    tunnels: vec![],
                     unmanaged: false,
+                    dhcp: false,
+                    mtu: None,
+                    search_domains: vec![],
                 },
                 "10-lo.network",
             ),
             (
                 Interface {
                     name: None,
-                    mac_address: Some(MacAddr(0, 0, 0, 0, 0, 0)),
+                    mac_address: Some(MacAddr(0xf4, 0x00, 0x34, 0x09, 0x73, 0xee)),
                     priority: 20,
                     nameservers: vec![],
                     ip_addresses: vec![],
                     routes: vec![],
                     bond: None,
+                    vlans: vec![],
+                    tunnels: vec![],
                     unmanaged: false,
+                    dhcp: false,
+                    mtu: None,
+                    search_domains: vec![],
                 },
-                "20-00:00:00:00:00:00.network",
+                "20-f4:00:34:09:73:ee.network",
             ),
             (
                 Interface {
@@ -269,7 +626,12 @@ mod tests {
                     ip_addresses: vec![],
                     routes: vec![],
                     bond: None,
+                    vlans: vec![],
+                    tunnels: vec![],
                     unmanaged: false,
+                    dhcp: false,
+                    mtu: None,
+                    search_domains: vec![],
                 },
                 "20-lo.network",
             ),
@@ -291,9 +653,208 @@ mod tests {
             ip_addresses: vec![],
             routes: vec![],
             bond: None,
+            vlans: vec![],
+            tunnels: vec![],
+            unmanaged: false,
+            dhcp: false,
+            mtu: None,
+            search_domains: vec![],
+        };
+        i.sd_network_unit_name().unwrap_err();
+    }
+
+    #[test]
+    fn interface_zero_mac() {
+        let mut i = Interface {
+            name: None,
+            mac_address: Some(MacAddr::zero()),
+            priority: 20,
+            nameservers: vec![],
+            ip_addresses: vec![],
+            routes: vec![],
+            bond: None,
+            vlans: vec![],
+            tunnels: vec![],
             unmanaged: false,
+            dhcp: false,
+            mtu: None,
+            search_domains: vec![],
         };
         i.sd_network_unit_name().unwrap_err();
+
+        i.name = Some(String::from("bond0"));
+        assert_eq!(i.sd_network_unit_name().unwrap(), "20-bond0.network");
+        assert_eq!(i.config(), "[Match]\nName=bond0\n\n[Network]\n");
+    }
+
+    #[test]
+    fn interface_address_conflicts() {
+        let eth0 = Interface {
+            name: Some(String::from("eth0")),
+            mac_address: None,
+            priority: 10,
+            nameservers: vec![],
+            ip_addresses: vec![IpNetwork::V4(
+                Ipv4Network::new(Ipv4Addr::new(10, 0, 0, 5), 24).unwrap(),
+            )],
+            routes: vec![],
+            bond: None,
+            vlans: vec![],
+            tunnels: vec![],
+            unmanaged: false,
+            dhcp: false,
+            mtu: None,
+            search_domains: vec![],
+        };
+        let eth1 = Interface {
+            name: Some(String::from("eth1")),
+            ip_addresses: vec![IpNetwork::V4(
+                Ipv4Network::new(Ipv4Addr::new(10, 0, 1, 5), 24).unwrap(),
+            )],
+            ..eth0.clone()
+        };
+        check_address_conflicts(&[eth0.clone(), eth1]).unwrap();
+
+        // same address, different prefix length
+        let eth1 = Interface {
+            name: Some(String::from("eth1")),
+            ip_addresses: vec![IpNetwork::V4(
+                Ipv4Network::new(Ipv4Addr::new(10, 0, 0, 5), 32).unwrap(),
+            )],
+            ..eth0.clone()
+        };
+        check_address_conflicts(&[eth0.clone(), eth1]).unwrap_err();
+
+        // interfaces without name nor MAC address are ignored
+        let unnamed = Interface {
+            name: None,
+            ..eth0.clone()
+        };
+        check_address_conflicts(&[eth0, unnamed]).unwrap();
+    }
+
+    #[test]
+    fn interface_config_dual_stack() {
+        let mut i = Interface {
+            name: Some(String::from("eth0")),
+            mac_address: None,
+            priority: 10,
+            nameservers: vec![
+                IpAddr::V4(Ipv4Addr::new(192, 0, 2, 53)),
+                IpAddr::V6(Ipv6Addr::new(0x2001, 0xdb8, 0, 0, 0, 0, 0, 0x53)),
+            ],
+            ip_addresses: vec![
+                IpNetwork::V4(Ipv4Network::new(Ipv4Addr::new(192, 0, 2, 10), 24).unwrap()),
+                IpNetwork::V6(
+                    Ipv6Network::new(Ipv6Addr::new(0x2001, 0xdb8, 0, 1, 0, 0, 0, 0x10), 64)
+                        .unwrap(),
+                ),
+            ],
+            routes: vec![
+                NetworkRoute {
+                    destination: IpNetwork::V4(Ipv4Network::new(Ipv4Addr::UNSPECIFIED, 0).unwrap()),
+                    gateway: IpAddr::V4(Ipv4Addr::new(192, 0, 2, 1)),
+                    metric: None,
+                },
+                NetworkRoute {
+                    destination: IpNetwork::V6(Ipv6Network::new(Ipv6Addr::UNSPECIFIED, 0).unwrap()),
+                    gateway: IpAddr::V6(Ipv6Addr::new(0xfe80, 0, 0, 0, 0, 0, 0, 1)),
+                    metric: Some(100),
+                },
+            ],
+            bond: None,
+            vlans: vec![],
+            tunnels: vec![],
+            unmanaged: false,
+            dhcp: false,
+            mtu: None,
+            search_domains: vec![],
+        };
+        let expected = "[Match]
+Name=eth0
+
+[Network]
+DNS=192.0.2.53
+DNS=2001:db8::53
+
+[Address]
+Address=192.0.2.10/24
+
+[Address]
+Address=2001:db8:0:1::10/64
+
+[Route]
+Destination=0.0.0.0/0
+Gateway=192.0.2.1
+
+[Route]
+Destination=::/0
+Gateway=fe80::1
+Metric=100
+";
+        assert_eq!(i.config(), expected);
+        check_routes(&[i.clone()]).unwrap();
+
+        // gateways must match the destination address family
+        i.routes[1].gateway = IpAddr::V4(Ipv4Addr::new(192, 0, 2, 1));
+        let err = check_routes(&[i]).unwrap_err();
+        assert!(err.to_string().contains("route to ::/0"), "{}", err);
+    }
+
+    #[test]
+    fn interface_config_search_domains() {
+        let i = Interface {
+            name: Some(String::from("eth0")),
+            mac_address: None,
+            priority: 10,
+            nameservers: vec![IpAddr::V4(Ipv4Addr::new(192, 0, 2, 53))],
+            ip_addresses: vec![],
+            routes: vec![],
+            bond: None,
+            vlans: vec![],
+            tunnels: vec![],
+            unmanaged: false,
+            dhcp: true,
+            mtu: None,
+            search_domains: vec![
+                String::from("example.com"),
+                String::from("corp.example.com"),
+                String::from("lab.example.net"),
+            ],
+        };
+        let expected = "[Match]
+Name=eth0
+
+[Network]
+DHCP=yes
+DNS=192.0.2.53
+Domains=example.com corp.example.com lab.example.net
+
+[DHCPv4]
+UseDNS=no
+
+[DHCPv6]
+UseDNS=no
+";
+        assert_eq!(i.config(), expected);
+
+        // invalid domains are skipped, as they would break the unit
+        let mut i = i;
+        i.search_domains = vec![
+            String::from("example.com."),
+            String::from("bad domain"),
+            String::from("evil.example\n[Network]\nDNS=203.0.113.1"),
+            String::from("-bad.example"),
+            String::from(""),
+        ];
+        assert!(i.config().contains("\nDomains=example.com.\n"));
+        assert!(!i.config().contains("203.0.113.1"));
+        i.search_domains = vec![String::from("bad_domain")];
+        assert!(!i.config().contains("Domains="));
+
+        validate_search_domain("a-1.example.com").unwrap();
+        validate_search_domain(&"a".repeat(64)).unwrap_err();
+        validate_search_domain(".").unwrap_err();
     }
 
     #[test]
@@ -326,13 +887,41 @@ mod tests {
         }
     }
 
+    #[test]
+    fn interface_name_validation() {
+        let valid = vec![
+            "bond0",
+            "eth0",
+            "enp0s31f6",
+            "a",
+            "bond.100",
+            "abcdefghijklmno",
+        ];
+        for name in valid {
+            validate_interface_name(name).unwrap();
+        }
+
+        let invalid = vec![
+            "",
+            ".",
+            "..",
+            "abcdefghijklmnop",
+            "bond/0",
+            "bond:0",
+            "bond 0",
+        ];
+        for name in invalid {
+            validate_interface_name(name).unwrap_err();
+        }
+    }
+
     #[test]
     fn interface_config() {
         let is = vec![
             (
                 Interface {
                     name: Some(String::from("lo")),
-                    mac_address: Some(MacAddr(0, 0, 0, 0, 0, 0)),
+                    mac_address: Some(MacAddr(0xf4, 0x00, 0x34, 0x09, 0x73, 0xee)),
                     priority: 20,
                     nameservers: vec![
                         IpAddr::V4(Ipv4Addr::new(127, 0, 0, 1)),
@@ -349,13 +938,19 @@ mod tests {
                             Ipv4Network::new(Ipv4Addr::new(127, 0, 0, 1), 8).unwrap(),
                         ),
                         gateway: IpAddr::V4(Ipv4Addr::new(127, 0, 0, 1)),
+                        metric: None,
                     }],
                     bond: Some(String::from("james")),
+                    vlans: vec![],
+                    tunnels: vec![],
                     unmanaged: false,
+                    dhcp: false,
+                    mtu: None,
+                    search_domains: vec![],
                 },
                 "[Match]
 Name=lo
-MACAddress=00:00:00:00:00:00
+MACAddress=f4:00:34:09:73:ee
 
 [Network]
 DNS=127.0.0.1
@@ -371,6 +966,30 @@ Address=::1/128
 [Route]
 Destination=127.0.0.1/8
 Gateway=127.0.0.1
+",
+            ),
+            (
+                Interface {
+                    name: Some(String::from("bond0")),
+                    mac_address: None,
+                    priority: 20,
+                    nameservers: vec![],
+                    ip_addresses: vec![],
+                    routes: vec![],
+                    bond: None,
+                    vlans: vec![String::from("bond0.100"), String::from("bond0.200")],
+                    tunnels: vec![],
+                    unmanaged: false,
+                    dhcp: false,
+                    mtu: None,
+                    search_domains: vec![],
+                },
+                "[Match]
+Name=bond0
+
+[Network]
+VLAN=bond0.100
+VLAN=bond0.200
 ",
             ),
             // this isn't really a valid interface object, but it's testing
@@ -385,7 +1004,12 @@ Gateway=127.0.0.1
                     ip_addresses: vec![],
                     routes: vec![],
                     bond: None,
+                    vlans: vec![],
+                    tunnels: vec![],
                     unmanaged: false,
+                    dhcp: false,
+                    mtu: None,
+                    search_domains: vec![],
                 },
                 "[Match]
 
@@ -399,6 +1023,92 @@ Gateway=127.0.0.1
         }
     }
 
+    #[test]
+    fn interface_config_dhcp_static_dns() {
+        let mut i = Interface {
+            name: Some(String::from("eth0")),
+            mac_address: None,
+            priority: 10,
+            nameservers: vec![
+                IpAddr::V4(Ipv4Addr::new(192, 0, 2, 53)),
+                IpAddr::V6(Ipv6Addr::new(0x2001, 0xdb8, 0, 0, 0, 0, 0, 0x53)),
+            ],
+            ip_addresses: vec![],
+            routes: vec![],
+            bond: None,
+            vlans: vec![],
+            tunnels: vec![],
+            unmanaged: false,
+            dhcp: true,
+            mtu: None,
+            search_domains: vec![],
+        };
+        let expected = "[Match]
+Name=eth0
+
+[Network]
+DHCP=yes
+DNS=192.0.2.53
+DNS=2001:db8::53
+
+[DHCPv4]
+UseDNS=no
+
+[DHCPv6]
+UseDNS=no
+";
+        assert_eq!(i.config(), expected);
+
+        // DNS from DHCP is used when there are no static nameservers
+        i.nameservers.clear();
+        let expected = "[Match]
+Name=eth0
+
+[Network]
+DHCP=yes
+";
+        assert_eq!(i.config(), expected);
+    }
+
+    #[test]
+    fn interface_role_priority() {
+        assert!(InterfaceRole::Bond.priority() < InterfaceRole::Physical.priority());
+        assert!(InterfaceRole::Vlan.priority() < InterfaceRole::Physical.priority());
+    }
+
+    #[test]
+    fn interface_config_mtu() {
+        let i = Interface {
+            name: Some(String::from("eth0")),
+            mac_address: None,
+            priority: 10,
+            nameservers: vec![],
+            ip_addresses: vec![IpNetwork::V4(
+                Ipv4Network::new(Ipv4Addr::new(10, 0, 0, 2), 24).unwrap(),
+            )],
+            routes: vec![],
+            bond: None,
+            vlans: vec![],
+            tunnels: vec![],
+            unmanaged: false,
+            dhcp: false,
+            mtu: Some(9000),
+            search_domains: vec![],
+        };
+        let expected = "[Match]
+Name=eth0
+
+[Network]
+
+[Link]
+MTUBytes=9000
+
+[Address]
+Address=10.0.0.2/24
+";
+        assert_eq!(i.config(), expected);
+    }
+
     #[test]
     fn virtual_netdev_config() {
         let ds = vec![
@@ -454,4 +1164,159 @@ MACAddress=00:00:00:00:00:00
             assert_eq!(d.sd_netdev_config(), s);
         }
     }
+
+    #[test]
+    fn bond_netdev_config() {
+        let lacp = BondConfig {
+            mode: BONDING_MODE_LACP,
+            transmit_hash_policy: Some(String::from("layer3+4")),
+            mii_monitor_sec: Some(String::from(".1")),
+            lacp_transmit_rate: Some(String::from("fast")),
+            ..BondConfig::default()
+        };
+        let active_backup = BondConfig {
+            mode: BONDING_MODE_ACTIVE_BACKUP,
+            up_delay_sec: Some(String::from(".2")),
+            down_delay_sec: Some(String::from(".2")),
+            ..BondConfig::default()
+        };
+        let ds = vec![
+            (
+                lacp,
+                "[NetDev]
+Name=bond0
+Kind=bond
+MACAddress=00:00:00:00:00:00
+
+[Bond]
+TransmitHashPolicy=layer3+4
+MIIMonitorSec=.1
+Mode=802.3ad
+LACPTransmitRate=fast
+",
+            ),
+            (
+                active_backup,
+                "[NetDev]
+Name=bond0
+Kind=bond
+MACAddress=00:00:00:00:00:00
+
+[Bond]
+UpDelaySec=.2
+DownDelaySec=.2
+Mode=active-backup
+",
+            ),
+        ];
+
+        for (bond, s) in ds {
+            let d = VirtualNetDev {
+                name: String::from("bond0"),
+                kind: NetDevKind::Bond,
+                mac_address: MacAddr(0, 0, 0, 0, 0, 0),
+                priority: Some(5),
+                sd_netdev_sections: vec![bond.sd_section().unwrap()],
+            };
+            assert_eq!(d.sd_netdev_config(), s);
+        }
+
+        let invalid = BondConfig {
+            mode: 42,
+            ..BondConfig::default()
+        };
+        invalid.sd_section().unwrap_err();
+
+        assert_eq!(
+            bonding_mode_from_string("802.3ad").unwrap(),
+            BONDING_MODE_LACP
+        );
+        bonding_mode_from_string("lacp").unwrap_err();
+    }
+
+    #[test]
+    fn gre_tunnel_netdev_config() {
+        let ds = vec![
+            (
+                TunnelConfig {
+                    local: Some(IpAddr::V4(Ipv4Addr::new(192, 0, 2, 10))),
+                    remote: IpAddr::V4(Ipv4Addr::new(198, 51, 100, 1)),
+                    ttl: Some(64),
+                },
+                "[NetDev]
+Name=mgmt0
+Kind=gre
+
+[Tunnel]
+Local=192.0.2.10
+Remote=198.51.100.1
+TTL=64
+",
+            ),
+            (
+                TunnelConfig {
+                    local: None,
+                    remote: IpAddr::V4(Ipv4Addr::new(198, 51, 100, 1)),
+                    ttl: None,
+                },
+                "[NetDev]
+Name=mgmt0
+Kind=gre
+
+[Tunnel]
+Remote=198.51.100.1
+",
+            ),
+            (
+                TunnelConfig {
+                    local: Some(IpAddr::V6(Ipv6Addr::new(
+                        0x2001, 0xdb8, 0, 0, 0, 0, 0, 0x10,
+                    ))),
+                    remote: IpAddr::V6(Ipv6Addr::new(0x2001, 0xdb8, 0, 1, 0, 0, 0, 1)),
+                    ttl: None,
+                },
+                "[NetDev]
+Name=mgmt0
+Kind=ip6gre
+
+[Tunnel]
+Local=2001:db8::10
+Remote=2001:db8:0:1::1
+",
+            ),
+        ];
+
+        for (tunnel, s) in ds {
+            let d = tunnel.netdev("mgmt0").unwrap();
+            assert_eq!(d.netdev_unit_name(), "10-mgmt0.netdev");
+            assert_eq!(d.sd_netdev_config(), s);
+        }
+
+        let mixed = TunnelConfig {
+            local: Some(IpAddr::V4(Ipv4Addr::new(192, 0, 2, 10))),
+            remote: IpAddr::V6(Ipv6Addr::new(0x2001, 0xdb8, 0, 1, 0, 0, 0, 1)),
+            ttl: None,
+        };
+        mixed.netdev("mgmt0").unwrap_err();
+
+        let link = Interface {
+            name: Some(String::from("eth0")),
+            mac_address: None,
+            priority: 10,
+            nameservers: vec![],
+            ip_addresses: vec![],
+            routes: vec![],
+            bond: None,
+            vlans: vec![],
+            tunnels: vec![String::from("mgmt0")],
+            unmanaged: false,
+            dhcp: true,
+            mtu: None,
+            search_domains: vec![],
+        };
+        assert_eq!(
+            link.config(),
+            "[Match]\nName=eth0\n\n[Network]\nDHCP=yes\nTunnel=mgmt0\n"
+        );
+    }
 }
@@ -7,7 +7,8 @@ fn basic_hostname() {
     let ep = "/hostname";
     let hostname = "test-hostname";
 
-    let mut provider = aliyun::AliyunProvider::try_new().unwrap();
+    let mut provider =
+        aliyun::AliyunProvider::with_client(crate::retry::Client::try_new().unwrap()).unwrap();
     provider.client = provider.client.max_retries(0);
 
     let _m = mockito::mock("GET", ep).with_status(503).create();
@@ -37,7 +38,8 @@ fn basic_hostname() {
 
 #[test]
 fn basic_pubkeys() {
-    let mut provider = aliyun::AliyunProvider::try_new().unwrap();
+    let mut provider =
+        aliyun::AliyunProvider::with_client(crate::retry::Client::try_new().unwrap()).unwrap();
     provider.client = provider.client.max_retries(0);
 
     // Setup two entries with identical content, in order to test de-dup.
@@ -25,8 +25,9 @@ pub struct AliyunProvider {
 }
 
 impl AliyunProvider {
-    pub fn try_new() -> Result<AliyunProvider> {
-        let client = retry::Client::try_new()?.return_on_404(true);
+    /// Build a provider fetching metadata with the given client.
+    pub(crate) fn with_client(client: retry::Client) -> Result<AliyunProvider> {
+        let client = client.return_on_404(true);
 
         Ok(AliyunProvider { client })
     }
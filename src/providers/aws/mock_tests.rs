@@ -5,13 +5,16 @@ use mockito;
 
 #[test]
 fn test_aws_basic() {
-    let ep = "/meta-data/public-keys";
+    let ep = "/2019-10-01/meta-data/public-keys";
     let client = crate::retry::Client::try_new()
         .context("failed to create http client")
         .unwrap()
         .max_retries(0)
         .return_on_404(true);
-    let provider = aws::AwsProvider { client };
+    let provider = aws::AwsProvider {
+        client,
+        api_version: "2019-10-01".to_string(),
+    };
 
     provider.fetch_ssh_keys().unwrap_err();
 
@@ -32,25 +35,47 @@ fn test_aws_basic() {
 
 #[test]
 fn test_aws_attributes() {
+    let ami_id = "ami-0123456789abcdef0";
+    let ami_launch_index = "3";
     let instance_id = "test-instance-id";
     let instance_type = "test-instance-type";
     let ipv4_local = "test-ipv4-local";
     let ipv4_public = "test-ipv4-public";
     let availability_zone = "test-availability-zone";
+    let availability_zone_id = "use1-az6";
+    let domain = "amazonaws.com.cn";
     let hostname = "test-hostname";
     let public_hostname = "test-public-hostname";
+    let security_groups = "test-sg-web\ntest-sg-ssh\n";
+    let lifecycle_state = "InService";
     let instance_id_doc = r#"{"region": "test-region"}"#;
     let region = "test-region";
 
     let endpoints = maplit::btreemap! {
-        "/meta-data/instance-id" => instance_id,
-        "/meta-data/instance-type" => instance_type,
-        "/meta-data/local-ipv4" => ipv4_local,
-        "/meta-data/public-ipv4" => ipv4_public,
-        "/meta-data/placement/availability-zone" => availability_zone,
-        "/meta-data/hostname" => hostname,
-        "/meta-data/public-hostname" => public_hostname,
-        "/dynamic/instance-identity/document" => instance_id_doc,
+        "/2019-10-01/meta-data/ami-id" => ami_id,
+        "/2019-10-01/meta-data/ami-launch-index" => ami_launch_index,
+        "/2019-10-01/meta-data/instance-id" => instance_id,
+        "/2019-10-01/meta-data/instance-type" => instance_type,
+        "/2019-10-01/meta-data/local-ipv4" => ipv4_local,
+        "/2019-10-01/meta-data/public-ipv4" => ipv4_public,
+        "/2019-10-01/meta-data/placement/availability-zone" => availability_zone,
+        "/2019-10-01/meta-data/placement/availability-zone-id" => availability_zone_id,
+        "/2019-10-01/meta-data/services/domain" => domain,
+        "/2019-10-01/meta-data/hostname" => hostname,
+        "/2019-10-01/meta-data/public-hostname" => public_hostname,
+        "/2019-10-01/meta-data/security-groups" => security_groups,
+        "/2019-10-01/meta-data/autoscaling/target-lifecycle-state" => lifecycle_state,
+        "/2019-10-01/meta-data/events/maintenance/scheduled" => "[]",
+        "/2019-10-01/meta-data/instance-life-cycle" => "on-demand",
+        "/2019-10-01/meta-data/block-device-mapping/" => "ami\nroot\n",
+        "/2019-10-01/meta-data/block-device-mapping/ami" => "/dev/xvda",
+        "/2019-10-01/meta-data/block-device-mapping/root" => "/dev/xvda",
+        "/2019-10-01/meta-data/network/interfaces/macs/" => "0e:49:61:0f:c3:11/\n",
+        "/2019-10-01/meta-data/network/interfaces/macs/0e:49:61:0f:c3:11/ipv6s" => "2001:db8::1\n",
+        "/2019-10-01/meta-data/tags/instance" => "Name\ncost-center\n",
+        "/2019-10-01/meta-data/tags/instance/Name" => "test-name",
+        "/2019-10-01/meta-data/tags/instance/cost-center" => "cc.1234",
+        "/2019-10-01/dynamic/instance-identity/document" => instance_id_doc,
     };
 
     let mut mocks = Vec::with_capacity(endpoints.len());
@@ -63,13 +88,25 @@ fn test_aws_attributes() {
     }
 
     let attributes = maplit::hashmap! {
+        "AWS_AMI_ID".to_string() => ami_id.to_string(),
+        "AWS_AMI_LAUNCH_INDEX".to_string() => ami_launch_index.to_string(),
         "AWS_INSTANCE_ID".to_string() => instance_id.to_string(),
         "AWS_INSTANCE_TYPE".to_string() => instance_type.to_string(),
         "AWS_IPV4_LOCAL".to_string() => ipv4_local.to_string(),
         "AWS_IPV4_PUBLIC".to_string() => ipv4_public.to_string(),
         "AWS_AVAILABILITY_ZONE".to_string() => availability_zone.to_string(),
+        "AWS_AVAILABILITY_ZONE_ID".to_string() => availability_zone_id.to_string(),
+        "AWS_DOMAIN".to_string() => domain.to_string(),
         "AWS_HOSTNAME".to_string() => hostname.to_string(),
         "AWS_PUBLIC_HOSTNAME".to_string() => public_hostname.to_string(),
+        "AWS_SECURITY_GROUPS".to_string() => "test-sg-web,test-sg-ssh".to_string(),
+        "AWS_AUTOSCALING_LIFECYCLE_STATE".to_string() => lifecycle_state.to_string(),
+        "AWS_BLOCK_DEVICE_AMI".to_string() => "/dev/xvda".to_string(),
+        "AWS_BLOCK_DEVICE_ROOT".to_string() => "/dev/xvda".to_string(),
+        "AWS_IPV6_0".to_string() => "2001:db8::1".to_string(),
+        "AWS_TAG_NAME".to_string() => "test-name".to_string(),
+        "AWS_TAG_COST_CENTER".to_string() => "cc.1234".to_string(),
+        "INSTANCE_PREEMPTIBLE".to_string() => "false".to_string(),
         "AWS_REGION".to_string() => region.to_string(),
     };
 
@@ -78,7 +115,10 @@ fn test_aws_attributes() {
         .unwrap()
         .max_retries(0)
         .return_on_404(true);
-    let provider = aws::AwsProvider { client };
+    let provider = aws::AwsProvider {
+        client,
+        api_version: "2019-10-01".to_string(),
+    };
 
     let v = provider.attributes().unwrap();
     assert_eq!(v, attributes);
@@ -89,36 +129,70 @@ fn test_aws_attributes() {
 
 #[test]
 fn test_aws_imds_versions() {
+    let ami_id = "ami-0123456789abcdef0";
+    let ami_launch_index = "3";
     let instance_id = "test-instance-id";
     let instance_type = "test-instance-type";
     let ipv4_local = "test-ipv4-local";
     let ipv4_public = "test-ipv4-public";
     let availability_zone = "test-availability-zone";
+    let availability_zone_id = "use1-az6";
+    let domain = "amazonaws.com.cn";
     let hostname = "test-hostname";
     let public_hostname = "test-public-hostname";
+    let security_groups = "test-sg-web\ntest-sg-ssh\n";
+    let lifecycle_state = "InService";
     let instance_id_doc = r#"{"region": "test-region"}"#;
     let region = "test-region";
 
     let attributes = maplit::hashmap! {
+        "AWS_AMI_ID".to_string() => ami_id.to_string(),
+        "AWS_AMI_LAUNCH_INDEX".to_string() => ami_launch_index.to_string(),
         "AWS_INSTANCE_ID".to_string() => instance_id.to_string(),
         "AWS_INSTANCE_TYPE".to_string() => instance_type.to_string(),
         "AWS_IPV4_LOCAL".to_string() => ipv4_local.to_string(),
         "AWS_IPV4_PUBLIC".to_string() => ipv4_public.to_string(),
         "AWS_AVAILABILITY_ZONE".to_string() => availability_zone.to_string(),
+        "AWS_AVAILABILITY_ZONE_ID".to_string() => availability_zone_id.to_string(),
+        "AWS_DOMAIN".to_string() => domain.to_string(),
         "AWS_HOSTNAME".to_string() => hostname.to_string(),
         "AWS_PUBLIC_HOSTNAME".to_string() => public_hostname.to_string(),
+        "AWS_SECURITY_GROUPS".to_string() => "test-sg-web,test-sg-ssh".to_string(),
+        "AWS_AUTOSCALING_LIFECYCLE_STATE".to_string() => lifecycle_state.to_string(),
+        "AWS_BLOCK_DEVICE_AMI".to_string() => "/dev/xvda".to_string(),
+        "AWS_BLOCK_DEVICE_ROOT".to_string() => "/dev/xvda".to_string(),
+        "AWS_IPV6_0".to_string() => "2001:db8::1".to_string(),
+        "AWS_TAG_NAME".to_string() => "test-name".to_string(),
+        "AWS_TAG_COST_CENTER".to_string() => "cc.1234".to_string(),
+        "INSTANCE_PREEMPTIBLE".to_string() => "false".to_string(),
         "AWS_REGION".to_string() => region.to_string(),
     };
 
     let endpoints = maplit::btreemap! {
-        "/meta-data/instance-id" => instance_id,
-        "/meta-data/instance-type" => instance_type,
-        "/meta-data/local-ipv4" => ipv4_local,
-        "/meta-data/public-ipv4" => ipv4_public,
-        "/meta-data/placement/availability-zone" => availability_zone,
-        "/meta-data/hostname" => hostname,
-        "/meta-data/public-hostname" => public_hostname,
-        "/dynamic/instance-identity/document" => instance_id_doc,
+        "/2019-10-01/meta-data/ami-id" => ami_id,
+        "/2019-10-01/meta-data/ami-launch-index" => ami_launch_index,
+        "/2019-10-01/meta-data/instance-id" => instance_id,
+        "/2019-10-01/meta-data/instance-type" => instance_type,
+        "/2019-10-01/meta-data/local-ipv4" => ipv4_local,
+        "/2019-10-01/meta-data/public-ipv4" => ipv4_public,
+        "/2019-10-01/meta-data/placement/availability-zone" => availability_zone,
+        "/2019-10-01/meta-data/placement/availability-zone-id" => availability_zone_id,
+        "/2019-10-01/meta-data/services/domain" => domain,
+        "/2019-10-01/meta-data/hostname" => hostname,
+        "/2019-10-01/meta-data/public-hostname" => public_hostname,
+        "/2019-10-01/meta-data/security-groups" => security_groups,
+        "/2019-10-01/meta-data/autoscaling/target-lifecycle-state" => lifecycle_state,
+        "/2019-10-01/meta-data/events/maintenance/scheduled" => "[]",
+        "/2019-10-01/meta-data/instance-life-cycle" => "on-demand",
+        "/2019-10-01/meta-data/block-device-mapping/" => "ami\nroot\n",
+        "/2019-10-01/meta-data/block-device-mapping/ami" => "/dev/xvda",
+        "/2019-10-01/meta-data/block-device-mapping/root" => "/dev/xvda",
+        "/2019-10-01/meta-data/network/interfaces/macs/" => "0e:49:61:0f:c3:11/\n",
+        "/2019-10-01/meta-data/network/interfaces/macs/0e:49:61:0f:c3:11/ipv6s" => "2001:db8::1\n",
+        "/2019-10-01/meta-data/tags/instance" => "Name\ncost-center\n",
+        "/2019-10-01/meta-data/tags/instance/Name" => "test-name",
+        "/2019-10-01/meta-data/tags/instance/cost-center" => "cc.1234",
+        "/2019-10-01/dynamic/instance-identity/document" => instance_id_doc,
     };
 
     let client = crate::retry::Client::try_new()
@@ -138,7 +212,7 @@ fn test_aws_imds_versions() {
             mocks.push(m);
         }
 
-        let _m = mockito::mock("PUT", "/api/token")
+        let _m = mockito::mock("PUT", "/latest/api/token")
             .match_header("X-aws-ec2-metadata-token-ttl-seconds", "21600")
             .with_status(403)
             .with_body("Forbidden")
@@ -166,7 +240,7 @@ fn test_aws_imds_versions() {
             mocks.push(m);
         }
 
-        let _m = mockito::mock("PUT", "/api/token")
+        let _m = mockito::mock("PUT", "/latest/api/token")
             .match_header("X-aws-ec2-metadata-token-ttl-seconds", "21600")
             .with_status(200)
             .with_body(token)
@@ -181,3 +255,546 @@ fn test_aws_imds_versions() {
         provider.attributes().unwrap_err();
     }
 }
+
+#[test]
+fn test_aws_api_version() {
+    let client = crate::retry::Client::try_new()
+        .context("failed to create http client")
+        .unwrap()
+        .max_retries(0)
+        .return_on_404(true);
+    let provider = aws::AwsProvider {
+        client,
+        api_version: "2019-10-01".to_string(),
+    }
+    .api_version(Some("2021-03-23".to_string()));
+
+    let _m = mockito::mock("GET", "/2021-03-23/meta-data/hostname")
+        .with_status(200)
+        .with_body("test-hostname")
+        .create();
+
+    let v = provider.hostname().unwrap();
+    assert_eq!(v, Some("test-hostname".to_string()));
+
+    mockito::reset();
+}
+
+#[test]
+fn test_aws_security_groups_empty() {
+    let client = crate::retry::Client::try_new()
+        .context("failed to create http client")
+        .unwrap()
+        .max_retries(0)
+        .return_on_404(true);
+    let provider = aws::AwsProvider {
+        client,
+        api_version: "2019-10-01".to_string(),
+    };
+
+    let _m_sg = mockito::mock("GET", "/2019-10-01/meta-data/security-groups")
+        .with_status(200)
+        .with_body("\n")
+        .create();
+    let _m_others = mockito::mock("GET", mockito::Matcher::Any)
+        .with_status(404)
+        .create();
+
+    let v = provider.attributes().unwrap();
+    assert!(!v.contains_key("AWS_SECURITY_GROUPS"));
+
+    mockito::reset();
+}
+
+#[test]
+fn test_aws_optional_attributes_absent() {
+    let client = crate::retry::Client::try_new()
+        .context("failed to create http client")
+        .unwrap()
+        .max_retries(0)
+        .return_on_404(true);
+    let provider = aws::AwsProvider {
+        client,
+        api_version: "2019-10-01".to_string(),
+    };
+
+    // instances outside of an auto scaling group, or in older
+    // environments, get a 404
+    let _m = mockito::mock("GET", mockito::Matcher::Any)
+        .with_status(404)
+        .create();
+
+    let v = provider.attributes().unwrap();
+    assert!(!v.contains_key("AWS_AUTOSCALING_LIFECYCLE_STATE"));
+    assert!(!v.contains_key("INSTANCE_PREEMPTIBLE"));
+    assert!(!v.contains_key("AWS_AVAILABILITY_ZONE_ID"));
+    assert!(!v.contains_key("AWS_DOMAIN"));
+
+    mockito::reset();
+}
+
+#[test]
+fn test_aws_write_credentials() {
+    use std::os::unix::fs::PermissionsExt;
+
+    let client = crate::retry::Client::try_new()
+        .context("failed to create http client")
+        .unwrap()
+        .max_retries(0)
+        .return_on_404(true);
+    let provider = aws::AwsProvider {
+        client,
+        api_version: "2019-10-01".to_string(),
+    };
+
+    let tempdir = tempfile::tempdir().unwrap();
+    let path = tempdir.path().join("credentials");
+
+    // no IAM role attached
+    let _m = mockito::mock("GET", mockito::Matcher::Any)
+        .with_status(404)
+        .create();
+    provider.write_credentials(&path).unwrap_err();
+    assert!(!path.exists());
+    mockito::reset();
+
+    let m_role = mockito::mock("GET", "/2019-10-01/meta-data/iam/security-credentials/")
+        .with_status(200)
+        .with_body("test-role\n")
+        .create();
+    let m_creds = mockito::mock(
+        "GET",
+        "/2019-10-01/meta-data/iam/security-credentials/test-role",
+    )
+    .with_status(200)
+    .with_body(
+        r#"{
+  "Code" : "Success",
+  "LastUpdated" : "2021-04-26T16:39:16Z",
+  "Type" : "AWS-HMAC",
+  "AccessKeyId" : "ASIAEXAMPLE",
+  "SecretAccessKey" : "secret/EXAMPLEKEY",
+  "Token" : "token-EXAMPLE",
+  "Expiration" : "2021-04-26T22:39:16Z"
+}"#,
+    )
+    .create();
+
+    provider.write_credentials(&path).unwrap();
+    m_role.assert();
+    m_creds.assert();
+
+    let expected = "# Temporary credentials of IAM role test-role
+# Expires at 2021-04-26T22:39:16Z
+[default]
+aws_access_key_id = ASIAEXAMPLE
+aws_secret_access_key = secret/EXAMPLEKEY
+aws_session_token = token-EXAMPLE
+";
+    assert_eq!(std::fs::read_to_string(&path).unwrap(), expected);
+    let mode = std::fs::metadata(&path).unwrap().permissions().mode();
+    assert_eq!(mode & 0o777, 0o600);
+
+    mockito::reset();
+}
+
+#[test]
+fn test_aws_scheduled_events() {
+    let client = crate::retry::Client::try_new()
+        .context("failed to create http client")
+        .unwrap()
+        .max_retries(0)
+        .return_on_404(true);
+    let provider = aws::AwsProvider {
+        client,
+        api_version: "2019-10-01".to_string(),
+    };
+
+    let events = std::fs::read_to_string("./tests/fixtures/aws/scheduled-events.json").unwrap();
+    let _m_events = mockito::mock("GET", "/2019-10-01/meta-data/events/maintenance/scheduled")
+        .with_status(200)
+        .with_body(events)
+        .create();
+    let _m_others = mockito::mock("GET", mockito::Matcher::Any)
+        .with_status(404)
+        .create();
+
+    let v = provider.attributes().unwrap();
+    assert_eq!(
+        v["AWS_SCHEDULED_EVENTS"],
+        "system-reboot@21 Jan 2019 09:00:43 GMT,instance-stop@29 Jan 2019 09:00:43 GMT"
+    );
+
+    // scheduled events are not available everywhere
+    mockito::reset();
+    let _m = mockito::mock("GET", mockito::Matcher::Any)
+        .with_status(404)
+        .create();
+    let v = provider.attributes().unwrap();
+    assert!(!v.contains_key("AWS_SCHEDULED_EVENTS"));
+
+    mockito::reset();
+}
+
+#[test]
+fn test_aws_block_device_mapping() {
+    let client = crate::retry::Client::try_new()
+        .context("failed to create http client")
+        .unwrap()
+        .max_retries(0)
+        .return_on_404(true);
+    let provider = aws::AwsProvider {
+        client,
+        api_version: "2019-10-01".to_string(),
+    };
+
+    // one file per mapping, named as in the listing
+    let fixtures = std::path::Path::new("./tests/fixtures/aws/block-device-mapping");
+    let mut names: Vec<String> = std::fs::read_dir(fixtures)
+        .unwrap()
+        .map(|entry| entry.unwrap().file_name().into_string().unwrap())
+        .collect();
+    names.sort();
+    let mut mocks = Vec::with_capacity(names.len() + 1);
+    mocks.push(
+        mockito::mock("GET", "/2019-10-01/meta-data/block-device-mapping/")
+            .with_status(200)
+            .with_body(names.join("\n"))
+            .create(),
+    );
+    for name in &names {
+        let device = std::fs::read_to_string(fixtures.join(name)).unwrap();
+        mocks.push(
+            mockito::mock(
+                "GET",
+                format!("/2019-10-01/meta-data/block-device-mapping/{}", name).as_str(),
+            )
+            .with_status(200)
+            .with_body(device)
+            .create(),
+        );
+    }
+    let _m_others = mockito::mock("GET", mockito::Matcher::Any)
+        .with_status(404)
+        .create();
+
+    let v = provider.attributes().unwrap();
+    let devices: std::collections::BTreeMap<_, _> = v
+        .iter()
+        .filter(|(k, _)| k.starts_with("AWS_BLOCK_DEVICE_"))
+        .map(|(k, v)| (k.as_str(), v.as_str()))
+        .collect();
+    assert_eq!(
+        devices,
+        maplit::btreemap! {
+            "AWS_BLOCK_DEVICE_AMI" => "/dev/xvda",
+            "AWS_BLOCK_DEVICE_EBS1" => "sdb",
+            "AWS_BLOCK_DEVICE_EBS2" => "sdc",
+            "AWS_BLOCK_DEVICE_EPHEMERAL0" => "sdd",
+            "AWS_BLOCK_DEVICE_ROOT" => "/dev/xvda",
+        }
+    );
+    for m in mocks {
+        m.assert();
+    }
+
+    // a listed mapping which cannot be fetched is an error
+    mockito::reset();
+    let _m_listing = mockito::mock("GET", "/2019-10-01/meta-data/block-device-mapping/")
+        .with_status(200)
+        .with_body("ami\nebs1\n")
+        .create();
+    let _m_others = mockito::mock("GET", mockito::Matcher::Any)
+        .with_status(404)
+        .create();
+    provider.attributes().unwrap_err();
+
+    mockito::reset();
+}
+
+#[test]
+fn test_aws_spot_instance() {
+    let client = crate::retry::Client::try_new()
+        .context("failed to create http client")
+        .unwrap()
+        .max_retries(0)
+        .return_on_404(true);
+    let provider = aws::AwsProvider {
+        client,
+        api_version: "2019-10-01".to_string(),
+    };
+
+    let _m_life_cycle = mockito::mock("GET", "/2019-10-01/meta-data/instance-life-cycle")
+        .with_status(200)
+        .with_body("spot")
+        .create();
+    let _m_others = mockito::mock("GET", mockito::Matcher::Any)
+        .with_status(404)
+        .create();
+
+    let v = provider.attributes().unwrap();
+    assert_eq!(v["INSTANCE_PREEMPTIBLE"], "true");
+
+    mockito::reset();
+}
+
+#[test]
+fn test_aws_imdsv2_token_renewal() {
+    let client = crate::retry::Client::try_new()
+        .context("failed to create http client")
+        .unwrap()
+        .max_retries(1)
+        .initial_backoff(std::time::Duration::from_millis(1))
+        .return_on_404(true);
+
+    let m_token = mockito::mock("PUT", "/latest/api/token")
+        .match_header("X-aws-ec2-metadata-token-ttl-seconds", "21600")
+        .with_status(200)
+        .with_body("token-1")
+        .expect(1)
+        .create();
+    let provider = aws::AwsProvider::with_client(client).unwrap();
+    m_token.assert();
+    drop(m_token);
+
+    // the first token expired, requests are retried with a new one
+    let m_token = mockito::mock("PUT", "/latest/api/token")
+        .match_header("X-aws-ec2-metadata-token-ttl-seconds", "21600")
+        .with_status(200)
+        .with_body("token-2")
+        .expect(1)
+        .create();
+    let m_expired = mockito::mock("GET", "/2019-10-01/meta-data/hostname")
+        .match_header("X-aws-ec2-metadata-token", "token-1")
+        .with_status(401)
+        .expect(1)
+        .create();
+    let m_hostname = mockito::mock("GET", "/2019-10-01/meta-data/hostname")
+        .match_header("X-aws-ec2-metadata-token", "token-2")
+        .with_status(200)
+        .with_body("test-hostname")
+        .expect(1)
+        .create();
+
+    let hostname = provider.hostname().unwrap();
+    assert_eq!(hostname, Some("test-hostname".to_string()));
+    m_token.assert();
+    m_expired.assert();
+    m_hostname.assert();
+
+    mockito::reset();
+}
+
+#[test]
+fn test_aws_imdsv1_fallback() {
+    let client = crate::retry::Client::try_new()
+        .context("failed to create http client")
+        .unwrap()
+        .max_retries(3)
+        .initial_backoff(std::time::Duration::from_millis(1))
+        .return_on_404(true);
+
+    // IMDSv2 is not available, fall back without retrying
+    let m_token = mockito::mock("PUT", "/latest/api/token")
+        .with_status(404)
+        .expect(1)
+        .create();
+    let provider = aws::AwsProvider::with_client(client).unwrap();
+    m_token.assert();
+
+    let m_hostname = mockito::mock("GET", "/2019-10-01/meta-data/hostname")
+        .match_header("X-aws-ec2-metadata-token", mockito::Matcher::Missing)
+        .with_status(200)
+        .with_body("test-hostname")
+        .create();
+    let hostname = provider.hostname().unwrap();
+    assert_eq!(hostname, Some("test-hostname".to_string()));
+    m_hostname.assert();
+
+    mockito::reset();
+}
+
+#[test]
+fn test_aws_attribute_suffix() {
+    let cases = vec![
+        ("Name", "NAME"),
+        ("ebs1", "EBS1"),
+        ("cost-center", "COST_CENTER"),
+        ("app.kubernetes.io", "APP_KUBERNETES_IO"),
+        ("team:owner", "TEAM_OWNER"),
+        ("Team Owner", "TEAM_OWNER"),
+    ];
+    for (key, suffix) in cases {
+        assert_eq!(aws::attribute_suffix(key), suffix, "{}", key);
+    }
+
+    // the first of colliding tags wins, reserved names are skipped
+    let tags = vec![
+        ("cost-center", "1234"),
+        ("cost.center", "5678"),
+        ("ssh_keys_url", "https://attacker.example.com/keys"),
+        ("deploy-ssh-keys-url", "https://attacker.example.com/keys"),
+        ("Name", "test"),
+    ];
+    let tags = tags
+        .into_iter()
+        .map(|(k, v)| (k.to_string(), v.to_string()))
+        .collect();
+    let expected = maplit::hashmap! {
+        "AWS_TAG_COST_CENTER".to_string() => "1234".to_string(),
+        "AWS_TAG_NAME".to_string() => "test".to_string(),
+    };
+    assert_eq!(aws::tag_attributes(tags), expected);
+}
+
+#[test]
+fn test_aws_tags() {
+    let client = crate::retry::Client::try_new()
+        .context("failed to create http client")
+        .unwrap()
+        .max_retries(0)
+        .return_on_404(true);
+    let provider = aws::AwsProvider {
+        client,
+        api_version: "2019-10-01".to_string(),
+    };
+
+    let _m_listing = mockito::mock("GET", "/2019-10-01/meta-data/tags/instance")
+        .with_status(200)
+        .with_body("Name\napp.tier\n")
+        .create();
+    let _m_name = mockito::mock("GET", "/2019-10-01/meta-data/tags/instance/Name")
+        .with_status(200)
+        .with_body("web-1")
+        .create();
+    let _m_tier = mockito::mock("GET", "/2019-10-01/meta-data/tags/instance/app.tier")
+        .with_status(200)
+        .with_body("frontend")
+        .create();
+    let _m_others = mockito::mock("GET", mockito::Matcher::Any)
+        .with_status(404)
+        .create();
+
+    let v = provider.attributes().unwrap();
+    assert_eq!(v["AWS_TAG_NAME"], "web-1");
+    assert_eq!(v["AWS_TAG_APP_TIER"], "frontend");
+
+    // tags not enabled in the instance metadata options
+    mockito::reset();
+    let _m = mockito::mock("GET", mockito::Matcher::Any)
+        .with_status(404)
+        .create();
+    let v = provider.attributes().unwrap();
+    assert!(!v.keys().any(|k| k.starts_with("AWS_TAG_")));
+
+    mockito::reset();
+}
+
+#[test]
+fn test_aws_parse_ipv6_list() {
+    let list = "2001:db8::1\n2001:db8:0:0:0:0:0:2\n\n";
+    let addresses = aws::parse_ipv6_list(list).unwrap();
+    assert_eq!(
+        addresses,
+        vec![
+            "2001:db8::1".parse::<std::net::Ipv6Addr>().unwrap(),
+            "2001:db8::2".parse::<std::net::Ipv6Addr>().unwrap(),
+        ]
+    );
+
+    assert!(aws::parse_ipv6_list("").unwrap().is_empty());
+    aws::parse_ipv6_list("2001:db8::1\n10.0.0.1\n").unwrap_err();
+}
+
+#[test]
+fn test_aws_ipv6_addresses() {
+    let client = crate::retry::Client::try_new()
+        .context("failed to create http client")
+        .unwrap()
+        .max_retries(0)
+        .return_on_404(true);
+    let provider = aws::AwsProvider {
+        client,
+        api_version: "2019-10-01".to_string(),
+    };
+
+    // first interface is dual-stack, second one IPv4-only
+    let _m_listing = mockito::mock("GET", "/2019-10-01/meta-data/network/interfaces/macs/")
+        .with_status(200)
+        .with_body("0e:49:61:0f:c3:11/\n0e:49:61:0f:c3:22/\n")
+        .create();
+    let _m_ipv6s = mockito::mock(
+        "GET",
+        "/2019-10-01/meta-data/network/interfaces/macs/0e:49:61:0f:c3:11/ipv6s",
+    )
+    .with_status(200)
+    .with_body("2001:db8::1\n2001:db8::2")
+    .create();
+    let _m_others = mockito::mock("GET", mockito::Matcher::Any)
+        .with_status(404)
+        .create();
+
+    let v = provider.attributes().unwrap();
+    assert_eq!(v["AWS_IPV6_0"], "2001:db8::1");
+    assert_eq!(v["AWS_IPV6_1"], "2001:db8::2");
+    assert!(!v.contains_key("AWS_IPV6_2"));
+
+    // no IPv6 address assigned at all
+    mockito::reset();
+    let _m_listing = mockito::mock("GET", "/2019-10-01/meta-data/network/interfaces/macs/")
+        .with_status(200)
+        .with_body("0e:49:61:0f:c3:22/\n")
+        .create();
+    let _m_others = mockito::mock("GET", mockito::Matcher::Any)
+        .with_status(404)
+        .create();
+    let v = provider.attributes().unwrap();
+    assert!(!v.keys().any(|k| k.starts_with("AWS_IPV6_")));
+
+    mockito::reset();
+}
+
+#[test]
+fn test_aws_instance_identity_document() {
+    let client = crate::retry::Client::try_new()
+        .context("failed to create http client")
+        .unwrap()
+        .max_retries(0)
+        .return_on_404(true);
+    let provider = aws::AwsProvider {
+        client,
+        api_version: "2019-10-01".to_string(),
+    };
+
+    let instance_id_doc = r#"{
+        "accountId": "123456789012",
+        "architecture": "arm64",
+        "availabilityZone": "us-east-1a",
+        "imageId": "ami-0123456789abcdef0",
+        "instanceId": "i-0123456789abcdef0",
+        "instanceType": "m6g.large",
+        "privateIp": "10.0.0.10",
+        "region": "us-east-1"
+    }"#;
+    let _m_doc = mockito::mock("GET", "/2019-10-01/dynamic/instance-identity/document")
+        .with_status(200)
+        .with_body(instance_id_doc)
+        .create();
+    let _m_type = mockito::mock("GET", "/2019-10-01/meta-data/instance-type")
+        .with_status(200)
+        .with_body("m6g.xlarge")
+        .create();
+    let _m_others = mockito::mock("GET", mockito::Matcher::Any)
+        .with_status(404)
+        .create();
+
+    let v = provider.attributes().unwrap();
+    assert_eq!(v["AWS_REGION"], "us-east-1");
+    assert_eq!(v["AWS_ACCOUNT_ID"], "123456789012");
+    assert_eq!(v["AWS_ARCHITECTURE"], "arm64");
+    assert_eq!(v["AWS_AMI_ID"], "ami-0123456789abcdef0");
+    // metadata endpoints take precedence over the document
+    assert_eq!(v["AWS_INSTANCE_TYPE"], "m6g.xlarge");
+
+    mockito::reset();
+}
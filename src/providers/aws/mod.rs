@@ -16,6 +16,8 @@
 //!
 
 use std::collections::HashMap;
+use std::net::Ipv6Addr;
+use std::path::Path;
 
 use anyhow::{anyhow, bail, Context, Result};
 #[cfg(test)]
@@ -31,61 +33,192 @@ use crate::retry;
 #[cfg(test)]
 mod mock_tests;
 
+/// Default instance metadata API version.
+const API_VERSION: &str = "2019-10-01";
+
+/// Permissions of the credentials file, which holds secrets.
+const CREDENTIALS_FILE_MODE: u32 = 0o600;
+
+/// Turn a metadata key (e.g. a tag key) into a valid attribute name suffix,
+/// uppercased and with any other character than letters and digits
+/// replaced by underscores.
+fn attribute_suffix(key: &str) -> String {
+    key.to_uppercase()
+        .replace(|c: char| !c.is_ascii_alphanumeric(), "_")
+}
+
+/// Tag attribute suffixes reserved for attributes with a special meaning,
+/// which tags must not be able to set.
+const RESERVED_TAG_SUFFIXES: &[&str] = &["SSH_KEYS_URL"];
+
+/// Turn instance tags into `AWS_TAG_<KEY>` attributes.
+///
+/// Tags whose key maps to a reserved suffix, or to the same attribute as an
+/// earlier tag (e.g. `cost-center` and `cost.center`), are skipped with a
+/// warning.
+fn tag_attributes(tags: Vec<(String, String)>) -> HashMap<String, String> {
+    let mut out = HashMap::with_capacity(tags.len());
+    for (key, value) in tags {
+        let suffix = attribute_suffix(&key);
+        if RESERVED_TAG_SUFFIXES
+            .iter()
+            .any(|r| suffix == *r || suffix.ends_with(&format!("_{}", r)))
+        {
+            warn!("ignoring instance tag '{}', reserved attribute name", key);
+            continue;
+        }
+        let name = format!("AWS_TAG_{}", suffix);
+        if out.contains_key(&name) {
+            warn!("ignoring instance tag '{}', conflicting with {}", key, name);
+            continue;
+        }
+        out.insert(name, value);
+    }
+    out
+}
+
+/// Parse a newline-separated list of IPv6 addresses, ignoring blank lines.
+fn parse_ipv6_list(list: &str) -> Result<Vec<Ipv6Addr>> {
+    list.lines()
+        .map(str::trim)
+        .filter(|line| !line.is_empty())
+        .map(|line| {
+            line.parse()
+                .with_context(|| format!("failed to parse IPv6 address '{}'", line))
+        })
+        .collect()
+}
+
 #[allow(non_snake_case)]
 #[derive(Debug, Deserialize)]
 struct InstanceIdDoc {
     region: String,
+    accountId: Option<String>,
+    architecture: Option<String>,
+    imageId: Option<String>,
+    instanceType: Option<String>,
+}
+
+/// Entry of the scheduled maintenance events list.
+#[derive(Debug, Deserialize)]
+#[serde(rename_all = "PascalCase")]
+struct ScheduledEvent {
+    code: String,
+    state: String,
+    not_before: String,
+}
+
+impl ScheduledEvent {
+    /// Summarize pending events as `<code>@<not before>`, comma-separated.
+    ///
+    /// Completed and canceled events are left out.
+    fn summary(events: &[ScheduledEvent]) -> Option<String> {
+        let pending: Vec<String> = events
+            .iter()
+            .filter(|e| e.state == "active")
+            .map(|e| format!("{}@{}", e.code, e.not_before))
+            .collect();
+        if pending.is_empty() {
+            None
+        } else {
+            Some(pending.join(","))
+        }
+    }
+}
+
+/// Temporary credentials of an IAM role, as served by the metadata service.
+#[derive(Debug, Deserialize)]
+#[serde(rename_all = "PascalCase")]
+struct IamCredentials {
+    code: String,
+    access_key_id: String,
+    secret_access_key: String,
+    token: String,
+    expiration: Option<String>,
+}
+
+impl IamCredentials {
+    /// Render the credentials in the AWS shared credentials file format.
+    fn to_credentials_file(&self, role: &str) -> String {
+        let mut out = format!("# Temporary credentials of IAM role {}\n", role);
+        if let Some(ref expiration) = self.expiration {
+            out.push_str(&format!("# Expires at {}\n", expiration));
+        }
+        out.push_str("[default]\n");
+        out.push_str(&format!("aws_access_key_id = {}\n", self.access_key_id));
+        out.push_str(&format!(
+            "aws_secret_access_key = {}\n",
+            self.secret_access_key
+        ));
+        out.push_str(&format!("aws_session_token = {}\n", self.token));
+        out
+    }
 }
 
 #[derive(Clone, Debug)]
 pub struct AwsProvider {
     client: retry::Client,
+    api_version: String,
 }
 
 impl AwsProvider {
-    pub fn try_new() -> Result<AwsProvider> {
-        let client = retry::Client::try_new()?.return_on_404(true);
-        AwsProvider::with_client(client)
-    }
-
-    fn with_client(client: retry::Client) -> Result<AwsProvider> {
-        let mut client = client;
-        let token = AwsProvider::fetch_imdsv2_token(client.clone());
-
-        // If IMDSv2 token is fetched successfully, set the header.
-        // Otherwise, proceed with IMDSv1 mechanism.
-        match token {
-            Ok(t) => {
-                client = client.header(
-                    header::HeaderName::from_bytes(b"X-aws-ec2-metadata-token")
-                        .context("setting header name for aws imdsv2 metadata")?,
-                    header::HeaderValue::from_bytes(t.as_bytes())
-                        .context("setting header value for aws imdsv2 metadata")?,
-                );
+    /// Build a provider fetching metadata with the given client.
+    pub(crate) fn with_client(client: retry::Client) -> Result<AwsProvider> {
+        let mut client = client.return_on_404(true);
+        let token_client = client.clone();
+        let renew = move || {
+            let token = AwsProvider::fetch_imdsv2_token(token_client.clone())?;
+            header::HeaderValue::from_bytes(token.as_bytes())
+                .context("setting header value for aws imdsv2 metadata")
+        };
+
+        // If IMDSv2 token is fetched successfully, send it with every
+        // request, renewing it once it expires.
+        // Otherwise (e.g. 404 on older IMDS), proceed with IMDSv1 mechanism.
+        match renew() {
+            Ok(value) => {
+                client = client.session_token(retry::SessionToken::new(
+                    header::HeaderName::from_static("x-aws-ec2-metadata-token"),
+                    value,
+                    renew,
+                ));
             }
             Err(err) => {
                 warn!("failed to fetch aws imdsv2 session token with: {}", err);
             }
         }
 
-        Ok(AwsProvider { client })
+        Ok(AwsProvider {
+            client,
+            api_version: API_VERSION.to_string(),
+        })
+    }
+
+    /// Override the instance metadata API version.
+    pub fn api_version(mut self, version: Option<String>) -> Self {
+        if let Some(version) = version {
+            self.api_version = version;
+        }
+        self
     }
 
     #[cfg(test)]
-    fn endpoint_for(key: &str, _use_latest: bool) -> String {
-        let url = mockito::server_url();
-        format!("{}/{}", url, key)
+    fn base_url() -> String {
+        mockito::server_url()
     }
 
     #[cfg(not(test))]
-    fn endpoint_for(key: &str, use_latest: bool) -> String {
-        const URL: &str = "http://169.254.169.254/2019-10-01";
-        const URL_LATEST: &str = "http://169.254.169.254/latest";
-        if use_latest {
-            format!("{}/{}", URL_LATEST, key)
-        } else {
-            format!("{}/{}", URL, key)
-        }
+    fn base_url() -> String {
+        const URL: &str = "http://169.254.169.254";
+        URL.to_string()
+    }
+
+    fn endpoint_for(&self, key: &str) -> String {
+        AwsProvider::versioned_endpoint(&self.api_version, key)
+    }
+
+    fn versioned_endpoint(version: &str, key: &str) -> String {
+        format!("{}/{}/{}", AwsProvider::base_url(), version, key)
     }
 
     fn fetch_imdsv2_token(client: retry::Client) -> Result<String> {
@@ -99,7 +232,7 @@ impl AwsProvider {
             .put(
                 retry::Raw,
                 // NOTE(zonggen): Use `latest` here since other versions would return "403 - Forbidden"
-                AwsProvider::endpoint_for("api/token", true),
+                AwsProvider::versioned_endpoint("latest", "api/token"),
                 None,
             )
             .dispatch_put()?
@@ -110,34 +243,178 @@ impl AwsProvider {
     fn fetch_ssh_keys(&self) -> Result<Vec<String>> {
         let keydata: Option<String> = self
             .client
-            .get(
-                retry::Raw,
-                AwsProvider::endpoint_for("meta-data/public-keys", false),
-            )
+            .get(retry::Raw, self.endpoint_for("meta-data/public-keys"))
             .send()?;
 
-        let mut keys = Vec::new();
+        let mut ids = Vec::new();
         if let Some(keys_list) = keydata {
             for l in keys_list.lines() {
                 let tokens: Vec<&str> = l.split('=').collect();
                 if tokens.len() != 2 {
                     bail!("error parsing keyID");
                 }
-                let key: String = self
-                    .client
-                    .get(
-                        retry::Raw,
-                        AwsProvider::endpoint_for(
-                            &format!("meta-data/public-keys/{}/openssh-key", tokens[0]),
-                            false,
-                        ),
-                    )
-                    .send()?
-                    .ok_or_else(|| anyhow!("missing ssh key"))?;
-                keys.push(key)
+                ids.push(tokens[0].to_string());
             }
         }
-        Ok(keys)
+
+        let provider = self.clone();
+        self.client.fetch_all(ids, move |id| {
+            provider
+                .client
+                .get(
+                    retry::Raw,
+                    provider.endpoint_for(&format!("meta-data/public-keys/{}/openssh-key", id)),
+                )
+                .send()?
+                .ok_or_else(|| anyhow!("missing ssh key"))
+        })
+    }
+
+    /// Fetch block device mappings, as pairs of mapping name (e.g. `ami`,
+    /// `root`, `ebs1`) and device name.
+    fn fetch_block_device_mapping(&self) -> Result<Vec<(String, String)>> {
+        let listing: Option<String> = self
+            .client
+            .get(
+                retry::Raw,
+                self.endpoint_for("meta-data/block-device-mapping/"),
+            )
+            .send()?;
+        let names: Vec<String> = listing
+            .unwrap_or_default()
+            .lines()
+            .map(|name| name.trim().trim_end_matches('/'))
+            .filter(|name| !name.is_empty())
+            .map(String::from)
+            .collect();
+
+        let provider = self.clone();
+        self.client.fetch_all(names, move |name| {
+            let device: String = provider
+                .client
+                .get(
+                    retry::Raw,
+                    provider.endpoint_for(&format!("meta-data/block-device-mapping/{}", name)),
+                )
+                .send()?
+                .ok_or_else(|| anyhow!("missing block device mapping '{}'", name))?;
+            Ok((name, device.trim().to_string()))
+        })
+    }
+
+    /// Fetch the IPv6 addresses of all network interfaces, in the order
+    /// interfaces are listed.
+    fn fetch_ipv6_addresses(&self) -> Result<Vec<Ipv6Addr>> {
+        let listing: Option<String> = self
+            .client
+            .get(
+                retry::Raw,
+                self.endpoint_for("meta-data/network/interfaces/macs/"),
+            )
+            .send()?;
+        let macs: Vec<String> = listing
+            .unwrap_or_default()
+            .lines()
+            .map(|mac| mac.trim().trim_end_matches('/'))
+            .filter(|mac| !mac.is_empty())
+            .map(String::from)
+            .collect();
+
+        let provider = self.clone();
+        let addresses = self.client.fetch_all(macs, move |mac| {
+            // missing if no IPv6 address is assigned to the interface
+            let list: Option<String> = provider
+                .client
+                .get(
+                    retry::Raw,
+                    provider
+                        .endpoint_for(&format!("meta-data/network/interfaces/macs/{}/ipv6s", mac)),
+                )
+                .send()?;
+            parse_ipv6_list(&list.unwrap_or_default())
+                .with_context(|| format!("invalid IPv6 addresses for interface {}", mac))
+        })?;
+        Ok(addresses.into_iter().flatten().collect())
+    }
+
+    /// Fetch instance tags, as pairs of tag key and value.
+    ///
+    /// Tags are only exposed if enabled in the instance metadata options,
+    /// otherwise none are returned.
+    fn fetch_tags(&self) -> Result<Vec<(String, String)>> {
+        let listing: Option<String> = self
+            .client
+            .get(retry::Raw, self.endpoint_for("meta-data/tags/instance"))
+            .send()?;
+        let keys: Vec<String> = listing
+            .unwrap_or_default()
+            .lines()
+            .map(str::trim)
+            .filter(|key| !key.is_empty())
+            .map(String::from)
+            .collect();
+
+        let provider = self.clone();
+        self.client.fetch_all(keys, move |key| {
+            let value: String = provider
+                .client
+                .get(
+                    retry::Raw,
+                    provider.endpoint_for(&format!("meta-data/tags/instance/{}", key)),
+                )
+                .send()?
+                .ok_or_else(|| anyhow!("missing instance tag '{}'", key))?;
+            Ok((key, value))
+        })
+    }
+
+    /// Fetch the name of the IAM role attached to the instance, if any.
+    fn fetch_iam_role(&self) -> Result<Option<String>> {
+        let roles: Option<String> = self
+            .client
+            .get(
+                retry::Raw,
+                self.endpoint_for("meta-data/iam/security-credentials/"),
+            )
+            .send()?;
+        Ok(roles.and_then(|roles| {
+            roles
+                .lines()
+                .map(str::trim)
+                .find(|role| !role.is_empty())
+                .map(String::from)
+        }))
+    }
+
+    fn fetch_iam_credentials(&self, role: &str) -> Result<IamCredentials> {
+        let creds: IamCredentials = self
+            .client
+            .get(
+                retry::Json,
+                self.endpoint_for(&format!("meta-data/iam/security-credentials/{}", role)),
+            )
+            .send()
+            .context("failed to get IAM credentials")?
+            .ok_or_else(|| anyhow!("failed to get IAM credentials: not found"))?;
+        if creds.code != "Success" {
+            bail!("failed to get IAM credentials: {}", creds.code);
+        }
+        Ok(creds)
+    }
+
+    /// Write temporary credentials of the instance IAM role to a file in the
+    /// AWS shared credentials format, only readable by its owner.
+    pub fn write_credentials(&self, path: &Path) -> Result<()> {
+        let role = self
+            .fetch_iam_role()?
+            .ok_or_else(|| anyhow!("no IAM role attached to this instance"))?;
+        let creds = self.fetch_iam_credentials(&role)?;
+        super::write_file_atomic(
+            path,
+            creds.to_credentials_file(&role).as_bytes(),
+            CREDENTIALS_FILE_MODE,
+        )?;
+        Ok(())
     }
 }
 
@@ -148,7 +425,7 @@ impl MetadataProvider for AwsProvider {
         let add_value = |map: &mut HashMap<_, _>, key: &str, name| -> Result<()> {
             let value = self
                 .client
-                .get(retry::Raw, AwsProvider::endpoint_for(name, false))
+                .get(retry::Raw, self.endpoint_for(name))
                 .send()?;
 
             if let Some(value) = value {
@@ -158,6 +435,12 @@ impl MetadataProvider for AwsProvider {
             Ok(())
         };
 
+        add_value(&mut out, "AWS_AMI_ID", "meta-data/ami-id")?;
+        add_value(
+            &mut out,
+            "AWS_AMI_LAUNCH_INDEX",
+            "meta-data/ami-launch-index",
+        )?;
         add_value(&mut out, "AWS_INSTANCE_ID", "meta-data/instance-id")?;
         add_value(&mut out, "AWS_INSTANCE_TYPE", "meta-data/instance-type")?;
         add_value(&mut out, "AWS_IPV4_LOCAL", "meta-data/local-ipv4")?;
@@ -167,19 +450,101 @@ impl MetadataProvider for AwsProvider {
             "AWS_AVAILABILITY_ZONE",
             "meta-data/placement/availability-zone",
         )?;
+        add_value(
+            &mut out,
+            "AWS_AVAILABILITY_ZONE_ID",
+            "meta-data/placement/availability-zone-id",
+        )?;
+        // DNS suffix of the partition, e.g. amazonaws.com.cn in China
+        add_value(&mut out, "AWS_DOMAIN", "meta-data/services/domain")?;
         add_value(&mut out, "AWS_HOSTNAME", "meta-data/hostname")?;
         add_value(&mut out, "AWS_PUBLIC_HOSTNAME", "meta-data/public-hostname")?;
+        // only present on instances managed by an auto scaling group
+        add_value(
+            &mut out,
+            "AWS_AUTOSCALING_LIFECYCLE_STATE",
+            "meta-data/autoscaling/target-lifecycle-state",
+        )?;
 
-        let region = self
+        // "spot", "scheduled" or "on-demand"
+        let life_cycle: Option<String> = self
+            .client
+            .get(
+                retry::Raw,
+                self.endpoint_for("meta-data/instance-life-cycle"),
+            )
+            .send()?;
+        if let Some(life_cycle) = life_cycle {
+            out.insert(
+                super::PREEMPTIBLE_ATTRIBUTE.to_string(),
+                (life_cycle.trim() == "spot").to_string(),
+            );
+        }
+
+        // security groups are listed one per line, and may be empty
+        let security_groups: Option<String> = self
+            .client
+            .get(retry::Raw, self.endpoint_for("meta-data/security-groups"))
+            .send()?;
+        if let Some(groups) = security_groups {
+            let groups: Vec<&str> = groups
+                .lines()
+                .map(str::trim)
+                .filter(|g| !g.is_empty())
+                .collect();
+            if !groups.is_empty() {
+                out.insert("AWS_SECURITY_GROUPS".to_string(), groups.join(","));
+            }
+        }
+
+        for (name, device) in self.fetch_block_device_mapping()? {
+            out.insert(
+                format!("AWS_BLOCK_DEVICE_{}", attribute_suffix(&name)),
+                device,
+            );
+        }
+
+        for (index, address) in self.fetch_ipv6_addresses()?.iter().enumerate() {
+            out.insert(format!("AWS_IPV6_{}", index), address.to_string());
+        }
+
+        out.extend(tag_attributes(self.fetch_tags()?));
+
+        // missing unless scheduled events are supported in the region
+        let events: Option<Vec<ScheduledEvent>> = self
             .client
             .get(
                 retry::Json,
-                AwsProvider::endpoint_for("dynamic/instance-identity/document", false),
+                self.endpoint_for("meta-data/events/maintenance/scheduled"),
             )
-            .send()?
-            .map(|instance_id_doc: InstanceIdDoc| instance_id_doc.region);
-        if let Some(region) = region {
-            out.insert("AWS_REGION".to_string(), region);
+            .send()?;
+        if let Some(summary) = events.as_deref().and_then(ScheduledEvent::summary) {
+            out.insert("AWS_SCHEDULED_EVENTS".to_string(), summary);
+        }
+
+        let instance_id_doc: Option<InstanceIdDoc> = self
+            .client
+            .get(
+                retry::Json,
+                self.endpoint_for("dynamic/instance-identity/document"),
+            )
+            .send()?;
+        if let Some(doc) = instance_id_doc {
+            out.insert("AWS_REGION".to_string(), doc.region);
+            if let Some(account_id) = doc.accountId {
+                out.insert("AWS_ACCOUNT_ID".to_string(), account_id);
+            }
+            if let Some(architecture) = doc.architecture {
+                out.insert("AWS_ARCHITECTURE".to_string(), architecture);
+            }
+            // only fill in what the metadata endpoints didn't provide
+            if let Some(image_id) = doc.imageId {
+                out.entry("AWS_AMI_ID".to_string()).or_insert(image_id);
+            }
+            if let Some(instance_type) = doc.instanceType {
+                out.entry("AWS_INSTANCE_TYPE".to_string())
+                    .or_insert(instance_type);
+            }
         }
 
         Ok(out)
@@ -187,10 +552,7 @@ impl MetadataProvider for AwsProvider {
 
     fn hostname(&self) -> Result<Option<String>> {
         self.client
-            .get(
-                retry::Raw,
-                AwsProvider::endpoint_for("meta-data/hostname", false),
-            )
+            .get(retry::Raw, self.endpoint_for("meta-data/hostname"))
             .send()
     }
 
@@ -1,8 +1,6 @@
 //! configdrive metadata fetcher for cloudstack
 
 use std::collections::HashMap;
-use std::fs::File;
-use std::io::Read;
 use std::path::{Path, PathBuf};
 
 use anyhow::{Context, Result};
@@ -11,6 +9,7 @@ use slog_scope::error;
 use tempfile::TempDir;
 
 use crate::providers::MetadataProvider;
+use crate::util::drive;
 
 const CONFIG_DRIVE_LABEL_1: &str = "config-2";
 const CONFIG_DRIVE_LABEL_2: &str = "CONFIG-2";
@@ -22,6 +21,8 @@ pub struct ConfigDrive {
     drive_path: PathBuf,
     /// Temporary directory for own mountpoint (if any).
     temp_dir: Option<TempDir>,
+    /// Retries of failed reads from the config-drive.
+    read_retry: drive::ReadRetry,
 }
 
 impl ConfigDrive {
@@ -32,10 +33,9 @@ impl ConfigDrive {
         // Short-circuit if the config-drive is already mounted.
         let path = Path::new("/media/ConfigDrive/cloudstack/metadata/");
         if path.exists() {
-            return Ok(ConfigDrive {
-                temp_dir: None,
-                drive_path: PathBuf::from("/media/ConfigDrive/"),
-            });
+            return Ok(ConfigDrive::with_drive_path(PathBuf::from(
+                "/media/ConfigDrive/",
+            )));
         }
 
         // Otherwise, try and mount with each of the labels.
@@ -58,13 +58,28 @@ impl ConfigDrive {
             )
         })?;
 
-        let cd = ConfigDrive {
-            drive_path: target.path().to_owned(),
-            temp_dir: Some(target),
-        };
+        let mut cd = ConfigDrive::with_drive_path(target.path().to_owned());
+        cd.temp_dir = Some(target);
         Ok(cd)
     }
 
+    /// Build a provider reading from a config-drive already available at `drive_path`.
+    ///
+    /// The config-drive is not unmounted on drop.
+    pub fn with_drive_path(drive_path: PathBuf) -> Self {
+        ConfigDrive {
+            drive_path,
+            temp_dir: None,
+            read_retry: drive::ReadRetry::default(),
+        }
+    }
+
+    /// Retry failed reads from the config-drive as configured.
+    pub fn read_retry(mut self, retry: drive::ReadRetry) -> Self {
+        self.read_retry = retry;
+        self
+    }
+
     /// Return the path to the metadata directory.
     fn metadata_dir(&self) -> PathBuf {
         self.drive_path.clone().join("cloudstack").join("metadata")
@@ -72,27 +87,18 @@ impl ConfigDrive {
 
     fn fetch_value(&self, key: &str) -> Result<Option<String>> {
         let filename = self.metadata_dir().join(format!("{}.txt", key));
-
-        if !filename.exists() {
-            return Ok(None);
-        }
-
-        let mut file = File::open(&filename)
-            .with_context(|| format!("failed to open file '{:?}'", filename))?;
-
-        let mut contents = String::new();
-        file.read_to_string(&mut contents)
-            .with_context(|| format!("failed to read from file '{:?}'", filename))?;
-
-        Ok(Some(contents))
+        drive::read_optional_file(&filename, self.read_retry)?
+            .map(String::from_utf8)
+            .transpose()
+            .with_context(|| format!("invalid UTF-8 in file '{:?}'", filename))
     }
 
     fn fetch_publickeys(&self) -> Result<Vec<PublicKey>> {
         let filename = self.metadata_dir().join("public_keys.txt");
-        let file = File::open(&filename)
-            .with_context(|| format!("failed to open file '{:?}'", filename))?;
+        let contents = drive::read_file(&filename, self.read_retry)?;
 
-        PublicKey::read_keys(file).context("failed to read public keys from config drive file")
+        PublicKey::read_keys(contents.as_slice())
+            .context("failed to read public keys from config drive file")
     }
 }
 
@@ -137,3 +143,56 @@ impl Drop for ConfigDrive {
         }
     }
 }
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::fs;
+
+    /// Build a config-drive tree with the given metadata files.
+    fn drive_with_files(files: &[(&str, &str)]) -> TempDir {
+        let drive = tempfile::tempdir().unwrap();
+        let metadata_dir = drive.path().join("cloudstack").join("metadata");
+        fs::create_dir_all(&metadata_dir).unwrap();
+        for (name, contents) in files {
+            fs::write(metadata_dir.join(name), contents).unwrap();
+        }
+        drive
+    }
+
+    #[test]
+    fn test_attributes() {
+        let drive = drive_with_files(&[
+            ("availability_zone.txt", "zone-1"),
+            ("instance_id.txt", "test-instance-id"),
+            ("local_hostname.txt", "test-hostname"),
+        ]);
+        let provider = ConfigDrive::with_drive_path(drive.path().to_owned());
+
+        let attributes = maplit::hashmap! {
+            "CLOUDSTACK_AVAILABILITY_ZONE".to_string() => "zone-1".to_string(),
+            "CLOUDSTACK_INSTANCE_ID".to_string() => "test-instance-id".to_string(),
+            "CLOUDSTACK_LOCAL_HOSTNAME".to_string() => "test-hostname".to_string(),
+        };
+        assert_eq!(provider.attributes().unwrap(), attributes);
+
+        // absent metadata files are skipped
+        let drive = drive_with_files(&[]);
+        let provider = ConfigDrive::with_drive_path(drive.path().to_owned());
+        assert!(provider.attributes().unwrap().is_empty());
+    }
+
+    #[test]
+    fn test_ssh_keys() {
+        let key = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIE+7Ikf7Ot5lNN5lJN9ndRvyFeojyeh8W2VqdXc5BQaq user1";
+        let drive = drive_with_files(&[("public_keys.txt", key)]);
+        let provider = ConfigDrive::with_drive_path(drive.path().to_owned());
+        let keys = provider.ssh_keys().unwrap();
+        assert_eq!(keys.len(), 1);
+        assert_eq!(keys[0].to_string(), key);
+
+        let drive = drive_with_files(&[]);
+        let provider = ConfigDrive::with_drive_path(drive.path().to_owned());
+        provider.ssh_keys().unwrap_err();
+    }
+}
@@ -1,9 +1,11 @@
-use crate::providers::cloudstack::network::CloudstackNetwork;
+use crate::providers::cloudstack::network::{self, CloudstackNetwork};
+use crate::providers::exoscale;
 use crate::providers::MetadataProvider;
 
 #[test]
 fn test_ssh_keys() {
-    let mut provider = CloudstackNetwork::try_new().unwrap();
+    let mut provider =
+        CloudstackNetwork::with_client(crate::retry::Client::try_new().unwrap()).unwrap();
     provider.client = provider.client.max_retries(0);
 
     let key1 = "ssh-rsa AAAAB3NzaC1yc2EAAAADAQABAAABgQCsXe6CfHl45kCIzMF92VhDf2NpBWUyS1+IiTtxm5a83mT9730Hb8xim7GYeJu47kiESw2DAN8vNJ/Irg0apZ217ah2rXXjPQuWYSXuEuap8yLBSjqw8exgqVj/kzW+YqmnHASxI13eoFDxTQQGzyqbqowvxu/5gQmDwBmNAa9bT809ziB/qmpS1mD6qyyFDpR23kUwu3TkgAbwMXBDoqK+pdwfaF9uo9XaLHNEH8lD5BZuG2BeDafm2o76DhNSo83MvcCPNXKLxu3BbX/FCMFO6O8RRqony4i91fEV1b8TbXrbJz1bwEYEnJRvmjnqI/389tQFeYvplXR2WdT9PCKyEAG+j8y6XgecIcdTqV/7gFfak1mp2S7mYHZDnXixsn3MjCP/cIxxJVDitKusnj1TdFqtSXl4tqGccbg/5Sqnt/EVSK4bGwwBxv/YmE0P9cbXLxuEVI0JYzgrQvC8TtUgd8kUu2jqi1/Yj9IWm3aFsl/hhh8YwYrv/gm8PV0TxkM= root@example1";
@@ -28,7 +30,8 @@ fn test_ssh_keys() {
 
 #[test]
 fn test_ssh_keys_404_ok() {
-    let mut provider = CloudstackNetwork::try_new().unwrap();
+    let mut provider =
+        CloudstackNetwork::with_client(crate::retry::Client::try_new().unwrap()).unwrap();
     provider.client = provider.client.max_retries(0);
 
     let _m = mockito::mock("GET", "/latest/meta-data/public-keys")
@@ -39,3 +42,51 @@ fn test_ssh_keys_404_ok() {
     mockito::reset();
     provider.ssh_keys().unwrap_err();
 }
+
+#[test]
+fn test_attributes() {
+    let mut provider =
+        CloudstackNetwork::with_client(crate::retry::Client::try_new().unwrap()).unwrap();
+    provider.client = provider.client.max_retries(0);
+
+    // fetched once by the provider, then once relabeled
+    let m_id = mockito::mock("GET", "/latest/meta-data/instance-id")
+        .with_status(200)
+        .with_body("test-instance-id")
+        .expect(2)
+        .create();
+    let m_ipv4 = mockito::mock("GET", "/latest/meta-data/public-ipv4")
+        .with_status(200)
+        .with_body("192.0.2.10")
+        .expect(2)
+        .create();
+    let _m_others = mockito::mock("GET", mockito::Matcher::Any)
+        .with_status(404)
+        .create();
+
+    let attributes = maplit::hashmap! {
+        "CLOUDSTACK_INSTANCE_ID".to_string() => "test-instance-id".to_string(),
+        "CLOUDSTACK_IPV4_PUBLIC".to_string() => "192.0.2.10".to_string(),
+    };
+    assert_eq!(provider.attributes().unwrap(), attributes);
+
+    // same metadata, relabeled for a derived platform
+    let endpoint_for = |key: &str| format!("{}/latest/meta-data/{}", mockito::server_url(), key);
+    let v = network::fetch_attributes(
+        &provider.client,
+        endpoint_for,
+        "EXOSCALE",
+        exoscale::ATTRIBUTES,
+    )
+    .unwrap();
+    let attributes = maplit::hashmap! {
+        "EXOSCALE_INSTANCE_ID".to_string() => "test-instance-id".to_string(),
+        "EXOSCALE_PUBLIC_IPV4".to_string() => "192.0.2.10".to_string(),
+    };
+    assert_eq!(v, attributes);
+    m_id.assert();
+    m_ipv4.assert();
+
+    mockito::reset();
+    provider.attributes().unwrap_err();
+}
@@ -1,6 +1,88 @@
 //! Metadata fetchers for the cloudstack provider
 
+use crate::providers::MetadataProvider;
+use crate::retry;
+use crate::util::drive;
+use anyhow::Result;
+use configdrive::ConfigDrive;
+use network::CloudstackNetwork;
+use slog_scope::warn;
+
 pub mod configdrive;
 #[cfg(test)]
 mod mock_tests;
 pub mod network;
+
+/// Read metadata from the config-drive first then fallback to fetch from
+/// metadata server, with the given client.
+pub fn try_config_drive_else_network(
+    client: retry::Client,
+    read_retry: drive::ReadRetry,
+) -> Result<Box<dyn MetadataProvider>> {
+    select_source(
+        ConfigDrive::try_new().map(|cd| cd.read_retry(read_retry)),
+        || CloudstackNetwork::with_client(client),
+    )
+}
+
+/// Use the config-drive if it could be set up, otherwise the metadata server.
+fn select_source<C, N, F>(config_drive: Result<C>, network: F) -> Result<Box<dyn MetadataProvider>>
+where
+    C: MetadataProvider + 'static,
+    N: MetadataProvider + 'static,
+    F: FnOnce() -> Result<N>,
+{
+    match config_drive {
+        Ok(config_drive) => Ok(Box::new(config_drive)),
+        Err(e) => {
+            warn!(
+                "failed to locate config-drive, using the metadata service API instead: {}",
+                e
+            );
+            Ok(Box::new(network()?))
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use anyhow::anyhow;
+    use std::collections::HashMap;
+
+    struct TestSource(&'static str);
+
+    impl MetadataProvider for TestSource {
+        fn attributes(&self) -> Result<HashMap<String, String>> {
+            Ok(maplit::hashmap! {
+                "CLOUDSTACK_SOURCE".to_string() => self.0.to_string(),
+            })
+        }
+    }
+
+    fn source(provider: Box<dyn MetadataProvider>) -> String {
+        provider.attributes().unwrap()["CLOUDSTACK_SOURCE"].clone()
+    }
+
+    #[test]
+    fn test_select_config_drive() {
+        let provider = select_source(Ok(TestSource("configdrive")), || -> Result<TestSource> {
+            panic!("metadata service should not be queried")
+        })
+        .unwrap();
+        assert_eq!(source(provider), "configdrive");
+    }
+
+    #[test]
+    fn test_select_network() {
+        let config_drive: Result<TestSource> = Err(anyhow!("no config-drive"));
+        let provider = select_source(config_drive, || Ok(TestSource("network"))).unwrap();
+        assert_eq!(source(provider), "network");
+
+        let config_drive: Result<TestSource> = Err(anyhow!("no config-drive"));
+        let res = select_source(config_drive, || -> Result<TestSource> {
+            Err(anyhow!("no metadata service"))
+        });
+        assert!(res.is_err());
+    }
+}
@@ -10,7 +10,63 @@ use crate::providers::MetadataProvider;
 use crate::retry;
 use crate::util;
 
-const SERVER_ADDRESS: &str = "SERVER_ADDRESS";
+/// DHCP option holding the address of the DHCP server, which also serves metadata.
+const SERVER_IDENTIFIER_OPTION: u8 = 54;
+
+/// Attributes served by the metadata service, as pairs of attribute name
+/// (without the `CLOUDSTACK_` prefix) and metadata key.
+const ATTRIBUTES: &[(&str, &str)] = &[
+    ("INSTANCE_ID", "instance-id"),
+    ("LOCAL_HOSTNAME", "local-hostname"),
+    ("PUBLIC_HOSTNAME", "public-hostname"),
+    ("AVAILABILITY_ZONE", "availability-zone"),
+    ("IPV4_PUBLIC", "public-ipv4"),
+    ("IPV4_LOCAL", "local-ipv4"),
+    ("SERVICE_OFFERING", "service-offering"),
+    ("CLOUD_IDENTIFIER", "cloud-identifier"),
+    ("VM_ID", "vm-id"),
+];
+
+/// Fetch attributes from a CloudStack-style metadata service, which serves
+/// each value under its own key.
+///
+/// `attributes` are pairs of attribute name and metadata key; names are
+/// prefixed with `prefix`, so that derived platforms (e.g. Exoscale) expose
+/// their own attribute names. Missing keys are skipped.
+pub(crate) fn fetch_attributes<F>(
+    client: &retry::Client,
+    endpoint_for: F,
+    prefix: &str,
+    attributes: &[(&str, &str)],
+) -> Result<HashMap<String, String>>
+where
+    F: Fn(&str) -> String,
+{
+    let mut out = HashMap::with_capacity(attributes.len());
+    for (name, key) in attributes {
+        let value: Option<String> = client.get(retry::Raw, endpoint_for(key)).send()?;
+        if let Some(value) = value {
+            out.insert(format!("{}_{}", prefix, name), value);
+        }
+    }
+
+    Ok(out)
+}
+
+/// Fetch SSH keys from a CloudStack-style metadata service.
+pub(crate) fn fetch_ssh_keys<F>(client: &retry::Client, endpoint_for: F) -> Result<Vec<PublicKey>>
+where
+    F: Fn(&str) -> String,
+{
+    let keys: Option<String> = client.get(retry::Raw, endpoint_for("public-keys")).send()?;
+
+    if let Some(keys) = keys {
+        let keys = PublicKey::read_keys(keys.as_bytes())?;
+        Ok(keys)
+    } else {
+        Ok(vec![])
+    }
+}
 
 #[derive(Clone, Debug)]
 pub struct CloudstackNetwork {
@@ -19,9 +75,10 @@ pub struct CloudstackNetwork {
 }
 
 impl CloudstackNetwork {
-    pub fn try_new() -> Result<CloudstackNetwork> {
+    /// Build a provider fetching metadata with the given client.
+    pub(crate) fn with_client(client: retry::Client) -> Result<CloudstackNetwork> {
         let server_base_url = CloudstackNetwork::get_server_base_url_from_dhcp()?;
-        let client = retry::Client::try_new()?.return_on_404(true);
+        let client = client.return_on_404(true);
 
         Ok(CloudstackNetwork {
             server_base_url,
@@ -38,7 +95,7 @@ impl CloudstackNetwork {
             #[cfg(test)]
             return Ok(mockito::server_url());
         }
-        let server = util::dns_lease_key_lookup(SERVER_ADDRESS)?;
+        let server = util::dhcp_option_lookup(SERVER_IDENTIFIER_OPTION)?;
         let ip = server
             .parse::<IpAddr>()
             .with_context(|| format!("failed to parse server ip address: {}", server))?;
@@ -48,35 +105,12 @@ impl CloudstackNetwork {
 
 impl MetadataProvider for CloudstackNetwork {
     fn attributes(&self) -> Result<HashMap<String, String>> {
-        let mut out = HashMap::with_capacity(9);
-        let add_value = |map: &mut HashMap<_, _>, key: &str, name| -> Result<()> {
-            let value = self
-                .client
-                .get(retry::Raw, self.endpoint_for(name))
-                .send()?;
-
-            if let Some(value) = value {
-                map.insert(key.to_string(), value);
-            }
-
-            Ok(())
-        };
-
-        add_value(&mut out, "CLOUDSTACK_INSTANCE_ID", "instance-id")?;
-        add_value(&mut out, "CLOUDSTACK_LOCAL_HOSTNAME", "local-hostname")?;
-        add_value(&mut out, "CLOUDSTACK_PUBLIC_HOSTNAME", "public-hostname")?;
-        add_value(
-            &mut out,
-            "CLOUDSTACK_AVAILABILITY_ZONE",
-            "availability-zone",
-        )?;
-        add_value(&mut out, "CLOUDSTACK_IPV4_PUBLIC", "public-ipv4")?;
-        add_value(&mut out, "CLOUDSTACK_IPV4_LOCAL", "local-ipv4")?;
-        add_value(&mut out, "CLOUDSTACK_SERVICE_OFFERING", "service-offering")?;
-        add_value(&mut out, "CLOUDSTACK_CLOUD_IDENTIFIER", "cloud-identifier")?;
-        add_value(&mut out, "CLOUDSTACK_VM_ID", "vm-id")?;
-
-        Ok(out)
+        fetch_attributes(
+            &self.client,
+            |key| self.endpoint_for(key),
+            "CLOUDSTACK",
+            ATTRIBUTES,
+        )
     }
 
     fn hostname(&self) -> Result<Option<String>> {
@@ -84,16 +118,6 @@ impl MetadataProvider for CloudstackNetwork {
     }
 
     fn ssh_keys(&self) -> Result<Vec<PublicKey>> {
-        let keys: Option<String> = self
-            .client
-            .get(retry::Raw, self.endpoint_for("public-keys"))
-            .send()?;
-
-        if let Some(keys) = keys {
-            let keys = PublicKey::read_keys(keys.as_bytes())?;
-            Ok(keys)
-        } else {
-            Ok(vec![])
-        }
+        fetch_ssh_keys(&self.client, |key| self.endpoint_for(key))
     }
 }
@@ -0,0 +1,87 @@
+use crate::providers::digitalocean::DigitalOceanProvider;
+use crate::providers::MetadataProvider;
+use mockito;
+
+#[test]
+fn test_base_url() {
+    let body = r#"{
+        "hostname": "test-hostname",
+        "interfaces": {},
+        "public_keys": [],
+        "region": "nyc3",
+        "dns": {"nameservers": ["1.1.1.1"]}
+    }"#;
+    let _m = mockito::mock("GET", "/metadata/v1.json")
+        .with_status(200)
+        .with_body(body)
+        .create();
+
+    let provider = DigitalOceanProvider::with_base_url(
+        crate::retry::Client::try_new().unwrap(),
+        Some(mockito::server_url()),
+    )
+    .unwrap();
+    assert_eq!(
+        provider.hostname().unwrap(),
+        Some("test-hostname".to_string())
+    );
+
+    mockito::reset();
+}
+
+#[test]
+fn test_floating_ip() {
+    let tests = vec![
+        (
+            r#""floating_ip": {"ipv4": {"active": true, "ip_address": "192.0.2.50"}},"#,
+            Some(("true", Some("192.0.2.50"))),
+        ),
+        (
+            r#""floating_ip": {"ipv4": {"active": false}},"#,
+            Some(("false", None)),
+        ),
+        ("", None),
+    ];
+    for (floating_ip, expected) in tests {
+        let body = format!(
+            r#"{{
+                "hostname": "test-hostname",
+                "interfaces": {{}},
+                "public_keys": [],
+                "region": "nyc3",
+                {}
+                "dns": {{"nameservers": ["1.1.1.1"]}}
+            }}"#,
+            floating_ip
+        );
+        let _m = mockito::mock("GET", "/metadata/v1.json")
+            .with_status(200)
+            .with_body(body)
+            .create();
+
+        let provider = DigitalOceanProvider::with_base_url(
+            crate::retry::Client::try_new().unwrap(),
+            Some(mockito::server_url()),
+        )
+        .unwrap();
+        let attributes = provider.attributes().unwrap();
+        let active = attributes
+            .get("DIGITALOCEAN_FLOATING_IP_ACTIVE")
+            .map(String::as_str);
+        let ipv4 = attributes
+            .get("DIGITALOCEAN_FLOATING_IPV4")
+            .map(String::as_str);
+        match expected {
+            Some((expected_active, expected_ipv4)) => {
+                assert_eq!(active, Some(expected_active), "{}", floating_ip);
+                assert_eq!(ipv4, expected_ipv4, "{}", floating_ip);
+            }
+            None => {
+                assert_eq!(active, None);
+                assert_eq!(ipv4, None);
+            }
+        }
+
+        mockito::reset();
+    }
+}
@@ -25,9 +25,15 @@ use pnet_base::MacAddr;
 use serde_derive::Deserialize;
 
 use crate::network;
-use crate::providers::MetadataProvider;
+use crate::providers::{self, MetadataProvider};
 use crate::retry;
 
+#[cfg(test)]
+mod mock_tests;
+
+/// Path of the JSON metadata document, relative to the server base URL.
+const METADATA_PATH: &str = "metadata/v1.json";
+
 #[derive(Clone, Deserialize)]
 struct Address {
     ip_address: IpAddr,
@@ -57,6 +63,17 @@ struct Dns {
     nameservers: Vec<IpAddr>,
 }
 
+#[derive(Clone, Deserialize)]
+struct FloatingIp {
+    ipv4: Option<FloatingIpv4>,
+}
+
+#[derive(Clone, Deserialize)]
+struct FloatingIpv4 {
+    active: bool,
+    ip_address: Option<Ipv4Addr>,
+}
+
 #[derive(Clone, Deserialize)]
 pub struct DigitalOceanProvider {
     hostname: String,
@@ -64,15 +81,25 @@ pub struct DigitalOceanProvider {
     public_keys: Vec<String>,
     region: String,
     dns: Dns,
+    floating_ip: Option<FloatingIp>,
 }
 
 impl DigitalOceanProvider {
-    pub fn try_new() -> Result<DigitalOceanProvider> {
-        let client = retry::Client::try_new()?;
+    /// Fetch metadata with the given client, optionally overriding the base
+    /// URL of the metadata server.
+    pub fn with_base_url(
+        client: retry::Client,
+        base_url: Option<String>,
+    ) -> Result<DigitalOceanProvider> {
+        let base_url = base_url.unwrap_or_else(|| providers::METADATA_BASE_URL.to_string());
+        DigitalOceanProvider::fetch(&client, &base_url)
+    }
+
+    fn fetch(client: &retry::Client, base_url: &str) -> Result<DigitalOceanProvider> {
         let data: DigitalOceanProvider = client
             .get(
                 retry::Json,
-                "http://169.254.169.254/metadata/v1.json".to_owned(),
+                providers::metadata_api_url(base_url, METADATA_PATH),
             )
             .send()?
             .ok_or_else(|| anyhow!("not found"))?;
@@ -126,6 +153,16 @@ impl DigitalOceanProvider {
             }
         }
 
+        if let Some(floating_ipv4) = self.floating_ip.as_ref().and_then(|f| f.ipv4.as_ref()) {
+            attrs.push((
+                "DIGITALOCEAN_FLOATING_IP_ACTIVE".to_owned(),
+                floating_ipv4.active.to_string(),
+            ));
+            if let (true, Some(ip)) = (floating_ipv4.active, floating_ipv4.ip_address) {
+                attrs.push(("DIGITALOCEAN_FLOATING_IPV4".to_owned(), ip.to_string()));
+            }
+        }
+
         attrs
     }
 
@@ -158,9 +195,14 @@ impl DigitalOceanProvider {
                     ip_addresses: addrs,
                     routes,
                     bond: None,
+                    vlans: vec![],
+                    tunnels: vec![],
                     name: None,
                     priority: 10,
                     unmanaged: false,
+                    dhcp: false,
+                    mtu: None,
+                    search_domains: vec![],
                 },
             );
         }
@@ -196,6 +238,7 @@ impl DigitalOceanProvider {
             routes.push(network::NetworkRoute {
                 destination: net,
                 gateway: interface.clone().ipv4.unwrap().gateway,
+                metric: None,
             });
 
             if interface.type_name == "public" {
@@ -205,6 +248,7 @@ impl DigitalOceanProvider {
                             .context("invalid ip address or prefix")?,
                     ),
                     gateway: interface.clone().ipv4.unwrap().gateway,
+                    metric: None,
                 });
             }
         }
@@ -226,6 +270,7 @@ impl DigitalOceanProvider {
             routes.push(network::NetworkRoute {
                 destination: net,
                 gateway: interface.clone().ipv6.unwrap().gateway,
+                metric: None,
             });
             if interface.type_name == "public" {
                 routes.push(network::NetworkRoute {
@@ -234,6 +279,7 @@ impl DigitalOceanProvider {
                             .context("invalid ip address or prefix")?,
                     ),
                     gateway: interface.clone().ipv6.unwrap().gateway,
+                    metric: None,
                 });
             }
         }
@@ -256,6 +302,7 @@ impl DigitalOceanProvider {
             routes.push(network::NetworkRoute {
                 destination: net,
                 gateway: interface.clone().anchor_ipv4.unwrap().gateway,
+                metric: None,
             });
         }
         Ok((addrs, routes))
@@ -7,7 +7,8 @@ fn basic_hostname() {
     let ep = "/local-hostname";
     let hostname = "test-hostname";
 
-    let mut provider = exoscale::ExoscaleProvider::try_new().unwrap();
+    let mut provider =
+        exoscale::ExoscaleProvider::with_client(crate::retry::Client::try_new().unwrap()).unwrap();
     provider.client = provider.client.max_retries(0);
 
     let _m = mockito::mock("GET", ep).with_status(503).create();
@@ -33,7 +34,8 @@ fn basic_hostname() {
 
 #[test]
 fn basic_pubkeys() {
-    let mut provider = exoscale::ExoscaleProvider::try_new().unwrap();
+    let mut provider =
+        exoscale::ExoscaleProvider::with_client(crate::retry::Client::try_new().unwrap()).unwrap();
     provider.client = provider.client.max_retries(0);
 
     let _m_keys = mockito::mock("GET", "/public-keys")
@@ -21,21 +21,35 @@ use std::collections::HashMap;
 use anyhow::Result;
 use openssh_keys::PublicKey;
 
+use crate::providers::cloudstack::network;
 use crate::providers::MetadataProvider;
 use crate::retry;
 
 #[cfg(test)]
 mod mock_tests;
 
+/// Attributes served by the CloudStack-style metadata service, as pairs of
+/// attribute name (without the `EXOSCALE_` prefix) and metadata key.
+pub(crate) const ATTRIBUTES: &[(&str, &str)] = &[
+    ("INSTANCE_ID", "instance-id"),
+    ("LOCAL_HOSTNAME", "local-hostname"),
+    ("PUBLIC_HOSTNAME", "public-hostname"),
+    ("AVAILABILITY_ZONE", "availability-zone"),
+    ("PUBLIC_IPV4", "public-ipv4"),
+    ("LOCAL_IPV4", "local-ipv4"),
+    ("SERVICE_OFFERING", "service-offering"),
+    ("CLOUD_IDENTIFIER", "cloud-identifier"),
+    ("VM_ID", "vm-id"),
+];
+
 #[derive(Clone, Debug)]
 pub struct ExoscaleProvider {
     client: retry::Client,
 }
 
 impl ExoscaleProvider {
-    pub fn try_new() -> Result<ExoscaleProvider> {
-        let client = retry::Client::try_new()?;
-
+    /// Build a provider fetching metadata with the given client.
+    pub(crate) fn with_client(client: retry::Client) -> Result<ExoscaleProvider> {
         Ok(ExoscaleProvider { client })
     }
 
@@ -53,31 +67,12 @@ impl ExoscaleProvider {
 
 impl MetadataProvider for ExoscaleProvider {
     fn attributes(&self) -> Result<HashMap<String, String>> {
-        let mut out = HashMap::with_capacity(9);
-        let add_value = |map: &mut HashMap<_, _>, key: &str, name| -> Result<()> {
-            let value = self
-                .client
-                .get(retry::Raw, self.endpoint_for(name))
-                .send()?;
-
-            if let Some(value) = value {
-                map.insert(key.to_string(), value);
-            }
-
-            Ok(())
-        };
-
-        add_value(&mut out, "EXOSCALE_INSTANCE_ID", "instance-id")?;
-        add_value(&mut out, "EXOSCALE_LOCAL_HOSTNAME", "local-hostname")?;
-        add_value(&mut out, "EXOSCALE_PUBLIC_HOSTNAME", "public-hostname")?;
-        add_value(&mut out, "EXOSCALE_AVAILABILITY_ZONE", "availability-zone")?;
-        add_value(&mut out, "EXOSCALE_PUBLIC_IPV4", "public-ipv4")?;
-        add_value(&mut out, "EXOSCALE_LOCAL_IPV4", "local-ipv4")?;
-        add_value(&mut out, "EXOSCALE_SERVICE_OFFERING", "service-offering")?;
-        add_value(&mut out, "EXOSCALE_CLOUD_IDENTIFIER", "cloud-identifier")?;
-        add_value(&mut out, "EXOSCALE_VM_ID", "vm-id")?;
-
-        Ok(out)
+        network::fetch_attributes(
+            &self.client,
+            |key| self.endpoint_for(key),
+            "EXOSCALE",
+            ATTRIBUTES,
+        )
     }
 
     fn hostname(&self) -> Result<Option<String>> {
@@ -95,13 +90,6 @@ impl MetadataProvider for ExoscaleProvider {
     }
 
     fn ssh_keys(&self) -> Result<Vec<PublicKey>> {
-        let keys: Option<String> = self
-            .client
-            .get(retry::Raw, self.endpoint_for("public-keys"))
-            .send()?;
-
-        Ok(keys
-            .map(|s| PublicKey::read_keys(s.as_bytes()))
-            .unwrap_or_else(|| Ok(vec![]))?)
+        network::fetch_ssh_keys(&self.client, |key| self.endpoint_for(key))
     }
 }
@@ -7,7 +7,8 @@ fn basic_hostname() {
     let ep = "/instance/hostname";
     let hostname = "test-hostname";
 
-    let mut provider = gcp::GcpProvider::try_new().unwrap();
+    let mut provider =
+        gcp::GcpProvider::with_client(crate::retry::Client::try_new().unwrap()).unwrap();
     provider.client = provider.client.max_retries(0);
 
     let _m = mockito::mock("GET", ep).with_status(503).create();
@@ -40,6 +41,9 @@ fn basic_attributes() {
         "/instance/network-interfaces/0/access-configs/0/external-ip" => ip_external,
         "/instance/network-interfaces/0/ip" => ip_local,
         "/instance/machine-type" => machine_type,
+        "/instance/network-interfaces/" => "0/\n",
+        "/instance/network-interfaces/0/ip-aliases/" => "",
+        "/instance/scheduling/preemptible" => "FALSE",
     };
     let mut mocks = Vec::with_capacity(endpoints.len());
     for (endpoint, body) in endpoints {
@@ -49,19 +53,29 @@ fn basic_attributes() {
             .create();
         mocks.push(m);
     }
+    // no service account attached
+    mocks.push(
+        mockito::mock("GET", "/instance/service-accounts/")
+            .with_status(404)
+            .create(),
+    );
 
     let attributes = maplit::hashmap! {
         "GCP_HOSTNAME".to_string() => hostname.to_string(),
         "GCP_IP_EXTERNAL_0".to_string() => ip_external.to_string(),
         "GCP_IP_LOCAL_0".to_string() => ip_local.to_string(),
         "GCP_MACHINE_TYPE".to_string() => machine_type.to_string(),
+        "INSTANCE_PREEMPTIBLE".to_string() => "false".to_string(),
     };
 
     let client = crate::retry::Client::try_new()
         .unwrap()
         .max_retries(0)
         .return_on_404(true);
-    let provider = gcp::GcpProvider { client };
+    let provider = gcp::GcpProvider {
+        client,
+        api_url: mockito::server_url(),
+    };
 
     let v = provider.attributes().unwrap();
     assert_eq!(v, attributes);
@@ -69,3 +83,197 @@ fn basic_attributes() {
     mockito::reset();
     provider.attributes().unwrap_err();
 }
+
+#[test]
+fn merged_ssh_keys() {
+    let key1 =
+        "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIE+7Ikf7Ot5lNN5lJN9ndRvyFeojyeh8W2VqdXc5BQaq user1";
+    let key2 =
+        "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOF0FFbhNo8rGnBKxkdVnOAbH6Z4E/rRQ3pGbCZa8X6I user2";
+    let key3 =
+        "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIHy/6aWkyIuIk2zEnG0YvUSaNXYUZCqjEk7QpVZ6fEmA user3";
+
+    let instance_old = format!("user1:{}\nuser2:{}\n", key1, key2);
+    let instance_new = format!("user2:{}\n", key2);
+    let project_new = format!("user3:{}\n", key3);
+
+    let mut provider =
+        gcp::GcpProvider::with_client(crate::retry::Client::try_new().unwrap()).unwrap();
+    provider.client = provider.client.max_retries(0);
+
+    let mock_keys = |block_project_keys: &str| {
+        let endpoints = maplit::btreemap! {
+            "/instance/attributes/sshKeys" => instance_old.clone(),
+            "/instance/attributes/ssh-keys" => instance_new.clone(),
+            "/instance/attributes/block-project-ssh-keys" => block_project_keys.to_string(),
+            "/project/attributes/ssh-keys" => project_new.clone(),
+        };
+        let mut mocks = Vec::with_capacity(endpoints.len() + 1);
+        for (endpoint, body) in endpoints {
+            let m = mockito::mock("GET", endpoint)
+                .with_status(200)
+                .with_body(body)
+                .create();
+            mocks.push(m);
+        }
+        let m = mockito::mock("GET", "/project/attributes/sshKeys")
+            .with_status(404)
+            .create();
+        mocks.push(m);
+        mocks
+    };
+
+    let _mocks = mock_keys("false");
+    let keys: Vec<String> = provider
+        .ssh_keys()
+        .unwrap()
+        .iter()
+        .map(ToString::to_string)
+        .collect();
+    assert_eq!(keys, vec![key1, key2, key3]);
+    mockito::reset();
+
+    let _mocks = mock_keys("true");
+    let keys: Vec<String> = provider
+        .ssh_keys()
+        .unwrap()
+        .iter()
+        .map(ToString::to_string)
+        .collect();
+    assert_eq!(keys, vec![key1, key2]);
+    mockito::reset();
+}
+
+#[test]
+fn ip_aliases() {
+    let endpoints = maplit::btreemap! {
+        "/instance/network-interfaces/" => "0/\n1/\n",
+        "/instance/network-interfaces/0/ip-aliases/" => "0\n1\n",
+        "/instance/network-interfaces/0/ip-aliases/0" => "10.128.1.0/24",
+        "/instance/network-interfaces/0/ip-aliases/1" => "10.128.2.16/28",
+    };
+    let mut mocks = Vec::with_capacity(endpoints.len());
+    for (endpoint, body) in endpoints {
+        let m = mockito::mock("GET", endpoint)
+            .with_status(200)
+            .with_body(body)
+            .create();
+        mocks.push(m);
+    }
+    // second interface without aliases
+    let m = mockito::mock("GET", "/instance/network-interfaces/1/ip-aliases/")
+        .with_status(404)
+        .create();
+    mocks.push(m);
+
+    let client = crate::retry::Client::try_new()
+        .unwrap()
+        .max_retries(0)
+        .return_on_404(true);
+    let provider = gcp::GcpProvider {
+        client,
+        api_url: mockito::server_url(),
+    };
+
+    let aliases = provider.fetch_ip_aliases().unwrap();
+    assert_eq!(
+        aliases,
+        vec![
+            (
+                "0".to_string(),
+                vec!["10.128.1.0/24".to_string(), "10.128.2.16/28".to_string()]
+            ),
+            ("1".to_string(), vec![]),
+        ]
+    );
+
+    mockito::reset();
+}
+
+#[test]
+fn test_base_url() {
+    let _m = mockito::mock("GET", "/computeMetadata/v1/instance/hostname")
+        .with_status(200)
+        .with_body("test-hostname")
+        .create();
+
+    let mut provider = gcp::GcpProvider::with_client(crate::retry::Client::try_new().unwrap())
+        .unwrap()
+        .base_url(Some(format!("{}/", mockito::server_url())));
+    provider.client = provider.client.max_retries(0);
+
+    let v = provider.hostname().unwrap();
+    assert_eq!(v, Some("test-hostname".to_string()));
+
+    mockito::reset();
+}
+
+#[test]
+fn test_service_account() {
+    let endpoints = maplit::btreemap! {
+        "/instance/service-accounts/" => "123456789-compute@developer.gserviceaccount.com/\ndefault/\n",
+        "/instance/service-accounts/default/email" => "123456789-compute@developer.gserviceaccount.com",
+        "/instance/service-accounts/default/scopes" => "https://www.googleapis.com/auth/devstorage.read_only\nhttps://www.googleapis.com/auth/logging.write\n",
+    };
+    let mut mocks = Vec::with_capacity(endpoints.len());
+    for (endpoint, body) in endpoints {
+        let m = mockito::mock("GET", endpoint)
+            .with_status(200)
+            .with_body(body)
+            .create();
+        mocks.push(m);
+    }
+
+    let client = crate::retry::Client::try_new()
+        .unwrap()
+        .max_retries(0)
+        .return_on_404(true);
+    let provider = gcp::GcpProvider {
+        client,
+        api_url: mockito::server_url(),
+    };
+
+    let (email, scopes) = provider.fetch_service_account().unwrap().unwrap();
+    assert_eq!(email, "123456789-compute@developer.gserviceaccount.com");
+    assert_eq!(
+        scopes,
+        vec![
+            "https://www.googleapis.com/auth/devstorage.read_only",
+            "https://www.googleapis.com/auth/logging.write",
+        ]
+    );
+
+    // no service account attached
+    mockito::reset();
+    let _m = mockito::mock("GET", "/instance/service-accounts/")
+        .with_status(404)
+        .create();
+    assert_eq!(provider.fetch_service_account().unwrap(), None);
+
+    mockito::reset();
+}
+
+#[test]
+fn preemptible() {
+    let _m_preemptible = mockito::mock("GET", "/instance/scheduling/preemptible")
+        .with_status(200)
+        .with_body("TRUE")
+        .create();
+    let _m_others = mockito::mock("GET", mockito::Matcher::Any)
+        .with_status(404)
+        .create();
+
+    let client = crate::retry::Client::try_new()
+        .unwrap()
+        .max_retries(0)
+        .return_on_404(true);
+    let provider = gcp::GcpProvider {
+        client,
+        api_url: mockito::server_url(),
+    };
+
+    let v = provider.attributes().unwrap();
+    assert_eq!(v["INSTANCE_PREEMPTIBLE"], "true");
+
+    mockito::reset();
+}
@@ -21,7 +21,7 @@ use openssh_keys::PublicKey;
 use reqwest::header::{HeaderName, HeaderValue};
 use std::collections::HashMap;
 
-use crate::providers::MetadataProvider;
+use crate::providers::{self, MetadataProvider};
 use crate::retry;
 
 #[cfg(test)]
@@ -29,32 +29,51 @@ mod mock_tests;
 
 static HDR_METADATA_FLAVOR: &str = "metadata-flavor";
 
+/// Path of the metadata API, relative to the metadata server base URL.
+const API_PATH: &str = "computeMetadata/v1";
+
 #[derive(Clone, Debug)]
 pub struct GcpProvider {
     client: retry::Client,
+    api_url: String,
 }
 
 impl GcpProvider {
-    pub fn try_new() -> Result<GcpProvider> {
-        let client = retry::Client::try_new()?
+    /// Build a provider fetching metadata with the given client.
+    pub(crate) fn with_client(client: retry::Client) -> Result<GcpProvider> {
+        let client = client
             .header(
                 HeaderName::from_static(HDR_METADATA_FLAVOR),
                 HeaderValue::from_static("Google"),
             )
             .return_on_404(true);
 
-        Ok(GcpProvider { client })
+        Ok(GcpProvider {
+            client,
+            api_url: GcpProvider::default_api_url(),
+        })
+    }
+
+    /// Override the base URL of the metadata server.
+    pub fn base_url(mut self, base_url: Option<String>) -> Self {
+        if let Some(base_url) = base_url {
+            self.api_url = providers::metadata_api_url(&base_url, API_PATH);
+        }
+        self
     }
 
     #[cfg(test)]
-    fn endpoint_for(name: &str) -> String {
-        let url = mockito::server_url();
-        format!("{}/{}", url, name)
+    fn default_api_url() -> String {
+        mockito::server_url()
     }
 
     #[cfg(not(test))]
-    fn endpoint_for(name: &str) -> String {
-        format!("http://169.254.169.254/computeMetadata/v1/{}", name)
+    fn default_api_url() -> String {
+        providers::metadata_api_url(providers::METADATA_BASE_URL, API_PATH)
+    }
+
+    fn endpoint_for(&self, name: &str) -> String {
+        format!("{}/{}", self.api_url, name)
     }
 
     fn fetch_all_ssh_keys(&self) -> Result<Vec<String>> {
@@ -66,40 +85,113 @@ impl GcpProvider {
         // https://cloud.google.com/compute/docs/instances/adding-removing-ssh-keys
 
         // Instance-level, old endpoint
-        // If there are any of these, don't do anything else.
-        let keys = self.fetch_ssh_keys("instance/attributes/sshKeys")?;
-        if !keys.is_empty() {
-            return Ok(keys);
-        }
+        let mut keys = self.fetch_ssh_keys("instance/attributes/sshKeys")?;
         // Instance-level, new endpoint
-        let mut keys = self.fetch_ssh_keys("instance/attributes/ssh-keys")?;
+        // Both are merged, as instances being migrated may have keys in both.
+        keys.append(&mut self.fetch_ssh_keys("instance/attributes/ssh-keys")?);
 
         let block_project_keys: Option<String> = self
             .client
             .clone()
             .get(
                 retry::Raw,
-                GcpProvider::endpoint_for("instance/attributes/block-project-ssh-keys"),
+                self.endpoint_for("instance/attributes/block-project-ssh-keys"),
             )
             .send()?;
 
-        if block_project_keys == Some("true".to_owned()) {
-            return Ok(keys);
+        if block_project_keys != Some("true".to_owned()) {
+            // Project-level, old endpoint
+            keys.append(&mut self.fetch_ssh_keys("project/attributes/sshKeys")?);
+            // Project-level, new endpoint
+            keys.append(&mut self.fetch_ssh_keys("project/attributes/ssh-keys")?);
         }
 
-        // Project-level, old endpoint
-        keys.append(&mut self.fetch_ssh_keys("project/attributes/sshKeys")?);
-        // Project-level, new endpoint
-        keys.append(&mut self.fetch_ssh_keys("project/attributes/ssh-keys")?);
+        // Drop duplicates, keeping the first occurrence of each key.
+        let mut unique = Vec::with_capacity(keys.len());
+        for key in keys {
+            if !unique.contains(&key) {
+                unique.push(key);
+            }
+        }
 
-        Ok(keys)
+        Ok(unique)
     }
 
-    fn fetch_ssh_keys(&self, key: &str) -> Result<Vec<String>> {
-        let key_data: Option<String> = self
+    /// List the entries of a metadata directory, without trailing slashes.
+    fn fetch_entries(&self, dir: &str) -> Result<Vec<String>> {
+        let listing: Option<String> = self.client.get(retry::Raw, self.endpoint_for(dir)).send()?;
+        let entries = listing
+            .unwrap_or_default()
+            .lines()
+            .map(|l| l.trim().trim_end_matches('/').to_string())
+            .filter(|l| !l.is_empty())
+            .collect();
+        Ok(entries)
+    }
+
+    /// Fetch the email and scopes of the default service account, if any.
+    ///
+    /// Access tokens are deliberately not fetched.
+    fn fetch_service_account(&self) -> Result<Option<(String, Vec<String>)>> {
+        let accounts = self.fetch_entries("instance/service-accounts/")?;
+        if !accounts.iter().any(|a| a == "default") {
+            return Ok(None);
+        }
+
+        let email: Option<String> = self
             .client
-            .get(retry::Raw, GcpProvider::endpoint_for(key))
+            .get(
+                retry::Raw,
+                self.endpoint_for("instance/service-accounts/default/email"),
+            )
             .send()?;
+        let email = match email.filter(|e| !e.is_empty()) {
+            Some(email) => email,
+            None => return Ok(None),
+        };
+        let scopes: Option<String> = self
+            .client
+            .get(
+                retry::Raw,
+                self.endpoint_for("instance/service-accounts/default/scopes"),
+            )
+            .send()?;
+        let scopes = scopes
+            .unwrap_or_default()
+            .lines()
+            .map(str::trim)
+            .filter(|s| !s.is_empty())
+            .map(String::from)
+            .collect();
+        Ok(Some((email, scopes)))
+    }
+
+    /// Fetch alias IP ranges for each network interface, keyed by interface index.
+    fn fetch_ip_aliases(&self) -> Result<Vec<(String, Vec<String>)>> {
+        let ifaces = self.fetch_entries("instance/network-interfaces/")?;
+        let provider = self.clone();
+        self.client.fetch_all(ifaces, move |iface| {
+            let dir = format!("instance/network-interfaces/{}/ip-aliases/", iface);
+            let mut aliases = Vec::new();
+            for entry in provider.fetch_entries(&dir)? {
+                let alias: Option<String> = provider
+                    .client
+                    .get(
+                        retry::Raw,
+                        provider.endpoint_for(&format!("{}{}", dir, entry)),
+                    )
+                    .send()?;
+                if let Some(alias) = alias.filter(|a| !a.is_empty()) {
+                    aliases.push(alias);
+                }
+            }
+            Ok((iface, aliases))
+        })
+    }
+
+    fn fetch_ssh_keys(&self, key: &str) -> Result<Vec<String>> {
+        let key_data: Option<String> =
+            self.client.get(retry::Raw, self.endpoint_for(key)).send()?;
         if let Some(key_data) = key_data {
             let mut keys = Vec::new();
             for l in key_data.lines() {
@@ -127,7 +219,7 @@ impl MetadataProvider for GcpProvider {
         let add_value = |map: &mut HashMap<_, _>, key: &str, name| -> Result<()> {
             let value: Option<String> = self
                 .client
-                .get(retry::Raw, GcpProvider::endpoint_for(name))
+                .get(retry::Raw, self.endpoint_for(name))
                 .send()?;
 
             if let Some(value) = value {
@@ -152,12 +244,40 @@ impl MetadataProvider for GcpProvider {
         )?;
         add_value(&mut out, "GCP_MACHINE_TYPE", "instance/machine-type")?;
 
+        // "TRUE" or "FALSE", spot VMs are preemptible too
+        let preemptible: Option<String> = self
+            .client
+            .get(
+                retry::Raw,
+                self.endpoint_for("instance/scheduling/preemptible"),
+            )
+            .send()?;
+        if let Some(preemptible) = preemptible {
+            out.insert(
+                super::PREEMPTIBLE_ATTRIBUTE.to_string(),
+                preemptible.trim().eq_ignore_ascii_case("true").to_string(),
+            );
+        }
+
+        for (iface, aliases) in self.fetch_ip_aliases()? {
+            for (i, alias) in aliases.into_iter().enumerate() {
+                out.insert(format!("GCP_IP_ALIAS_{}_{}", iface, i), alias);
+            }
+        }
+
+        if let Some((email, scopes)) = self.fetch_service_account()? {
+            out.insert("GCP_SERVICE_ACCOUNT_EMAIL".to_string(), email);
+            if !scopes.is_empty() {
+                out.insert("GCP_SERVICE_ACCOUNT_SCOPES".to_string(), scopes.join(","));
+            }
+        }
+
         Ok(out)
     }
 
     fn hostname(&self) -> Result<Option<String>> {
         self.client
-            .get(retry::Raw, GcpProvider::endpoint_for("instance/hostname"))
+            .get(retry::Raw, self.endpoint_for("instance/hostname"))
             .send()
     }
 
@@ -21,6 +21,8 @@ use std::str;
 use tempfile::TempDir;
 
 use crate::providers::MetadataProvider;
+use crate::retry::{self, Deserializer};
+use crate::util::drive;
 
 use mailparse::*;
 use serde_derive::Deserialize;
@@ -34,6 +36,8 @@ pub struct IBMGen2Provider {
     drive_path: PathBuf,
     /// Temporary directory for own mountpoint.
     temp_dir: TempDir,
+    /// Retries of failed reads from the config-drive.
+    read_retry: drive::ReadRetry,
 }
 
 impl IBMGen2Provider {
@@ -55,10 +59,17 @@ impl IBMGen2Provider {
         let provider = Self {
             drive_path: target.path().to_owned(),
             temp_dir: target,
+            read_retry: drive::ReadRetry::default(),
         };
         Ok(provider)
     }
 
+    /// Retry failed reads from the config-drive as configured.
+    pub fn read_retry(mut self, retry: drive::ReadRetry) -> Self {
+        self.read_retry = retry;
+        self
+    }
+
     /// Return the path to the metadata directory.
     fn metadata_dir(&self) -> PathBuf {
         self.drive_path.clone()
@@ -67,9 +78,8 @@ impl IBMGen2Provider {
     /// Read metadata file and parse attributes.
     fn read_metadata(&self) -> Result<HashMap<String, String>> {
         let filename = self.metadata_dir().join("meta-data");
-        let file = File::open(&filename)
-            .with_context(|| format!("failed to open file '{:?}'", filename))?;
-        let bufrd = BufReader::new(file);
+        let contents = drive::read_file(&filename, self.read_retry)?;
+        let bufrd = BufReader::new(contents.as_slice());
         Self::parse_metadata(bufrd)
     }
 
@@ -152,7 +162,8 @@ impl IBMGen2Provider {
         if cloud_config.is_empty() {
             bail!("no cloud-config section found in vendor-data");
         }
-        let deserialized_cloud_config: VendorDataCloudConfig = serde_yaml::from_str(&cloud_config)
+        let deserialized_cloud_config: VendorDataCloudConfig = retry::Yaml
+            .deserialize(cloud_config.as_bytes())
             .context("failed to deserialize cloud-config content")?;
         Ok(deserialized_cloud_config.ssh_authorized_keys)
     }
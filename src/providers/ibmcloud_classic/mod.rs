@@ -17,7 +17,6 @@ use pnet_base::MacAddr;
 use serde::Deserialize;
 use slog_scope::warn;
 use std::collections::HashMap;
-use std::fs::File;
 use std::io::{BufReader, Read};
 use std::net::IpAddr;
 use std::path::{Path, PathBuf};
@@ -25,6 +24,7 @@ use tempfile::TempDir;
 
 use crate::network;
 use crate::providers::MetadataProvider;
+use crate::util::drive;
 
 // Filesystem label for the Config Drive.
 static CONFIG_DRIVE_FS_LABEL: &str = "config-2";
@@ -39,6 +39,8 @@ pub struct IBMClassicProvider {
     drive_path: PathBuf,
     /// Temporary directory for own mountpoint.
     temp_dir: TempDir,
+    /// Retries of failed reads from the config-drive.
+    read_retry: drive::ReadRetry,
 }
 
 /// Partial object for `meta_data.json`
@@ -72,6 +74,8 @@ pub struct NetLinkJSON {
     pub id: String,
     #[serde(rename = "ethernet_mac_address")]
     pub mac_addr: String,
+    /// Link MTU (optional).
+    pub mtu: Option<u32>,
 }
 
 /// JSON entry in `networks` array.
@@ -130,10 +134,17 @@ impl IBMClassicProvider {
         let provider = Self {
             drive_path: target.path().to_owned(),
             temp_dir: target,
+            read_retry: drive::ReadRetry::default(),
         };
         Ok(provider)
     }
 
+    /// Retry failed reads from the config-drive as configured.
+    pub fn read_retry(mut self, retry: drive::ReadRetry) -> Self {
+        self.read_retry = retry;
+        self
+    }
+
     /// Return the path to the metadata directory.
     fn metadata_dir(&self) -> PathBuf {
         let drive = self.drive_path.clone();
@@ -143,9 +154,8 @@ impl IBMClassicProvider {
     /// Read and parse metadata file.
     fn read_metadata(&self) -> Result<MetaDataJSON> {
         let filename = self.metadata_dir().join("meta_data.json");
-        let file = File::open(&filename)
-            .with_context(|| format!("failed to open file '{:?}'", filename))?;
-        let bufrd = BufReader::new(file);
+        let contents = drive::read_file(&filename, self.read_retry)?;
+        let bufrd = BufReader::new(contents.as_slice());
         Self::parse_metadata(bufrd)
     }
 
@@ -180,9 +190,8 @@ impl IBMClassicProvider {
     /// Read and parse network configuration.
     fn read_network_data(&self) -> Result<NetworkDataJSON> {
         let filename = self.metadata_dir().join("network_data.json");
-        let file = File::open(&filename)
-            .with_context(|| format!("failed to open file '{:?}'", filename))?;
-        let bufrd = BufReader::new(file);
+        let contents = drive::read_file(&filename, self.read_retry)?;
+        let bufrd = BufReader::new(contents.as_slice());
         Self::parse_network_data(bufrd)
     }
 
@@ -198,11 +207,11 @@ impl IBMClassicProvider {
         use std::str::FromStr;
 
         // Validate links and parse them into a map, keyed by id.
-        let mut devices: HashMap<String, (String, MacAddr)> =
+        let mut devices: HashMap<String, (String, MacAddr, Option<u32>)> =
             HashMap::with_capacity(input.links.len());
         for dev in input.links {
             let mac = MacAddr::from_str(&dev.mac_addr)?;
-            devices.insert(dev.id, (dev.name, mac));
+            devices.insert(dev.id, (dev.name, mac, dev.mtu));
         }
 
         // Parse resolvers.
@@ -221,8 +230,8 @@ impl IBMClassicProvider {
         let mut output = Vec::with_capacity(input.networks.len());
         for net in input.networks {
             // Ensure that the referenced link exists.
-            let (name, mac_addr) = match devices.get(&net.link) {
-                Some(dev) => (dev.0.clone(), dev.1),
+            let (name, mac_addr, mtu) = match devices.get(&net.link) {
+                Some(dev) => (dev.0.clone(), dev.1, dev.2),
                 None => continue,
             };
 
@@ -236,6 +245,7 @@ impl IBMClassicProvider {
                 let route = network::NetworkRoute {
                     destination,
                     gateway: entry.gateway,
+                    metric: None,
                 };
                 routes.push(route);
             }
@@ -248,7 +258,12 @@ impl IBMClassicProvider {
                 ip_addresses: vec![ip_net],
                 routes,
                 bond: None,
+                vlans: vec![],
+                tunnels: vec![],
                 unmanaged: false,
+                dhcp: false,
+                mtu,
+                search_domains: vec![],
             };
             output.push(iface);
         }
@@ -310,6 +325,7 @@ impl Drop for IBMClassicProvider {
 #[cfg(test)]
 mod tests {
     use super::*;
+    use std::fs::File;
     use std::io::Cursor;
 
     #[test]
@@ -366,6 +382,7 @@ mod tests {
 
         for entry in interfaces {
             assert_eq!(entry.nameservers.len(), 2);
+            assert_eq!(entry.mtu, None);
         }
     }
 }
@@ -0,0 +1,139 @@
+use crate::providers::linode;
+use crate::providers::MetadataProvider;
+use mockito;
+
+const INSTANCE: &str = r#"{
+    "id": 12345678,
+    "host_uuid": "a631b16d14534d84e2830da16d1b28e1f08d4c5a",
+    "label": "linode12345678",
+    "region": "us-ord",
+    "type": "g6-nanode-1",
+    "tags": ["web"],
+    "specs": {"vcpus": 1, "memory": 1024, "disk": 25600, "transfer": 1000, "gpus": 0},
+    "backups": {"enabled": false, "status": null}
+}"#;
+
+fn test_client() -> crate::retry::Client {
+    crate::retry::Client::try_new()
+        .unwrap()
+        .max_retries(1)
+        .initial_backoff(std::time::Duration::from_millis(1))
+}
+
+fn mock_token(token: &str) -> mockito::Mock {
+    mockito::mock("PUT", "/v1/token")
+        .match_header("Metadata-Token-Expiry-Seconds", "3600")
+        .with_status(200)
+        .with_body(token)
+        .create()
+}
+
+#[test]
+fn test_token() {
+    // the token is required
+    let _m = mockito::mock("PUT", "/v1/token").with_status(403).create();
+    linode::LinodeProvider::with_client(test_client()).unwrap_err();
+    mockito::reset();
+
+    let _m_token = mock_token("test-token");
+    let provider = linode::LinodeProvider::with_client(test_client()).unwrap();
+
+    let m_instance = mockito::mock("GET", "/v1/instance")
+        .match_header("Metadata-Token", "test-token")
+        .match_header("Accept", "application/json")
+        .with_status(200)
+        .with_body(INSTANCE)
+        .expect(1)
+        .create();
+    let v = provider.hostname().unwrap();
+    assert_eq!(v, Some("linode12345678".to_string()));
+    m_instance.assert();
+
+    mockito::reset();
+}
+
+#[test]
+fn test_token_renewal() {
+    let m_token = mock_token("token-1");
+    let provider = linode::LinodeProvider::with_client(test_client()).unwrap();
+    drop(m_token);
+
+    let m_token = mock_token("token-2");
+    let m_expired = mockito::mock("GET", "/v1/instance")
+        .match_header("Metadata-Token", "token-1")
+        .with_status(401)
+        .expect(1)
+        .create();
+    let m_instance = mockito::mock("GET", "/v1/instance")
+        .match_header("Metadata-Token", "token-2")
+        .with_status(200)
+        .with_body(INSTANCE)
+        .expect(1)
+        .create();
+
+    let v = provider.hostname().unwrap();
+    assert_eq!(v, Some("linode12345678".to_string()));
+    m_token.assert();
+    m_expired.assert();
+    m_instance.assert();
+
+    mockito::reset();
+}
+
+#[test]
+fn test_attributes() {
+    let _m_token = mock_token("test-token");
+    let provider = linode::LinodeProvider::with_client(test_client()).unwrap();
+
+    let _m_instance = mockito::mock("GET", "/v1/instance")
+        .match_header("Metadata-Token", "test-token")
+        .with_status(200)
+        .with_body(INSTANCE)
+        .create();
+
+    let attributes = maplit::hashmap! {
+        "LINODE_INSTANCE_ID".to_string() => "12345678".to_string(),
+        "LINODE_HOST_UUID".to_string() => "a631b16d14534d84e2830da16d1b28e1f08d4c5a".to_string(),
+        "LINODE_LABEL".to_string() => "linode12345678".to_string(),
+        "LINODE_REGION".to_string() => "us-ord".to_string(),
+        "LINODE_INSTANCE_TYPE".to_string() => "g6-nanode-1".to_string(),
+    };
+    assert_eq!(provider.attributes().unwrap(), attributes);
+
+    mockito::reset();
+    provider.attributes().unwrap_err();
+}
+
+#[test]
+fn test_ssh_keys() {
+    let _m_token = mock_token("test-token");
+    let provider = linode::LinodeProvider::with_client(test_client()).unwrap();
+
+    let keys = r#"{
+        "users": {
+            "alice": ["ssh-rsa AAAAB3NzaC1yc2EAAAADAQABAAABgQCsXe6CfHl45kCIzMF92VhDf2NpBWUyS1+IiTtxm5a83mT9730Hb8xim7GYeJu47kiESw2DAN8vNJ/Irg0apZ217ah2rXXjPQuWYSXuEuap8yLBSjqw8exgqVj/kzW+YqmnHASxI13eoFDxTQQGzyqbqowvxu/5gQmDwBmNAa9bT809ziB/qmpS1mD6qyyFDpR23kUwu3TkgAbwMXBDoqK+pdwfaF9uo9XaLHNEH8lD5BZuG2BeDafm2o76DhNSo83MvcCPNXKLxu3BbX/FCMFO6O8RRqony4i91fEV1b8TbXrbJz1bwEYEnJRvmjnqI/389tQFeYvplXR2WdT9PCKyEAG+j8y6XgecIcdTqV/7gFfak1mp2S7mYHZDnXixsn3MjCP/cIxxJVDitKusnj1TdFqtSXl4tqGccbg/5Sqnt/EVSK4bGwwBxv/YmE0P9cbXLxuEVI0JYzgrQvC8TtUgd8kUu2jqi1/Yj9IWm3aFsl/hhh8YwYrv/gm8PV0TxkM= root@example1"],
+            "root": ["ssh-rsa AAAAB3NzaC1yc2EAAAADAQABAAABgQDj6FBVgkTt7/DB93VVLk6304Nx7WUjLBJDSCh38zjCimHUpeo9uYDxflfu2N1CLtrSImIKBVP/JRy9g7K4zmRAH/wXw2UxYziX+hZoFIpbW3GmYQqhjx2lDvIRXJI7blhHhTUNWX5f10lFAYOLqA9J859AB1w7ND09+MS3jQgSazCx17h+QZ0qQ6kLSfnXw9PMUOE1Xba9hD1nYj14ryTVj9jrFPMFuUfXdb/G9lsDJ+cGvdE2/RMuPfDmEdo04zvZ5fQJJKvS7OyAuYev4Y+JC8MhEr756ITDZ17yq4BEMo/8rNPxZ5Von/8xnvry+8/2C3ep9rZyHtCwpRb6WT6TndV2ddXKhEIneyd1XiOcWPJguHj5vSoMN3mo8k2PvznGauvxBstvpjUSFLQu869/ZQwyMnbQi3wnkJk5CpLXePXn1J9njocJjt8+SKGijmmIAsmYosx8gmmu3H1mvq9Wi0qqWDITMm+J24AZBEPBhwVrjhLZb5MKxylF6JFJJBs= root@example2", "not a key"]
+        }
+    }"#;
+    let _m_keys = mockito::mock("GET", "/v1/ssh-keys")
+        .match_header("Metadata-Token", "test-token")
+        .with_status(200)
+        .with_body(keys)
+        .create();
+
+    // only keys of root, invalid ones are skipped
+    let keys = provider.ssh_keys().unwrap();
+    assert_eq!(keys.len(), 1);
+    assert_eq!(keys[0].comment, Some("root@example2".to_string()));
+
+    // no keys for root
+    mockito::reset();
+    let _m_keys = mockito::mock("GET", "/v1/ssh-keys")
+        .with_status(200)
+        .with_body(r#"{"users": {"alice": []}}"#)
+        .create();
+    assert_eq!(provider.ssh_keys().unwrap(), vec![]);
+
+    mockito::reset();
+    provider.ssh_keys().unwrap_err();
+}
@@ -0,0 +1,161 @@
+//! linode provider metadata fetcher
+//! This provider is selected via the platform ID `linode`.
+//! The metadata service requires a session token, fetched first with a
+//! `PUT` request and then sent with every other request.
+
+use std::collections::{BTreeMap, HashMap};
+
+use anyhow::{anyhow, Context, Result};
+#[cfg(test)]
+use mockito;
+use openssh_keys::PublicKey;
+use reqwest::header;
+use serde_derive::Deserialize;
+use slog_scope::error;
+
+use crate::providers::MetadataProvider;
+use crate::retry;
+
+#[cfg(test)]
+mod mock_tests;
+
+/// Header carrying the session token.
+const TOKEN_HEADER: &str = "metadata-token";
+
+/// Header requesting a session token lifetime, in seconds.
+const TOKEN_EXPIRY_HEADER: &str = "metadata-token-expiry-seconds";
+
+/// Requested session token lifetime, in seconds.
+const TOKEN_EXPIRY_SECS: &str = "3600";
+
+/// User whose keys are authorized on the instance.
+///
+/// Keys set for `root` at deploy time are the instance keys, written for
+/// the user given to `--ssh-keys`. Other users are Linode account users,
+/// whose keys are not meant for this instance's default user.
+const SSH_KEYS_USER: &str = "root";
+
+#[derive(Clone, Debug, Deserialize)]
+struct Instance {
+    id: u64,
+    host_uuid: Option<String>,
+    #[serde(default)]
+    label: String,
+    region: Option<String>,
+    #[serde(rename = "type")]
+    instance_type: Option<String>,
+}
+
+#[derive(Clone, Debug, Deserialize)]
+struct SshKeys {
+    /// Public keys, by user.
+    #[serde(default)]
+    users: BTreeMap<String, Vec<String>>,
+}
+
+#[derive(Clone, Debug)]
+pub struct LinodeProvider {
+    client: retry::Client,
+}
+
+impl LinodeProvider {
+    /// Build a provider fetching metadata with the given client.
+    pub(crate) fn with_client(client: retry::Client) -> Result<LinodeProvider> {
+        let token_client = client.clone();
+        let renew = move || {
+            let token = LinodeProvider::fetch_token(token_client.clone())?;
+            header::HeaderValue::from_bytes(token.trim().as_bytes())
+                .context("setting header value for linode metadata token")
+        };
+
+        let token = renew().context("failed to fetch linode metadata token")?;
+        let client = client.session_token(retry::SessionToken::new(
+            header::HeaderName::from_static(TOKEN_HEADER),
+            token,
+            renew,
+        ));
+
+        Ok(LinodeProvider { client })
+    }
+
+    #[cfg(test)]
+    fn endpoint_for(name: &str) -> String {
+        format!("{}/v1/{}", mockito::server_url(), name)
+    }
+
+    #[cfg(not(test))]
+    fn endpoint_for(name: &str) -> String {
+        format!("http://169.254.169.254/v1/{}", name)
+    }
+
+    fn fetch_token(client: retry::Client) -> Result<String> {
+        client
+            .header(
+                header::HeaderName::from_static(TOKEN_EXPIRY_HEADER),
+                header::HeaderValue::from_static(TOKEN_EXPIRY_SECS),
+            )
+            .put(retry::Raw, LinodeProvider::endpoint_for("token"), None)
+            .dispatch_put()?
+            .ok_or_else(|| anyhow!("empty linode metadata token"))
+    }
+
+    /// Fetch a JSON document, which is only served when explicitly asked for.
+    fn fetch_json<T>(&self, name: &str) -> Result<T>
+    where
+        T: for<'de> serde::Deserialize<'de>,
+    {
+        self.client
+            .get(retry::Json, LinodeProvider::endpoint_for(name))
+            .header(
+                header::ACCEPT,
+                header::HeaderValue::from_static("application/json"),
+            )
+            .send()?
+            .ok_or_else(|| anyhow!("linode metadata '{}' not found", name))
+    }
+
+    fn fetch_instance(&self) -> Result<Instance> {
+        self.fetch_json("instance")
+    }
+}
+
+impl MetadataProvider for LinodeProvider {
+    fn attributes(&self) -> Result<HashMap<String, String>> {
+        let instance = self.fetch_instance()?;
+        let mut out = HashMap::with_capacity(5);
+
+        out.insert("LINODE_INSTANCE_ID".to_string(), instance.id.to_string());
+        let mut add_value = |key: &str, value: Option<String>| {
+            if let Some(value) = value.filter(|v| !v.is_empty()) {
+                out.insert(key.to_string(), value);
+            }
+        };
+        add_value("LINODE_HOST_UUID", instance.host_uuid);
+        add_value("LINODE_LABEL", Some(instance.label));
+        add_value("LINODE_REGION", instance.region);
+        add_value("LINODE_INSTANCE_TYPE", instance.instance_type);
+
+        Ok(out)
+    }
+
+    fn hostname(&self) -> Result<Option<String>> {
+        let instance = self.fetch_instance()?;
+        if instance.label.is_empty() {
+            return Ok(None);
+        }
+        Ok(Some(instance.label))
+    }
+
+    fn ssh_keys(&self) -> Result<Vec<PublicKey>> {
+        let mut keys: SshKeys = self.fetch_json("ssh-keys")?;
+        let mut out = Vec::new();
+        for key in keys.users.remove(SSH_KEYS_USER).unwrap_or_default() {
+            match PublicKey::parse(&key) {
+                Ok(pk) => out.push(pk),
+                Err(e) => error!("failed to parse SSH Public Key: {}", e),
+            };
+        }
+
+        Ok(out)
+    }
+}
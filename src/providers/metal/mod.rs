@@ -0,0 +1,274 @@
+//! Metadata fetcher for bare metal hosts provisioned by Metal3.
+//!
+//! Metal3 (e.g. through the Cluster API provider CAPM3) provides a
+//! config-drive following the OpenStack layout, with per-host metadata in
+//! `meta_data.json` and network configuration in `network_data.json`.
+//!
+//! The set of metadata keys is up to the deployment, so all top-level
+//! scalar entries are exposed as `METAL_<KEY>` attributes.
+
+use anyhow::{Context, Result};
+use openssh_keys::PublicKey;
+use serde_json::{Map, Value};
+use slog_scope::{error, warn};
+use std::collections::HashMap;
+use std::io::{BufReader, Read};
+use std::path::{Path, PathBuf};
+use tempfile::TempDir;
+
+use crate::network;
+use crate::providers::openstack::network_data::NetworkData;
+use crate::providers::MetadataProvider;
+use crate::util::drive;
+
+// Filesystem label for the Config Drive.
+static CONFIG_DRIVE_FS_LABEL: &str = "config-2";
+
+// Filesystem type for the Config Drive.
+static CONFIG_DRIVE_FS_TYPE: &str = "iso9660";
+
+/// Metadata keys holding the hostname, by order of preference.
+const HOSTNAME_KEYS: &[&str] = &["hostname", "local-hostname", "local_hostname", "name"];
+
+/// Metal3 provider.
+#[derive(Debug)]
+pub struct MetalProvider {
+    /// Path to the top directory of the mounted config-drive.
+    drive_path: PathBuf,
+    /// Temporary directory for own mountpoint (if any).
+    temp_dir: Option<TempDir>,
+    /// Whether to fail on network configuration which can't be applied.
+    strict_network: bool,
+    /// Retries of failed reads from the config-drive.
+    read_retry: drive::ReadRetry,
+}
+
+impl MetalProvider {
+    /// Try to build a new provider client.
+    ///
+    /// This internally tries to mount (and own) the config-drive.
+    pub fn try_new() -> Result<Self> {
+        let target = tempfile::Builder::new()
+            .prefix("afterburn-")
+            .tempdir()
+            .context("failed to create temporary directory")?;
+        crate::util::mount_ro(
+            &Path::new("/dev/disk/by-label/").join(CONFIG_DRIVE_FS_LABEL),
+            target.path(),
+            CONFIG_DRIVE_FS_TYPE,
+            3, // maximum retries
+        )?;
+
+        let mut provider = Self::with_drive_path(target.path().to_owned());
+        provider.temp_dir = Some(target);
+        Ok(provider)
+    }
+
+    /// Build a provider reading from a config-drive already available at `drive_path`.
+    ///
+    /// The config-drive is not unmounted on drop.
+    pub fn with_drive_path(drive_path: PathBuf) -> Self {
+        Self {
+            drive_path,
+            temp_dir: None,
+            strict_network: false,
+            read_retry: drive::ReadRetry::default(),
+        }
+    }
+
+    /// Retry failed reads from the config-drive as configured.
+    pub fn read_retry(mut self, retry: drive::ReadRetry) -> Self {
+        self.read_retry = retry;
+        self
+    }
+
+    /// Fail on network configuration which can't be applied, instead of skipping it.
+    pub fn strict_network(mut self, strict: bool) -> Self {
+        self.strict_network = strict;
+        self
+    }
+
+    /// Return the path to the metadata directory.
+    fn metadata_dir(&self) -> PathBuf {
+        self.drive_path.join("openstack").join("latest")
+    }
+
+    /// Read and parse metadata file.
+    fn read_metadata(&self) -> Result<Map<String, Value>> {
+        let filename = self.metadata_dir().join("meta_data.json");
+        let contents = drive::read_file(&filename, self.read_retry)?;
+        Self::parse_metadata(BufReader::new(contents.as_slice()))
+            .with_context(|| format!("failed to parse file '{:?}'", filename))
+    }
+
+    /// Parse metadata, a JSON object with arbitrary keys.
+    fn parse_metadata<T: Read>(input: BufReader<T>) -> Result<Map<String, Value>> {
+        serde_json::from_reader(input).context("failed to parse JSON metadata")
+    }
+
+    /// Read and parse network configuration, which is optional.
+    fn read_network_data(&self) -> Result<NetworkData> {
+        let filename = self.metadata_dir().join("network_data.json");
+        let contents = match drive::read_optional_file(&filename, self.read_retry)? {
+            Some(contents) => contents,
+            None => return Ok(NetworkData::default()),
+        };
+        serde_json::from_slice(&contents)
+            .with_context(|| format!("failed to parse file '{:?}'", filename))
+    }
+
+    /// Convert all top-level scalar metadata entries to attributes.
+    ///
+    /// Keys are upper-cased, with characters not valid in environment
+    /// variable names replaced by `_`. If several keys end up the same,
+    /// the first one in lexical order wins.
+    fn attributes_from(metadata: &Map<String, Value>) -> HashMap<String, String> {
+        let mut out = HashMap::with_capacity(metadata.len());
+        let mut keys: Vec<&String> = metadata.keys().collect();
+        keys.sort();
+        for key in keys {
+            let value = match &metadata[key] {
+                Value::String(s) => s.clone(),
+                Value::Number(n) => n.to_string(),
+                Value::Bool(b) => b.to_string(),
+                Value::Null | Value::Array(_) | Value::Object(_) => continue,
+            };
+            let name: String = key
+                .chars()
+                .map(|c| {
+                    if c.is_ascii_alphanumeric() {
+                        c.to_ascii_uppercase()
+                    } else {
+                        '_'
+                    }
+                })
+                .collect();
+            let name = format!("METAL_{}", name);
+            if out.contains_key(&name) {
+                warn!("ignoring metadata key '{}', conflicting with {}", key, name);
+                continue;
+            }
+            out.insert(name, value);
+        }
+        out
+    }
+
+    fn hostname_from(metadata: &Map<String, Value>) -> Option<String> {
+        HOSTNAME_KEYS
+            .iter()
+            .filter_map(|key| metadata.get(*key).and_then(Value::as_str))
+            .find(|v| !v.is_empty())
+            .map(String::from)
+    }
+
+    fn ssh_keys_from(metadata: &Map<String, Value>) -> Result<Vec<PublicKey>> {
+        let keys = match metadata.get("public_keys").and_then(Value::as_object) {
+            Some(keys) => keys,
+            None => return Ok(vec![]),
+        };
+        let mut out = Vec::with_capacity(keys.len());
+        for key in keys.values().filter_map(Value::as_str) {
+            out.push(PublicKey::parse(key)?);
+        }
+        Ok(out)
+    }
+}
+
+impl MetadataProvider for MetalProvider {
+    fn attributes(&self) -> Result<HashMap<String, String>> {
+        let metadata = self.read_metadata()?;
+        Ok(Self::attributes_from(&metadata))
+    }
+
+    fn hostname(&self) -> Result<Option<String>> {
+        let metadata = self.read_metadata()?;
+        Ok(Self::hostname_from(&metadata))
+    }
+
+    fn ssh_keys(&self) -> Result<Vec<PublicKey>> {
+        let metadata = self.read_metadata()?;
+        Self::ssh_keys_from(&metadata)
+    }
+
+    fn networks(&self) -> Result<Vec<network::Interface>> {
+        self.read_network_data()?.interfaces(self.strict_network)
+    }
+
+    fn virtual_network_devices(&self) -> Result<Vec<network::VirtualNetDev>> {
+        self.read_network_data()?.virtual_network_devices()
+    }
+
+    fn boot_checkin(&self) -> Result<()> {
+        warn!("boot check-in requested, but not supported on this platform");
+        Ok(())
+    }
+}
+
+impl Drop for MetalProvider {
+    fn drop(&mut self) {
+        if self.temp_dir.is_some() {
+            if let Err(e) = crate::util::unmount(&self.drive_path, 3) {
+                error!("failed to cleanup Metal3 config-drive: {:?}", e);
+            };
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_config_drive() {
+        let provider = MetalProvider::with_drive_path(PathBuf::from("./tests/fixtures/metal"));
+
+        let attributes = provider.attributes().unwrap();
+        let expected = maplit::hashmap! {
+            "METAL_HOSTNAME".to_string() => "worker-0.example.com".to_string(),
+            "METAL_LOCAL_HOSTNAME".to_string() => "worker-0".to_string(),
+            "METAL_METAL3_NAME".to_string() => "worker-0".to_string(),
+            "METAL_METAL3_NAMESPACE".to_string() => "metal3".to_string(),
+            "METAL_NAME".to_string() => "worker-0".to_string(),
+            "METAL_PROVIDERID".to_string() => "metal3://metal3/worker-0/worker-0-8xk2p".to_string(),
+            "METAL_RACK_UNIT".to_string() => "12".to_string(),
+            "METAL_UUID".to_string() => "7a5f1c62-5e5b-4c36-9a3b-3f1f3a7d2c1e".to_string(),
+        };
+        assert_eq!(attributes, expected);
+
+        assert_eq!(
+            provider.hostname().unwrap(),
+            Some("worker-0.example.com".to_string())
+        );
+        assert_eq!(provider.ssh_keys().unwrap().len(), 1);
+
+        let interfaces = provider.networks().unwrap();
+        assert_eq!(interfaces.len(), 1);
+        assert_eq!(interfaces[0].ip_addresses.len(), 1);
+        assert_eq!(interfaces[0].routes.len(), 1);
+        assert_eq!(interfaces[0].nameservers.len(), 1);
+    }
+
+    #[test]
+    fn test_dynamic_attributes() {
+        let metadata = serde_json::json!({
+            "new.field": "second",
+            "new-field": "first",
+            "flag": true,
+            "empty": null,
+            "list": ["a"],
+        });
+        let attributes = MetalProvider::attributes_from(metadata.as_object().unwrap());
+        let expected = maplit::hashmap! {
+            "METAL_FLAG".to_string() => "true".to_string(),
+            "METAL_NEW_FIELD".to_string() => "first".to_string(),
+        };
+        assert_eq!(attributes, expected);
+
+        let metadata = serde_json::json!({"name": "host", "local-hostname": ""});
+        assert_eq!(
+            MetalProvider::hostname_from(metadata.as_object().unwrap()),
+            Some("host".to_string())
+        );
+        assert_eq!(MetalProvider::hostname_from(&Map::new()), None);
+    }
+}
@@ -124,7 +124,7 @@ fn test_boot_checkin() {
         .with_status(200)
         .create();
 
-    let provider = azure::Azure::try_new();
+    let provider = azure::Azure::with_client(None);
     let r = provider.unwrap().boot_checkin();
 
     m_version.assert();
@@ -151,7 +151,7 @@ fn test_hostname() {
         .with_status(200)
         .create();
 
-    let provider = azure::Azure::try_new();
+    let provider = azure::Azure::with_client(None);
     let r = provider.unwrap().hostname().unwrap();
 
     m_version.assert();
@@ -178,16 +178,27 @@ fn test_vmsize() {
         .with_body(testvmsize)
         .with_status(200)
         .create();
+    let m_lb = mockito::mock("GET", "/metadata/loadbalancer?api-version=2020-10-01")
+        .with_status(404)
+        .create();
+    let m_compute = mockito::mock("GET", "/metadata/instance/compute?api-version=2021-02-01")
+        .with_body(r#"{"vmSize": "testvmsize", "priority": "Regular", "evictionPolicy": ""}"#)
+        .with_status(200)
+        .create();
 
-    let provider = azure::Azure::try_new();
+    let provider = azure::Azure::with_client(None);
     let attributes = provider.unwrap().attributes().unwrap();
     let r = attributes.get("AZURE_VMSIZE");
 
     m_version.assert();
 
     m_vmsize.assert();
+    m_lb.assert();
+    m_compute.assert();
     let vmsize = r.unwrap();
     assert_eq!(vmsize, testvmsize);
+    assert!(!attributes.contains_key("AZURE_LB_INBOUND_PORTS"));
+    assert_eq!(attributes["INSTANCE_PREEMPTIBLE"], "false");
 
     mockito::reset();
 
@@ -201,7 +212,7 @@ fn test_goalstate_certs() {
     let m_version = mock_fab_version();
     let m_goalstate = mock_goalstate(true);
 
-    let provider = azure::Azure::try_new().unwrap();
+    let provider = azure::Azure::with_client(None).unwrap();
     let goalstate = provider.fetch_goalstate().unwrap();
 
     m_version.assert();
@@ -219,7 +230,7 @@ fn test_goalstate_no_certs() {
     let m_version = mock_fab_version();
     let m_goalstate = mock_goalstate(false);
 
-    let provider = azure::Azure::try_new().unwrap();
+    let provider = azure::Azure::with_client(None).unwrap();
     let goalstate = provider.fetch_goalstate().unwrap();
 
     m_version.assert();
@@ -229,3 +240,200 @@ fn test_goalstate_no_certs() {
 
     mockito::reset();
 }
+
+#[test]
+fn test_fabric_version() {
+    let m_version = mockito::mock("GET", "/?comp=versions")
+        .match_header("x-ms-version", "2012-09-15")
+        .with_body(
+            r#"<?xml version="1.0" encoding="utf-8"?>
+<Versions>
+  <Supported>
+    <Version>2012-11-30</Version>
+    <Version>2012-09-15</Version>
+  </Supported>
+</Versions>"#,
+        )
+        .with_status(200)
+        .create();
+
+    azure::Azure::with_fabric_version(None, Some("2012-09-15".to_string())).unwrap();
+    m_version.assert();
+
+    // Versions not advertised by the WireServer are rejected.
+    let m_version = mock_fab_version();
+    azure::Azure::with_fabric_version(None, Some("2099-01-01".to_string())).unwrap_err();
+    m_version.assert();
+
+    mockito::reset();
+}
+
+#[test]
+fn test_loadbalancer() {
+    let m_version = mock_fab_version();
+
+    let body = r#"{
+  "loadbalancer": {
+    "publicIpAddresses": [
+      { "frontendIpAddress": "51.0.0.1", "privateIpAddress": "10.1.0.4" },
+      { "frontendIpAddress": "2603:1030::1", "privateIpAddress": "ace:cab:deca::4" },
+      { "frontendIpAddress": "51.0.0.2", "privateIpAddress": "10.1.0.4" }
+    ],
+    "inboundRules": [
+      { "frontendIpAddress": "51.0.0.1", "protocol": "tcp", "frontendPort": 443, "backendPort": 443, "privateIpAddress": "10.1.0.4" },
+      { "frontendIpAddress": "51.0.0.1", "protocol": "tcp", "frontendPort": 80, "backendPort": 8080, "privateIpAddress": "10.1.0.4" },
+      { "frontendIpAddress": "51.0.0.2", "protocol": "udp", "frontendPort": 443, "backendPort": 443, "privateIpAddress": "10.1.0.4" }
+    ],
+    "outboundRules": [
+      { "frontendIpAddress": "51.0.0.1", "privateIpAddress": "10.1.0.4" }
+    ]
+  }
+}"#;
+    let m_lb = mockito::mock("GET", "/metadata/loadbalancer?api-version=2020-10-01")
+        .match_header("Metadata", "true")
+        .with_body(body)
+        .with_status(200)
+        .create();
+
+    let provider = azure::Azure::with_client(None).unwrap();
+    let lb = provider.fetch_loadbalancer().unwrap().unwrap();
+
+    m_version.assert();
+    m_lb.assert();
+
+    let expected = maplit::hashmap! {
+        "AZURE_LB_PUBLIC_IPV4_0".to_string() => "51.0.0.1".to_string(),
+        "AZURE_LB_PUBLIC_IPV4_1".to_string() => "51.0.0.2".to_string(),
+        "AZURE_LB_INBOUND_PORTS".to_string() => "80,443".to_string(),
+    };
+    assert_eq!(lb.attributes(), expected);
+
+    mockito::reset();
+}
+
+#[test]
+fn test_loadbalancer_unavailable() {
+    let m_version = mock_fab_version();
+    let m_vmsize = mockito::mock(
+        "GET",
+        "/metadata/instance/compute/vmSize?api-version=2017-08-01&format=text",
+    )
+    .with_body("testvmsize")
+    .with_status(200)
+    .create();
+    let m_lb = mockito::mock("GET", "/metadata/loadbalancer?api-version=2020-10-01")
+        .with_status(500)
+        .create();
+    let m_compute = mockito::mock("GET", "/metadata/instance/compute?api-version=2021-02-01")
+        .with_body(r#"{"priority": "Regular", "evictionPolicy": ""}"#)
+        .with_status(200)
+        .create();
+
+    let client = crate::retry::Client::try_new().unwrap().max_retries(0);
+    let provider = azure::Azure::with_client(Some(client)).unwrap();
+    let attributes = provider.attributes().unwrap();
+
+    m_version.assert();
+    m_vmsize.assert();
+    m_lb.assert();
+    m_compute.assert();
+    assert_eq!(attributes["AZURE_VMSIZE"], "testvmsize");
+    assert!(!attributes.contains_key("AZURE_LB_INBOUND_PORTS"));
+    assert_eq!(attributes[crate::providers::PREEMPTIBLE_ATTRIBUTE], "false");
+
+    // nor on the scheduling policy
+    mockito::reset();
+    let _m_vmsize = mockito::mock(
+        "GET",
+        "/metadata/instance/compute/vmSize?api-version=2017-08-01&format=text",
+    )
+    .with_body("testvmsize")
+    .with_status(200)
+    .create();
+    let m_compute = mockito::mock("GET", "/metadata/instance/compute?api-version=2021-02-01")
+        .with_status(500)
+        .create();
+    let attributes = provider.attributes().unwrap();
+    m_compute.assert();
+    assert_eq!(attributes["AZURE_VMSIZE"], "testvmsize");
+    assert!(!attributes.contains_key(crate::providers::PREEMPTIBLE_ATTRIBUTE));
+
+    mockito::reset();
+}
+
+#[test]
+fn test_spot_instance() {
+    let m_version = mock_fab_version();
+    let endpoint = "/metadata/instance/compute?api-version=2021-02-01";
+
+    let provider = azure::Azure::with_client(None).unwrap();
+    m_version.assert();
+
+    // spot instances have an eviction policy
+    let m_compute = mockito::mock("GET", endpoint)
+        .match_header("Metadata", "true")
+        .with_body(r#"{"priority": "Spot", "evictionPolicy": "Deallocate"}"#)
+        .with_status(200)
+        .create();
+    let scheduling = provider.fetch_compute_scheduling().unwrap().unwrap();
+    m_compute.assert();
+    assert!(scheduling.is_evictable());
+
+    // older low-priority instances may only report their priority
+    mockito::reset();
+    let _m_compute = mockito::mock("GET", endpoint)
+        .with_body(r#"{"priority": "Low"}"#)
+        .with_status(200)
+        .create();
+    assert!(provider
+        .fetch_compute_scheduling()
+        .unwrap()
+        .unwrap()
+        .is_evictable());
+
+    mockito::reset();
+    let _m_compute = mockito::mock("GET", endpoint)
+        .with_body(r#"{"priority": "Regular", "evictionPolicy": ""}"#)
+        .with_status(200)
+        .create();
+    assert!(!provider
+        .fetch_compute_scheduling()
+        .unwrap()
+        .unwrap()
+        .is_evictable());
+
+    mockito::reset();
+}
+
+#[test]
+fn test_managed_identity_token() {
+    use std::os::unix::fs::PermissionsExt;
+
+    let endpoint = "/metadata/identity/oauth2/token?api-version=2018-02-01&resource=https%3A%2F%2Fmanagement.azure.com%2F";
+    let body = r#"{
+  "access_token": "eyJ0eXAi.fake.token",
+  "expires_in": "3599",
+  "expires_on": "1506484173",
+  "resource": "https://management.azure.com/",
+  "token_type": "Bearer"
+}"#;
+    let m_token = mockito::mock("GET", endpoint)
+        .match_header("Metadata", "true")
+        .with_body(body)
+        .with_status(200)
+        .create();
+
+    let tempdir = tempfile::tempdir().unwrap();
+    let path = tempdir.path().join("token");
+    let client = crate::retry::Client::try_new().unwrap();
+    azure::Azure::write_managed_identity_token(client, "https://management.azure.com/", &path)
+        .unwrap();
+    m_token.assert();
+
+    let content = std::fs::read_to_string(&path).unwrap();
+    assert_eq!(content, "eyJ0eXAi.fake.token");
+    let mode = std::fs::metadata(&path).unwrap().permissions().mode();
+    assert_eq!(mode & 0o777, 0o600);
+
+    mockito::reset();
+}
@@ -19,6 +19,7 @@ use super::goalstate;
 
 use std::collections::HashMap;
 use std::net::IpAddr;
+use std::path::Path;
 
 use anyhow::{anyhow, bail, Context, Result};
 use openssh_keys::PublicKey;
@@ -40,7 +41,12 @@ static HDR_CIPHER_NAME: &str = "x-ms-cipher-name";
 static HDR_CERT: &str = "x-ms-guest-agent-public-x509-cert";
 
 const MS_AGENT_NAME: &str = "com.coreos.afterburn";
+const MS_IDENTITY_API_VERSION: &str = "2018-02-01";
 const MS_VERSION: &str = "2012-11-30";
+
+/// Permissions of the managed identity token file, which holds secrets.
+const TOKEN_FILE_MODE: u32 = 0o600;
+
 const SMIME_HEADER: &str = "\
 MIME-Version:1.0
 Content-Disposition: attachment; filename=/home/core/encrypted-ssh-cert.pem
@@ -91,6 +97,7 @@ struct Supported {
 #[derive(Debug, Clone)]
 pub struct Azure {
     client: retry::Client,
+    imds_client: retry::Client,
     endpoint: IpAddr,
 }
 
@@ -100,29 +107,124 @@ struct Attributes {
     pub dynamic_ipv4: Option<IpAddr>,
 }
 
+/// Response from the IMDS managed identity token endpoint.
+#[derive(Debug, Deserialize)]
+struct ManagedIdentityToken {
+    pub access_token: String,
+}
+
+/// Scheduling policy of the instance, from the IMDS compute endpoint.
+#[derive(Debug, Deserialize)]
+struct ComputeScheduling {
+    /// `Regular`, `Spot` or `Low`, empty on older instances.
+    #[serde(default)]
+    pub priority: String,
+    /// `Deallocate` or `Delete` for evictable instances, empty otherwise.
+    #[serde(rename = "evictionPolicy", default)]
+    pub eviction_policy: String,
+}
+
+impl ComputeScheduling {
+    /// Whether the instance may be evicted, i.e. is a spot or low-priority one.
+    fn is_evictable(&self) -> bool {
+        !self.eviction_policy.is_empty()
+            || self.priority.eq_ignore_ascii_case("spot")
+            || self.priority.eq_ignore_ascii_case("low")
+    }
+}
+
+/// Response from the IMDS load balancer endpoint.
+#[derive(Debug, Deserialize)]
+struct LoadBalancerMetadata {
+    #[serde(rename = "loadbalancer", default)]
+    pub loadbalancer: LoadBalancer,
+}
+
+#[derive(Debug, Default, Deserialize)]
+struct LoadBalancer {
+    #[serde(rename = "publicIpAddresses", default)]
+    pub public_ip_addresses: Vec<LoadBalancerPublicIp>,
+    #[serde(rename = "inboundRules", default)]
+    pub inbound_rules: Vec<LoadBalancerInboundRule>,
+}
+
+#[derive(Debug, Deserialize)]
+struct LoadBalancerPublicIp {
+    #[serde(rename = "frontendIpAddress")]
+    pub frontend_ip_address: IpAddr,
+}
+
+#[derive(Debug, Deserialize)]
+struct LoadBalancerInboundRule {
+    #[serde(rename = "frontendPort")]
+    pub frontend_port: u16,
+}
+
+impl LoadBalancer {
+    /// Translate load balancer metadata into attributes.
+    fn attributes(&self) -> HashMap<String, String> {
+        let mut out = HashMap::new();
+
+        let ipv4_addrs = self
+            .public_ip_addresses
+            .iter()
+            .map(|ip| ip.frontend_ip_address)
+            .filter(IpAddr::is_ipv4);
+        for (i, addr) in ipv4_addrs.enumerate() {
+            out.insert(format!("AZURE_LB_PUBLIC_IPV4_{}", i), addr.to_string());
+        }
+
+        let mut ports: Vec<u16> = self
+            .inbound_rules
+            .iter()
+            .map(|rule| rule.frontend_port)
+            .collect();
+        ports.sort_unstable();
+        ports.dedup();
+        if !ports.is_empty() {
+            let ports: Vec<String> = ports.iter().map(u16::to_string).collect();
+            out.insert("AZURE_LB_INBOUND_PORTS".to_string(), ports.join(","));
+        }
+
+        out
+    }
+}
+
 impl Azure {
-    /// Try to build a new provider agent for Azure.
-    ///
-    /// This internally tries to reach the WireServer and verify compatibility.
-    pub fn try_new() -> Result<Self> {
-        Self::with_client(None)
+    /// Try to build a new provider agent for Azure, with a given client,
+    /// using a specific WireServer API version instead of the default one.
+    pub fn with_fabric_version(
+        client: Option<retry::Client>,
+        version: Option<String>,
+    ) -> Result<Self> {
+        match version {
+            Some(version) => {
+                let wireserver_ip = Azure::get_fabric_address();
+                Self::verify_platform(client, wireserver_ip, &version)
+            }
+            None => Self::with_client(client),
+        }
     }
 
     /// Try to build a new provider agent for Azure, with a given client.
+    ///
+    /// This internally tries to reach the WireServer and verify compatibility.
     pub(crate) fn with_client(client: Option<retry::Client>) -> Result<Azure> {
         let wireserver_ip = Azure::get_fabric_address();
-        Self::verify_platform(client, wireserver_ip)
+        Self::verify_platform(client, wireserver_ip, MS_VERSION)
     }
 
     /// Try to reach cloud endpoint to ensure we are on a compatible Azure platform.
     pub(crate) fn verify_platform(
         client: Option<retry::Client>,
         endpoint: IpAddr,
+        fabric_version: &str,
     ) -> Result<Azure> {
         let mut client = match client {
             Some(c) => c,
             None => retry::Client::try_new()?,
         };
+        let imds_client = Self::imds_client(client.clone());
 
         // Add headers required by API.
         client = client
@@ -132,14 +234,18 @@ impl Azure {
             )
             .header(
                 HeaderName::from_static(HDR_VERSION),
-                HeaderValue::from_static(MS_VERSION),
+                HeaderValue::from_str(fabric_version).context("invalid fabric version")?,
             );
 
-        let azure = Azure { client, endpoint };
+        let azure = Azure {
+            client,
+            imds_client,
+            endpoint,
+        };
 
         // Make sure WireServer API version is compatible with our logic.
         azure
-            .is_fabric_compatible(MS_VERSION)
+            .is_fabric_compatible(fabric_version)
             .map_err(|e| {
                 let is_root = Uid::current().is_root();
                 if !is_root {
@@ -179,7 +285,8 @@ impl Azure {
 
     #[cfg(not(test))]
     fn get_fabric_address_from_dhcp() -> Result<IpAddr> {
-        let v = crate::util::dns_lease_key_lookup("OPTION_245")?;
+        // the WireServer address is in the private DHCP option 245
+        let v = crate::util::dhcp_option_lookup(245)?;
         // value is an 8 digit hex value. convert it to u32 and
         // then parse that into an ip. Ipv4Addr::from(u32)
         // performs conversion from big-endian
@@ -303,16 +410,7 @@ impl Azure {
         use std::net::SocketAddr;
 
         let goalstate = self.fetch_goalstate()?;
-        let endpoint = &goalstate.container.role_instance_list.role_instances[0]
-            .configuration
-            .shared_config;
-
-        let shared_config: goalstate::SharedConfig = self
-            .client
-            .get(retry::Xml, endpoint.to_string())
-            .send()
-            .context("failed to get shared configuration")?
-            .ok_or_else(|| anyhow!("failed to get shared configuration: not found"))?;
+        let shared_config = self.fetch_shared_config(&goalstate)?;
 
         let mut attributes = Attributes::default();
 
@@ -334,15 +432,45 @@ impl Azure {
         Ok(attributes)
     }
 
+    fn fetch_shared_config(
+        &self,
+        goalstate: &goalstate::GoalState,
+    ) -> Result<goalstate::SharedConfig> {
+        let endpoint = &goalstate
+            .role_instance(None)
+            .ok_or_else(|| anyhow!("empty RoleInstanceList"))?
+            .configuration
+            .shared_config;
+
+        self.client
+            .get(retry::Xml, endpoint.to_string())
+            .send()
+            .context("failed to get shared configuration")?
+            .ok_or_else(|| anyhow!("failed to get shared configuration: not found"))
+    }
+
+    /// Find the role instance of this VM in the goal state.
+    ///
+    /// When the goal state lists several role instances, the shared
+    /// configuration tells which one is ours.
+    fn local_role_instance<'a>(
+        &self,
+        goalstate: &'a goalstate::GoalState,
+    ) -> Result<Option<&'a goalstate::RoleInstance>> {
+        let name = if goalstate.container.role_instance_list.role_instances.len() > 1 {
+            Some(self.fetch_shared_config(goalstate)?.incarnation.instance)
+        } else {
+            None
+        };
+        Ok(goalstate.role_instance(name.as_deref()))
+    }
+
     fn fetch_hostname(&self) -> Result<Option<String>> {
         const NAME_URL: &str = "metadata/instance/compute/name?api-version=2017-08-01&format=text";
         let url = format!("{}/{}", Self::metadata_endpoint(), NAME_URL);
 
-        let name = retry::Client::try_new()?
-            .header(
-                HeaderName::from_static("metadata"),
-                HeaderValue::from_static("true"),
-            )
+        let name = self
+            .imds_client
             .get(retry::Raw, url)
             .send()
             .context("failed to get hostname")?;
@@ -354,26 +482,95 @@ impl Azure {
             "metadata/instance/compute/vmSize?api-version=2017-08-01&format=text";
         let url = format!("{}/{}", Self::metadata_endpoint(), VMSIZE_URL);
 
-        let vmsize = retry::Client::try_new()?
-            .header(
-                HeaderName::from_static("metadata"),
-                HeaderValue::from_static("true"),
-            )
+        let vmsize = self
+            .imds_client
             .get(retry::Raw, url)
             .send()?
             .context("failed to get vmsize")?;
         Ok(vmsize)
     }
 
+    /// Fetch the scheduling policy of the instance.
+    fn fetch_compute_scheduling(&self) -> Result<Option<ComputeScheduling>> {
+        const COMPUTE_URL: &str = "metadata/instance/compute?api-version=2021-02-01";
+        let url = format!("{}/{}", Self::metadata_endpoint(), COMPUTE_URL);
+
+        let scheduling = self
+            .imds_client
+            .clone()
+            .return_on_404(true)
+            .get(retry::Json, url)
+            .send()
+            .context("failed to get compute metadata")?;
+        Ok(scheduling)
+    }
+
+    /// Fetch load balancer metadata, if the instance is behind a load balancer.
+    fn fetch_loadbalancer(&self) -> Result<Option<LoadBalancer>> {
+        const LB_URL: &str = "metadata/loadbalancer?api-version=2020-10-01";
+        let url = format!("{}/{}", Self::metadata_endpoint(), LB_URL);
+
+        let lb: Option<LoadBalancerMetadata> = self
+            .imds_client
+            .clone()
+            .return_on_404(true)
+            .get(retry::Json, url)
+            .send()
+            .context("failed to get load balancer metadata")?;
+        Ok(lb.map(|v| v.loadbalancer))
+    }
+
+    /// Add headers required by the Instance Metadata Service to a client.
+    fn imds_client(client: retry::Client) -> retry::Client {
+        client.header(
+            HeaderName::from_static("metadata"),
+            HeaderValue::from_static("true"),
+        )
+    }
+
+    /// Fetch a managed identity access token for the given resource.
+    fn fetch_managed_identity_token(client: retry::Client, resource: &str) -> Result<String> {
+        let mut url = reqwest::Url::parse(&Self::metadata_endpoint())
+            .and_then(|base| base.join("metadata/identity/oauth2/token"))
+            .context("failed to build managed identity token URL")?;
+        url.query_pairs_mut()
+            .append_pair("api-version", MS_IDENTITY_API_VERSION)
+            .append_pair("resource", resource);
+
+        let token: ManagedIdentityToken = Self::imds_client(client)
+            .get(retry::Json, url.to_string())
+            .send()
+            .context("failed to get managed identity token")?
+            .ok_or_else(|| anyhow!("failed to get managed identity token: not found"))?;
+        Ok(token.access_token)
+    }
+
+    /// Write a managed identity access token for the given resource to a
+    /// file only readable by its owner, fetching it with the given client.
+    ///
+    /// The token is sensitive, so it is never exposed as an attribute.
+    pub fn write_managed_identity_token(
+        client: retry::Client,
+        resource: &str,
+        path: &Path,
+    ) -> Result<()> {
+        let token = Self::fetch_managed_identity_token(client, resource)?;
+        crate::providers::write_file_atomic(path, token.as_bytes(), TOKEN_FILE_MODE)?;
+        Ok(())
+    }
+
     /// Report ready state to the WireServer.
     ///
     /// This is used to signal to the cloud platform that the VM has
     /// booted into userland. The definition of "ready" is fuzzy.
     fn report_ready_state(&self) -> Result<()> {
         let goalstate = self.fetch_goalstate()?;
+        let role = self
+            .local_role_instance(&goalstate)?
+            .ok_or_else(|| anyhow!("empty RoleInstanceList"))?;
         let body = ready_state!(
             goalstate.container_id(),
-            goalstate.instance_id()?,
+            &role.instance_id,
             goalstate.incarnation()
         );
         let url = self.fabric_base_url() + "/machine/?comp=health";
@@ -400,6 +597,25 @@ impl MetadataProvider for Azure {
 
         out.insert("AZURE_VMSIZE".to_string(), vmsize);
 
+        // load balancer metadata is informational, don't fail on it
+        match self.fetch_loadbalancer() {
+            Ok(Some(lb)) => out.extend(lb.attributes()),
+            Ok(None) => {}
+            Err(e) => warn!("failed to fetch load balancer metadata: {}", e),
+        }
+
+        // so is the scheduling policy
+        match self.fetch_compute_scheduling() {
+            Ok(Some(scheduling)) => {
+                out.insert(
+                    crate::providers::PREEMPTIBLE_ATTRIBUTE.to_string(),
+                    scheduling.is_evictable().to_string(),
+                );
+            }
+            Ok(None) => {}
+            Err(e) => warn!("failed to fetch compute metadata: {}", e),
+        }
+
         Ok(out)
     }
 
@@ -409,7 +625,10 @@ impl MetadataProvider for Azure {
 
     fn ssh_keys(&self) -> Result<Vec<PublicKey>> {
         let goalstate = self.fetch_goalstate()?;
-        let certs_endpoint = match goalstate.certs_endpoint() {
+        let certs_endpoint = match self
+            .local_role_instance(&goalstate)?
+            .and_then(|role| role.configuration.certificates.clone())
+        {
             Some(ep) => ep,
             None => {
                 warn!("SSH pubkeys requested, but not provisioned for this instance");
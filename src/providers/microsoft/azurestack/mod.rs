@@ -90,6 +90,7 @@ struct Supported {
 #[derive(Debug, Clone)]
 pub struct AzureStack {
     client: retry::Client,
+    imds_client: retry::Client,
     endpoint: IpAddr,
 }
 
@@ -123,6 +124,10 @@ impl AzureStack {
             Some(c) => c,
             None => retry::Client::try_new()?,
         };
+        let imds_client = client.clone().header(
+            HeaderName::from_static("metadata"),
+            HeaderValue::from_static("true"),
+        );
 
         // Add headers required by API.
         client = client
@@ -135,7 +140,11 @@ impl AzureStack {
                 HeaderValue::from_static(MS_VERSION),
             );
 
-        let azure_stack = AzureStack { client, endpoint };
+        let azure_stack = AzureStack {
+            client,
+            imds_client,
+            endpoint,
+        };
 
         // Make sure WireServer API version is compatible with our logic.
         azure_stack
@@ -167,14 +176,10 @@ impl AzureStack {
             .ok_or_else(|| anyhow!("failed to get goal state: not found response"))
     }
 
-    fn fetch_identity() -> Result<InstanceMetadata> {
+    fn fetch_identity(&self) -> Result<InstanceMetadata> {
         const NAME_URL: &str = "Microsoft.Compute/identity?api-version=2019-03-11";
         let url = format!("{}/{}", Self::metadata_endpoint(), NAME_URL);
-        retry::Client::try_new()?
-            .header(
-                HeaderName::from_static("metadata"),
-                HeaderValue::from_static("true"),
-            )
+        self.imds_client
             .get(retry::Json, url)
             .send()
             .context("failed to get metadata JSON")?
@@ -193,7 +198,8 @@ impl AzureStack {
 
     #[cfg(not(test))]
     fn get_fabric_address_from_dhcp() -> Result<IpAddr> {
-        let v = crate::util::dns_lease_key_lookup("OPTION_245")?;
+        // the WireServer address is in the private DHCP option 245
+        let v = crate::util::dhcp_option_lookup(245)?;
         // value is an 8 digit hex value. convert it to u32 and
         // then parse that into an ip. Ipv4Addr::from(u32)
         // performs conversion from big-endian
@@ -305,7 +311,7 @@ impl AzureStack {
     }
 
     fn fetch_hostname(&self) -> Result<Option<String>> {
-        let instance_metadata = AzureStack::fetch_identity()?;
+        let instance_metadata = self.fetch_identity()?;
         Ok(Some(instance_metadata.vm_name))
     }
 
@@ -14,7 +14,7 @@ pub(crate) struct GoalState {
 impl GoalState {
     /// Return the certificates endpoint (if any).
     pub(crate) fn certs_endpoint(&self) -> Option<String> {
-        let role = match self.container.role_instance_list.role_instances.get(0) {
+        let role = match self.role_instance(None) {
             Some(r) => r,
             None => return None,
         };
@@ -22,6 +22,16 @@ impl GoalState {
         role.configuration.certificates.clone()
     }
 
+    /// Return the role instance named `instance`, as reported by the shared
+    /// configuration. Falls back to the first role instance if there is no
+    /// such name or no match.
+    pub(crate) fn role_instance(&self, instance: Option<&str>) -> Option<&RoleInstance> {
+        let roles = &self.container.role_instance_list.role_instances;
+        instance
+            .and_then(|name| roles.iter().find(|r| r.has_name(name)))
+            .or_else(|| roles.get(0))
+    }
+
     /// Return this instance `ContainerId`.
     pub(crate) fn container_id(&self) -> &str {
         &self.container.container_id
@@ -66,6 +76,15 @@ pub(crate) struct RoleInstance {
     pub instance_id: String,
 }
 
+impl RoleInstance {
+    /// Whether this is the role instance with the given name.
+    ///
+    /// `InstanceId` is either the bare name or `<deployment>.<name>`.
+    fn has_name(&self, name: &str) -> bool {
+        self.instance_id == name || self.instance_id.ends_with(&format!(".{}", name))
+    }
+}
+
 #[derive(Debug, Deserialize, Clone)]
 pub(crate) struct Configuration {
     #[serde(rename = "Certificates")]
@@ -118,3 +137,72 @@ pub(crate) struct Endpoint {
     #[serde(rename = "loadBalancedPublicAddress", default)]
     pub load_balanced_public_address: String,
 }
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_role_instance() {
+        let body = r#"<?xml version="1.0" encoding="utf-8"?>
+<GoalState>
+  <Incarnation>2</Incarnation>
+  <Container>
+    <ContainerId>a511aa6d-29e7-4f53-8788-55655dfe848f</ContainerId>
+    <RoleInstanceList>
+      <RoleInstance>
+        <InstanceId>f6cd1d7ef1644557b9059345e5ba890c.lars-test-0</InstanceId>
+        <Configuration>
+          <SharedConfig>http://100.115.176.3:80/shared-0</SharedConfig>
+          <Certificates>http://100.115.176.3:80/certs-0</Certificates>
+        </Configuration>
+      </RoleInstance>
+      <RoleInstance>
+        <InstanceId>f6cd1d7ef1644557b9059345e5ba890c.lars-test-1</InstanceId>
+        <Configuration>
+          <SharedConfig>http://100.115.176.3:80/shared-1</SharedConfig>
+          <Certificates>http://100.115.176.3:80/certs-1</Certificates>
+        </Configuration>
+      </RoleInstance>
+    </RoleInstanceList>
+  </Container>
+</GoalState>
+"#;
+        let goalstate: GoalState = serde_xml_rs::from_str(body).unwrap();
+        let certs = |instance| {
+            goalstate
+                .role_instance(instance)
+                .unwrap()
+                .configuration
+                .certificates
+                .clone()
+                .unwrap()
+        };
+
+        assert_eq!(
+            certs(Some("lars-test-1")),
+            "http://100.115.176.3:80/certs-1"
+        );
+        assert_eq!(
+            certs(Some("f6cd1d7ef1644557b9059345e5ba890c.lars-test-1")),
+            "http://100.115.176.3:80/certs-1"
+        );
+        // no partial matches
+        assert_eq!(certs(Some("test-1")), "http://100.115.176.3:80/certs-0");
+        assert_eq!(
+            certs(Some("lars-test-2")),
+            "http://100.115.176.3:80/certs-0"
+        );
+        assert_eq!(certs(None), "http://100.115.176.3:80/certs-0");
+        assert_eq!(
+            goalstate.certs_endpoint().unwrap(),
+            "http://100.115.176.3:80/certs-0"
+        );
+
+        let empty = GoalState {
+            container: Container::default(),
+            incarnation: "1".to_string(),
+        };
+        assert!(empty.role_instance(Some("lars-test-1")).is_none());
+    }
+}
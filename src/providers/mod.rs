@@ -31,28 +31,41 @@ pub mod exoscale;
 pub mod gcp;
 pub mod ibmcloud;
 pub mod ibmcloud_classic;
+pub mod linode;
+pub mod metal;
 pub mod microsoft;
 pub mod openstack;
 pub mod packet;
+pub mod qemu;
+pub mod scaleway;
 pub mod vmware;
 pub mod vultr;
 
 use crate::network;
-use anyhow::{anyhow, Context, Result};
+use crate::retry;
+use anyhow::{anyhow, bail, Context, Result};
 use libsystemd::logging;
 use openssh_keys::PublicKey;
-use slog_scope::warn;
-use std::collections::HashMap;
+use pnet_base::MacAddr;
+use serde_derive::Serialize;
+use slog_scope::{debug, info, warn};
+use std::borrow::Cow;
+use std::collections::{BTreeMap, HashMap};
 use std::fs::{self, File};
 use std::io::prelude::*;
-use std::path::Path;
+use std::net::IpAddr;
+use std::os::unix::fs::PermissionsExt;
+use std::path::{Path, PathBuf};
+use std::str::FromStr;
 use users::{self, User};
 
 /// Message ID marker for authorized-keys entries in journal.
 const AFTERBURN_SSH_AUTHORIZED_KEYS_MESSAGEID: &str = "0f7d7a502f2d433caa1323440a6b4190";
 
-fn create_file(filename: &str) -> Result<File> {
-    let file_path = Path::new(&filename);
+/// Message ID marker for metadata summary entries in journal.
+const AFTERBURN_METADATA_SUMMARY_MESSAGEID: &str = "ea2ed9c69cdc4fe9956126e611095607";
+
+fn create_file(file_path: &Path) -> Result<File> {
     // create the directories if they don't exist
     let folder = file_path
         .parent()
@@ -63,6 +76,84 @@ fn create_file(filename: &str) -> Result<File> {
     File::create(file_path).with_context(|| format!("failed to create file {:?}", file_path))
 }
 
+/// Check whether a file already exists with exactly the given contents.
+fn is_unchanged(file_path: &Path, contents: &[u8]) -> bool {
+    match fs::read(file_path) {
+        Ok(existing) => existing == contents,
+        Err(_) => false,
+    }
+}
+
+/// Write a file, unless it already holds the given contents.
+///
+/// Leaving identical files untouched avoids triggering path watchers
+/// and restarts of dependent units on re-runs. Returns whether the file
+/// was written.
+fn write_file_if_changed(file_path: &Path, contents: &[u8]) -> Result<bool> {
+    if is_unchanged(file_path, contents) {
+        info!("file {:?} unchanged", file_path);
+        return Ok(false);
+    }
+    let mut file = create_file(file_path)?;
+    file.write_all(contents)
+        .with_context(|| format!("failed to write to file {:?}", file_path))?;
+    Ok(true)
+}
+
+/// Default permissions of the attributes file.
+pub const ATTRIBUTES_FILE_MODE: u32 = 0o644;
+
+/// Permissions of the user data file, which may hold secrets.
+const USER_DATA_FILE_MODE: u32 = 0o600;
+
+/// Permissions of the marker file written once the hostname is applied.
+const HOSTNAME_MARKER_FILE_MODE: u32 = 0o644;
+
+/// Atomically replace a file with the given contents and permissions,
+/// unless it already matches them.
+///
+/// Returns whether the file was written.
+fn write_file_atomic(file_path: &Path, contents: &[u8], mode: u32) -> Result<bool> {
+    let same_mode = fs::metadata(file_path)
+        .map(|m| m.permissions().mode() & 0o7777 == mode)
+        .unwrap_or(false);
+    if same_mode && is_unchanged(file_path, contents) {
+        info!("file {:?} unchanged", file_path);
+        return Ok(false);
+    }
+
+    let folder = file_path
+        .parent()
+        .ok_or_else(|| anyhow!("could not get parent directory of {:?}", file_path))?;
+    fs::create_dir_all(&folder)
+        .with_context(|| format!("failed to create directory {:?}", folder))?;
+
+    let mut temp_file = tempfile::Builder::new()
+        .prefix(".afterburn-")
+        .tempfile_in(&folder)
+        .context("failed to create temporary file")?;
+    temp_file
+        .write_all(contents)
+        .and_then(|_| {
+            temp_file
+                .as_file()
+                .set_permissions(fs::Permissions::from_mode(mode))
+        })
+        .and_then(|_| temp_file.as_file().sync_all())
+        .with_context(|| format!("failed to write to file {:?}", temp_file.path()))?;
+
+    // atomically rename to destination
+    // don't leak temporary file on error
+    temp_file
+        .persist(file_path)
+        .map_err(|e| {
+            e.file.close().ok();
+            e.error
+        })
+        .with_context(|| format!("failed to persist file {:?}", file_path))?;
+    Ok(true)
+}
+
 /// Add a message to the journal logging SSH key additions; this
 /// will be used by at least Fedora CoreOS to display in the console
 /// if no ssh keys are present.
@@ -78,7 +169,454 @@ fn write_ssh_key_journal_entry(log: logging::Priority, name: &str, path: &str) {
     }
 }
 
-fn write_ssh_keys(user: User, ssh_keys: Vec<PublicKey>) -> Result<()> {
+/// Summary of the metadata applied to this instance.
+#[derive(Debug, Default)]
+pub struct MetadataSummary {
+    pub provider: String,
+    pub hostname: Option<String>,
+    pub ssh_keys: Option<usize>,
+    pub network_interfaces: Option<usize>,
+}
+
+impl MetadataSummary {
+    /// Return the journal message and structured fields for this summary.
+    fn journal_entry(&self) -> (String, Vec<(&'static str, String)>) {
+        let mut message = format!("applied metadata from provider {}", self.provider);
+        let mut fields = vec![
+            ("AFTERBURN_PROVIDER", self.provider.clone()),
+            (
+                "MESSAGE_ID",
+                AFTERBURN_METADATA_SUMMARY_MESSAGEID.to_string(),
+            ),
+        ];
+        if let Some(ref hostname) = self.hostname {
+            message.push_str(&format!(", hostname: {}", hostname));
+            fields.push(("AFTERBURN_HOSTNAME", hostname.clone()));
+        }
+        if let Some(count) = self.ssh_keys {
+            message.push_str(&format!(", ssh keys: {}", count));
+            fields.push(("AFTERBURN_SSH_KEYS", count.to_string()));
+        }
+        if let Some(count) = self.network_interfaces {
+            message.push_str(&format!(", network interfaces: {}", count));
+            fields.push(("AFTERBURN_NETWORK_INTERFACES", count.to_string()));
+        }
+        (message, fields)
+    }
+
+    /// Add a structured message to the journal, for auditing purposes.
+    ///
+    /// If the journal can't be reached, the summary is logged instead.
+    pub fn write_journal_entry(&self) {
+        let (message, fields) = self.journal_entry();
+        if let Err(e) = logging::journal_send(logging::Priority::Info, &message, fields.into_iter())
+        {
+            warn!("failed to send information to journald: {}", e);
+            info!("{}", message);
+        }
+    }
+}
+
+/// Default name for the SSH authorized keys fragment.
+pub const SSH_KEYS_FRAGMENT_NAME: &str = "afterburn";
+
+/// Check that an SSH authorized keys fragment name is a plain file name.
+pub fn validate_ssh_keys_fragment_name(name: &str) -> Result<()> {
+    if name.is_empty() || name.starts_with('.') || name.contains('/') {
+        bail!("invalid SSH keys fragment name {:?}", name);
+    }
+    Ok(())
+}
+
+/// Return the path of the SSH authorized keys fragment in a home directory.
+fn ssh_keys_fragment_path(home_dir: &Path, fragment_name: &str) -> PathBuf {
+    home_dir
+        .join(".ssh")
+        .join("authorized_keys.d")
+        .join(fragment_name)
+}
+
+/// Default base URL of the link-local metadata server.
+pub const METADATA_BASE_URL: &str = "http://169.254.169.254";
+
+/// Check that a metadata server base URL is an absolute HTTP(S) URL.
+pub fn validate_metadata_base_url(base_url: &str) -> Result<()> {
+    let url = reqwest::Url::parse(base_url)
+        .with_context(|| format!("failed to parse URL {:?}", base_url))?;
+    if url.scheme() != "http" && url.scheme() != "https" {
+        bail!("unsupported URL scheme {:?}", url.scheme());
+    }
+    if url.query().is_some() || url.fragment().is_some() {
+        bail!("URL {:?} must not have a query or fragment", base_url);
+    }
+    Ok(())
+}
+
+/// Return the URL of a metadata API rooted at `path` below `base_url`.
+fn metadata_api_url(base_url: &str, path: &str) -> String {
+    format!("{}/{}", base_url.trim_end_matches('/'), path)
+}
+
+/// Address family preferred for the `<PREFIX>_PRIMARY_IP` attribute.
+#[derive(Clone, Copy, Debug, PartialEq, Eq)]
+pub enum IpPreference {
+    Ipv4,
+    Ipv6,
+}
+
+impl FromStr for IpPreference {
+    type Err = anyhow::Error;
+
+    fn from_str(s: &str) -> Result<Self> {
+        match s {
+            "ipv4" => Ok(IpPreference::Ipv4),
+            "ipv6" => Ok(IpPreference::Ipv6),
+            _ => bail!("unknown IP preference {:?}, expected ipv4 or ipv6", s),
+        }
+    }
+}
+
+/// Attributes holding public addresses, by provider prefix. Each name also
+/// covers its numbered variants (e.g. `IPV4_PUBLIC_0` for `IPV4_PUBLIC`).
+const PUBLIC_IP_ATTRIBUTES: &[(&str, &[&str])] = &[
+    ("ALIYUN", &["IPV4_PUBLIC"]),
+    // IPv6 addresses are globally routable on AWS
+    ("AWS", &["IPV4_PUBLIC", "IPV6"]),
+    ("AZURE", &["LB_PUBLIC_IPV4"]),
+    ("CLOUDSTACK", &["IPV4_PUBLIC"]),
+    ("CUSTOM", &["PUBLIC_IPV4", "PUBLIC_IPV6"]),
+    ("DIGITALOCEAN", &["IPV4_PUBLIC", "IPV6_PUBLIC"]),
+    ("EXOSCALE", &["PUBLIC_IPV4"]),
+    ("GCP", &["IP_EXTERNAL"]),
+    ("OPENSTACK", &["IPV4_PUBLIC", "IPV6_PUBLIC"]),
+    ("PACKET", &["IPV4_PUBLIC", "IPV6_PUBLIC"]),
+    ("SCALEWAY", &["IPV4_PUBLIC", "IPV6_PUBLIC"]),
+    ("VULTR", &["IPV4_PUBLIC", "IPV6_PUBLIC"]),
+];
+
+/// Check whether an attribute name (without its provider prefix) is the
+/// given name, or a numbered variant of it.
+fn is_attribute_or_numbered(key: &str, name: &str) -> bool {
+    match key.strip_prefix(name) {
+        Some("") => true,
+        Some(rest) => rest.strip_prefix('_').map_or(false, |n| {
+            !n.is_empty() && n.bytes().all(|b| b.is_ascii_digit())
+        }),
+        None => false,
+    }
+}
+
+/// Add a `<PREFIX>_PRIMARY_IP` attribute, holding a public address of the
+/// preferred family, or else of the other one.
+///
+/// Candidates are the attributes listed in `PUBLIC_IP_ATTRIBUTES` with an IP
+/// address as value. Among those, the first one by name (i.e. the
+/// unnumbered or `_0` address) wins. `<PREFIX>` is the provider prefix of
+/// the selected attribute.
+pub fn insert_primary_ip(attributes: &mut HashMap<String, String>, preference: IpPreference) {
+    let is_candidate = |key: &str| {
+        PUBLIC_IP_ATTRIBUTES.iter().any(|(prefix, names)| {
+            key.strip_prefix(prefix)
+                .and_then(|k| k.strip_prefix('_'))
+                .map_or(false, |k| {
+                    names.iter().any(|name| is_attribute_or_numbered(k, name))
+                })
+        })
+    };
+    let mut candidates: Vec<(String, IpAddr)> = attributes
+        .iter()
+        .filter(|(k, _)| is_candidate(k))
+        .filter_map(|(k, v)| v.trim().parse().ok().map(|addr| (k.clone(), addr)))
+        .collect();
+    candidates.sort();
+
+    let preferred = |addr: &IpAddr| match preference {
+        IpPreference::Ipv4 => addr.is_ipv4(),
+        IpPreference::Ipv6 => addr.is_ipv6(),
+    };
+    let selected = candidates
+        .iter()
+        .find(|(_, addr)| preferred(addr))
+        .or_else(|| candidates.first());
+    if let Some((key, addr)) = selected {
+        let prefix = key.split('_').next().unwrap_or_default();
+        attributes.insert(format!("{}_PRIMARY_IP", prefix), addr.to_string());
+    }
+}
+
+/// Format of the attributes file.
+#[derive(Clone, Copy, Debug, PartialEq, Eq)]
+pub enum AttributesFormat {
+    /// `AFTERBURN_<NAME>=<value>` lines, for systemd `EnvironmentFile=`.
+    Env,
+    /// A JSON object with the attributes, hostname, SSH keys and network
+    /// interfaces.
+    Json,
+}
+
+impl Default for AttributesFormat {
+    fn default() -> Self {
+        AttributesFormat::Env
+    }
+}
+
+impl FromStr for AttributesFormat {
+    type Err = anyhow::Error;
+
+    fn from_str(s: &str) -> Result<Self> {
+        match s {
+            "env" => Ok(AttributesFormat::Env),
+            "json" => Ok(AttributesFormat::Json),
+            _ => bail!("unknown attributes format {:?}", s),
+        }
+    }
+}
+
+/// Metadata written in the JSON attributes format.
+#[derive(Debug, Serialize)]
+struct MetadataDocument {
+    attributes: BTreeMap<String, String>,
+    hostname: Option<String>,
+    ssh_keys: Vec<String>,
+    network_interfaces: Vec<InterfaceSummary>,
+}
+
+/// Summary of a network interface in the JSON attributes format.
+#[derive(Debug, Serialize)]
+struct InterfaceSummary {
+    name: Option<String>,
+    mac_address: Option<String>,
+    ip_addresses: Vec<String>,
+    nameservers: Vec<String>,
+}
+
+impl From<&network::Interface> for InterfaceSummary {
+    fn from(iface: &network::Interface) -> Self {
+        InterfaceSummary {
+            name: iface.name.clone(),
+            mac_address: iface.mac_address.map(|mac| mac.to_string()),
+            ip_addresses: iface.ip_addresses.iter().map(ToString::to_string).collect(),
+            nameservers: iface.nameservers.iter().map(ToString::to_string).collect(),
+        }
+    }
+}
+
+/// Format a value for a systemd `EnvironmentFile=` (which shells can also
+/// source), quoting it if needed.
+///
+/// Values with control characters (e.g. newlines) can't be represented on a
+/// single line, and are rejected.
+fn env_file_value(value: &str) -> Option<Cow<'_, str>> {
+    if value.chars().any(char::is_control) {
+        return None;
+    }
+    let is_plain = |c: char| c.is_ascii_alphanumeric() || "-_.,:/@%+=".contains(c);
+    if value.chars().all(is_plain) {
+        return Some(Cow::Borrowed(value));
+    }
+    let mut quoted = String::with_capacity(value.len() + 2);
+    quoted.push('"');
+    for c in value.chars() {
+        // characters special within double quotes
+        if "\"\\`$".contains(c) {
+            quoted.push('\\');
+        }
+        quoted.push(c);
+    }
+    quoted.push('"');
+    Some(Cow::Owned(quoted))
+}
+
+/// Sort attributes selected by `filter`, so that identical metadata gives
+/// identical files.
+fn select_attributes(
+    attributes: HashMap<String, String>,
+    filter: &[String],
+) -> BTreeMap<String, String> {
+    attributes
+        .into_iter()
+        .filter(|(k, _)| is_attribute_selected(k, filter))
+        .collect()
+}
+
+/// Source of the hostname applied to the machine.
+#[derive(Clone, Copy, Debug, PartialEq, Eq)]
+pub enum HostnameSource {
+    /// Whatever the provider reports as hostname.
+    ProviderDefault,
+    /// A fully qualified hostname from metadata.
+    Fqdn,
+    /// The provider hostname, without its domain.
+    Short,
+    /// The instance ID.
+    InstanceId,
+}
+
+impl Default for HostnameSource {
+    fn default() -> Self {
+        HostnameSource::ProviderDefault
+    }
+}
+
+impl FromStr for HostnameSource {
+    type Err = anyhow::Error;
+
+    fn from_str(s: &str) -> Result<Self> {
+        match s {
+            "provider-default" => Ok(HostnameSource::ProviderDefault),
+            "fqdn" => Ok(HostnameSource::Fqdn),
+            "short" => Ok(HostnameSource::Short),
+            "instance-id" => Ok(HostnameSource::InstanceId),
+            _ => bail!("unknown hostname source {:?}", s),
+        }
+    }
+}
+
+/// Pick the hostname from the provider hostname and attributes, according
+/// to `source`.
+///
+/// For `Fqdn`, the provider hostname is used if qualified, otherwise the
+/// first qualified value among the non-public `*HOSTNAME` attributes, by
+/// name. If there is none, the provider hostname is kept as is.
+/// For `InstanceId`, the first `*_INSTANCE_ID` attribute by name is used.
+pub fn select_hostname(
+    source: HostnameSource,
+    hostname: Option<String>,
+    attributes: &HashMap<String, String>,
+) -> Option<String> {
+    let sorted: BTreeMap<&String, &String> = attributes.iter().collect();
+    match source {
+        HostnameSource::ProviderDefault => hostname,
+        HostnameSource::Fqdn => {
+            let qualified = hostname
+                .iter()
+                .chain(
+                    sorted
+                        .iter()
+                        .filter(|(k, _)| k.ends_with("HOSTNAME") && !k.contains("PUBLIC"))
+                        .map(|(_, v)| *v),
+                )
+                .find(|name| name.trim_end_matches('.').contains('.'))
+                .cloned();
+            qualified.or(hostname)
+        }
+        HostnameSource::Short => hostname.map(|name| match name.find('.') {
+            Some(index) => name[..index].to_string(),
+            None => name,
+        }),
+        HostnameSource::InstanceId => sorted
+            .iter()
+            .find(|(k, v)| k.ends_with("_INSTANCE_ID") && !v.is_empty())
+            .map(|(_, v)| v.to_string()),
+    }
+}
+
+/// Check whether an attribute is selected by a list of glob patterns.
+///
+/// Patterns apply to the attribute name either with or without the
+/// `AFTERBURN_` prefix. An empty list selects all attributes.
+pub fn is_attribute_selected(name: &str, filter: &[String]) -> bool {
+    filter.is_empty()
+        || filter.iter().any(|pattern| {
+            crate::util::glob_match(pattern, name)
+                || crate::util::glob_match(pattern, &format!("AFTERBURN_{}", name))
+        })
+}
+
+/// Name of the attribute telling whether the instance is a spot or preemptible
+/// one, which the provider may reclaim at any time.
+///
+/// This is not provider-prefixed, so that tooling handling shutdowns can rely
+/// on a single key across providers.
+pub const PREEMPTIBLE_ATTRIBUTE: &str = "INSTANCE_PREEMPTIBLE";
+
+/// Attributes pointing to an `authorized_keys` file with additional SSH keys.
+///
+/// Only attributes defined by providers are listed, as others (e.g. AWS
+/// instance tags) may be set by anyone allowed to tag the instance.
+const SSH_KEYS_URL_ATTRIBUTES: &[&str] = &["METAL_SSH_KEYS_URL"];
+
+/// Select the SSH keys URLs among attributes, as pairs of attribute name
+/// and URL. URLs not using HTTPS are skipped with a warning.
+fn ssh_keys_urls(attributes: &HashMap<String, String>) -> Vec<(&'static str, &str)> {
+    SSH_KEYS_URL_ATTRIBUTES
+        .iter()
+        .filter_map(|name| attributes.get(*name).map(|url| (*name, url.as_str())))
+        .filter(|(name, url)| {
+            let https = url.starts_with("https://");
+            if !https {
+                warn!("ignoring non-HTTPS SSH keys URL {} ({})", url, name);
+            }
+            https
+        })
+        .collect()
+}
+
+/// Append SSH keys from the URLs referenced by `SSH_KEYS_URL` attributes.
+///
+/// Keys already present are not duplicated. URLs which can't be fetched
+/// are skipped with a warning.
+pub fn append_url_ssh_keys(
+    keys: &mut Vec<PublicKey>,
+    attributes: &HashMap<String, String>,
+    client: Option<retry::Client>,
+) -> Result<()> {
+    let urls = ssh_keys_urls(attributes);
+    if urls.is_empty() {
+        return Ok(());
+    }
+    let client = match client {
+        Some(c) => c,
+        None => retry::Client::try_new()?,
+    };
+    append_ssh_keys_from(keys, &urls, client);
+    Ok(())
+}
+
+/// Append SSH keys from the given URLs, as pairs of attribute name and URL.
+fn append_ssh_keys_from(keys: &mut Vec<PublicKey>, urls: &[(&str, &str)], client: retry::Client) {
+    let client = client.return_on_404(true);
+    for (name, url) in urls {
+        let body: Result<Option<String>> = client.get(retry::Raw, url.to_string()).send();
+        let body = match body {
+            Ok(Some(body)) => body,
+            Ok(None) => {
+                warn!("SSH keys file not found at {} ({})", url, name);
+                continue;
+            }
+            Err(e) => {
+                warn!("failed to fetch SSH keys from {} ({}): {:#}", url, name, e);
+                continue;
+            }
+        };
+        let fetched = match PublicKey::read_keys(body.as_bytes()) {
+            Ok(fetched) => fetched,
+            Err(e) => {
+                warn!("failed to parse SSH keys from {} ({}): {}", url, name, e);
+                continue;
+            }
+        };
+        for key in fetched {
+            if !keys
+                .iter()
+                .any(|k| k.to_key_format() == key.to_key_format())
+            {
+                keys.push(key);
+            }
+        }
+    }
+}
+
+/// Write SSH keys into the named fragment for the given user, or remove
+/// the fragment if there are no keys.
+///
+/// Returns the path of the written fragment, if any.
+fn write_ssh_keys(
+    user: User,
+    ssh_keys: Vec<PublicKey>,
+    fragment_name: &str,
+    root: Option<&Path>,
+) -> Result<Option<PathBuf>> {
     use std::io::ErrorKind::NotFound;
     use users::os::unix::UserExt;
 
@@ -86,10 +624,16 @@ fn write_ssh_keys(user: User, ssh_keys: Vec<PublicKey>) -> Result<()> {
     let _guard = users::switch::switch_user_group(user.uid(), user.primary_group_id())
         .context("failed to switch user/group")?;
 
-    // get paths
-    let dir_path = user.home_dir().join(".ssh").join("authorized_keys.d");
-    let file_name = "afterburn";
-    let file_path = &dir_path.join(file_name);
+    // get paths, relative to the output root if any
+    let home_dir = match root {
+        Some(root) => crate::util::join_root(root, user.home_dir()),
+        None => user.home_dir().to_path_buf(),
+    };
+    let file_path = &ssh_keys_fragment_path(&home_dir, fragment_name);
+    let written = !ssh_keys.is_empty();
+    let dir_path = file_path
+        .parent()
+        .ok_or_else(|| anyhow!("invalid SSH keys fragment path {:?}", file_path))?;
 
     if !ssh_keys.is_empty() {
         // ensure directory exists
@@ -98,7 +642,7 @@ fn write_ssh_keys(user: User, ssh_keys: Vec<PublicKey>) -> Result<()> {
 
         // create temporary file
         let mut temp_file = tempfile::Builder::new()
-            .prefix(&format!(".{}-", file_name))
+            .prefix(&format!(".{}-", fragment_name))
             .tempfile_in(&dir_path)
             .context("failed to create temporary file")?;
 
@@ -148,7 +692,11 @@ fn write_ssh_keys(user: User, ssh_keys: Vec<PublicKey>) -> Result<()> {
     // make clippy happy while fulfilling our interface
     drop(user);
 
-    Ok(())
+    Ok(if written {
+        Some(file_path.to_path_buf())
+    } else {
+        None
+    })
 }
 
 pub trait MetadataProvider {
@@ -189,68 +737,1027 @@ pub trait MetadataProvider {
         Ok(None)
     }
 
-    fn write_attributes(&self, attributes_file_path: String) -> Result<()> {
-        let mut attributes_file = create_file(&attributes_file_path)?;
-        for (k, v) in self.attributes()? {
-            writeln!(&mut attributes_file, "AFTERBURN_{}={}", k, v).with_context(|| {
-                format!("failed to write attributes to file {:?}", attributes_file)
-            })?;
+    /// Return the instance user data, if any.
+    fn user_data(&self) -> Result<Option<String>> {
+        warn!("user data requested, but not supported on this platform");
+        Ok(None)
+    }
+
+    /// Check whether no attributes, hostname, SSH keys, nor network
+    /// interfaces are available from this provider.
+    fn is_empty(&self) -> Result<bool> {
+        Ok(self.attributes()?.is_empty()
+            && self.hostname()?.is_none()
+            && self.ssh_keys()?.is_empty()
+            && self.networks()?.is_empty())
+    }
+
+    /// Atomically write attributes to the given file, with the given permissions.
+    ///
+    /// Attributes are sorted by name, so that the output is reproducible.
+    /// If `filter` is not empty, only attributes selected by its glob
+    /// patterns are written (see `is_attribute_selected`).
+    ///
+    /// Returns the number of attributes written.
+    fn write_attributes(
+        &self,
+        attributes_file_path: String,
+        mode: u32,
+        filter: &[String],
+    ) -> Result<usize> {
+        let attributes = select_attributes(self.attributes()?, filter);
+        debug!("writing attributes: {:?}", attributes.keys());
+        let mut contents = String::new();
+        let mut count = 0;
+        for (k, v) in attributes {
+            match env_file_value(&v) {
+                Some(value) => {
+                    contents.push_str(&format!("AFTERBURN_{}={}\n", k, value));
+                    count += 1;
+                }
+                None => warn!("skipping attribute {} with control characters", k),
+            }
         }
-        Ok(())
+        write_file_atomic(Path::new(&attributes_file_path), contents.as_bytes(), mode)
+            .context("failed to write attributes")?;
+        Ok(count)
+    }
+
+    /// Atomically write attributes to the given file, with the given
+    /// permissions, as a JSON object also holding the hostname, SSH keys
+    /// and network interfaces.
+    ///
+    /// If `filter` is not empty, only attributes selected by its glob
+    /// patterns are written (see `is_attribute_selected`).
+    ///
+    /// Returns the number of attributes written.
+    fn write_attributes_json(
+        &self,
+        attributes_file_path: String,
+        mode: u32,
+        filter: &[String],
+    ) -> Result<usize> {
+        let attributes = select_attributes(self.attributes()?, filter);
+        debug!("writing attributes: {:?}", attributes.keys());
+        let count = attributes.len();
+        // the other fields are informational, and don't fail the attributes
+        let hostname = self.hostname().unwrap_or_else(|e| {
+            warn!("failed to fetch hostname for attributes: {:#}", e);
+            None
+        });
+        let ssh_keys = self.ssh_keys().unwrap_or_else(|e| {
+            warn!("failed to fetch SSH keys for attributes: {:#}", e);
+            vec![]
+        });
+        let networks = self.networks().unwrap_or_else(|e| {
+            warn!("failed to fetch network interfaces for attributes: {:#}", e);
+            vec![]
+        });
+        let document = MetadataDocument {
+            attributes,
+            hostname,
+            ssh_keys: ssh_keys.iter().map(ToString::to_string).collect(),
+            network_interfaces: networks.iter().map(InterfaceSummary::from).collect(),
+        };
+        let mut contents =
+            serde_json::to_string_pretty(&document).context("failed to serialize attributes")?;
+        contents.push('\n');
+        write_file_atomic(Path::new(&attributes_file_path), contents.as_bytes(), mode)
+            .context("failed to write attributes")?;
+        Ok(count)
     }
 
-    fn write_ssh_keys(&self, ssh_keys_user: String) -> Result<()> {
+    /// Write SSH keys for the given user into the named fragment,
+    /// optionally under an output root.
+    ///
+    /// If `selinux_relabel` is set, the default SELinux context of the
+    /// written fragment is restored afterwards.
+    ///
+    /// Returns the number of keys written.
+    fn write_ssh_keys(
+        &self,
+        ssh_keys_user: String,
+        fragment_name: &str,
+        root: Option<&Path>,
+        selinux_relabel: bool,
+    ) -> Result<usize> {
         let ssh_keys = self.ssh_keys()?;
+        let count = ssh_keys.len();
         let user = users::get_user_by_name(&ssh_keys_user)
             .ok_or_else(|| anyhow!("could not find user with username {:?}", ssh_keys_user))?;
 
-        write_ssh_keys(user, ssh_keys)?;
+        // relabel as the current user, once done writing as the target one
+        let written = write_ssh_keys(user, ssh_keys, fragment_name, root)?;
+        if let (true, Some(path)) = (selinux_relabel, written) {
+            crate::util::restorecon(&path).context("failed to relabel SSH keys fragment")?;
+        }
+
+        Ok(count)
+    }
 
+    /// Atomically write user data to the given file, readable by its owner only.
+    ///
+    /// Nothing is written if the instance has no user data.
+    fn write_user_data(&self, user_data_file_path: String) -> Result<()> {
+        match self.user_data()? {
+            Some(user_data) => {
+                write_file_atomic(
+                    Path::new(&user_data_file_path),
+                    user_data.as_bytes(),
+                    USER_DATA_FILE_MODE,
+                )
+                .context("failed to write user data")?;
+            }
+            None => info!("no user data available"),
+        }
         Ok(())
     }
 
-    fn write_hostname(&self, hostname_file_path: String) -> Result<()> {
-        match self.hostname()? {
-            Some(ref hostname) => {
-                let mut hostname_file = create_file(&hostname_file_path)?;
-                writeln!(&mut hostname_file, "{}", hostname).with_context(|| {
-                    format!(
-                        "failed to write hostname {:?} to file {:?}",
-                        hostname, hostname_file
-                    )
-                })
+    /// Write the hostname to the given file.
+    ///
+    /// Once done, the hostname is also written to `applied_marker` (if any),
+    /// which units can watch to order after the hostname is set.
+    ///
+    /// Returns the hostname written, if any.
+    fn write_hostname(
+        &self,
+        hostname_file_path: String,
+        applied_marker: Option<&Path>,
+    ) -> Result<Option<String>> {
+        let hostname = self.hostname()?;
+        if let Some(ref hostname) = hostname {
+            let contents = format!("{}\n", hostname);
+            write_file_if_changed(Path::new(&hostname_file_path), contents.as_bytes())
+                .with_context(|| format!("failed to write hostname {:?}", hostname))?;
+            if let Some(marker) = applied_marker {
+                write_file_atomic(marker, contents.as_bytes(), HOSTNAME_MARKER_FILE_MODE)
+                    .context("failed to write hostname marker")?;
             }
-            None => Ok(()),
         }
+        Ok(hostname)
     }
 
-    fn write_network_units(&self, network_units_dir: String) -> Result<()> {
+    /// Write network units to the given directory.
+    ///
+    /// In strict mode, inconsistent network configuration and interfaces
+    /// which can't be matched are an error instead of a warning.
+    ///
+    /// If `local_macs` is set, interfaces whose MAC address is not among
+    /// them (e.g. a NIC which failed to attach) are skipped.
+    ///
+    /// Returns the number of interfaces for which a unit was written.
+    fn write_network_units(
+        &self,
+        network_units_dir: String,
+        strict: bool,
+        local_macs: Option<&[MacAddr]>,
+    ) -> Result<usize> {
         let dir_path = Path::new(&network_units_dir);
         fs::create_dir_all(&dir_path)
             .with_context(|| format!("failed to create directory {:?}", dir_path))?;
 
+        let interfaces = self.networks()?;
+        if let Err(e) = network::check_address_conflicts(&interfaces) {
+            if strict {
+                return Err(e.context("conflicting network configuration"));
+            }
+            warn!("conflicting network configuration: {}", e);
+        }
+        if let Err(e) = network::check_routes(&interfaces) {
+            if strict {
+                return Err(e.context("invalid network routes"));
+            }
+            warn!("invalid network routes: {}", e);
+        }
+
         // Write `.network` fragments for network interfaces/links.
-        for interface in &self.networks()? {
-            let unit_name = interface.sd_network_unit_name()?;
+        let mut count = 0;
+        for interface in &interfaces {
+            if let Some(macs) = local_macs {
+                if !interface.is_present(macs) {
+                    warn!(
+                        "skipping network interface {}: not present on this host",
+                        interface
+                            .mac_address
+                            .map(|mac| mac.to_string())
+                            .unwrap_or_default()
+                    );
+                    continue;
+                }
+            }
+            // Interfaces that can't be matched by name nor by MAC are skipped,
+            // instead of writing a unit that would match nothing.
+            let unit_name = match interface.sd_network_unit_name() {
+                Ok(name) => name,
+                Err(e) if strict => return Err(e.context("invalid network interface")),
+                Err(e) => {
+                    warn!("skipping network interface: {}", e);
+                    continue;
+                }
+            };
             let file_path = dir_path.join(unit_name);
-            let mut unit_file = File::create(&file_path)
-                .with_context(|| format!("failed to create file {:?}", file_path))?;
-            write!(&mut unit_file, "{}", interface.config()).with_context(|| {
-                format!(
-                    "failed to write network interface unit file {:?}",
-                    unit_file
-                )
-            })?;
+            write_file_if_changed(&file_path, interface.config().as_bytes())
+                .context("failed to write network interface unit file")?;
+            count += 1;
         }
 
         // Write `.netdev` fragments for virtual network devices.
         for device in &self.virtual_network_devices()? {
             let file_path = dir_path.join(device.netdev_unit_name());
-            let mut unit_file = File::create(&file_path)
-                .with_context(|| format!("failed to create netdev unit file {:?}", file_path))?;
-            write!(&mut unit_file, "{}", device.sd_netdev_config())
-                .with_context(|| format!("failed to write netdev unit file {:?}", unit_file))?;
+            write_file_if_changed(&file_path, device.sd_netdev_config().as_bytes())
+                .context("failed to write netdev unit file")?;
         }
-        Ok(())
+        Ok(count)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    struct TestProvider {
+        interfaces: Vec<network::Interface>,
+    }
+
+    impl MetadataProvider for TestProvider {
+        fn networks(&self) -> Result<Vec<network::Interface>> {
+            Ok(self.interfaces.clone())
+        }
+    }
+
+    #[test]
+    fn test_is_empty() {
+        let provider = TestProvider { interfaces: vec![] };
+        assert!(provider.is_empty().unwrap());
+
+        let provider = TestProvider {
+            interfaces: vec![network::Interface {
+                name: Some("eth0".to_string()),
+                mac_address: None,
+                priority: 10,
+                nameservers: vec![],
+                ip_addresses: vec![],
+                routes: vec![],
+                bond: None,
+                vlans: vec![],
+                tunnels: vec![],
+                unmanaged: false,
+                dhcp: false,
+                mtu: None,
+                search_domains: vec![],
+            }],
+        };
+        assert!(!provider.is_empty().unwrap());
+    }
+
+    #[test]
+    fn test_ssh_keys_fragment_path() {
+        let home = Path::new("/home/core");
+        assert_eq!(
+            ssh_keys_fragment_path(home, SSH_KEYS_FRAGMENT_NAME),
+            PathBuf::from("/home/core/.ssh/authorized_keys.d/afterburn")
+        );
+        assert_eq!(
+            ssh_keys_fragment_path(home, "afterburn-aws"),
+            PathBuf::from("/home/core/.ssh/authorized_keys.d/afterburn-aws")
+        );
+
+        validate_ssh_keys_fragment_name("afterburn-aws").unwrap();
+        for name in &["", ".afterburn", "..", "../authorized_keys", "a/b"] {
+            validate_ssh_keys_fragment_name(name).unwrap_err();
+        }
+    }
+
+    struct AttributesProvider {
+        attributes: HashMap<String, String>,
+    }
+
+    impl MetadataProvider for AttributesProvider {
+        fn attributes(&self) -> Result<HashMap<String, String>> {
+            Ok(self.attributes.clone())
+        }
+    }
+
+    #[test]
+    fn test_write_attributes() {
+        use std::os::unix::fs::MetadataExt;
+
+        let dir = tempfile::tempdir().unwrap();
+        let path = dir.path().join("metadata").join("afterburn");
+        let provider = AttributesProvider {
+            attributes: maplit::hashmap! {
+                "TEST_TOKEN".to_string() => "secret".to_string(),
+            },
+        };
+
+        provider
+            .write_attributes(path.to_str().unwrap().to_string(), 0o600, &[])
+            .unwrap();
+        assert_eq!(
+            fs::read_to_string(&path).unwrap(),
+            "AFTERBURN_TEST_TOKEN=secret\n"
+        );
+        let meta = fs::metadata(&path).unwrap();
+        assert_eq!(meta.permissions().mode() & 0o777, 0o600);
+
+        // the file is replaced, not rewritten in place
+        let provider = AttributesProvider {
+            attributes: maplit::hashmap! {
+                "TEST_HOSTNAME".to_string() => "test-hostname".to_string(),
+            },
+        };
+        provider
+            .write_attributes(
+                path.to_str().unwrap().to_string(),
+                ATTRIBUTES_FILE_MODE,
+                &[],
+            )
+            .unwrap();
+        assert_eq!(
+            fs::read_to_string(&path).unwrap(),
+            "AFTERBURN_TEST_HOSTNAME=test-hostname\n"
+        );
+        let new_meta = fs::metadata(&path).unwrap();
+        assert_ne!(new_meta.ino(), meta.ino());
+        assert_eq!(new_meta.permissions().mode() & 0o777, 0o644);
+
+        // no temporary files are left behind
+        let entries = fs::read_dir(path.parent().unwrap()).unwrap().count();
+        assert_eq!(entries, 1);
+    }
+
+    #[test]
+    fn test_write_attributes_filter() {
+        let dir = tempfile::tempdir().unwrap();
+        let path = dir.path().join("afterburn");
+        let provider = AttributesProvider {
+            attributes: maplit::hashmap! {
+                "AWS_IPV4_LOCAL".to_string() => "10.0.0.5".to_string(),
+                "AWS_IPV4_PUBLIC".to_string() => "203.0.113.5".to_string(),
+                "AWS_HOSTNAME".to_string() => "ip-10-0-0-5".to_string(),
+                "AWS_REGION".to_string() => "us-east-1".to_string(),
+            },
+        };
+
+        let filter = vec!["AWS_IPV4_*".to_string(), "AFTERBURN_AWS_REGION".to_string()];
+        provider
+            .write_attributes(
+                path.to_str().unwrap().to_string(),
+                ATTRIBUTES_FILE_MODE,
+                &filter,
+            )
+            .unwrap();
+        assert_eq!(
+            fs::read_to_string(&path).unwrap(),
+            "AFTERBURN_AWS_IPV4_LOCAL=10.0.0.5\nAFTERBURN_AWS_IPV4_PUBLIC=203.0.113.5\nAFTERBURN_AWS_REGION=us-east-1\n"
+        );
+
+        assert!(is_attribute_selected("AWS_HOSTNAME", &[]));
+        assert!(!is_attribute_selected("AWS_HOSTNAME", &filter));
+    }
+
+    #[test]
+    fn test_attributes_formats() {
+        assert_eq!(AttributesFormat::default(), AttributesFormat::Env);
+        assert_eq!(
+            "json".parse::<AttributesFormat>().unwrap(),
+            AttributesFormat::Json
+        );
+        "yaml".parse::<AttributesFormat>().unwrap_err();
+
+        let dir = tempfile::tempdir().unwrap();
+        let path = dir.path().join("afterburn");
+        let path_str = path.to_str().unwrap().to_string();
+        let provider = AttributesProvider {
+            attributes: maplit::hashmap! {
+                "TEST_REGION".to_string() => "us-east-1".to_string(),
+                "TEST_HOSTNAME".to_string() => "test-hostname".to_string(),
+            },
+        };
+
+        // environment file
+        provider
+            .write_attributes(path_str.clone(), ATTRIBUTES_FILE_MODE, &[])
+            .unwrap();
+        assert_eq!(
+            fs::read_to_string(&path).unwrap(),
+            "AFTERBURN_TEST_HOSTNAME=test-hostname\nAFTERBURN_TEST_REGION=us-east-1\n"
+        );
+
+        // JSON document
+        let filter = vec!["TEST_REGION".to_string()];
+        provider
+            .write_attributes_json(path_str, ATTRIBUTES_FILE_MODE, &filter)
+            .unwrap();
+        let contents = fs::read_to_string(&path).unwrap();
+        assert!(contents.ends_with("}\n"));
+        let document: serde_json::Value = serde_json::from_str(&contents).unwrap();
+        assert_eq!(
+            document,
+            serde_json::json!({
+                "attributes": {
+                    "TEST_REGION": "us-east-1",
+                },
+                "hostname": null,
+                "ssh_keys": [],
+                "network_interfaces": [],
+            })
+        );
+
+        // network interface summary
+        let interface = network::Interface {
+            name: Some("eth0".to_string()),
+            mac_address: Some(MacAddr::new(0x02, 0x00, 0x00, 0x00, 0x00, 0x01)),
+            priority: 10,
+            nameservers: vec!["192.0.2.53".parse().unwrap()],
+            ip_addresses: vec!["192.0.2.10/24".parse().unwrap()],
+            routes: vec![],
+            bond: None,
+            vlans: vec![],
+            tunnels: vec![],
+            unmanaged: false,
+            dhcp: false,
+            mtu: None,
+            search_domains: vec![],
+        };
+        assert_eq!(
+            serde_json::to_value(InterfaceSummary::from(&interface)).unwrap(),
+            serde_json::json!({
+                "name": "eth0",
+                "mac_address": "02:00:00:00:00:01",
+                "ip_addresses": ["192.0.2.10/24"],
+                "nameservers": ["192.0.2.53"],
+            })
+        );
+    }
+
+    #[test]
+    fn test_env_file_value() {
+        let cases = vec![
+            ("", Some("")),
+            ("i-0123", Some("i-0123")),
+            ("2001:db8::1", Some("2001:db8::1")),
+            ("a=b", Some("a=b")),
+            ("web server", Some(r#""web server""#)),
+            (
+                r#"it's "quoted" $HOME `id` \"#,
+                Some(r#""it's \"quoted\" \$HOME \`id\` \\""#),
+            ),
+            ("x; rm -rf /", Some(r#""x; rm -rf /""#)),
+            ("foo\nBAR=baz", None),
+            ("foo\rbar", None),
+            ("tab\there", None),
+        ];
+        for (value, expected) in cases {
+            assert_eq!(env_file_value(value).as_deref(), expected, "{:?}", value);
+        }
+
+        // attributes which can't be represented are skipped
+        let dir = tempfile::tempdir().unwrap();
+        let path = dir.path().join("afterburn");
+        let provider = AttributesProvider {
+            attributes: maplit::hashmap! {
+                "AWS_TAG_NAME".to_string() => "foo\nAFTERBURN_AWS_REGION=evil".to_string(),
+                "AWS_TAG_TEAM".to_string() => "web team".to_string(),
+                "AWS_REGION".to_string() => "us-east-1".to_string(),
+            },
+        };
+        provider
+            .write_attributes(
+                path.to_str().unwrap().to_string(),
+                ATTRIBUTES_FILE_MODE,
+                &[],
+            )
+            .unwrap();
+        assert_eq!(
+            fs::read_to_string(&path).unwrap(),
+            "AFTERBURN_AWS_REGION=us-east-1\nAFTERBURN_AWS_TAG_TEAM=\"web team\"\n"
+        );
+    }
+
+    #[test]
+    fn test_unchanged_files() {
+        use std::os::unix::fs::MetadataExt;
+
+        let dir = tempfile::tempdir().unwrap();
+        let path = dir.path().join("afterburn");
+        let provider = AttributesProvider {
+            attributes: maplit::hashmap! {
+                "TEST_HOSTNAME".to_string() => "test-hostname".to_string(),
+            },
+        };
+        let attributes_path = path.to_str().unwrap().to_string();
+        provider
+            .write_attributes(attributes_path.clone(), ATTRIBUTES_FILE_MODE, &[])
+            .unwrap();
+        let ino = fs::metadata(&path).unwrap().ino();
+
+        // identical contents and mode: the file is left alone
+        provider
+            .write_attributes(attributes_path.clone(), ATTRIBUTES_FILE_MODE, &[])
+            .unwrap();
+        assert_eq!(fs::metadata(&path).unwrap().ino(), ino);
+
+        // a different mode is applied
+        provider
+            .write_attributes(attributes_path, 0o600, &[])
+            .unwrap();
+        let meta = fs::metadata(&path).unwrap();
+        assert_ne!(meta.ino(), ino);
+        assert_eq!(meta.permissions().mode() & 0o777, 0o600);
+
+        let unit_path = dir.path().join("00-eth0.network");
+        assert!(write_file_if_changed(&unit_path, b"[Match]\nName=eth0\n").unwrap());
+        assert!(!write_file_if_changed(&unit_path, b"[Match]\nName=eth0\n").unwrap());
+        assert!(write_file_if_changed(&unit_path, b"[Match]\nName=eth1\n").unwrap());
+        assert_eq!(
+            fs::read_to_string(&unit_path).unwrap(),
+            "[Match]\nName=eth1\n"
+        );
+    }
+
+    #[test]
+    fn test_attributes_sorted() {
+        let names = [
+            "ZONE",
+            "HOSTNAME",
+            "REGION",
+            "INSTANCE_ID",
+            "IPV4_PUBLIC",
+            "IPV4_PRIVATE",
+        ];
+        let dir = tempfile::tempdir().unwrap();
+        let mut outputs = Vec::new();
+        for (i, order) in [names.to_vec(), names.iter().rev().cloned().collect()]
+            .iter()
+            .enumerate()
+        {
+            // distinct maps, filled in a different order
+            let provider = AttributesProvider {
+                attributes: order
+                    .iter()
+                    .map(|name| (format!("TEST_{}", name), name.to_lowercase()))
+                    .collect(),
+            };
+            let path = dir.path().join(format!("afterburn-{}", i));
+            provider
+                .write_attributes(
+                    path.to_str().unwrap().to_string(),
+                    ATTRIBUTES_FILE_MODE,
+                    &[],
+                )
+                .unwrap();
+            outputs.push(fs::read(&path).unwrap());
+        }
+        assert_eq!(outputs[0], outputs[1]);
+        assert_eq!(
+            String::from_utf8(outputs[0].clone()).unwrap(),
+            "AFTERBURN_TEST_HOSTNAME=hostname
+AFTERBURN_TEST_INSTANCE_ID=instance_id
+AFTERBURN_TEST_IPV4_PRIVATE=ipv4_private
+AFTERBURN_TEST_IPV4_PUBLIC=ipv4_public
+AFTERBURN_TEST_REGION=region
+AFTERBURN_TEST_ZONE=zone
+"
+        );
+    }
+
+    struct HostnameProvider {
+        hostname: Option<String>,
+    }
+
+    impl MetadataProvider for HostnameProvider {
+        fn hostname(&self) -> Result<Option<String>> {
+            Ok(self.hostname.clone())
+        }
+    }
+
+    #[test]
+    fn test_hostname_marker() {
+        let dir = tempfile::tempdir().unwrap();
+        let path = dir.path().join("hostname");
+        let marker = dir.path().join("run").join("hostname-applied");
+        let provider = HostnameProvider {
+            hostname: Some("test-hostname".to_string()),
+        };
+
+        // failing to write the hostname leaves no marker
+        fs::create_dir(&path).unwrap();
+        provider
+            .write_hostname(path.to_str().unwrap().to_string(), Some(&marker))
+            .unwrap_err();
+        assert!(!marker.exists());
+        fs::remove_dir(&path).unwrap();
+
+        // nor does the lack of hostname
+        let empty = HostnameProvider { hostname: None };
+        empty
+            .write_hostname(path.to_str().unwrap().to_string(), Some(&marker))
+            .unwrap();
+        assert!(!path.exists());
+        assert!(!marker.exists());
+
+        provider
+            .write_hostname(path.to_str().unwrap().to_string(), Some(&marker))
+            .unwrap();
+        assert_eq!(fs::read_to_string(&path).unwrap(), "test-hostname\n");
+        assert_eq!(fs::read_to_string(&marker).unwrap(), "test-hostname\n");
+    }
+
+    #[test]
+    fn test_url_ssh_keys() {
+        let key1 = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIE+7Ikf7Ot5lNN5lJN9ndRvyFeojyeh8W2VqdXc5BQaq user1";
+        let key2 = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOF0FFbhNo8rGnBKxkdVnOAbH6Z4E/rRQ3pGbCZa8X6I user2";
+        let _m = mockito::mock("GET", "/keys")
+            .with_status(200)
+            .with_body(format!("# deploy keys\n{}\n\n{} again\n", key2, key1))
+            .create();
+        let _m404 = mockito::mock("GET", "/missing").with_status(404).create();
+        let _m500 = mockito::mock("GET", "/broken").with_status(500).create();
+
+        // unreachable or missing files don't drop the other keys
+        let broken = format!("{}/broken", mockito::server_url());
+        let keys_url = format!("{}/keys", mockito::server_url());
+        let missing = format!("{}/missing", mockito::server_url());
+        let urls = vec![
+            ("METAL_SSH_KEYS_URL", broken.as_str()),
+            ("METAL_SSH_KEYS_URL", keys_url.as_str()),
+            ("METAL_SSH_KEYS_URL", missing.as_str()),
+        ];
+        let mut keys = vec![PublicKey::parse(key1).unwrap()];
+        let client = retry::Client::try_new().unwrap().max_retries(0);
+        append_ssh_keys_from(&mut keys, &urls, client);
+        let keys: Vec<String> = keys.iter().map(|k| k.to_string()).collect();
+        assert_eq!(keys, vec![key1.to_string(), key2.to_string()]);
+
+        // only provider-defined HTTPS URLs are used, not e.g. instance tags
+        let attributes = maplit::hashmap! {
+            "METAL_SSH_KEYS_URL".to_string() => "https://keys.example.com/root".to_string(),
+            "AWS_TAG_SSH_KEYS_URL".to_string() => "https://attacker.example.com/keys".to_string(),
+            "METAL_DEPLOY_SSH_KEYS_URL".to_string() => "https://attacker.example.com/keys".to_string(),
+            "SSH_KEYS_URL".to_string() => "https://attacker.example.com/keys".to_string(),
+            "METAL_HOSTNAME".to_string() => "host".to_string(),
+        };
+        assert_eq!(
+            ssh_keys_urls(&attributes),
+            vec![("METAL_SSH_KEYS_URL", "https://keys.example.com/root")]
+        );
+        let attributes = maplit::hashmap! {
+            "METAL_SSH_KEYS_URL".to_string() => keys_url.clone(),
+        };
+        assert!(ssh_keys_urls(&attributes).is_empty());
+        let mut keys = vec![];
+        append_url_ssh_keys(&mut keys, &attributes, None).unwrap();
+        assert!(keys.is_empty());
+
+        // no URL attribute, nothing fetched
+        let mut keys = vec![];
+        append_url_ssh_keys(&mut keys, &HashMap::new(), None).unwrap();
+        assert!(keys.is_empty());
+
+        mockito::reset();
+    }
+
+    #[test]
+    fn test_metadata_base_url() {
+        assert_eq!(
+            metadata_api_url(METADATA_BASE_URL, "computeMetadata/v1"),
+            "http://169.254.169.254/computeMetadata/v1"
+        );
+        assert_eq!(
+            metadata_api_url("http://127.0.0.1:8080/", "latest/meta-data"),
+            "http://127.0.0.1:8080/latest/meta-data"
+        );
+
+        validate_metadata_base_url("http://127.0.0.1:8080").unwrap();
+        validate_metadata_base_url("https://metadata.example.com/prefix/").unwrap();
+        for url in &["", "127.0.0.1:8080", "ftp://127.0.0.1", "http://a/?x=1"] {
+            validate_metadata_base_url(url).unwrap_err();
+        }
+    }
+
+    #[test]
+    fn test_metadata_summary() {
+        let summary = MetadataSummary {
+            provider: "packet".to_string(),
+            hostname: Some("test-hostname".to_string()),
+            ssh_keys: Some(2),
+            network_interfaces: None,
+        };
+        let (message, fields) = summary.journal_entry();
+        assert_eq!(
+            message,
+            "applied metadata from provider packet, hostname: test-hostname, ssh keys: 2"
+        );
+        let fields: HashMap<_, _> = fields.into_iter().collect();
+        let expected = maplit::hashmap! {
+            "AFTERBURN_PROVIDER" => "packet".to_string(),
+            "AFTERBURN_HOSTNAME" => "test-hostname".to_string(),
+            "AFTERBURN_SSH_KEYS" => "2".to_string(),
+            "MESSAGE_ID" => AFTERBURN_METADATA_SUMMARY_MESSAGEID.to_string(),
+        };
+        assert_eq!(fields, expected);
+    }
+
+    #[test]
+    fn test_network_units_skip_zero_mac() {
+        let base = network::Interface {
+            name: None,
+            mac_address: Some(MacAddr::zero()),
+            priority: 10,
+            nameservers: vec![],
+            ip_addresses: vec![],
+            routes: vec![],
+            bond: None,
+            vlans: vec![],
+            tunnels: vec![],
+            unmanaged: false,
+            dhcp: false,
+            mtu: None,
+            search_domains: vec![],
+        };
+        let named = network::Interface {
+            name: Some("bond0".to_string()),
+            ..base.clone()
+        };
+        let provider = TestProvider {
+            interfaces: vec![base, named],
+        };
+
+        let tempdir = tempfile::tempdir().unwrap();
+        let dir = tempdir.path().join("units");
+        provider
+            .write_network_units(dir.to_string_lossy().to_string(), false, None)
+            .unwrap();
+
+        let mut units: Vec<_> = fs::read_dir(&dir)
+            .unwrap()
+            .map(|e| e.unwrap().file_name().into_string().unwrap())
+            .collect();
+        units.sort();
+        assert_eq!(units, vec!["10-bond0.network"]);
+
+        let content = fs::read_to_string(dir.join("10-bond0.network")).unwrap();
+        assert!(!content.contains("MACAddress="));
+
+        // in strict mode, unmatchable interfaces are an error
+        provider
+            .write_network_units(dir.to_string_lossy().to_string(), true, None)
+            .unwrap_err();
+    }
+
+    #[test]
+    fn test_network_units_only_present() {
+        let present: MacAddr = "52:54:00:aa:bb:01".parse().unwrap();
+        let absent: MacAddr = "52:54:00:aa:bb:02".parse().unwrap();
+        let eth0 = network::Interface {
+            name: None,
+            mac_address: Some(present),
+            priority: 10,
+            nameservers: vec![],
+            ip_addresses: vec![],
+            routes: vec![],
+            bond: None,
+            vlans: vec![],
+            tunnels: vec![],
+            unmanaged: false,
+            dhcp: true,
+            mtu: None,
+            search_domains: vec![],
+        };
+        let eth1 = network::Interface {
+            mac_address: Some(absent),
+            ..eth0.clone()
+        };
+        let bond0 = network::Interface {
+            name: Some("bond0".to_string()),
+            mac_address: None,
+            priority: 20,
+            ..eth0.clone()
+        };
+        let provider = TestProvider {
+            interfaces: vec![eth0, eth1, bond0],
+        };
+        let list_units = |dir: &Path| {
+            let mut units: Vec<_> = fs::read_dir(dir)
+                .unwrap()
+                .map(|e| e.unwrap().file_name().into_string().unwrap())
+                .collect();
+            units.sort();
+            units
+        };
+
+        // by default, units are written for all interfaces
+        let tempdir = tempfile::tempdir().unwrap();
+        provider
+            .write_network_units(tempdir.path().to_string_lossy().to_string(), false, None)
+            .unwrap();
+        assert_eq!(
+            list_units(tempdir.path()),
+            vec![
+                "10-52:54:00:aa:bb:01.network",
+                "10-52:54:00:aa:bb:02.network",
+                "20-bond0.network"
+            ]
+        );
+
+        // absent interfaces are skipped, even in strict mode
+        let tempdir = tempfile::tempdir().unwrap();
+        provider
+            .write_network_units(
+                tempdir.path().to_string_lossy().to_string(),
+                true,
+                Some(&[present]),
+            )
+            .unwrap();
+        assert_eq!(
+            list_units(tempdir.path()),
+            vec!["10-52:54:00:aa:bb:01.network", "20-bond0.network"]
+        );
+    }
+
+    #[test]
+    fn test_network_units_address_conflict() {
+        let addr = "192.0.2.10/24".parse().unwrap();
+        let eth0 = network::Interface {
+            name: Some("eth0".to_string()),
+            mac_address: None,
+            priority: 10,
+            nameservers: vec![],
+            ip_addresses: vec![addr],
+            routes: vec![],
+            bond: None,
+            vlans: vec![],
+            tunnels: vec![],
+            unmanaged: false,
+            dhcp: false,
+            mtu: None,
+            search_domains: vec![],
+        };
+        let eth1 = network::Interface {
+            name: Some("eth1".to_string()),
+            ..eth0.clone()
+        };
+        let provider = TestProvider {
+            interfaces: vec![eth0, eth1],
+        };
+
+        let tempdir = tempfile::tempdir().unwrap();
+        let dir = tempdir.path().to_string_lossy().to_string();
+        provider
+            .write_network_units(dir.clone(), true, None)
+            .unwrap_err();
+        provider.write_network_units(dir, false, None).unwrap();
+        assert!(tempdir.path().join("10-eth0.network").exists());
+        assert!(tempdir.path().join("10-eth1.network").exists());
+    }
+
+    #[test]
+    fn test_primary_ip() {
+        let v4 = maplit::hashmap! {
+            "PACKET_IPV4_PRIVATE_0".to_string() => "10.0.0.2".to_string(),
+            "PACKET_IPV4_PUBLIC_0".to_string() => "203.0.113.5".to_string(),
+            "PACKET_IPV4_PUBLIC_1".to_string() => "203.0.113.6".to_string(),
+            "PACKET_IPV4_PUBLIC_GATEWAY_0".to_string() => "203.0.113.1".to_string(),
+        };
+        let v6 = maplit::hashmap! {
+            "PACKET_IPV6_PUBLIC_0".to_string() => "2001:db8::5".to_string(),
+            "PACKET_IPV6_PUBLIC_GATEWAY_0".to_string() => "2001:db8::1".to_string(),
+        };
+        let mut both = v4.clone();
+        both.extend(v6.clone());
+
+        let tests = vec![
+            (&v4, IpPreference::Ipv4, Some("203.0.113.5")),
+            (&v4, IpPreference::Ipv6, Some("203.0.113.5")),
+            (&v6, IpPreference::Ipv4, Some("2001:db8::5")),
+            (&v6, IpPreference::Ipv6, Some("2001:db8::5")),
+            (&both, IpPreference::Ipv4, Some("203.0.113.5")),
+            (&both, IpPreference::Ipv6, Some("2001:db8::5")),
+        ];
+        for (attributes, preference, expected) in tests {
+            let mut attributes = attributes.clone();
+            insert_primary_ip(&mut attributes, preference);
+            assert_eq!(
+                attributes.get("PACKET_PRIMARY_IP").map(String::as_str),
+                expected,
+                "{:?}",
+                preference
+            );
+        }
+
+        // empty or non-address values are not candidates, nor are private ones
+        let mut attributes = maplit::hashmap! {
+            "OPENSTACK_IPV4_LOCAL".to_string() => "10.0.0.5".to_string(),
+            "OPENSTACK_IPV4_PUBLIC".to_string() => "".to_string(),
+            "OPENSTACK_PUBLIC_HOSTNAME".to_string() => "host.example.com".to_string(),
+        };
+        insert_primary_ip(&mut attributes, IpPreference::Ipv4);
+        assert!(!attributes.contains_key("OPENSTACK_PRIMARY_IP"));
+
+        let mut attributes = maplit::hashmap! {
+            "GCP_IP_EXTERNAL_0".to_string() => "198.51.100.7".to_string(),
+        };
+        insert_primary_ip(&mut attributes, IpPreference::Ipv6);
+        assert_eq!(attributes["GCP_PRIMARY_IP"], "198.51.100.7");
+
+        // unmarked IPv6 addresses are public on AWS, unlike tags
+        let aws = maplit::hashmap! {
+            "AWS_IPV4_LOCAL".to_string() => "10.0.0.5".to_string(),
+            "AWS_IPV4_PUBLIC".to_string() => "203.0.113.9".to_string(),
+            "AWS_IPV6_0".to_string() => "2001:db8::9".to_string(),
+            "AWS_TAG_PUBLIC_IP".to_string() => "198.51.100.1".to_string(),
+            "AWS_TAG_EXTERNAL_IPV6".to_string() => "2001:db8::1".to_string(),
+        };
+        for (preference, expected) in &[
+            (IpPreference::Ipv4, "203.0.113.9"),
+            (IpPreference::Ipv6, "2001:db8::9"),
+        ] {
+            let mut attributes = aws.clone();
+            insert_primary_ip(&mut attributes, *preference);
+            assert_eq!(attributes["AWS_PRIMARY_IP"], *expected);
+        }
+        let mut attributes = maplit::hashmap! {
+            "AWS_TAG_PUBLIC_IP".to_string() => "198.51.100.1".to_string(),
+        };
+        insert_primary_ip(&mut attributes, IpPreference::Ipv4);
+        assert!(!attributes.contains_key("AWS_PRIMARY_IP"));
+
+        assert!(is_attribute_or_numbered("IPV4_PUBLIC_12", "IPV4_PUBLIC"));
+        assert!(!is_attribute_or_numbered(
+            "IPV4_PUBLIC_GATEWAY_0",
+            "IPV4_PUBLIC"
+        ));
+        assert!(!is_attribute_or_numbered("IPV4_PUBLIC_", "IPV4_PUBLIC"));
+
+        "ipv4".parse::<IpPreference>().unwrap();
+        "ipv6".parse::<IpPreference>().unwrap();
+        "IPv4".parse::<IpPreference>().unwrap_err();
+    }
+
+    #[test]
+    fn test_select_hostname() {
+        let attributes = maplit::hashmap! {
+            "AWS_HOSTNAME".to_string() => "ip-10-0-0-5.ec2.internal".to_string(),
+            "AWS_PUBLIC_HOSTNAME".to_string() => "ec2-203-0-113-5.compute-1.amazonaws.com".to_string(),
+            "AWS_INSTANCE_ID".to_string() => "i-0123456789abcdef0".to_string(),
+        };
+        let short = Some("ip-10-0-0-5".to_string());
+        let fqdn = Some("ip-10-0-0-5.ec2.internal".to_string());
+
+        let tests = vec![
+            (HostnameSource::ProviderDefault, &short, Some("ip-10-0-0-5")),
+            (
+                HostnameSource::ProviderDefault,
+                &fqdn,
+                Some("ip-10-0-0-5.ec2.internal"),
+            ),
+            (
+                HostnameSource::Fqdn,
+                &short,
+                Some("ip-10-0-0-5.ec2.internal"),
+            ),
+            (
+                HostnameSource::Fqdn,
+                &fqdn,
+                Some("ip-10-0-0-5.ec2.internal"),
+            ),
+            (HostnameSource::Short, &short, Some("ip-10-0-0-5")),
+            (HostnameSource::Short, &fqdn, Some("ip-10-0-0-5")),
+            (
+                HostnameSource::InstanceId,
+                &short,
+                Some("i-0123456789abcdef0"),
+            ),
+            (HostnameSource::Short, &None, None),
+        ];
+        for (source, hostname, expected) in tests {
+            assert_eq!(
+                select_hostname(source, hostname.clone(), &attributes),
+                expected.map(String::from),
+                "{:?} {:?}",
+                source,
+                hostname
+            );
+        }
+
+        // nothing to select from, public hostnames are not candidates
+        let attributes = maplit::hashmap! {
+            "PACKET_PUBLIC_HOSTNAME".to_string() => "host.example.com".to_string(),
+        };
+        assert_eq!(
+            select_hostname(HostnameSource::Fqdn, short.clone(), &attributes),
+            short
+        );
+        assert_eq!(
+            select_hostname(HostnameSource::InstanceId, short, &attributes),
+            None
+        );
+
+        assert_eq!(
+            "instance-id".parse::<HostnameSource>().unwrap(),
+            HostnameSource::InstanceId
+        );
+        "hostname".parse::<HostnameSource>().unwrap_err();
     }
 }
@@ -3,7 +3,6 @@
 
 use serde::Deserialize;
 use std::collections::HashMap;
-use std::fs::File;
 use std::io::{BufReader, Read};
 use std::path::{Path, PathBuf};
 
@@ -12,8 +11,10 @@ use openssh_keys::PublicKey;
 use slog_scope::{error, warn};
 use tempfile::TempDir;
 
+use super::network_data::NetworkData;
 use crate::network;
 use crate::providers::MetadataProvider;
+use crate::util::drive;
 
 const CONFIG_DRIVE_LABEL: &str = "config-2";
 
@@ -32,6 +33,12 @@ pub struct MetadataEc2JSON {
     /// Public IPV4.
     #[serde(rename = "public-ipv4")]
     pub public_ipv4: Option<String>,
+    /// Local IPV6.
+    #[serde(rename = "local-ipv6")]
+    pub local_ipv6: Option<String>,
+    /// Public IPV6.
+    #[serde(rename = "public-ipv6")]
+    pub public_ipv6: Option<String>,
 }
 
 /// Partial object for openstack `meta_data.json`
@@ -41,8 +48,38 @@ pub struct MetadataOpenstackJSON {
     pub availability_zone: Option<String>,
     /// Local hostname.
     pub hostname: Option<String>,
+    /// Instance name.
+    pub name: Option<String>,
     /// SSH public keys.
     pub public_keys: Option<HashMap<String, String>>,
+    /// User-provided metadata.
+    pub meta: Option<HashMap<String, String>>,
+}
+
+impl MetadataOpenstackJSON {
+    /// Return the instance hostname, falling back to the instance name.
+    pub fn hostname(&self) -> Option<String> {
+        self.hostname
+            .iter()
+            .chain(self.name.iter())
+            .find(|v| !v.is_empty())
+            .cloned()
+    }
+
+    /// Return the SSH keys stored, one per line, in the `meta` entry `key`.
+    pub fn meta_ssh_keys(&self, key: &str) -> Vec<String> {
+        self.meta
+            .as_ref()
+            .and_then(|meta| meta.get(key))
+            .map(|blob| {
+                blob.lines()
+                    .map(str::trim)
+                    .filter(|l| !l.is_empty() && !l.starts_with('#'))
+                    .map(String::from)
+                    .collect()
+            })
+            .unwrap_or_default()
+    }
 }
 
 /// OpenStack config-drive.
@@ -52,6 +89,10 @@ pub struct OpenstackConfigDrive {
     drive_path: PathBuf,
     /// Temporary directory for own mountpoint (if any).
     temp_dir: Option<TempDir>,
+    /// `meta` entry holding additional SSH keys (if any).
+    ssh_keys_meta_key: Option<String>,
+    /// Retries of failed reads from the config-drive.
+    read_retry: drive::ReadRetry,
 }
 
 impl OpenstackConfigDrive {
@@ -71,13 +112,35 @@ impl OpenstackConfigDrive {
             3,
         )?;
 
-        let cd = OpenstackConfigDrive {
-            drive_path: target.path().to_owned(),
-            temp_dir: Some(target),
-        };
+        let mut cd = OpenstackConfigDrive::with_drive_path(target.path().to_owned());
+        cd.temp_dir = Some(target);
         Ok(cd)
     }
 
+    /// Build a provider reading from a config-drive already available at `drive_path`.
+    ///
+    /// The config-drive is not unmounted on drop.
+    pub fn with_drive_path(drive_path: PathBuf) -> Self {
+        OpenstackConfigDrive {
+            drive_path,
+            temp_dir: None,
+            ssh_keys_meta_key: None,
+            read_retry: drive::ReadRetry::default(),
+        }
+    }
+
+    /// Retry failed reads from the config-drive as configured.
+    pub fn read_retry(mut self, retry: drive::ReadRetry) -> Self {
+        self.read_retry = retry;
+        self
+    }
+
+    /// Also read SSH keys from the given `meta` entry in `meta_data.json`.
+    pub fn ssh_keys_meta_key(mut self, key: Option<String>) -> Self {
+        self.ssh_keys_meta_key = key;
+        self
+    }
+
     /// Return the path to the metadata directory.
     fn metadata_dir(&self, platform: &str) -> PathBuf {
         self.drive_path.clone().join(platform).join("latest")
@@ -100,9 +163,8 @@ impl OpenstackConfigDrive {
     /// The metadata is stored as key:value pair in ec2/latest/meta-data.json file
     fn read_metadata_ec2(&self) -> Result<MetadataEc2JSON> {
         let filename = self.metadata_dir("ec2").join("meta-data.json");
-        let file = File::open(&filename)
-            .with_context(|| format!("failed to open file '{:?}'", filename))?;
-        let bufrd = BufReader::new(file);
+        let contents = drive::read_file(&filename, self.read_retry)?;
+        let bufrd = BufReader::new(contents.as_slice());
         Self::parse_metadata_ec2(bufrd)
             .with_context(|| format!("failed to parse file '{:?}'", filename))
     }
@@ -110,60 +172,79 @@ impl OpenstackConfigDrive {
     /// The metadata is stored as key:value pair in openstack/latest/meta_data.json file
     fn read_metadata_openstack(&self) -> Result<MetadataOpenstackJSON> {
         let filename = self.metadata_dir("openstack").join("meta_data.json");
-        let file = File::open(&filename)
-            .with_context(|| format!("failed to open file '{:?}'", filename))?;
-        let bufrd = BufReader::new(file);
+        let contents = drive::read_file(&filename, self.read_retry)?;
+        let bufrd = BufReader::new(contents.as_slice());
         Self::parse_metadata_openstack(bufrd)
             .with_context(|| format!("failed to parse file '{:?}'", filename))
     }
 
+    /// Read `openstack/latest/network_data.json`, if present.
+    fn read_network_data(&self) -> Result<Option<NetworkData>> {
+        let filename = self.metadata_dir("openstack").join("network_data.json");
+        drive::read_optional_file(&filename, self.read_retry)?
+            .map(|contents| {
+                serde_json::from_slice(&contents)
+                    .with_context(|| format!("failed to parse file '{:?}'", filename))
+            })
+            .transpose()
+    }
+
+    /// Insert attributes from ec2 metadata into `out`.
+    fn insert_ec2_attributes(out: &mut HashMap<String, String>, metadata: MetadataEc2JSON) {
+        if let Some(instance_id) = metadata.instance_id {
+            out.insert("OPENSTACK_INSTANCE_ID".to_string(), instance_id);
+        }
+        if let Some(instance_type) = metadata.instance_type {
+            out.insert("OPENSTACK_INSTANCE_TYPE".to_string(), instance_type);
+        }
+        if let Some(local_ipv4) = metadata.local_ipv4 {
+            super::insert_addresses(out, "OPENSTACK_IPV4_LOCAL", &local_ipv4);
+        }
+        if let Some(public_ipv4) = metadata.public_ipv4 {
+            super::insert_addresses(out, "OPENSTACK_IPV4_PUBLIC", &public_ipv4);
+        }
+        if let Some(local_ipv6) = metadata.local_ipv6 {
+            super::insert_addresses(out, "OPENSTACK_IPV6_LOCAL", &local_ipv6);
+        }
+        if let Some(public_ipv6) = metadata.public_ipv6 {
+            super::insert_addresses(out, "OPENSTACK_IPV6_PUBLIC", &public_ipv6);
+        }
+    }
+
     /// The public key is stored as key:value pair in openstack/latest/meta_data.json file
     fn fetch_publickeys(&self) -> Result<Vec<PublicKey>> {
-        let filename = self.metadata_dir("openstack").join("meta_data.json");
-        let file = File::open(&filename)
-            .with_context(|| format!("failed to open file '{:?}'", filename))?;
-
-        let bufrd = BufReader::new(file);
-        let metadata: MetadataOpenstackJSON = Self::parse_metadata_openstack(bufrd)
-            .with_context(|| format!("failed to parse file '{:?}'", filename))?;
-
-        let public_keys_map = metadata.public_keys.unwrap_or_default();
-        let public_keys_vec: Vec<&std::string::String> = public_keys_map.values().collect();
-        let mut out = vec![];
-        for key in public_keys_vec {
-            let key = PublicKey::parse(key)?;
-            out.push(key);
+        let metadata: MetadataOpenstackJSON = self.read_metadata_openstack()?;
+
+        let mut keys: Vec<String> = metadata
+            .public_keys
+            .as_ref()
+            .map(|keys| keys.values().cloned().collect())
+            .unwrap_or_default();
+        if let Some(ref meta_key) = self.ssh_keys_meta_key {
+            keys.append(&mut metadata.meta_ssh_keys(meta_key));
         }
-        Ok(out)
+        Ok(super::parse_ssh_keys(&keys))
     }
 }
 
 impl MetadataProvider for OpenstackConfigDrive {
     fn attributes(&self) -> Result<HashMap<String, String>> {
-        let mut out = HashMap::with_capacity(5);
+        let mut out = HashMap::with_capacity(7);
         let metadata_ec2: MetadataEc2JSON = self.read_metadata_ec2()?;
         let metadata_openstack: MetadataOpenstackJSON = self.read_metadata_openstack()?;
-        if let Some(hostname) = metadata_openstack.hostname {
+        if let Some(hostname) = metadata_openstack.hostname() {
             out.insert("OPENSTACK_HOSTNAME".to_string(), hostname);
         }
-        if let Some(instance_id) = metadata_ec2.instance_id {
-            out.insert("OPENSTACK_INSTANCE_ID".to_string(), instance_id);
-        }
-        if let Some(instance_type) = metadata_ec2.instance_type {
-            out.insert("OPENSTACK_INSTANCE_TYPE".to_string(), instance_type);
-        }
-        if let Some(local_ipv4) = metadata_ec2.local_ipv4 {
-            out.insert("OPENSTACK_IPV4_LOCAL".to_string(), local_ipv4);
-        }
-        if let Some(public_ipv4) = metadata_ec2.public_ipv4 {
-            out.insert("OPENSTACK_IPV4_PUBLIC".to_string(), public_ipv4);
+        Self::insert_ec2_attributes(&mut out, metadata_ec2);
+        if let Some(network_data) = self.read_network_data()? {
+            super::insert_network_data_addresses(&mut out, &network_data)?;
         }
         Ok(out)
     }
 
     fn hostname(&self) -> Result<Option<String>> {
         let metadata: MetadataOpenstackJSON = self.read_metadata_openstack()?;
-        Ok(metadata.hostname)
+        Ok(metadata.hostname())
     }
 
     fn ssh_keys(&self) -> Result<Vec<PublicKey>> {
@@ -198,6 +279,7 @@ impl Drop for OpenstackConfigDrive {
 #[cfg(test)]
 mod tests {
     use super::*;
+    use std::fs::File;
 
     #[test]
     fn test_attributes_ec2() {
@@ -210,6 +292,25 @@ mod tests {
         assert_eq!(parsed.instance_type.unwrap_or_default(), "m1.small");
         assert_eq!(parsed.local_ipv4.unwrap_or_default(), "10.0.151.35");
         assert_eq!(parsed.public_ipv4.unwrap_or_default(), "");
+        assert_eq!(parsed.local_ipv6, None);
+        assert_eq!(parsed.public_ipv6, None);
+    }
+
+    #[test]
+    fn test_attributes_ec2_ipv6() {
+        let fixture =
+            File::open("./tests/fixtures/openstack-config-drive/ec2/meta-data-ipv6.json").unwrap();
+        let bufrd = BufReader::new(fixture);
+        let parsed = OpenstackConfigDrive::parse_metadata_ec2(bufrd).unwrap();
+
+        let mut out = HashMap::new();
+        OpenstackConfigDrive::insert_ec2_attributes(&mut out, parsed);
+
+        assert_eq!(out["OPENSTACK_IPV4_LOCAL"], "10.0.151.35");
+        assert_eq!(out["OPENSTACK_IPV6_LOCAL"], "fd00:10::35");
+        assert_eq!(out["OPENSTACK_IPV6_LOCAL_0"], "fd00:10::35");
+        assert_eq!(out["OPENSTACK_IPV6_PUBLIC"], "2001:db8::35");
+        assert_eq!(out["OPENSTACK_IPV6_PUBLIC_0"], "2001:db8::35");
     }
 
     #[test]
@@ -244,4 +345,91 @@ mod tests {
 
         assert_eq!(parsed.public_keys.unwrap_or_default(), expect);
     }
+
+    #[test]
+    fn test_hostname_fallback() {
+        let tests = vec![
+            (r#"{"hostname": "host", "name": "name"}"#, Some("host")),
+            (r#"{"hostname": "host"}"#, Some("host")),
+            (r#"{"name": "name"}"#, Some("name")),
+            (r#"{"hostname": "", "name": "name"}"#, Some("name")),
+            (r#"{}"#, None),
+        ];
+        for (input, expected) in tests {
+            let parsed =
+                OpenstackConfigDrive::parse_metadata_openstack(BufReader::new(input.as_bytes()))
+                    .unwrap();
+            assert_eq!(parsed.hostname(), expected.map(String::from), "{}", input);
+        }
+    }
+
+    #[test]
+    fn test_meta_ssh_keys() {
+        let key1 = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIE+7Ikf7Ot5lNN5lJN9ndRvyFeojyeh8W2VqdXc5BQaq user1";
+        let key2 = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOF0FFbhNo8rGnBKxkdVnOAbH6Z4E/rRQ3pGbCZa8X6I user2";
+        let metadata = serde_json::json!({
+            "public_keys": {"mykey": key1},
+            "meta": {"heat-keys": format!("{}\n\n# comment\n{} duplicate\n{}\n", key2, key1, key2)},
+        });
+
+        let drive = tempfile::tempdir().unwrap();
+        let dir = drive.path().join("openstack/latest");
+        std::fs::create_dir_all(&dir).unwrap();
+        std::fs::write(dir.join("meta_data.json"), metadata.to_string()).unwrap();
+
+        let provider = OpenstackConfigDrive::with_drive_path(drive.path().to_owned());
+        let keys: Vec<String> = provider
+            .ssh_keys()
+            .unwrap()
+            .iter()
+            .map(ToString::to_string)
+            .collect();
+        assert_eq!(keys, vec![key1]);
+
+        let provider = provider.ssh_keys_meta_key(Some("heat-keys".to_string()));
+        let keys: Vec<String> = provider
+            .ssh_keys()
+            .unwrap()
+            .iter()
+            .map(ToString::to_string)
+            .collect();
+        assert_eq!(keys, vec![key1, key2]);
+
+        let provider = provider.ssh_keys_meta_key(Some("missing".to_string()));
+        assert_eq!(provider.ssh_keys().unwrap().len(), 1);
+    }
+
+    #[test]
+    fn test_drive_path() {
+        let drive = tempfile::tempdir().unwrap();
+        for (platform, name) in &[("ec2", "meta-data.json"), ("openstack", "meta_data.json")] {
+            let dir = drive.path().join(platform).join("latest");
+            std::fs::create_dir_all(&dir).unwrap();
+            std::fs::copy(
+                Path::new("./tests/fixtures/openstack-config-drive")
+                    .join(platform)
+                    .join(name),
+                dir.join(name),
+            )
+            .unwrap();
+        }
+        let provider = OpenstackConfigDrive::with_drive_path(drive.path().to_owned());
+
+        let attributes = provider.attributes().unwrap();
+        assert_eq!(attributes["OPENSTACK_HOSTNAME"], "abai-fcos-afterburn-test");
+        assert_eq!(attributes["OPENSTACK_INSTANCE_ID"], "i-022da7a2");
+        assert_eq!(provider.ssh_keys().unwrap().len(), 1);
+
+        // the ec2 metadata is required for attributes, but not for the rest
+        std::fs::remove_file(drive.path().join("ec2/latest/meta-data.json")).unwrap();
+        provider.attributes().unwrap_err();
+        assert_eq!(
+            provider.hostname().unwrap(),
+            Some("abai-fcos-afterburn-test".to_string())
+        );
+
+        std::fs::remove_file(drive.path().join("openstack/latest/meta_data.json")).unwrap();
+        provider.hostname().unwrap_err();
+        provider.ssh_keys().unwrap_err();
+    }
 }
@@ -4,7 +4,8 @@ use mockito;
 
 #[test]
 fn test_ssh_keys() {
-    let mut provider = OpenstackProviderNetwork::try_new().unwrap();
+    let mut provider =
+        OpenstackProviderNetwork::with_client(crate::retry::Client::try_new().unwrap()).unwrap();
     provider.client = provider.client.max_retries(0);
 
     let key1 = "ssh-rsa AAAAB3NzaC1yc2EAAAADAQABAAABgQCsXe6CfHl45kCIzMF92VhDf2NpBWUyS1+IiTtxm5a83mT9730Hb8xim7GYeJu47kiESw2DAN8vNJ/Irg0apZ217ah2rXXjPQuWYSXuEuap8yLBSjqw8exgqVj/kzW+YqmnHASxI13eoFDxTQQGzyqbqowvxu/5gQmDwBmNAa9bT809ziB/qmpS1mD6qyyFDpR23kUwu3TkgAbwMXBDoqK+pdwfaF9uo9XaLHNEH8lD5BZuG2BeDafm2o76DhNSo83MvcCPNXKLxu3BbX/FCMFO6O8RRqony4i91fEV1b8TbXrbJz1bwEYEnJRvmjnqI/389tQFeYvplXR2WdT9PCKyEAG+j8y6XgecIcdTqV/7gFfak1mp2S7mYHZDnXixsn3MjCP/cIxxJVDitKusnj1TdFqtSXl4tqGccbg/5Sqnt/EVSK4bGwwBxv/YmE0P9cbXLxuEVI0JYzgrQvC8TtUgd8kUu2jqi1/Yj9IWm3aFsl/hhh8YwYrv/gm8PV0TxkM= root@example1";
@@ -38,7 +39,8 @@ fn test_ssh_keys() {
 
 #[test]
 fn test_ssh_keys_404_ok() {
-    let mut provider = OpenstackProviderNetwork::try_new().unwrap();
+    let mut provider =
+        OpenstackProviderNetwork::with_client(crate::retry::Client::try_new().unwrap()).unwrap();
     provider.client = provider.client.max_retries(0);
 
     let _m = mockito::mock("GET", "/public-keys")
@@ -49,3 +51,159 @@ fn test_ssh_keys_404_ok() {
     mockito::reset();
     provider.ssh_keys().unwrap_err();
 }
+
+#[test]
+fn test_multiple_ipv4() {
+    let mut provider =
+        OpenstackProviderNetwork::with_client(crate::retry::Client::try_new().unwrap()).unwrap();
+    provider.client = provider.client.max_retries(0);
+
+    let endpoints = maplit::btreemap! {
+        "/hostname" => "test-hostname",
+        "/instance-id" => "test-instance-id",
+        "/instance-type" => "test-instance-type",
+        "/local-ipv4" => "10.0.0.5",
+        "/public-ipv4" => "203.0.113.10\n203.0.113.20",
+        "/openstack/network_data.json" => r#"{"networks": [
+            {"type": "ipv4", "link": "tap0", "ip_address": "10.0.0.5", "netmask": "255.255.255.0"},
+            {"type": "ipv4", "link": "tap1", "ip_address": "10.0.1.6", "netmask": "255.255.255.0"}
+        ]}"#,
+    };
+    let mut mocks = Vec::with_capacity(endpoints.len());
+    for (endpoint, body) in endpoints {
+        let m = mockito::mock("GET", endpoint)
+            .with_status(200)
+            .with_body(body)
+            .create();
+        mocks.push(m)
+    }
+
+    let attributes = maplit::hashmap! {
+        "OPENSTACK_HOSTNAME".to_string() => "test-hostname".to_string(),
+        "OPENSTACK_INSTANCE_ID".to_string() => "test-instance-id".to_string(),
+        "OPENSTACK_INSTANCE_TYPE".to_string() => "test-instance-type".to_string(),
+        "OPENSTACK_IPV4_LOCAL".to_string() => "10.0.0.5".to_string(),
+        "OPENSTACK_IPV4_LOCAL_0".to_string() => "10.0.0.5".to_string(),
+        "OPENSTACK_IPV4_LOCAL_1".to_string() => "10.0.1.6".to_string(),
+        "OPENSTACK_IPV4_PUBLIC".to_string() => "203.0.113.10".to_string(),
+        "OPENSTACK_IPV4_PUBLIC_0".to_string() => "203.0.113.10".to_string(),
+        "OPENSTACK_IPV4_PUBLIC_1".to_string() => "203.0.113.20".to_string(),
+    };
+    let v = provider.attributes().unwrap();
+    assert_eq!(v, attributes);
+
+    mockito::reset();
+}
+
+#[test]
+fn test_hostname_ec2_only() {
+    let mut provider =
+        OpenstackProviderNetwork::with_client(crate::retry::Client::try_new().unwrap()).unwrap();
+    provider.client = provider.client.max_retries(0);
+
+    let _m = mockito::mock("GET", "/hostname")
+        .with_status(200)
+        .with_body("ec2-hostname")
+        .create();
+    let hostname = provider.hostname().unwrap();
+    assert_eq!(hostname, Some("ec2-hostname".to_string()));
+
+    mockito::reset();
+}
+
+#[test]
+fn test_hostname_json_only() {
+    let mut provider =
+        OpenstackProviderNetwork::with_client(crate::retry::Client::try_new().unwrap()).unwrap();
+    provider.client = provider.client.max_retries(0);
+
+    let tests = vec![
+        (
+            r#"{"hostname": "json-hostname", "name": "json-name"}"#,
+            "json-hostname",
+        ),
+        (r#"{"name": "json-name"}"#, "json-name"),
+    ];
+    for (body, expected) in tests {
+        let _m_ec2 = mockito::mock("GET", "/hostname").with_status(404).create();
+        let _m_json = mockito::mock("GET", "/openstack/meta_data.json")
+            .with_status(200)
+            .with_body(body)
+            .create();
+        let hostname = provider.hostname().unwrap();
+        assert_eq!(hostname, Some(expected.to_string()));
+
+        mockito::reset();
+    }
+
+    // neither source present
+    let _m_ec2 = mockito::mock("GET", "/hostname").with_status(404).create();
+    let _m_json = mockito::mock("GET", "/openstack/meta_data.json")
+        .with_status(404)
+        .create();
+    assert_eq!(provider.hostname().unwrap(), None);
+
+    mockito::reset();
+}
+
+#[test]
+fn test_base_url() {
+    let mut provider =
+        OpenstackProviderNetwork::with_client(crate::retry::Client::try_new().unwrap())
+            .unwrap()
+            .base_url(Some(mockito::server_url()));
+    provider.client = provider.client.max_retries(0);
+
+    let _m_ec2 = mockito::mock("GET", "/latest/meta-data/hostname")
+        .with_status(404)
+        .create();
+    let _m_json = mockito::mock("GET", "/openstack/latest/meta_data.json")
+        .with_status(200)
+        .with_body(r#"{"hostname": "json-hostname"}"#)
+        .create();
+    let hostname = provider.hostname().unwrap();
+    assert_eq!(hostname, Some("json-hostname".to_string()));
+
+    mockito::reset();
+}
+
+#[test]
+fn test_ssh_keys_meta_key() {
+    let key1 =
+        "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIE+7Ikf7Ot5lNN5lJN9ndRvyFeojyeh8W2VqdXc5BQaq user1";
+    let key2 =
+        "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOF0FFbhNo8rGnBKxkdVnOAbH6Z4E/rRQ3pGbCZa8X6I user2";
+    let metadata = serde_json::json!({
+        "meta": {"magnum-keys": format!("{} duplicate\n{}\n", key1, key2)},
+    });
+
+    let mut provider =
+        OpenstackProviderNetwork::with_client(crate::retry::Client::try_new().unwrap())
+            .unwrap()
+            .ssh_keys_meta_key(Some("magnum-keys".to_string()));
+    provider.client = provider.client.max_retries(0);
+
+    let endpoints = maplit::btreemap! {
+        "/public-keys" => "0=test1".to_string(),
+        "/public-keys/0/openssh-key" => key1.to_string(),
+        "/openstack/meta_data.json" => metadata.to_string(),
+    };
+    let mut mocks = Vec::with_capacity(endpoints.len());
+    for (endpoint, body) in endpoints {
+        let m = mockito::mock("GET", endpoint)
+            .with_status(200)
+            .with_body(body)
+            .create();
+        mocks.push(m)
+    }
+
+    let keys: Vec<String> = provider
+        .ssh_keys()
+        .unwrap()
+        .iter()
+        .map(ToString::to_string)
+        .collect();
+    assert_eq!(keys, vec![key1, key2]);
+
+    mockito::reset();
+}
@@ -14,26 +14,154 @@
 
 //! openstack metadata fetcher
 
+use std::collections::HashMap;
+
 use crate::providers;
+use crate::retry;
+use crate::util::drive;
 use anyhow::Result;
 use configdrive::OpenstackConfigDrive;
 use network::OpenstackProviderNetwork;
+use network_data::NetworkData;
+use openssh_keys::PublicKey;
 use slog_scope::warn;
 
 pub mod configdrive;
 pub mod network;
+pub mod network_data;
 
 #[cfg(test)]
 mod mock_tests;
 
 /// Read metadata from the config-drive first then fallback to fetch from metadata server.
 ///
+/// `base_url` optionally overrides the address of the metadata server,
+/// `ssh_keys_meta_key` names a `meta` entry holding additional SSH keys, and
+/// `read_retry` tells how to retry failed reads from the config-drive.
+///
 /// Reference: https://github.com/coreos/fedora-coreos-tracker/issues/422
-pub fn try_config_drive_else_network() -> Result<Box<dyn providers::MetadataProvider>> {
+pub fn try_config_drive_else_network(
+    client: retry::Client,
+    base_url: Option<String>,
+    ssh_keys_meta_key: Option<String>,
+    read_retry: drive::ReadRetry,
+) -> Result<Box<dyn providers::MetadataProvider>> {
     if let Ok(config_drive) = OpenstackConfigDrive::try_new() {
-        Ok(Box::new(config_drive))
+        Ok(Box::new(
+            config_drive
+                .ssh_keys_meta_key(ssh_keys_meta_key)
+                .read_retry(read_retry),
+        ))
     } else {
         warn!("failed to locate config-drive, using the metadata service API instead");
-        Ok(Box::new(OpenstackProviderNetwork::try_new()?))
+        Ok(Box::new(
+            OpenstackProviderNetwork::with_client(client)?
+                .base_url(base_url)
+                .ssh_keys_meta_key(ssh_keys_meta_key),
+        ))
+    }
+}
+
+/// Parse SSH keys, dropping duplicates of the same key material.
+///
+/// The first occurrence of each key is kept, along with its options and comment.
+/// Malformed keys are skipped with a warning, so that one bad entry doesn't
+/// prevent the others from being written.
+fn parse_ssh_keys(keys: &[String]) -> Vec<PublicKey> {
+    let mut out: Vec<PublicKey> = Vec::with_capacity(keys.len());
+    for key in keys {
+        let key = match PublicKey::parse(key) {
+            Ok(key) => key,
+            Err(e) => {
+                warn!("skipping malformed SSH key: {}", e);
+                continue;
+            }
+        };
+        if !out.iter().any(|k| k.to_key_format() == key.to_key_format()) {
+            out.push(key);
+        }
+    }
+    out
+}
+
+/// Insert an address attribute which may hold multiple addresses.
+///
+/// Floating IPs can result in several addresses, which are exposed as
+/// `<key>_<n>`. The first one is also kept as `<key>`, as the primary.
+fn insert_addresses(map: &mut HashMap<String, String>, key: &str, value: &str) {
+    let addrs: Vec<&str> = value
+        .split(|c: char| c == ',' || c.is_whitespace())
+        .filter(|addr| !addr.is_empty())
+        .collect();
+    map.insert(key.to_string(), addrs.first().unwrap_or(&value).to_string());
+    for (i, addr) in addrs.iter().enumerate() {
+        map.insert(format!("{}_{}", key, i), addr.to_string());
+    }
+}
+
+/// Insert the fixed addresses listed in `network_data.json` as local
+/// address attributes, after those already there (without duplicates).
+fn insert_network_data_addresses(
+    map: &mut HashMap<String, String>,
+    data: &NetworkData,
+) -> Result<()> {
+    for addr in data.static_addresses()? {
+        let key = if addr.is_ipv4() {
+            "OPENSTACK_IPV4_LOCAL"
+        } else {
+            "OPENSTACK_IPV6_LOCAL"
+        };
+        let addr = addr.to_string();
+        let count = (0..)
+            .take_while(|i| map.contains_key(&format!("{}_{}", key, i)))
+            .count();
+        if (0..count).any(|i| map.get(&format!("{}_{}", key, i)) == Some(&addr)) {
+            continue;
+        }
+        map.entry(key.to_string()).or_insert_with(|| addr.clone());
+        map.insert(format!("{}_{}", key, count), addr);
+    }
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_insert_network_data_addresses() {
+        let data: NetworkData = serde_json::from_value(serde_json::json!({
+            "networks": [
+                {"type": "ipv4", "link": "tap0", "ip_address": "10.0.0.5", "netmask": "255.255.255.0"},
+                {"type": "ipv4_dhcp", "link": "tap1"},
+                {"type": "ipv4", "link": "tap2", "ip_address": "10.0.1.7/24"},
+                {"type": "ipv6", "link": "tap0", "ip_address": "fd00::5/64"},
+            ],
+        }))
+        .unwrap();
+
+        let mut map = HashMap::new();
+        insert_addresses(&mut map, "OPENSTACK_IPV4_LOCAL", "10.0.0.5");
+        insert_network_data_addresses(&mut map, &data).unwrap();
+        let expected = maplit::hashmap! {
+            "OPENSTACK_IPV4_LOCAL".to_string() => "10.0.0.5".to_string(),
+            "OPENSTACK_IPV4_LOCAL_0".to_string() => "10.0.0.5".to_string(),
+            "OPENSTACK_IPV4_LOCAL_1".to_string() => "10.0.1.7".to_string(),
+            "OPENSTACK_IPV6_LOCAL".to_string() => "fd00::5".to_string(),
+            "OPENSTACK_IPV6_LOCAL_0".to_string() => "fd00::5".to_string(),
+        };
+        assert_eq!(map, expected);
+    }
+
+    #[test]
+    fn test_parse_ssh_keys() {
+        let keys = vec![
+            "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIE+7Ikf7Ot5lNN5lJN9ndRvyFeojyeh8W2VqdXc5BQaq first".to_string(),
+            "not a key".to_string(),
+            "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIE+7Ikf7Ot5lNN5lJN9ndRvyFeojyeh8W2VqdXc5BQaq second".to_string(),
+        ];
+        let parsed = parse_ssh_keys(&keys);
+        assert_eq!(parsed.len(), 1);
+        assert_eq!(parsed[0].comment, Some("first".to_string()));
     }
 }
@@ -5,40 +5,96 @@ use std::collections::HashMap;
 use anyhow::{anyhow, bail, Result};
 use openssh_keys::PublicKey;
 
-use crate::providers::MetadataProvider;
+use super::configdrive::MetadataOpenstackJSON;
+use super::network_data::NetworkData;
+use crate::providers::{self, MetadataProvider};
 use crate::retry;
 
-#[cfg(not(test))]
-const URL: &str = "http://169.254.169.254/latest/meta-data";
+/// Path of the EC2-style metadata API, relative to the server base URL.
+const EC2_API_PATH: &str = "latest/meta-data";
+/// Path of the OpenStack metadata API, relative to the server base URL.
+const OPENSTACK_API_PATH: &str = "openstack/latest";
 
 #[derive(Clone, Debug)]
 pub struct OpenstackProviderNetwork {
     pub(crate) client: retry::Client,
+    ec2_url: String,
+    openstack_url: String,
+    ssh_keys_meta_key: Option<String>,
 }
 
 impl OpenstackProviderNetwork {
-    pub fn try_new() -> Result<OpenstackProviderNetwork> {
-        let client = retry::Client::try_new()?.return_on_404(true);
-        Ok(OpenstackProviderNetwork { client })
+    /// Build a provider fetching metadata with the given client.
+    pub(crate) fn with_client(client: retry::Client) -> Result<OpenstackProviderNetwork> {
+        let client = client.return_on_404(true);
+        let (ec2_url, openstack_url) = OpenstackProviderNetwork::default_urls();
+        Ok(OpenstackProviderNetwork {
+            client,
+            ec2_url,
+            openstack_url,
+            ssh_keys_meta_key: None,
+        })
+    }
+
+    /// Also read SSH keys from the given `meta` entry in `meta_data.json`.
+    pub fn ssh_keys_meta_key(mut self, key: Option<String>) -> Self {
+        self.ssh_keys_meta_key = key;
+        self
+    }
+
+    /// Override the base URL of the metadata server.
+    pub fn base_url(mut self, base_url: Option<String>) -> Self {
+        if let Some(base_url) = base_url {
+            self.ec2_url = providers::metadata_api_url(&base_url, EC2_API_PATH);
+            self.openstack_url = providers::metadata_api_url(&base_url, OPENSTACK_API_PATH);
+        }
+        self
     }
 
     #[cfg(test)]
-    fn endpoint_for(key: &str) -> String {
-        format!("{}/{}", &mockito::server_url(), key)
+    fn default_urls() -> (String, String) {
+        let url = mockito::server_url();
+        (url.clone(), format!("{}/openstack", url))
     }
 
     #[cfg(not(test))]
-    fn endpoint_for(key: &str) -> String {
-        format!("{}/{}", URL, key)
+    fn default_urls() -> (String, String) {
+        (
+            providers::metadata_api_url(providers::METADATA_BASE_URL, EC2_API_PATH),
+            providers::metadata_api_url(providers::METADATA_BASE_URL, OPENSTACK_API_PATH),
+        )
+    }
+
+    fn endpoint_for(&self, key: &str) -> String {
+        format!("{}/{}", self.ec2_url, key)
+    }
+
+    fn openstack_endpoint_for(&self, key: &str) -> String {
+        format!("{}/{}", self.openstack_url, key)
+    }
+
+    /// Fetch the hostname from the EC2-style endpoint, falling back to
+    /// the OpenStack JSON metadata.
+    fn fetch_hostname(&self) -> Result<Option<String>> {
+        let hostname: Option<String> = self
+            .client
+            .get(retry::Raw, self.endpoint_for("hostname"))
+            .send()?;
+        if let Some(hostname) = hostname.filter(|h| !h.is_empty()) {
+            return Ok(Some(hostname));
+        }
+
+        let metadata: Option<MetadataOpenstackJSON> = self
+            .client
+            .get(retry::Json, self.openstack_endpoint_for("meta_data.json"))
+            .send()?;
+        Ok(metadata.and_then(|m| m.hostname()))
     }
 
     fn fetch_keys(&self) -> Result<Vec<String>> {
         let keys_list: Option<String> = self
             .client
-            .get(
-                retry::Raw,
-                OpenstackProviderNetwork::endpoint_for("public-keys"),
-            )
+            .get(retry::Raw, self.endpoint_for("public-keys"))
             .send()?;
         let mut keys = Vec::new();
         if let Some(keys_list) = keys_list {
@@ -51,16 +107,23 @@ impl OpenstackProviderNetwork {
                     .client
                     .get(
                         retry::Raw,
-                        OpenstackProviderNetwork::endpoint_for(&format!(
-                            "public-keys/{}/openssh-key",
-                            tokens[0]
-                        )),
+                        self.endpoint_for(&format!("public-keys/{}/openssh-key", tokens[0])),
                     )
                     .send()?
                     .ok_or_else(|| anyhow!("missing ssh key"))?;
                 keys.push(key);
             }
         }
+
+        if let Some(ref meta_key) = self.ssh_keys_meta_key {
+            let metadata: Option<MetadataOpenstackJSON> = self
+                .client
+                .get(retry::Json, self.openstack_endpoint_for("meta_data.json"))
+                .send()?;
+            if let Some(metadata) = metadata {
+                keys.append(&mut metadata.meta_ssh_keys(meta_key));
+            }
+        }
         Ok(keys)
     }
 }
@@ -69,43 +132,49 @@ impl MetadataProvider for OpenstackProviderNetwork {
     fn attributes(&self) -> Result<HashMap<String, String>> {
         let mut out = HashMap::with_capacity(5);
 
+        let fetch_value = |name| -> Result<Option<String>> {
+            self.client.get(retry::Raw, self.endpoint_for(name)).send()
+        };
         let add_value = |map: &mut HashMap<_, _>, key: &str, name| -> Result<()> {
-            let value = self
-                .client
-                .get(retry::Raw, OpenstackProviderNetwork::endpoint_for(name))
-                .send()?;
-            if let Some(value) = value {
+            if let Some(value) = fetch_value(name)? {
                 map.insert(key.to_string(), value);
             }
             Ok(())
         };
+        let add_addresses = |map: &mut HashMap<_, _>, key: &str, name| -> Result<()> {
+            if let Some(value) = fetch_value(name)? {
+                super::insert_addresses(map, key, &value);
+            }
+            Ok(())
+        };
 
-        add_value(&mut out, "OPENSTACK_HOSTNAME", "hostname")?;
+        if let Some(hostname) = self.fetch_hostname()? {
+            out.insert("OPENSTACK_HOSTNAME".to_string(), hostname);
+        }
         add_value(&mut out, "OPENSTACK_INSTANCE_ID", "instance-id")?;
         add_value(&mut out, "OPENSTACK_INSTANCE_TYPE", "instance-type")?;
-        add_value(&mut out, "OPENSTACK_IPV4_LOCAL", "local-ipv4")?;
-        add_value(&mut out, "OPENSTACK_IPV4_PUBLIC", "public-ipv4")?;
+        add_addresses(&mut out, "OPENSTACK_IPV4_LOCAL", "local-ipv4")?;
+        add_addresses(&mut out, "OPENSTACK_IPV4_PUBLIC", "public-ipv4")?;
+
+        let network_data: Option<NetworkData> = self
+            .client
+            .get(
+                retry::Json,
+                self.openstack_endpoint_for("network_data.json"),
+            )
+            .send()?;
+        if let Some(network_data) = network_data {
+            super::insert_network_data_addresses(&mut out, &network_data)?;
+        }
 
         Ok(out)
     }
 
     fn hostname(&self) -> Result<Option<String>> {
-        self.client
-            .get(
-                retry::Raw,
-                OpenstackProviderNetwork::endpoint_for("hostname"),
-            )
-            .send()
+        self.fetch_hostname()
     }
 
     fn ssh_keys(&self) -> Result<Vec<PublicKey>> {
-        let mut out = Vec::new();
-
-        for key in &self.fetch_keys()? {
-            let key = PublicKey::parse(&key)?;
-            out.push(key);
-        }
-
-        Ok(out)
+        Ok(super::parse_ssh_keys(&self.fetch_keys()?))
     }
 }
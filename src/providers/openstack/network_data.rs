@@ -0,0 +1,533 @@
+//! Network configuration from OpenStack `network_data.json`
+//! reference: https://docs.openstack.org/nova/latest/user/metadata.html#openstack-format-metadata
+
+use anyhow::{anyhow, bail, Context, Result};
+use ipnetwork::IpNetwork;
+use pnet_base::MacAddr;
+use serde::Deserialize;
+use std::collections::HashMap;
+use std::net::IpAddr;
+use std::str::FromStr;
+
+use crate::network::{self, InterfaceRole};
+
+/// Partial object for `network_data.json`
+#[derive(Debug, Default, Deserialize)]
+pub struct NetworkData {
+    /// Physical and virtual links.
+    #[serde(default)]
+    pub links: Vec<Link>,
+    /// Networks configured on links.
+    #[serde(default)]
+    pub networks: Vec<Network>,
+    /// Network services, e.g. DNS servers.
+    #[serde(default)]
+    pub services: Vec<Service>,
+}
+
+/// JSON entry in `links` array.
+#[derive(Debug, Deserialize)]
+pub struct Link {
+    /// Unique link ID.
+    pub id: String,
+    /// Link type, e.g. `phy`, `bond` or `vlan`.
+    #[serde(rename = "type", default)]
+    pub kind: String,
+    /// Interface name (optional).
+    pub name: Option<String>,
+    /// Link MAC address (optional).
+    pub ethernet_mac_address: Option<String>,
+    /// Link MTU (optional).
+    pub mtu: Option<u32>,
+    /// Member links of a bond (see `Link.id`).
+    #[serde(default)]
+    pub bond_links: Vec<String>,
+    /// Bonding mode of a bond, e.g. `802.3ad`.
+    pub bond_mode: Option<String>,
+    /// Link monitoring interval of a bond, in milliseconds.
+    pub bond_miimon: Option<u32>,
+    /// Hash policy for member selection of a bond, e.g. `layer3+4`.
+    pub bond_xmit_hash_policy: Option<String>,
+    /// Parent link of a VLAN (see `Link.id`).
+    pub vlan_link: Option<String>,
+    /// 802.1Q ID of a VLAN.
+    pub vlan_id: Option<u16>,
+    /// MAC address of a VLAN (optional).
+    pub vlan_mac_address: Option<String>,
+}
+
+/// JSON entry in `networks` array.
+#[derive(Debug, Deserialize)]
+pub struct Network {
+    /// Network type, e.g. `ipv4` or `ipv4_dhcp`.
+    #[serde(rename = "type")]
+    pub kind: String,
+    /// Reference to the underlying link (see `Link.id`).
+    pub link: String,
+    /// IP address, either bare or in CIDR notation.
+    pub ip_address: Option<String>,
+    /// IP network mask, if not part of the address.
+    pub netmask: Option<IpAddr>,
+    /// Routable networks.
+    #[serde(default)]
+    pub routes: Vec<Route>,
+}
+
+/// JSON entry in `networks.routes` array.
+#[derive(Debug, Deserialize)]
+pub struct Route {
+    /// Route network address.
+    pub network: IpAddr,
+    /// Route netmask.
+    pub netmask: IpAddr,
+    /// Route gateway.
+    pub gateway: IpAddr,
+}
+
+/// JSON entry in `services` array.
+#[derive(Debug, Deserialize)]
+pub struct Service {
+    #[serde(rename = "type")]
+    pub kind: String,
+    pub address: IpAddr,
+}
+
+impl Link {
+    fn is_bond(&self) -> bool {
+        self.kind == "bond"
+    }
+
+    fn is_vlan(&self) -> bool {
+        self.kind == "vlan"
+    }
+
+    /// Return the MAC address advertised for this link, if any.
+    fn mac_address(&self) -> Result<Option<MacAddr>> {
+        let mac = if self.is_vlan() {
+            self.vlan_mac_address
+                .as_ref()
+                .or_else(|| self.ethernet_mac_address.as_ref())
+        } else {
+            self.ethernet_mac_address.as_ref()
+        };
+        mac.map(|mac| MacAddr::from_str(mac))
+            .transpose()
+            .with_context(|| format!("invalid MAC address for link '{}'", self.id))
+    }
+
+    /// Return the name of the device for a bond or VLAN link.
+    ///
+    /// Virtual devices are created by name, defaulting to the link ID.
+    fn device_name(&self) -> Result<String> {
+        let name = self.name.clone().unwrap_or_else(|| self.id.clone());
+        network::validate_interface_name(&name)
+            .with_context(|| format!("invalid device name for link '{}'", self.id))?;
+        Ok(name)
+    }
+
+    /// Return the configuration of this link, without any network.
+    fn interface(&self) -> Result<network::Interface> {
+        let (name, mac_address, role) = if self.is_bond() {
+            // bonds share the MAC address of their members, match by name
+            (Some(self.device_name()?), None, InterfaceRole::Bond)
+        } else if self.is_vlan() {
+            (Some(self.device_name()?), None, InterfaceRole::Vlan)
+        } else {
+            (
+                self.name.clone(),
+                self.mac_address()?,
+                InterfaceRole::Physical,
+            )
+        };
+        Ok(network::Interface {
+            name,
+            mac_address,
+            priority: role.priority(),
+            nameservers: vec![],
+            ip_addresses: vec![],
+            routes: vec![],
+            bond: None,
+            vlans: vec![],
+            tunnels: vec![],
+            unmanaged: false,
+            dhcp: false,
+            mtu: self.mtu,
+            search_domains: vec![],
+        })
+    }
+}
+
+impl Network {
+    /// Whether this network is statically configured.
+    fn is_static(&self) -> bool {
+        self.kind == "ipv4" || self.kind == "ipv6"
+    }
+
+    /// Whether this network is configured via DHCP.
+    fn is_dhcp(&self) -> bool {
+        self.kind == "ipv4_dhcp" || self.kind == "ipv6_dhcp"
+    }
+
+    /// Return the address of this network, with its prefix.
+    fn address(&self) -> Result<Option<IpNetwork>> {
+        let address = match self.ip_address {
+            Some(ref address) => address,
+            None => return Ok(None),
+        };
+        if address.contains('/') {
+            let net = IpNetwork::from_str(address)
+                .with_context(|| format!("failed to parse address '{}'", address))?;
+            return Ok(Some(net));
+        }
+        let ip = IpAddr::from_str(address)
+            .with_context(|| format!("failed to parse address '{}'", address))?;
+        let net = match self.netmask {
+            Some(netmask) => network::try_parse_cidr(ip, netmask)?,
+            None => {
+                let prefix = if ip.is_ipv4() { 32 } else { 128 };
+                IpNetwork::new(ip, prefix).context("failed to parse network")?
+            }
+        };
+        Ok(Some(net))
+    }
+}
+
+impl NetworkData {
+    /// Transform network data into a set of interface configurations.
+    ///
+    /// Networks on the same link are merged into a single interface, with
+    /// static addresses and/or DHCP. Other kinds of networks (e.g. SLAAC)
+    /// are left alone. Interfaces are returned in the order their networks
+    /// appear, followed by bonds, VLANs and their underlying links.
+    ///
+    /// Networks on unknown links, and links which can't be matched by name
+    /// nor by MAC address, are skipped unless `strict` is set.
+    pub fn interfaces(&self, strict: bool) -> Result<Vec<network::Interface>> {
+        let links = self.links_by_id();
+
+        let nameservers: Vec<IpAddr> = self
+            .services
+            .iter()
+            .filter(|svc| svc.kind == "dns")
+            .map(|svc| svc.address)
+            .collect();
+
+        let mut output: Vec<(&str, network::Interface)> = Vec::new();
+        for net in self
+            .networks
+            .iter()
+            .filter(|n| n.is_static() || n.is_dhcp())
+        {
+            // Ensure that the referenced link exists.
+            let link = match find_link(&links, &net.link, strict)? {
+                Some(link) => link,
+                None => continue,
+            };
+
+            let iface = link_entry(&mut output, link)?;
+            if iface.nameservers.is_empty() {
+                iface.nameservers = nameservers.clone();
+            }
+
+            if net.is_dhcp() {
+                iface.dhcp = true;
+                continue;
+            }
+            if let Some(address) = net.address()? {
+                iface.ip_addresses.push(address);
+            }
+            for entry in &net.routes {
+                let destination = network::try_parse_cidr(entry.network, entry.netmask)?;
+                iface.routes.push(network::NetworkRoute {
+                    destination,
+                    gateway: entry.gateway,
+                    metric: None,
+                });
+            }
+        }
+
+        // Enslave bond members, and attach VLANs to their parent link.
+        for link in &self.links {
+            if link.is_bond() {
+                let bond_name = link.device_name()?;
+                link_entry(&mut output, link)?;
+                for id in &link.bond_links {
+                    if let Some(member) = find_link(&links, id, strict)? {
+                        link_entry(&mut output, member)?.bond = Some(bond_name.clone());
+                    }
+                }
+            } else if link.is_vlan() {
+                let vlan_name = link.device_name()?;
+                link_entry(&mut output, link)?;
+                let parent_id = link.vlan_link.as_deref().unwrap_or_default();
+                if let Some(parent) = find_link(&links, parent_id, strict)? {
+                    link_entry(&mut output, parent)?.vlans.push(vlan_name);
+                }
+            }
+        }
+
+        let mut interfaces = Vec::with_capacity(output.len());
+        for (id, iface) in output {
+            if iface.name.is_none() && iface.mac_address.is_none() {
+                if strict {
+                    bail!("link '{}' has neither a name nor a MAC address", id);
+                }
+                continue;
+            }
+            interfaces.push(iface);
+        }
+        Ok(interfaces)
+    }
+
+    /// Return the addresses of all static networks, in order, e.g. the
+    /// fixed IPs of an instance with several ports.
+    pub fn static_addresses(&self) -> Result<Vec<IpAddr>> {
+        let mut addresses = Vec::new();
+        for net in self.networks.iter().filter(|n| n.is_static()) {
+            if let Some(address) = net.address()? {
+                addresses.push(address.ip());
+            }
+        }
+        Ok(addresses)
+    }
+
+    /// Return the virtual network devices for bond and VLAN links.
+    ///
+    /// Devices without a MAC address of their own take the one of their
+    /// first member (for bonds) or of their parent link (for VLANs).
+    pub fn virtual_network_devices(&self) -> Result<Vec<network::VirtualNetDev>> {
+        let links = self.links_by_id();
+
+        let mut devices = Vec::new();
+        for link in self.links.iter().filter(|l| l.is_bond() || l.is_vlan()) {
+            let mac_address = resolve_mac_address(&links, link)?
+                .ok_or_else(|| anyhow!("cannot find a MAC address for link '{}'", link.id))?;
+            let (kind, section) = if link.is_bond() {
+                let mode = match link.bond_mode {
+                    Some(ref mode) => network::bonding_mode_from_string(mode)
+                        .with_context(|| format!("invalid bond mode for link '{}'", link.id))?,
+                    None => network::BONDING_MODE_BALANCE_RR,
+                };
+                let config = network::BondConfig {
+                    mode,
+                    transmit_hash_policy: link.bond_xmit_hash_policy.clone(),
+                    mii_monitor_sec: link.bond_miimon.map(|ms| format!("{}ms", ms)),
+                    ..network::BondConfig::default()
+                };
+                (network::NetDevKind::Bond, config.sd_section()?)
+            } else {
+                let id = link
+                    .vlan_id
+                    .ok_or_else(|| anyhow!("missing VLAN ID for link '{}'", link.id))?;
+                let section = network::SdSection {
+                    name: "VLAN".to_string(),
+                    attributes: vec![("Id".to_string(), id.to_string())],
+                };
+                (network::NetDevKind::Vlan, section)
+            };
+            devices.push(network::VirtualNetDev {
+                name: link.device_name()?,
+                kind,
+                mac_address,
+                priority: Some(5),
+                sd_netdev_sections: vec![section],
+            });
+        }
+        Ok(devices)
+    }
+
+    fn links_by_id(&self) -> HashMap<&str, &Link> {
+        self.links.iter().map(|l| (l.id.as_str(), l)).collect()
+    }
+}
+
+/// Look up a link by ID, failing on unknown links only if `strict` is set.
+fn find_link<'a>(
+    links: &HashMap<&str, &'a Link>,
+    id: &str,
+    strict: bool,
+) -> Result<Option<&'a Link>> {
+    match links.get(id) {
+        Some(link) => Ok(Some(link)),
+        None if strict => bail!("reference to unknown link '{}'", id),
+        None => Ok(None),
+    }
+}
+
+/// Return the interface for a link, adding it if not there yet.
+fn link_entry<'a, 'l>(
+    output: &'a mut Vec<(&'l str, network::Interface)>,
+    link: &'l Link,
+) -> Result<&'a mut network::Interface> {
+    let pos = match output.iter().position(|(id, _)| *id == link.id) {
+        Some(pos) => pos,
+        None => {
+            output.push((link.id.as_str(), link.interface()?));
+            output.len() - 1
+        }
+    };
+    Ok(&mut output[pos].1)
+}
+
+/// Return the MAC address of a link, or else of the links below it.
+fn resolve_mac_address(links: &HashMap<&str, &Link>, link: &Link) -> Result<Option<MacAddr>> {
+    let mut current = link;
+    // bound the walk, in case of reference loops
+    for _ in 0..=links.len() {
+        if let Some(mac) = current.mac_address()? {
+            return Ok(Some(mac));
+        }
+        let next = if current.is_bond() {
+            current.bond_links.first()
+        } else if current.is_vlan() {
+            current.vlan_link.as_ref()
+        } else {
+            None
+        };
+        current = match next.and_then(|id| links.get(id.as_str())) {
+            Some(link) => link,
+            None => return Ok(None),
+        };
+    }
+    Ok(None)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    /// Render all units for network data, in lexical order of unit names.
+    fn render_units(fixture: &str) -> String {
+        let path = format!("./tests/fixtures/openstack-network-data/{}.json", fixture);
+        let data: NetworkData =
+            serde_json::from_reader(std::fs::File::open(path).unwrap()).unwrap();
+
+        let mut units = std::collections::BTreeMap::new();
+        for iface in data.interfaces(true).unwrap() {
+            units.insert(iface.sd_network_unit_name().unwrap(), iface.config());
+        }
+        for device in data.virtual_network_devices().unwrap() {
+            units.insert(device.netdev_unit_name(), device.sd_netdev_config());
+        }
+        units
+            .iter()
+            .map(|(name, contents)| format!("# {}\n{}", name, contents))
+            .collect::<Vec<_>>()
+            .join("\n")
+    }
+
+    #[test]
+    fn test_bond_units() {
+        let expected =
+            std::fs::read_to_string("./tests/fixtures/openstack-network-data/bond.units").unwrap();
+        assert_eq!(render_units("bond"), expected);
+    }
+
+    #[test]
+    fn test_vlan_bond_units() {
+        let expected =
+            std::fs::read_to_string("./tests/fixtures/openstack-network-data/vlan-bond.units")
+                .unwrap();
+        assert_eq!(render_units("vlan-bond"), expected);
+    }
+
+    #[test]
+    fn test_virtual_units_first() {
+        let path = "./tests/fixtures/openstack-network-data/vlan-bond.json";
+        let data: NetworkData =
+            serde_json::from_reader(std::fs::File::open(path).unwrap()).unwrap();
+        let interfaces = data.interfaces(true).unwrap();
+        let devices = data.virtual_network_devices().unwrap();
+
+        // the bond takes the MAC address of its first member
+        let member = interfaces
+            .iter()
+            .find(|iface| iface.bond.is_some())
+            .unwrap();
+        let bond = devices.iter().find(|d| d.name == "bond0").unwrap();
+        assert_eq!(member.mac_address, Some(bond.mac_address));
+
+        // so devices matched by name must be configured first
+        let (by_name, by_mac): (Vec<_>, Vec<_>) = interfaces
+            .iter()
+            .partition(|iface| iface.mac_address.is_none());
+        assert_eq!(by_name.len(), 3);
+        for virtual_iface in &by_name {
+            for physical in &by_mac {
+                assert!(
+                    virtual_iface.sd_network_unit_name().unwrap()
+                        < physical.sd_network_unit_name().unwrap()
+                );
+            }
+        }
+    }
+
+    #[test]
+    fn test_interfaces() {
+        let data: NetworkData = serde_json::from_value(serde_json::json!({
+            "links": [
+                {"id": "enp1s0", "type": "phy", "ethernet_mac_address": "52:54:00:aa:bb:01", "mtu": 9000},
+                {"id": "enp2s0", "type": "phy", "ethernet_mac_address": "52:54:00:aa:bb:02"},
+                {"id": "enp3s0", "type": "phy", "ethernet_mac_address": "52:54:00:aa:bb:03"},
+            ],
+            "networks": [
+                {"id": "n0", "type": "ipv4_dhcp", "link": "enp2s0"},
+                {
+                    "id": "n1", "type": "ipv4", "link": "enp1s0",
+                    "ip_address": "192.0.2.10", "netmask": "255.255.255.0",
+                    "routes": [{"network": "0.0.0.0", "netmask": "0.0.0.0", "gateway": "192.0.2.1"}],
+                },
+                {"id": "n2", "type": "ipv6", "link": "enp1s0", "ip_address": "2001:db8::10/64"},
+                {"id": "n3", "type": "ipv4", "link": "missing", "ip_address": "198.51.100.10"},
+            ],
+            "services": [
+                {"type": "dns", "address": "192.0.2.53"},
+                {"type": "ntp", "address": "192.0.2.123"},
+            ],
+        }))
+        .unwrap();
+
+        let interfaces = data.interfaces(false).unwrap();
+        assert_eq!(interfaces.len(), 2);
+
+        // DHCP addressing, with static DNS
+        let iface = &interfaces[0];
+        assert_eq!(
+            iface.mac_address,
+            Some(MacAddr::from_str("52:54:00:aa:bb:02").unwrap())
+        );
+        assert!(iface.dhcp);
+        assert!(iface.ip_addresses.is_empty());
+        assert_eq!(iface.nameservers, vec![IpAddr::from([192, 0, 2, 53])]);
+
+        let iface = &interfaces[1];
+        assert!(!iface.dhcp);
+        assert_eq!(iface.name, None);
+        assert_eq!(
+            iface.mac_address,
+            Some(MacAddr::from_str("52:54:00:aa:bb:01").unwrap())
+        );
+        assert_eq!(iface.mtu, Some(9000));
+        assert_eq!(iface.nameservers, vec![IpAddr::from([192, 0, 2, 53])]);
+        assert_eq!(
+            iface.ip_addresses,
+            vec![
+                IpNetwork::from_str("192.0.2.10/24").unwrap(),
+                IpNetwork::from_str("2001:db8::10/64").unwrap(),
+            ]
+        );
+        assert_eq!(iface.routes.len(), 1);
+        assert_eq!(iface.routes[0].gateway, IpAddr::from([192, 0, 2, 1]));
+
+        let data: NetworkData = serde_json::from_str(r#"{"links": [], "networks": [{"id": "n1", "type": "ipv4", "link": "enp1s0", "ip_address": "bogus"}]}"#).unwrap();
+        assert!(data.interfaces(false).unwrap().is_empty());
+        data.interfaces(true).unwrap_err();
+        let data: NetworkData = serde_json::from_str(r#"{"links": [{"id": "l"}], "networks": [{"id": "n1", "type": "ipv4", "link": "l", "ip_address": "bogus"}]}"#).unwrap();
+        data.interfaces(false).unwrap_err();
+
+        // links which can't be matched are only skipped in lenient mode
+        let data: NetworkData = serde_json::from_str(r#"{"links": [{"id": "l"}], "networks": [{"id": "n1", "type": "ipv4", "link": "l", "ip_address": "192.0.2.10"}]}"#).unwrap();
+        assert!(data.interfaces(false).unwrap().is_empty());
+        data.interfaces(true).unwrap_err();
+    }
+}
@@ -1,5 +1,6 @@
 use crate::providers::{packet, MetadataProvider};
 use mockito::{self, Matcher};
+use std::net::IpAddr;
 
 #[test]
 fn test_boot_checkin() {
@@ -18,8 +19,15 @@ fn test_boot_checkin() {
         },
         error: None,
         phone_home_url: mockito::server_url(),
+        ipxe_script_url: None,
+    };
+    let provider = packet::PacketProvider {
+        client: crate::retry::Client::try_new().unwrap(),
+        data,
+        bond_name: None,
+        default_dns: vec![],
+        strict_network: false,
     };
-    let provider = packet::PacketProvider { data };
 
     let mock = mockito::mock("POST", "/")
         .match_header(
@@ -126,3 +134,466 @@ fn test_packet_attributes() {
     let client = crate::retry::Client::try_new().unwrap().max_retries(0);
     packet::PacketProvider::fetch_content(Some(client)).unwrap_err();
 }
+
+#[test]
+fn test_packet_bond_name_override() {
+    let metadata = r#"{
+        "id": "test-id",
+        "hostname": "test-hostname",
+        "iqn": "test-iqn",
+        "plan": "test-plan",
+        "facility": "test-facility",
+        "tags": [],
+        "ssh_keys": [],
+        "network": {
+            "interfaces": [
+              { "name": "eth0", "mac": "24:8a:07:aa:bb:c0", "bond": "bond0" },
+              { "name": "eth1", "mac": "24:8a:07:aa:bb:c1", "bond": "bond0" }
+            ],
+            "addresses": [
+              {
+                "id": "fde74ec8-bc24-43ca-a852-875bd6e10bee",
+                "address_family": 4,
+                "netmask": "255.255.255.254",
+                "public": true,
+                "management": true,
+                "address": "147.0.0.1",
+                "gateway": "147.0.0.0"
+              }
+            ],
+            "bonding": { "mode": 4 }
+        },
+        "phone_home_url": "test-url"
+    }"#;
+
+    let _m = mockito::mock("GET", "/metadata")
+        .with_status(200)
+        .with_body(metadata)
+        .create();
+
+    let provider = packet::PacketProvider::try_new()
+        .unwrap()
+        .bond_name(Some("uplink0".to_string()));
+    let dns = vec!["1.1.1.1".parse().unwrap()];
+    let (interfaces, devices) = provider.build_network(dns).unwrap();
+
+    assert_eq!(devices.len(), 1);
+    assert_eq!(devices[0].netdev_unit_name(), "05-uplink0.netdev");
+    assert!(devices[0].sd_netdev_config().contains("Name=uplink0\n"));
+
+    let members: Vec<_> = interfaces.iter().filter(|i| i.name.is_none()).collect();
+    assert_eq!(members.len(), 2);
+    for member in members {
+        assert!(member.config().contains("Bond=uplink0\n"));
+    }
+
+    let bond = interfaces
+        .iter()
+        .find(|i| i.name == Some("uplink0".to_string()))
+        .unwrap();
+    assert_eq!(bond.sd_network_unit_name().unwrap(), "05-uplink0.network");
+    assert!(!interfaces.iter().any(|i| i.config().contains("bond0")));
+
+    mockito::reset();
+}
+
+#[test]
+fn test_packet_default_dns() {
+    let _m = mockito::mock("GET", "/metadata")
+        .with_status(200)
+        .with_body(
+            r#"{
+        "id": "test-id",
+        "hostname": "test-hostname",
+        "iqn": "test-iqn",
+        "plan": "test-plan",
+        "facility": "test-facility",
+        "tags": [],
+        "ssh_keys": [],
+        "network": { "interfaces": [], "addresses": [], "bonding": { "mode": 4 } },
+        "phone_home_url": "test-url"
+    }"#,
+        )
+        .create();
+
+    let fallback: Vec<IpAddr> = vec!["1.1.1.1".parse().unwrap(), "8.8.8.8".parse().unwrap()];
+    let provider = packet::PacketProvider::try_new()
+        .unwrap()
+        .default_dns(fallback.clone());
+
+    // state file without DNS lines
+    let state = "# This is private data. Do not parse.\nOPER_STATE=routable\n";
+    let dns = provider.parse_dns_servers(state.as_bytes()).unwrap();
+    assert_eq!(dns, fallback);
+
+    // discovered servers take precedence
+    let state = "OPER_STATE=routable\nDNS=147.75.207.207 147.75.207.208\n";
+    let dns = provider.parse_dns_servers(state.as_bytes()).unwrap();
+    assert_eq!(
+        dns,
+        vec![
+            "147.75.207.207".parse::<IpAddr>().unwrap(),
+            "147.75.207.208".parse::<IpAddr>().unwrap()
+        ]
+    );
+
+    mockito::reset();
+}
+
+#[test]
+fn test_packet_error_response() {
+    let _m = mockito::mock("GET", "/metadata")
+        .with_status(200)
+        .with_body(r#"{"error": "Not found"}"#)
+        .create();
+
+    let client = crate::retry::Client::try_new().unwrap().max_retries(0);
+    let err = packet::PacketProvider::fetch_content(Some(client)).unwrap_err();
+    assert!(err.to_string().contains("Not found"), "{:?}", err);
+
+    // Other malformed content is reported as a parsing error.
+    let _m = mockito::mock("GET", "/metadata")
+        .with_status(200)
+        .with_body(r#"{"hostname": "test-hostname"}"#)
+        .create();
+    let client = crate::retry::Client::try_new().unwrap().max_retries(0);
+    let err = packet::PacketProvider::fetch_content(Some(client)).unwrap_err();
+    assert!(err.to_string().contains("failed to parse"), "{:?}", err);
+
+    mockito::reset();
+}
+
+#[test]
+fn test_packet_unit_ordering() {
+    let metadata = r#"{
+        "id": "test-id",
+        "hostname": "test-hostname",
+        "iqn": "test-iqn",
+        "plan": "test-plan",
+        "facility": "test-facility",
+        "tags": [],
+        "ssh_keys": [],
+        "network": {
+            "interfaces": [
+              { "name": "eth0", "mac": "24:8a:07:aa:bb:c0", "bond": "bond0" },
+              { "name": "eth1", "mac": "24:8a:07:aa:bb:c1", "bond": "bond0" }
+            ],
+            "addresses": [],
+            "bonding": { "mode": 4 }
+        },
+        "phone_home_url": "test-url"
+    }"#;
+
+    let _m = mockito::mock("GET", "/metadata")
+        .with_status(200)
+        .with_body(metadata)
+        .create();
+
+    let provider = packet::PacketProvider::try_new().unwrap();
+    let dns = vec!["1.1.1.1".parse().unwrap()];
+    let (interfaces, _devices) = provider.build_network(dns).unwrap();
+
+    // networkd applies the first matching unit in lexical order, the bond
+    // must precede its members, which share its MAC address.
+    let mut unit_names: Vec<String> = interfaces
+        .iter()
+        .map(|i| i.sd_network_unit_name().unwrap())
+        .collect();
+    unit_names.sort();
+    assert_eq!(
+        unit_names,
+        vec![
+            "05-bond0.network",
+            "10-24:8a:07:aa:bb:c0.network",
+            "10-24:8a:07:aa:bb:c1.network",
+        ]
+    );
+
+    mockito::reset();
+}
+
+#[test]
+fn test_packet_strict_network() {
+    // an address, but no bond to assign it to
+    let metadata = r#"{
+        "id": "test-id",
+        "hostname": "test-hostname",
+        "iqn": "test-iqn",
+        "plan": "test-plan",
+        "facility": "test-facility",
+        "tags": [],
+        "ssh_keys": [],
+        "network": {
+            "interfaces": [
+              { "name": "eth0", "mac": "24:8a:07:aa:bb:c0" }
+            ],
+            "addresses": [
+              {
+                "id": "test-address",
+                "address_family": 4,
+                "public": true,
+                "management": true,
+                "address": "147.75.0.10",
+                "netmask": "255.255.255.254",
+                "gateway": "147.75.0.9"
+              }
+            ],
+            "bonding": { "mode": 4 }
+        },
+        "phone_home_url": "test-url"
+    }"#;
+
+    let _m = mockito::mock("GET", "/metadata")
+        .with_status(200)
+        .with_body(metadata)
+        .create();
+
+    // lenient mode skips the address
+    let provider = packet::PacketProvider::try_new().unwrap();
+    let (interfaces, devices) = provider.build_network(vec![]).unwrap();
+    assert_eq!(interfaces.len(), 1);
+    assert!(interfaces[0].ip_addresses.is_empty());
+    assert!(devices.is_empty());
+
+    let provider = provider.strict_network(true);
+    provider.build_network(vec![]).unwrap_err();
+
+    mockito::reset();
+}
+
+#[test]
+fn test_packet_ipxe_and_user_data() {
+    let metadata = r#"{
+        "id": "test-id",
+        "hostname": "test-hostname",
+        "iqn": "test-iqn",
+        "plan": "test-plan",
+        "facility": "test-facility",
+        "tags": [],
+        "ssh_keys": [],
+        "network": {
+            "interfaces": [],
+            "addresses": [],
+            "bonding": { "mode": 0 }
+        },
+        "phone_home_url": "test-url",
+        "ipxe_script_url": "https://boot.example.com/ipxe"
+    }"#;
+    let user_data = "#!/bin/sh\necho hello\n";
+
+    let _m = mockito::mock("GET", "/metadata")
+        .with_status(200)
+        .with_body(metadata)
+        .create();
+    let _m_user_data = mockito::mock("GET", "/userdata")
+        .with_status(200)
+        .with_body(user_data)
+        .create();
+
+    let provider = packet::PacketProvider::try_new().unwrap();
+    let attributes = provider.attributes().unwrap();
+    assert_eq!(
+        attributes["PACKET_IPXE_SCRIPT_URL"],
+        "https://boot.example.com/ipxe"
+    );
+    assert_eq!(provider.user_data().unwrap(), Some(user_data.to_string()));
+
+    let dir = tempfile::tempdir().unwrap();
+    let path = dir.path().join("user-data");
+    provider
+        .write_user_data(path.to_string_lossy().into_owned())
+        .unwrap();
+    assert_eq!(std::fs::read_to_string(&path).unwrap(), user_data);
+    mockito::reset();
+
+    // empty user data is not written
+    let _m_user_data = mockito::mock("GET", "/userdata")
+        .with_status(200)
+        .with_body("")
+        .create();
+    assert_eq!(provider.user_data().unwrap(), None);
+    let path = dir.path().join("empty-user-data");
+    provider
+        .write_user_data(path.to_string_lossy().into_owned())
+        .unwrap();
+    assert!(!path.exists());
+    mockito::reset();
+
+    // neither is missing user data
+    let _m_user_data = mockito::mock("GET", "/userdata").with_status(404).create();
+    assert_eq!(provider.user_data().unwrap(), None);
+    mockito::reset();
+}
+
+#[test]
+fn test_packet_netdev_units() {
+    let metadata = r#"{
+        "id": "test-id",
+        "hostname": "test-hostname",
+        "iqn": "test-iqn",
+        "plan": "test-plan",
+        "facility": "test-facility",
+        "tags": [],
+        "ssh_keys": [],
+        "network": {
+            "interfaces": [
+              { "name": "eth0", "mac": "24:8a:07:aa:bb:c0", "bond": "bond0" },
+              { "name": "eth1", "mac": "24:8a:07:aa:bb:c1", "bond": "bond0" }
+            ],
+            "addresses": [
+              {
+                "id": "fde74ec8-bc24-43ca-a852-875bd6e10bee",
+                "address_family": 4,
+                "netmask": "255.255.255.254",
+                "public": true,
+                "management": true,
+                "address": "147.0.0.1",
+                "gateway": "147.0.0.0"
+              }
+            ],
+            "bonding": { "mode": 4 }
+        },
+        "phone_home_url": "test-url"
+    }"#;
+
+    let _m = mockito::mock("GET", "/metadata")
+        .with_status(200)
+        .with_body(metadata)
+        .create();
+
+    let provider = packet::PacketProvider::try_new().unwrap();
+    let dns = vec!["1.1.1.1".parse().unwrap()];
+    let (interfaces, devices) = provider.build_network(dns).unwrap();
+
+    let mut units: Vec<String> = interfaces
+        .iter()
+        .map(|i| i.sd_network_unit_name().unwrap())
+        .chain(devices.iter().map(|d| d.netdev_unit_name()))
+        .collect();
+    units.sort();
+    assert_eq!(
+        units,
+        vec![
+            "05-bond0.netdev",
+            "05-bond0.network",
+            "10-24:8a:07:aa:bb:c0.network",
+            "10-24:8a:07:aa:bb:c1.network",
+        ]
+    );
+
+    // the bond device carries the bonding settings from metadata
+    assert_eq!(
+        devices[0].sd_netdev_config(),
+        "[NetDev]
+Name=bond0
+Kind=bond
+MACAddress=24:8a:07:aa:bb:c0
+
+[Bond]
+TransmitHashPolicy=layer3+4
+MIIMonitorSec=.1
+UpDelaySec=.2
+DownDelaySec=.2
+Mode=802.3ad
+LACPTransmitRate=fast
+"
+    );
+
+    mockito::reset();
+}
+
+#[test]
+fn test_packet_route_metrics() {
+    let metadata = r#"{
+        "id": "test-id",
+        "hostname": "test-hostname",
+        "iqn": "test-iqn",
+        "plan": "test-plan",
+        "facility": "test-facility",
+        "tags": [],
+        "ssh_keys": [],
+        "network": {
+            "interfaces": [
+              { "name": "eth0", "mac": "24:8a:07:aa:bb:c0", "bond": "bond0" }
+            ],
+            "addresses": [
+              {
+                "id": "a1",
+                "address_family": 4,
+                "netmask": "255.255.255.254",
+                "public": true,
+                "management": true,
+                "address": "147.0.0.1",
+                "gateway": "147.0.0.0"
+              },
+              {
+                "id": "a2",
+                "address_family": 6,
+                "netmask": "ffff:ffff:ffff:ffff:ffff:ffff:ffff:fffe",
+                "public": true,
+                "management": true,
+                "address": "2604:1380::1",
+                "gateway": "2604:1380::"
+              },
+              {
+                "id": "a3",
+                "address_family": 4,
+                "netmask": "255.255.255.254",
+                "public": false,
+                "management": true,
+                "address": "10.0.0.3",
+                "gateway": "10.0.0.2"
+              },
+              {
+                "id": "a4",
+                "address_family": 6,
+                "netmask": "ffff:ffff:ffff:ffff:ffff:ffff:ffff:fffe",
+                "public": false,
+                "management": false,
+                "address": "fd00::1",
+                "gateway": "fd00::"
+              }
+            ],
+            "bonding": { "mode": 4 }
+        },
+        "phone_home_url": "test-url"
+    }"#;
+
+    let _m = mockito::mock("GET", "/metadata")
+        .with_status(200)
+        .with_body(metadata)
+        .create();
+
+    let provider = packet::PacketProvider::try_new().unwrap();
+    let dns = vec!["1.1.1.1".parse().unwrap()];
+    let (interfaces, _devices) = provider.build_network(dns).unwrap();
+    let bond = interfaces
+        .iter()
+        .find(|i| i.name == Some("bond0".to_string()))
+        .unwrap();
+
+    // both IPv6 addresses give a default route, the public one wins
+    let config = bond.config();
+    for route in &[
+        "[Route]\nDestination=0.0.0.0/0\nGateway=147.0.0.0\n\n",
+        "[Route]\nDestination=::/0\nGateway=2604:1380::\n\n",
+        "[Route]\nDestination=10.0.0.0/8\nGateway=10.0.0.2\nMetric=2048\n\n",
+        "[Route]\nDestination=::/0\nGateway=fd00::\nMetric=2048\n",
+    ] {
+        assert!(config.contains(route), "{}", config);
+    }
+
+    // routes without a metric get the kernel default, 1024 for IPv6
+    let ipv6_metric = |gateway: &str| {
+        let gateway: IpAddr = gateway.parse().unwrap();
+        bond.routes
+            .iter()
+            .find(|r| r.gateway == gateway)
+            .unwrap()
+            .metric
+            .unwrap_or(1024)
+    };
+    assert!(ipv6_metric("2604:1380::") < ipv6_metric("fd00::"));
+
+    mockito::reset();
+}
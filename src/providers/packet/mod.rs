@@ -19,6 +19,7 @@
 
 use std::collections::HashMap;
 use std::fs::File;
+use std::io::Read;
 use std::net::{IpAddr, Ipv4Addr, Ipv6Addr};
 use std::str::FromStr;
 
@@ -28,7 +29,7 @@ use pnet_base::MacAddr;
 use serde_derive::Deserialize;
 use slog_scope::warn;
 
-use crate::network::{self, Interface, NetworkRoute};
+use crate::network::{self, Interface, InterfaceRole, NetworkRoute};
 use crate::providers::MetadataProvider;
 use crate::retry;
 use crate::util;
@@ -51,6 +52,13 @@ struct PacketData {
 
     error: Option<String>,
     phone_home_url: String,
+    ipxe_script_url: Option<String>,
+}
+
+/// Error response from the metadata endpoint, lacking all device fields.
+#[derive(Clone, Debug, Deserialize)]
+struct PacketErrorResponse {
+    error: Option<String>,
 }
 
 #[derive(Clone, Debug, Deserialize)]
@@ -85,9 +93,21 @@ struct PacketAddressInfo {
 
 #[derive(Clone, Debug)]
 pub struct PacketProvider {
+    client: retry::Client,
     data: PacketData,
+    bond_name: Option<String>,
+    default_dns: Vec<IpAddr>,
+    strict_network: bool,
 }
 
+/// systemd-networkd state file, listing the DNS servers in use.
+const NETIF_STATE_PATH: &str = "/run/systemd/netif/state";
+
+/// Metric of routes through private gateways, above the kernel default of
+/// IPv6 routes (1024) and IPv4 routes (0), so that routes through public
+/// gateways are preferred.
+const PRIVATE_ROUTE_METRIC: u32 = 2048;
+
 impl PacketProvider {
     /// Try to build a new provider client.
     ///
@@ -103,12 +123,49 @@ impl PacketProvider {
             None => retry::Client::try_new()?,
         };
 
-        let data: PacketData = client
-            .get(retry::Json, Self::endpoint_for("metadata"))
+        let body: String = client
+            .get(retry::Raw, Self::endpoint_for("metadata"))
             .send()?
             .ok_or_else(|| anyhow!("metadata endpoint unreachable"))?;
+        let data = Self::parse_metadata(&body)?;
+
+        Ok(Self {
+            client,
+            data,
+            bond_name: None,
+            default_dns: vec![],
+            strict_network: false,
+        })
+    }
+
+    /// Parse metadata content, reporting error responses from the endpoint.
+    fn parse_metadata(body: &str) -> Result<PacketData> {
+        serde_json::from_str(body).or_else(|e| {
+            match serde_json::from_str::<PacketErrorResponse>(body) {
+                Ok(PacketErrorResponse { error: Some(msg) }) => {
+                    bail!("metadata endpoint returned an error: {}", msg)
+                }
+                _ => Err(e).context("failed to parse metadata JSON"),
+            }
+        })
+    }
+
+    /// Override the name of the bond device advertised in metadata.
+    pub fn bond_name(mut self, name: Option<String>) -> Self {
+        self.bond_name = name;
+        self
+    }
+
+    /// Set the DNS servers to use when none are discovered.
+    pub fn default_dns(mut self, servers: Vec<IpAddr>) -> Self {
+        self.default_dns = servers;
+        self
+    }
 
-        Ok(Self { data })
+    /// Fail on addresses which can't be assigned, instead of skipping them.
+    pub fn strict_network(mut self, strict: bool) -> Self {
+        self.strict_network = strict;
+        self
     }
 
     #[cfg(test)]
@@ -183,57 +240,106 @@ impl PacketProvider {
             self.data.phone_home_url.clone(),
         ));
         attrs.push(("PACKET_PLAN".to_owned(), self.data.plan.clone()));
+        if let Some(url) = self.data.ipxe_script_url.clone().filter(|u| !u.is_empty()) {
+            attrs.push(("PACKET_IPXE_SCRIPT_URL".to_owned(), url));
+        }
         attrs
     }
 
-    fn get_dns_servers() -> Result<Vec<IpAddr>> {
-        let f = File::open("/run/systemd/netif/state")
-            .context("failed to open /run/systemd/netif/state")?;
-        let ip_strings = util::key_lookup('=', "DNS", f)
-            .context("failed to parse /run/systemd/netif/state")?
-            .ok_or_else(|| anyhow!("DNS not found in netif state file"))?;
+    fn get_dns_servers(&self) -> Result<Vec<IpAddr>> {
+        let f = File::open(NETIF_STATE_PATH)
+            .with_context(|| format!("failed to open {}", NETIF_STATE_PATH))?;
+        self.parse_dns_servers(f)
+    }
+
+    /// Parse DNS servers from netif state, falling back to the default
+    /// servers if none are listed.
+    fn parse_dns_servers<R: Read>(&self, state: R) -> Result<Vec<IpAddr>> {
+        let ip_strings = util::key_lookup('=', "DNS", state)
+            .with_context(|| format!("failed to parse {}", NETIF_STATE_PATH))?
+            .unwrap_or_default();
         let mut addrs = Vec::new();
-        for ip_string in ip_strings.split(' ') {
+        for ip_string in ip_strings.split_whitespace() {
             addrs.push(IpAddr::from_str(ip_string).context("failed to parse IP address")?);
         }
         if addrs.is_empty() {
-            bail!("no DNS servers in /run/systemd/netif/state");
+            warn!(
+                "no DNS servers in {}, using default servers {:?}",
+                NETIF_STATE_PATH, self.default_dns
+            );
+            addrs = self.default_dns.clone();
         }
         Ok(addrs)
     }
 
     fn parse_network(&self) -> Result<(Vec<Interface>, Vec<network::VirtualNetDev>)> {
+        let dns_servers = self.get_dns_servers()?;
+        self.build_network(dns_servers)
+    }
+
+    fn build_network(
+        &self,
+        dns_servers: Vec<IpAddr>,
+    ) -> Result<(Vec<Interface>, Vec<network::VirtualNetDev>)> {
         let netinfo = &self.data.network;
         let mut interfaces = Vec::new();
         let mut bonds = Vec::new();
-        let dns_servers = PacketProvider::get_dns_servers()?;
+
+        // a custom bond name can only replace a single bond from metadata
+        if self.bond_name.is_some() {
+            let mut names: Vec<&String> = netinfo
+                .interfaces
+                .iter()
+                .filter_map(|i| i.bond.as_ref())
+                .collect();
+            names.sort();
+            names.dedup();
+            if names.len() > 1 {
+                bail!(
+                    "cannot override bond name, multiple bonds in metadata: {:?}",
+                    names
+                );
+            }
+        }
+
         for i in netinfo.interfaces.clone() {
             let mac = MacAddr::from_str(&i.mac)
                 .with_context(|| format!("failed to parse mac address: '{}'", i.mac))?;
+            let bond = i.bond.map(|name| self.bond_name.clone().unwrap_or(name));
             interfaces.push(Interface {
                 mac_address: Some(mac),
-                bond: i.bond.clone(),
+                bond: bond.clone(),
+                vlans: vec![],
+                tunnels: vec![],
                 name: None,
-                priority: 10,
+                priority: InterfaceRole::Physical.priority(),
                 nameservers: Vec::new(),
                 ip_addresses: Vec::new(),
                 routes: Vec::new(),
                 // the interface should be unmanaged if it doesn't have a bond
                 // section
-                unmanaged: i.bond.is_none(),
+                unmanaged: bond.is_none(),
+                dhcp: false,
+                mtu: None,
+                search_domains: vec![],
             });
 
             // if there is a bond key, make sure we have a bond device for it
-            if let Some(ref bond_name) = i.bond {
+            if let Some(ref bond_name) = bond {
                 let bond = Interface {
                     name: Some(bond_name.clone()),
-                    priority: 5,
+                    priority: InterfaceRole::Bond.priority(),
                     nameservers: dns_servers.clone(),
                     mac_address: None,
                     bond: None,
+                    vlans: vec![],
+                    tunnels: vec![],
                     ip_addresses: Vec::new(),
                     routes: Vec::new(),
                     unmanaged: false,
+                    dhcp: false,
+                    mtu: None,
+                    search_domains: vec![],
                 };
                 if !bonds
                     .iter()
@@ -267,30 +373,42 @@ impl PacketProvider {
                         Ipv6Network::new(Ipv6Addr::new(0, 0, 0, 0, 0, 0, 0, 0), 0).unwrap(),
                     ),
                 };
+                // private IPv6 addresses also get a default route, which
+                // must not win over the public one
+                let metric = if a.public {
+                    None
+                } else {
+                    Some(PRIVATE_ROUTE_METRIC)
+                };
                 first_bond.routes.push(NetworkRoute {
                     destination: dest,
                     gateway: a.gateway,
+                    metric,
                 });
             }
         } else {
+            if self.strict_network && !netinfo.addresses.is_empty() {
+                bail!("no bond interfaces, cannot assign addresses");
+            }
             warn!("no bond interfaces. addresses are left unassigned.");
             // the rest of the function operates on bonds, so just return
             return Ok((interfaces, vec![]));
         }
 
-        let mut attrs = vec![
-            ("TransmitHashPolicy".to_owned(), "layer3+4".to_owned()),
-            ("MIIMonitorSec".to_owned(), ".1".to_owned()),
-            ("UpDelaySec".to_owned(), ".2".to_owned()),
-            ("DownDelaySec".to_owned(), ".2".to_owned()),
-            (
-                "Mode".to_owned(),
-                network::bonding_mode_to_string(netinfo.bonding.mode)?,
-            ),
-        ];
-        if netinfo.bonding.mode == network::BONDING_MODE_LACP {
-            attrs.push(("LACPTransmitRate".to_owned(), "fast".to_owned()));
+        let lacp_transmit_rate = if netinfo.bonding.mode == network::BONDING_MODE_LACP {
+            Some("fast".to_owned())
+        } else {
+            None
+        };
+        let bond_section = network::BondConfig {
+            mode: netinfo.bonding.mode,
+            transmit_hash_policy: Some("layer3+4".to_owned()),
+            mii_monitor_sec: Some(".1".to_owned()),
+            up_delay_sec: Some(".2".to_owned()),
+            down_delay_sec: Some(".2".to_owned()),
+            lacp_transmit_rate,
         }
+        .sd_section()?;
 
         let mut network_devices = Vec::with_capacity(bonds.len());
         for (mac, bond) in bonds {
@@ -303,10 +421,7 @@ impl PacketProvider {
                 kind: network::NetDevKind::Bond,
                 mac_address: mac,
                 priority: Some(5),
-                sd_netdev_sections: vec![network::SdSection {
-                    name: "Bond".to_owned(),
-                    attributes: attrs.clone(),
-                }],
+                sd_netdev_sections: vec![bond_section.clone()],
             };
             network_devices.push(bond_netdev);
 
@@ -351,9 +466,18 @@ impl MetadataProvider for PacketProvider {
     }
 
     fn boot_checkin(&self) -> Result<()> {
-        let client = retry::Client::try_new()?;
         let url = self.data.phone_home_url.clone();
-        client.post(retry::Json, url, None).dispatch_post()?;
+        self.client.post(retry::Json, url, None).dispatch_post()?;
         Ok(())
     }
+
+    fn user_data(&self) -> Result<Option<String>> {
+        let user_data: Option<String> = self
+            .client
+            .clone()
+            .return_on_404(true)
+            .get(retry::Raw, Self::endpoint_for("userdata"))
+            .send()?;
+        Ok(user_data.filter(|d| !d.is_empty()))
+    }
 }
@@ -0,0 +1,297 @@
+//! Metadata fetcher for QEMU/KVM guests (e.g. on libvirt), via fw_cfg.
+//!
+//! Metadata is passed as a JSON document through the QEMU firmware
+//! configuration device, e.g. with
+//! `-fw_cfg name=opt/com.coreos/metadata,file=metadata.json`, and read back
+//! from sysfs.
+
+use std::collections::HashMap;
+use std::fs;
+use std::net::{IpAddr, Ipv4Addr, Ipv6Addr};
+use std::path::Path;
+use std::process::Command;
+use std::str::FromStr;
+
+use anyhow::{bail, Context, Result};
+use ipnetwork::IpNetwork;
+use openssh_keys::PublicKey;
+use pnet_base::MacAddr;
+use serde_derive::Deserialize;
+use slog_scope::{debug, warn};
+
+use crate::network;
+use crate::providers::MetadataProvider;
+
+/// Path of the metadata blob, as exposed by the fw_cfg sysfs driver.
+const FW_CFG_PATH: &str = "/sys/firmware/qemu_fw_cfg/by_name/opt/com.coreos/metadata/raw";
+
+/// Kernel module exposing fw_cfg entries in sysfs.
+const FW_CFG_MODULE: &str = "qemu_fw_cfg";
+
+/// Network configuration of an interface.
+#[derive(Clone, Debug, Deserialize)]
+struct InterfaceConfig {
+    name: Option<String>,
+    mac: Option<String>,
+    #[serde(default)]
+    dhcp: bool,
+    /// Static addresses, in CIDR notation.
+    #[serde(default)]
+    addresses: Vec<String>,
+    /// Gateways for default routes.
+    #[serde(default)]
+    gateways: Vec<IpAddr>,
+    #[serde(default)]
+    nameservers: Vec<IpAddr>,
+    #[serde(default, rename = "search-domains")]
+    search_domains: Vec<String>,
+    mtu: Option<u32>,
+}
+
+impl InterfaceConfig {
+    fn to_network(&self) -> Result<network::Interface> {
+        if self.name.is_none() && self.mac.is_none() {
+            bail!("interface without a name nor a MAC address");
+        }
+        let mac_address = self
+            .mac
+            .as_deref()
+            .map(|mac| {
+                MacAddr::from_str(mac)
+                    .with_context(|| format!("failed to parse mac address '{}'", mac))
+            })
+            .transpose()?;
+        let ip_addresses = self
+            .addresses
+            .iter()
+            .map(|addr| {
+                IpNetwork::from_str(addr)
+                    .with_context(|| format!("failed to parse address '{}'", addr))
+            })
+            .collect::<Result<Vec<_>>>()?;
+        let routes = self
+            .gateways
+            .iter()
+            .map(|gateway| {
+                let destination = match gateway {
+                    IpAddr::V4(_) => IpNetwork::new(IpAddr::V4(Ipv4Addr::UNSPECIFIED), 0),
+                    IpAddr::V6(_) => IpNetwork::new(IpAddr::V6(Ipv6Addr::UNSPECIFIED), 0),
+                }
+                .context("invalid default route")?;
+                Ok(network::NetworkRoute {
+                    destination,
+                    gateway: *gateway,
+                    metric: None,
+                })
+            })
+            .collect::<Result<Vec<_>>>()?;
+
+        Ok(network::Interface {
+            name: self.name.clone(),
+            mac_address,
+            priority: 10,
+            nameservers: self.nameservers.clone(),
+            ip_addresses,
+            routes,
+            bond: None,
+            vlans: vec![],
+            tunnels: vec![],
+            unmanaged: false,
+            dhcp: self.dhcp,
+            mtu: self.mtu,
+            search_domains: self.search_domains.clone(),
+        })
+    }
+}
+
+/// Metadata document.
+#[derive(Clone, Debug, Default, Deserialize)]
+struct Metadata {
+    hostname: Option<String>,
+    #[serde(rename = "instance-id")]
+    instance_id: Option<String>,
+    #[serde(rename = "ssh-keys", default)]
+    ssh_keys: Vec<String>,
+    #[serde(default)]
+    interfaces: Vec<InterfaceConfig>,
+}
+
+/// QEMU fw_cfg provider.
+#[derive(Clone, Debug)]
+pub struct QemuProvider {
+    metadata: Metadata,
+}
+
+impl QemuProvider {
+    /// Read metadata from fw_cfg, loading the sysfs driver if needed.
+    ///
+    /// Guests started without a metadata blob get empty metadata, so that
+    /// e.g. SSH keys are a no-op rather than a failure.
+    pub fn try_new() -> Result<Self> {
+        let path = Path::new(FW_CFG_PATH);
+        if !path.exists() {
+            load_fw_cfg_module();
+        }
+        if !path.exists() {
+            warn!("no metadata found in fw_cfg, using empty metadata");
+            return Ok(Self {
+                metadata: Metadata::default(),
+            });
+        }
+        Self::from_file(path)
+    }
+
+    /// Read metadata from the given file.
+    fn from_file(path: &Path) -> Result<Self> {
+        let contents =
+            fs::read(path).with_context(|| format!("failed to read file '{:?}'", path))?;
+        let metadata = serde_json::from_slice(&contents)
+            .with_context(|| format!("failed to parse file '{:?}'", path))?;
+        Ok(Self { metadata })
+    }
+}
+
+/// Load the fw_cfg sysfs driver, which isn't always built-in or
+/// auto-loaded. Failures are only logged, as reading metadata then fails
+/// with a more meaningful error.
+fn load_fw_cfg_module() {
+    debug!("fw_cfg entries not found, loading {}", FW_CFG_MODULE);
+    match Command::new("modprobe").arg(FW_CFG_MODULE).output() {
+        Err(e) => warn!("failed to run modprobe: {}", e),
+        Ok(out) => {
+            if !out.status.success() {
+                warn!(
+                    "failed to load {}: {}",
+                    FW_CFG_MODULE,
+                    String::from_utf8_lossy(&out.stderr)
+                );
+            }
+        }
+    };
+}
+
+impl MetadataProvider for QemuProvider {
+    fn attributes(&self) -> Result<HashMap<String, String>> {
+        let mut out = HashMap::with_capacity(2);
+        let mut add_value = |key: &str, value: &Option<String>| {
+            if let Some(value) = value.as_ref().filter(|v| !v.is_empty()) {
+                out.insert(key.to_string(), value.clone());
+            }
+        };
+        add_value("QEMU_HOSTNAME", &self.metadata.hostname);
+        add_value("QEMU_INSTANCE_ID", &self.metadata.instance_id);
+
+        Ok(out)
+    }
+
+    fn hostname(&self) -> Result<Option<String>> {
+        Ok(self
+            .metadata
+            .hostname
+            .clone()
+            .filter(|hostname| !hostname.is_empty()))
+    }
+
+    fn ssh_keys(&self) -> Result<Vec<PublicKey>> {
+        let mut out = Vec::with_capacity(self.metadata.ssh_keys.len());
+        for key in &self.metadata.ssh_keys {
+            match PublicKey::parse(key) {
+                Ok(key) => out.push(key),
+                Err(e) => warn!("skipping malformed SSH key: {}", e),
+            }
+        }
+        Ok(out)
+    }
+
+    fn networks(&self) -> Result<Vec<network::Interface>> {
+        self.metadata
+            .interfaces
+            .iter()
+            .map(InterfaceConfig::to_network)
+            .collect()
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_fw_cfg() {
+        let provider =
+            QemuProvider::from_file(Path::new("./tests/fixtures/qemu/metadata.json")).unwrap();
+
+        let expected = maplit::hashmap! {
+            "QEMU_HOSTNAME".to_string() => "kvm-guest.example.com".to_string(),
+            "QEMU_INSTANCE_ID".to_string() => "5f1a8d2e-93c4-4c6b-b0a7-2d9e7f3c1a44".to_string(),
+        };
+        assert_eq!(provider.attributes().unwrap(), expected);
+        assert_eq!(
+            provider.hostname().unwrap(),
+            Some("kvm-guest.example.com".to_string())
+        );
+        let keys = provider.ssh_keys().unwrap();
+        assert_eq!(keys.len(), 1);
+        assert_eq!(keys[0].comment, Some("core@example".to_string()));
+
+        let interfaces = provider.networks().unwrap();
+        assert_eq!(interfaces.len(), 2);
+        let expected = network::Interface {
+            name: None,
+            mac_address: Some(MacAddr::from_str("52:54:00:12:34:56").unwrap()),
+            priority: 10,
+            nameservers: vec![IpAddr::from_str("192.0.2.1").unwrap()],
+            ip_addresses: vec![
+                IpNetwork::from_str("192.0.2.10/24").unwrap(),
+                IpNetwork::from_str("2001:db8::10/64").unwrap(),
+            ],
+            routes: vec![
+                network::NetworkRoute {
+                    destination: IpNetwork::from_str("0.0.0.0/0").unwrap(),
+                    gateway: IpAddr::from_str("192.0.2.1").unwrap(),
+                    metric: None,
+                },
+                network::NetworkRoute {
+                    destination: IpNetwork::from_str("::/0").unwrap(),
+                    gateway: IpAddr::from_str("2001:db8::1").unwrap(),
+                    metric: None,
+                },
+            ],
+            bond: None,
+            vlans: vec![],
+            tunnels: vec![],
+            unmanaged: false,
+            dhcp: false,
+            mtu: Some(1500),
+            search_domains: vec!["example.com".to_string()],
+        };
+        assert_eq!(interfaces[0], expected);
+        assert_eq!(interfaces[1].name, Some("eth1".to_string()));
+        assert!(interfaces[1].dhcp);
+    }
+
+    #[test]
+    fn test_fw_cfg_minimal() {
+        let dir = tempfile::tempdir().unwrap();
+        let path = dir.path().join("raw");
+
+        fs::write(&path, "{}").unwrap();
+        let provider = QemuProvider::from_file(&path).unwrap();
+        assert!(provider.attributes().unwrap().is_empty());
+        assert_eq!(provider.hostname().unwrap(), None);
+        assert!(provider.ssh_keys().unwrap().is_empty());
+        assert!(provider.networks().unwrap().is_empty());
+
+        fs::write(&path, r#"{"ssh-keys": ["not a key"]}"#).unwrap();
+        let provider = QemuProvider::from_file(&path).unwrap();
+        assert!(provider.ssh_keys().unwrap().is_empty());
+
+        fs::write(&path, r#"{"interfaces": [{"dhcp": true}]}"#).unwrap();
+        let provider = QemuProvider::from_file(&path).unwrap();
+        provider.networks().unwrap_err();
+
+        fs::write(&path, "not json").unwrap();
+        QemuProvider::from_file(&path).unwrap_err();
+        QemuProvider::from_file(&dir.path().join("missing")).unwrap_err();
+    }
+}
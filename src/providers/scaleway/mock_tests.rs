@@ -0,0 +1,164 @@
+use crate::providers::scaleway;
+use crate::providers::MetadataProvider;
+use mockito;
+
+/// Fetch metadata from the mock server, serving the given configuration.
+fn fetch_provider(body: &str) -> anyhow::Result<scaleway::ScalewayProvider> {
+    let client = crate::retry::Client::try_new().unwrap().max_retries(0);
+    let _m = mockito::mock("GET", "/conf?format=json")
+        .with_status(200)
+        .with_header("content-type", "application/json")
+        .with_body(body)
+        .create();
+    let provider = scaleway::ScalewayProvider::fetch(&client);
+    mockito::reset();
+    provider
+}
+
+#[test]
+fn test_fetch() {
+    let client = crate::retry::Client::try_new().unwrap().max_retries(0);
+
+    let _m = mockito::mock("GET", "/conf?format=json")
+        .with_status(503)
+        .create();
+    scaleway::ScalewayProvider::fetch(&client).unwrap_err();
+
+    let _m = mockito::mock("GET", "/conf?format=json")
+        .with_status(200)
+        .with_body("not json")
+        .create();
+    scaleway::ScalewayProvider::fetch(&client).unwrap_err();
+
+    mockito::reset();
+    scaleway::ScalewayProvider::fetch(&client).unwrap_err();
+}
+
+#[test]
+fn test_attributes() {
+    let fixture = std::fs::read_to_string("./tests/fixtures/scaleway/conf.json").unwrap();
+    let provider = fetch_provider(&fixture).unwrap();
+
+    let attributes = maplit::hashmap! {
+        "SCALEWAY_HOSTNAME".to_string() => "scw-test".to_string(),
+        "SCALEWAY_INSTANCE_ID".to_string() => "6c2a5e0b-4a4e-4f5c-9a55-2ea5d8c1b7a3".to_string(),
+        "SCALEWAY_INSTANCE_TYPE".to_string() => "DEV1-S".to_string(),
+        "SCALEWAY_IPV4_PUBLIC".to_string() => "51.15.0.10".to_string(),
+        "SCALEWAY_IPV4_PRIVATE".to_string() => "10.64.0.5".to_string(),
+        "SCALEWAY_IPV6_PUBLIC".to_string() => "2001:bc8:1200:1::1".to_string(),
+        "SCALEWAY_ZONE_ID".to_string() => "fr-par-1".to_string(),
+        "SCALEWAY_PRIVATE_NETWORK_ID_0".to_string() => "b7c8d9e0-f1a2-4b3c-8d4e-5f6a7b8c9d0e".to_string(),
+        "SCALEWAY_PRIVATE_MAC_0".to_string() => "02:00:00:00:2a:01".to_string(),
+    };
+    assert_eq!(provider.attributes().unwrap(), attributes);
+    assert_eq!(provider.hostname().unwrap(), Some("scw-test".to_string()));
+
+    // no public IP nor IPv6 attached
+    let provider = fetch_provider(
+        r#"{
+            "id": "6c2a5e0b-4a4e-4f5c-9a55-2ea5d8c1b7a3",
+            "hostname": "",
+            "public_ip": null,
+            "private_ip": "10.64.0.5",
+            "ipv6": null,
+            "zone": "fr-par-1"
+        }"#,
+    )
+    .unwrap();
+    let v = provider.attributes().unwrap();
+    assert!(!v.contains_key("SCALEWAY_IPV4_PUBLIC"));
+    assert!(!v.contains_key("SCALEWAY_IPV6_PUBLIC"));
+    assert!(!v.contains_key("SCALEWAY_HOSTNAME"));
+    assert_eq!(v["SCALEWAY_IPV4_PRIVATE"], "10.64.0.5");
+    assert_eq!(provider.hostname().unwrap(), None);
+}
+
+#[test]
+fn test_networks() {
+    let fixture = std::fs::read_to_string("./tests/fixtures/scaleway/conf.json").unwrap();
+    let provider = fetch_provider(&fixture).unwrap();
+
+    // public interface with a static IPv6 address, private one via DHCP
+    let units: Vec<_> = provider
+        .networks()
+        .unwrap()
+        .iter()
+        .map(|iface| (iface.sd_network_unit_name().unwrap(), iface.config()))
+        .collect();
+    assert_eq!(
+        units,
+        vec![
+            (
+                "10-de:00:00:12:34:56.network".to_string(),
+                "[Match]
+MACAddress=de:00:00:12:34:56
+
+[Network]
+DHCP=yes
+
+[Address]
+Address=2001:bc8:1200:1::1/64
+
+[Route]
+Destination=::/0
+Gateway=2001:bc8:1200:1::
+"
+                .to_string()
+            ),
+            (
+                "10-02:00:00:00:2a:01.network".to_string(),
+                "[Match]\nMACAddress=02:00:00:00:2a:01\n\n[Network]\nDHCP=yes\n".to_string()
+            ),
+        ]
+    );
+
+    // IPv4 only
+    let provider = fetch_provider(
+        r#"{
+            "id": "6c2a5e0b-4a4e-4f5c-9a55-2ea5d8c1b7a3",
+            "mac_address": "de:00:00:12:34:56",
+            "ipv6": null
+        }"#,
+    )
+    .unwrap();
+    let interfaces = provider.networks().unwrap();
+    assert_eq!(interfaces.len(), 1);
+    assert!(interfaces[0].dhcp);
+    assert!(interfaces[0].ip_addresses.is_empty());
+    assert!(interfaces[0].routes.is_empty());
+    let attributes = provider.attributes().unwrap();
+    assert!(!attributes.contains_key("SCALEWAY_IPV6_PUBLIC"));
+    assert!(!attributes.contains_key("SCALEWAY_PRIVATE_NETWORK_ID_0"));
+
+    // invalid IPv6 block
+    let provider = fetch_provider(
+        r#"{
+            "id": "6c2a5e0b-4a4e-4f5c-9a55-2ea5d8c1b7a3",
+            "mac_address": "de:00:00:12:34:56",
+            "ipv6": {"address": "2001:bc8:1200:1::1", "gateway": "", "netmask": "wide"}
+        }"#,
+    )
+    .unwrap();
+    provider.networks().unwrap_err();
+}
+
+#[test]
+fn test_ssh_keys() {
+    let fixture = std::fs::read_to_string("./tests/fixtures/scaleway/conf.json").unwrap();
+    let provider = fetch_provider(&fixture).unwrap();
+
+    let keys = provider.ssh_keys().unwrap();
+    assert_eq!(keys.len(), 2);
+    assert_eq!(keys[0].comment, Some("root@example1".to_string()));
+    assert_eq!(keys[1].comment, Some("root@example2".to_string()));
+
+    // invalid keys are skipped
+    let provider = fetch_provider(
+        r#"{
+            "id": "6c2a5e0b-4a4e-4f5c-9a55-2ea5d8c1b7a3",
+            "ssh_public_keys": [{"key": "not a key", "fingerprint": ""}]
+        }"#,
+    )
+    .unwrap();
+    assert_eq!(provider.ssh_keys().unwrap(), vec![]);
+}
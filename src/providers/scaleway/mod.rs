@@ -0,0 +1,241 @@
+//! scaleway provider metadata fetcher
+//! This provider is selected via the platform ID `scaleway`.
+//! All metadata is fetched at once, from the JSON instance configuration.
+
+use std::collections::HashMap;
+use std::net::{IpAddr, Ipv6Addr};
+use std::str::FromStr;
+
+use anyhow::{anyhow, Context, Result};
+use ipnetwork::{IpNetwork, Ipv6Network};
+#[cfg(test)]
+use mockito;
+use openssh_keys::PublicKey;
+use pnet_base::MacAddr;
+use serde_derive::Deserialize;
+use slog_scope::{error, warn};
+
+use crate::network;
+use crate::providers::MetadataProvider;
+use crate::retry;
+
+#[cfg(test)]
+mod mock_tests;
+
+#[derive(Clone, Debug, Deserialize)]
+struct PublicIp {
+    address: String,
+}
+
+/// Public IPv6 block, only present on dual-stack instances.
+#[derive(Clone, Debug, Deserialize)]
+struct Ipv6 {
+    address: String,
+    #[serde(default)]
+    gateway: String,
+    #[serde(default)]
+    netmask: String,
+}
+
+impl Ipv6 {
+    /// Return the address with its prefix, and the gateway if any.
+    fn to_network(&self) -> Result<(IpNetwork, Option<Ipv6Addr>)> {
+        let address = Ipv6Addr::from_str(&self.address)
+            .with_context(|| format!("failed to parse IPv6 address '{}'", self.address))?;
+        let prefix = u8::from_str(&self.netmask)
+            .with_context(|| format!("failed to parse IPv6 netmask '{}'", self.netmask))?;
+        let net = Ipv6Network::new(address, prefix).context("invalid IPv6 address or prefix")?;
+        let gateway = if self.gateway.is_empty() {
+            None
+        } else {
+            let gateway = Ipv6Addr::from_str(&self.gateway)
+                .with_context(|| format!("failed to parse IPv6 gateway '{}'", self.gateway))?;
+            Some(gateway)
+        };
+        Ok((IpNetwork::V6(net), gateway))
+    }
+}
+
+/// Interface attached to a private network.
+#[derive(Clone, Debug, Deserialize)]
+struct PrivateNic {
+    private_network_id: String,
+    mac_address: String,
+}
+
+#[derive(Clone, Debug, Deserialize)]
+struct SshPublicKey {
+    key: String,
+}
+
+/// Instance configuration, served at `/conf?format=json`.
+#[derive(Clone, Debug, Deserialize)]
+struct Metadata {
+    id: String,
+    #[serde(default)]
+    hostname: String,
+    commercial_type: Option<String>,
+    public_ip: Option<PublicIp>,
+    private_ip: Option<String>,
+    ipv6: Option<Ipv6>,
+    /// MAC address of the public interface.
+    mac_address: Option<String>,
+    #[serde(default)]
+    private_nics: Vec<PrivateNic>,
+    zone: Option<String>,
+    #[serde(default)]
+    ssh_public_keys: Vec<SshPublicKey>,
+}
+
+/// Parse a MAC address from metadata.
+fn parse_mac(mac: &str) -> Result<MacAddr> {
+    MacAddr::from_str(mac).with_context(|| format!("failed to parse MAC address '{}'", mac))
+}
+
+/// Build the configuration of an interface, matched by MAC address.
+///
+/// IPv4 addresses of all interfaces come from DHCP.
+fn dhcp_interface(mac: MacAddr) -> network::Interface {
+    network::Interface {
+        name: None,
+        mac_address: Some(mac),
+        priority: 10,
+        nameservers: vec![],
+        ip_addresses: vec![],
+        routes: vec![],
+        bond: None,
+        vlans: vec![],
+        tunnels: vec![],
+        unmanaged: false,
+        dhcp: true,
+        mtu: None,
+        search_domains: vec![],
+    }
+}
+
+#[derive(Clone, Debug)]
+pub struct ScalewayProvider {
+    metadata: Metadata,
+}
+
+impl ScalewayProvider {
+    /// Build a provider fetching metadata with the given client.
+    pub(crate) fn with_client(client: retry::Client) -> Result<ScalewayProvider> {
+        ScalewayProvider::fetch(&client)
+    }
+
+    fn fetch(client: &retry::Client) -> Result<ScalewayProvider> {
+        let metadata: Metadata = client
+            .get(
+                retry::Json,
+                ScalewayProvider::endpoint_for("conf?format=json"),
+            )
+            .send()?
+            .ok_or_else(|| anyhow!("metadata not found"))?;
+
+        Ok(ScalewayProvider { metadata })
+    }
+
+    #[cfg(test)]
+    fn endpoint_for(name: &str) -> String {
+        let url = mockito::server_url();
+        format!("{}/{}", url, name)
+    }
+
+    #[cfg(not(test))]
+    fn endpoint_for(name: &str) -> String {
+        format!("http://169.254.42.42/{}", name)
+    }
+}
+
+impl MetadataProvider for ScalewayProvider {
+    fn attributes(&self) -> Result<HashMap<String, String>> {
+        let mut out = HashMap::with_capacity(7 + 2 * self.metadata.private_nics.len());
+
+        let mut add_value = |key: &str, value: Option<&String>| {
+            if let Some(value) = value.filter(|v| !v.is_empty()) {
+                out.insert(key.to_string(), value.clone());
+            }
+        };
+        add_value("SCALEWAY_HOSTNAME", Some(&self.metadata.hostname));
+        add_value("SCALEWAY_INSTANCE_ID", Some(&self.metadata.id));
+        add_value(
+            "SCALEWAY_INSTANCE_TYPE",
+            self.metadata.commercial_type.as_ref(),
+        );
+        add_value(
+            "SCALEWAY_IPV4_PUBLIC",
+            self.metadata.public_ip.as_ref().map(|ip| &ip.address),
+        );
+        add_value("SCALEWAY_IPV4_PRIVATE", self.metadata.private_ip.as_ref());
+        add_value(
+            "SCALEWAY_IPV6_PUBLIC",
+            self.metadata.ipv6.as_ref().map(|ip| &ip.address),
+        );
+        add_value("SCALEWAY_ZONE_ID", self.metadata.zone.as_ref());
+        for (i, nic) in self.metadata.private_nics.iter().enumerate() {
+            add_value(
+                &format!("SCALEWAY_PRIVATE_NETWORK_ID_{}", i),
+                Some(&nic.private_network_id),
+            );
+            add_value(
+                &format!("SCALEWAY_PRIVATE_MAC_{}", i),
+                Some(&nic.mac_address),
+            );
+        }
+
+        Ok(out)
+    }
+
+    fn hostname(&self) -> Result<Option<String>> {
+        if self.metadata.hostname.is_empty() {
+            return Ok(None);
+        }
+        Ok(Some(self.metadata.hostname.clone()))
+    }
+
+    fn ssh_keys(&self) -> Result<Vec<PublicKey>> {
+        let mut out = Vec::with_capacity(self.metadata.ssh_public_keys.len());
+        for entry in &self.metadata.ssh_public_keys {
+            match PublicKey::parse(&entry.key) {
+                Ok(pk) => out.push(pk),
+                Err(e) => error!("failed to parse SSH Public Key: {}", e),
+            };
+        }
+
+        Ok(out)
+    }
+
+    fn networks(&self) -> Result<Vec<network::Interface>> {
+        let mut out = Vec::with_capacity(1 + self.metadata.private_nics.len());
+
+        // public interface, with a static IPv6 address on dual-stack instances
+        match self.metadata.mac_address {
+            Some(ref mac) => {
+                let mut iface = dhcp_interface(parse_mac(mac)?);
+                if let Some(ref ipv6) = self.metadata.ipv6 {
+                    let (address, gateway) = ipv6.to_network()?;
+                    iface.ip_addresses.push(address);
+                    if let Some(gateway) = gateway {
+                        iface.routes.push(network::NetworkRoute {
+                            destination: IpNetwork::V6(
+                                Ipv6Network::new(Ipv6Addr::UNSPECIFIED, 0)
+                                    .context("invalid default route")?,
+                            ),
+                            gateway: IpAddr::V6(gateway),
+                            metric: None,
+                        });
+                    }
+                }
+                out.push(iface);
+            }
+            None => warn!("no MAC address for the public interface, skipping it"),
+        }
+
+        for nic in &self.metadata.private_nics {
+            out.push(dhcp_interface(parse_mac(&nic.mac_address)?));
+        }
+
+        Ok(out)
+    }
+}
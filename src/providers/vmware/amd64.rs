@@ -2,6 +2,7 @@
 //!
 //! This uses the guest->host backdoor protocol for introspection.
 
+use super::guestinfo::{self, GuestMetadata};
 use super::VmwareProvider;
 use anyhow::{bail, Context, Result};
 
@@ -26,9 +27,21 @@ impl VmwareProvider {
 
         let mut erpc = backdoor.open_enhanced_chan()?;
         let guestinfo_net_kargs = Self::fetch_guestinfo(&mut erpc, INITRD_NET_KARGS)?;
+        let metadata = match Self::fetch_guestinfo(&mut erpc, guestinfo::METADATA_KEY)? {
+            Some(raw) => {
+                let encoding = Self::fetch_guestinfo(&mut erpc, guestinfo::METADATA_ENCODING_KEY)?;
+                // Unsupported payloads must not break network kargs in the initrd.
+                GuestMetadata::parse(&raw, encoding.as_deref()).unwrap_or_else(|e| {
+                    slog_scope::warn!("failed to parse guestinfo metadata: {:#}", e);
+                    GuestMetadata::default()
+                })
+            }
+            None => GuestMetadata::default(),
+        };
 
         let provider = Self {
             guestinfo_net_kargs,
+            metadata,
         };
 
         slog_scope::trace!("cached vmware provider: {:?}", provider);
@@ -39,7 +52,7 @@ impl VmwareProvider {
     fn fetch_guestinfo(erpc: &mut vmw_backdoor::EnhancedChan, key: &str) -> Result<Option<String>> {
         let guestinfo = erpc
             .get_guestinfo(key.as_bytes())
-            .context("failed to retrieve network kargs")?
+            .with_context(|| format!("failed to retrieve guestinfo property '{}'", key))?
             .map(|bytes| String::from_utf8_lossy(&bytes).into_owned());
         Ok(guestinfo)
     }
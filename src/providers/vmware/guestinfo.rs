@@ -0,0 +1,356 @@
+//! Metadata passed through VMware guestinfo properties.
+//!
+//! This follows the conventions of the cloud-init VMware datasource: the
+//! `guestinfo.metadata` document (JSON or YAML) may be encoded, as told by
+//! `guestinfo.metadata.encoding`, and may carry a netplan-style (version 2)
+//! `network` configuration.
+
+use std::collections::{BTreeMap, HashMap};
+use std::net::{IpAddr, Ipv4Addr, Ipv6Addr};
+use std::str::FromStr;
+
+use anyhow::{anyhow, bail, Context, Result};
+use ipnetwork::IpNetwork;
+use openssh_keys::PublicKey;
+use pnet_base::MacAddr;
+use serde_derive::Deserialize;
+
+use crate::network;
+
+/// Guestinfo key for the metadata document.
+pub(crate) static METADATA_KEY: &str = "guestinfo.metadata";
+
+/// Guestinfo key for the encoding of the metadata document.
+pub(crate) static METADATA_ENCODING_KEY: &str = "guestinfo.metadata.encoding";
+
+/// Public SSH keys, either a single (possibly multi-line) string or a list.
+#[derive(Clone, Debug, Deserialize)]
+#[serde(untagged)]
+enum PublicKeys {
+    One(String),
+    Many(Vec<String>),
+}
+
+#[derive(Clone, Debug, Default, Deserialize)]
+struct Match {
+    macaddress: Option<String>,
+    name: Option<String>,
+}
+
+#[derive(Clone, Debug, Default, Deserialize)]
+struct Nameservers {
+    #[serde(default)]
+    addresses: Vec<IpAddr>,
+    #[serde(default)]
+    search: Vec<String>,
+}
+
+/// Configuration of an ethernet device.
+#[derive(Clone, Debug, Default, Deserialize)]
+struct Ethernet {
+    #[serde(rename = "match")]
+    match_: Option<Match>,
+    #[serde(rename = "set-name")]
+    set_name: Option<String>,
+    #[serde(default)]
+    dhcp4: bool,
+    #[serde(default)]
+    dhcp6: bool,
+    /// Static addresses, in CIDR notation.
+    #[serde(default)]
+    addresses: Vec<String>,
+    gateway4: Option<Ipv4Addr>,
+    gateway6: Option<Ipv6Addr>,
+    nameservers: Option<Nameservers>,
+    mtu: Option<u32>,
+}
+
+impl Ethernet {
+    /// Build the network configuration of the device with the given ID.
+    ///
+    /// Without a `match` section, the ID is the interface name.
+    fn to_network(&self, id: &str) -> Result<network::Interface> {
+        let match_ = self.match_.clone().unwrap_or_default();
+        let name = self
+            .set_name
+            .clone()
+            .or(match_.name)
+            .or_else(|| match self.match_ {
+                None => Some(id.to_string()),
+                Some(_) => None,
+            });
+        let mac_address = match_
+            .macaddress
+            .as_deref()
+            .map(|mac| {
+                MacAddr::from_str(mac)
+                    .with_context(|| format!("failed to parse mac address '{}'", mac))
+            })
+            .transpose()?;
+        if name.is_none() && mac_address.is_none() {
+            bail!("ethernet '{}' matches neither a name nor a MAC address", id);
+        }
+
+        let ip_addresses = self
+            .addresses
+            .iter()
+            .map(|addr| {
+                IpNetwork::from_str(addr)
+                    .with_context(|| format!("failed to parse address '{}'", addr))
+            })
+            .collect::<Result<Vec<_>>>()?;
+        let mut routes = Vec::new();
+        if let Some(gateway) = self.gateway4 {
+            routes.push(network::NetworkRoute {
+                destination: IpNetwork::new(IpAddr::V4(Ipv4Addr::UNSPECIFIED), 0)?,
+                gateway: IpAddr::V4(gateway),
+                metric: None,
+            });
+        }
+        if let Some(gateway) = self.gateway6 {
+            routes.push(network::NetworkRoute {
+                destination: IpNetwork::new(IpAddr::V6(Ipv6Addr::UNSPECIFIED), 0)?,
+                gateway: IpAddr::V6(gateway),
+                metric: None,
+            });
+        }
+
+        Ok(network::Interface {
+            name,
+            mac_address,
+            priority: 10,
+            nameservers: self
+                .nameservers
+                .as_ref()
+                .map(|ns| ns.addresses.clone())
+                .unwrap_or_default(),
+            search_domains: self
+                .nameservers
+                .as_ref()
+                .map(|ns| ns.search.clone())
+                .unwrap_or_default(),
+            ip_addresses,
+            routes,
+            bond: None,
+            vlans: vec![],
+            tunnels: vec![],
+            unmanaged: false,
+            dhcp: self.dhcp4 || self.dhcp6,
+            mtu: self.mtu,
+        })
+    }
+}
+
+#[derive(Clone, Debug, Default, Deserialize)]
+struct NetworkConfig {
+    version: Option<u8>,
+    #[serde(default)]
+    ethernets: BTreeMap<String, Ethernet>,
+}
+
+/// Metadata document.
+#[derive(Clone, Debug, Default, Deserialize)]
+pub(crate) struct GuestMetadata {
+    #[serde(rename = "instance-id")]
+    instance_id: Option<String>,
+    #[serde(rename = "local-hostname")]
+    local_hostname: Option<String>,
+    hostname: Option<String>,
+    #[serde(rename = "public-keys", alias = "public_keys")]
+    public_keys: Option<PublicKeys>,
+    network: Option<NetworkConfig>,
+}
+
+impl GuestMetadata {
+    /// Decode and parse the raw metadata document.
+    pub(crate) fn parse(raw: &str, encoding: Option<&str>) -> Result<Self> {
+        let document = match encoding.map(str::trim).unwrap_or_default() {
+            "" => raw.to_string(),
+            "base64" | "b64" => {
+                let decoded = base64::decode(raw.trim()).context("failed to decode base64")?;
+                String::from_utf8(decoded).context("decoded metadata is not UTF-8")?
+            }
+            encoding => bail!("unsupported guestinfo metadata encoding '{}'", encoding),
+        };
+
+        // JSON documents are also valid YAML, but JSON errors are clearer
+        let trimmed = document.trim_start();
+        if trimmed.starts_with('{') {
+            serde_json::from_str(trimmed).context("failed to parse JSON metadata")
+        } else {
+            serde_yaml::from_str(&document).context("failed to parse YAML metadata")
+        }
+    }
+
+    pub(crate) fn attributes(&self) -> HashMap<String, String> {
+        let mut out = HashMap::with_capacity(2);
+        if let Some(instance_id) = self.instance_id.clone().filter(|v| !v.is_empty()) {
+            out.insert("VMWARE_INSTANCE_ID".to_string(), instance_id);
+        }
+        if let Some(hostname) = self.hostname() {
+            out.insert("VMWARE_HOSTNAME".to_string(), hostname);
+        }
+        out
+    }
+
+    pub(crate) fn hostname(&self) -> Option<String> {
+        self.local_hostname
+            .iter()
+            .chain(self.hostname.iter())
+            .find(|h| !h.is_empty())
+            .cloned()
+    }
+
+    pub(crate) fn ssh_keys(&self) -> Result<Vec<PublicKey>> {
+        let keys = match &self.public_keys {
+            None => return Ok(vec![]),
+            Some(PublicKeys::One(keys)) => keys.lines().map(String::from).collect(),
+            Some(PublicKeys::Many(keys)) => keys.clone(),
+        };
+        keys.iter()
+            .map(|key| key.trim())
+            .filter(|key| !key.is_empty())
+            .map(|key| PublicKey::parse(key).context("failed to parse SSH key"))
+            .collect()
+    }
+
+    pub(crate) fn networks(&self) -> Result<Vec<network::Interface>> {
+        let config = match &self.network {
+            None => return Ok(vec![]),
+            Some(config) => config,
+        };
+        match config.version {
+            Some(2) => {}
+            Some(v) => bail!("unsupported network configuration version {}", v),
+            None => return Err(anyhow!("missing network configuration version")),
+        }
+        config
+            .ethernets
+            .iter()
+            .map(|(id, ethernet)| ethernet.to_network(id))
+            .collect()
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    const KEY: &str = "ssh-rsa AAAAB3NzaC1yc2EAAAADAQABAAABAQC+bqdi18/+JfjrqmOEtVKyCU0bsIc6tBqqU7p9mesJkALocLddDU6d97w2zwERhzaqReDyg4msvQQohgtncb4afKKWQjCCCWlcwtP0nAeg9GFtUfmLeYcP2KAjxblabncluuAnvMHyBixKAjr5eWD4B1HjOmpMRmycwmy85QhGTYhF+AkiHGCPPUDrVy2cIvrPSDXEEa7bz5aQUime0Eold56n3O7E5BJuAozf+oeiWCERRRt9ATlLkMvwVItzBHN25YoMOd0KfgYMtBVAw86TErYFx4Tu98blYNUQTthf9VxcU8xy0rFacXmuS7LHbp+CKDY0X5dNHuhqz0wFto4J test-comment";
+
+    fn document() -> String {
+        format!(
+            r#"{{
+                "instance-id": "vm-1234",
+                "local-hostname": "node-0.example.com",
+                "public-keys": ["{}"],
+                "network": {{
+                    "version": 2,
+                    "ethernets": {{
+                        "nic0": {{
+                            "match": {{"macaddress": "00:50:56:aa:bb:cc"}},
+                            "set-name": "ens192",
+                            "addresses": ["192.0.2.10/24"],
+                            "gateway4": "192.0.2.1",
+                            "nameservers": {{
+                                "addresses": ["192.0.2.53"],
+                                "search": ["example.com", "corp.example.com"]
+                            }},
+                            "mtu": 9000
+                        }},
+                        "ens224": {{"dhcp4": true}}
+                    }}
+                }}
+            }}"#,
+            KEY
+        )
+    }
+
+    #[test]
+    fn test_parse() {
+        let metadata = GuestMetadata::parse(&document(), None).unwrap();
+        let expected = maplit::hashmap! {
+            "VMWARE_INSTANCE_ID".to_string() => "vm-1234".to_string(),
+            "VMWARE_HOSTNAME".to_string() => "node-0.example.com".to_string(),
+        };
+        assert_eq!(metadata.attributes(), expected);
+        assert_eq!(metadata.hostname(), Some("node-0.example.com".to_string()));
+        let keys = metadata.ssh_keys().unwrap();
+        assert_eq!(keys.len(), 1);
+        assert_eq!(keys[0].comment, Some("test-comment".to_string()));
+
+        // same document, base64-encoded
+        let encoded = base64::encode(document());
+        let decoded = GuestMetadata::parse(&format!("{}\n", encoded), Some("base64")).unwrap();
+        assert_eq!(decoded.attributes(), expected);
+
+        GuestMetadata::parse(&encoded, Some("gzip+base64")).unwrap_err();
+        GuestMetadata::parse("not base64!", Some("base64")).unwrap_err();
+        GuestMetadata::parse("{ not json", None).unwrap_err();
+
+        // nothing set
+        let metadata = GuestMetadata::parse("{}", None).unwrap();
+        assert!(metadata.attributes().is_empty());
+        assert_eq!(metadata.hostname(), None);
+        assert!(metadata.ssh_keys().unwrap().is_empty());
+        assert!(metadata.networks().unwrap().is_empty());
+    }
+
+    #[test]
+    fn test_ssh_keys_string() {
+        let raw = format!(r#"{{"public_keys": "{}\n{}\n"}}"#, KEY, KEY);
+        let metadata = GuestMetadata::parse(&raw, None).unwrap();
+        assert_eq!(metadata.ssh_keys().unwrap().len(), 2);
+    }
+
+    #[test]
+    fn test_networks() {
+        let metadata = GuestMetadata::parse(&document(), None).unwrap();
+        let interfaces = metadata.networks().unwrap();
+        let expected = vec![
+            network::Interface {
+                name: Some("ens224".to_string()),
+                mac_address: None,
+                priority: 10,
+                nameservers: vec![],
+                ip_addresses: vec![],
+                routes: vec![],
+                bond: None,
+                vlans: vec![],
+                tunnels: vec![],
+                unmanaged: false,
+                dhcp: true,
+                mtu: None,
+                search_domains: vec![],
+            },
+            network::Interface {
+                name: Some("ens192".to_string()),
+                mac_address: Some(MacAddr::from_str("00:50:56:aa:bb:cc").unwrap()),
+                priority: 10,
+                nameservers: vec![IpAddr::from_str("192.0.2.53").unwrap()],
+                ip_addresses: vec![IpNetwork::from_str("192.0.2.10/24").unwrap()],
+                routes: vec![network::NetworkRoute {
+                    destination: IpNetwork::from_str("0.0.0.0/0").unwrap(),
+                    gateway: IpAddr::from_str("192.0.2.1").unwrap(),
+                    metric: None,
+                }],
+                bond: None,
+                vlans: vec![],
+                tunnels: vec![],
+                unmanaged: false,
+                dhcp: false,
+                mtu: Some(9000),
+                search_domains: vec!["example.com".to_string(), "corp.example.com".to_string()],
+            },
+        ];
+        assert_eq!(interfaces, expected);
+
+        let raw = r#"{"network": {"version": 1, "config": []}}"#;
+        let metadata = GuestMetadata::parse(raw, None).unwrap();
+        metadata.networks().unwrap_err();
+
+        let raw = r#"{"network": {"version": 2, "ethernets": {"nic0": {"match": {}}}}}"#;
+        let metadata = GuestMetadata::parse(raw, None).unwrap();
+        metadata.networks().unwrap_err();
+    }
+}
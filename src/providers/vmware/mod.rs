@@ -3,14 +3,20 @@
 use std::collections::HashMap;
 
 use anyhow::Result;
+use openssh_keys::PublicKey;
 
+use crate::network;
 use crate::providers::MetadataProvider;
 
+mod guestinfo;
+
 /// VMware provider.
 #[derive(Clone, Debug)]
 pub struct VmwareProvider {
     /// External network kargs for initrd.
     guestinfo_net_kargs: Option<String>,
+    /// Metadata document, if any.
+    metadata: guestinfo::GuestMetadata,
 }
 
 // Architecture-specific implementation.
@@ -24,7 +30,19 @@ cfg_if::cfg_if! {
 
 impl MetadataProvider for VmwareProvider {
     fn attributes(&self) -> Result<HashMap<String, String>> {
-        Ok(HashMap::new())
+        Ok(self.metadata.attributes())
+    }
+
+    fn hostname(&self) -> Result<Option<String>> {
+        Ok(self.metadata.hostname())
+    }
+
+    fn ssh_keys(&self) -> Result<Vec<PublicKey>> {
+        self.metadata.ssh_keys()
+    }
+
+    fn networks(&self) -> Result<Vec<network::Interface>> {
+        self.metadata.networks()
     }
 
     fn rd_network_kargs(&self) -> Result<Option<String>> {
@@ -1,53 +1,59 @@
+use crate::network;
 use crate::providers::vultr;
 use crate::providers::MetadataProvider;
 use mockito;
+use pnet_base::MacAddr;
+use std::str::FromStr;
 
-#[test]
-fn test_hostname() {
-    let ep = "/hostname";
-    let hostname = "test-hostname";
-
-    let mut provider = vultr::VultrProvider::try_new().unwrap();
-    provider.client = provider.client.max_retries(0);
-
-    let _m = mockito::mock("GET", ep).with_status(503).create();
-    provider.hostname().unwrap_err();
-
-    let _m = mockito::mock("GET", ep)
+/// Fetch metadata from the mock server, serving the given document.
+fn fetch_provider(body: &str) -> anyhow::Result<vultr::VultrProvider> {
+    let client = crate::retry::Client::try_new().unwrap().max_retries(0);
+    let _m = mockito::mock("GET", "/v1.json")
         .with_status(200)
-        .with_body(hostname)
+        .with_header("content-type", "application/json")
+        .with_body(body)
         .create();
-    let v = provider.hostname().unwrap();
-    assert_eq!(v, Some(hostname.to_string()));
+    let provider = vultr::VultrProvider::fetch(&client);
+    mockito::reset();
+    provider
+}
+
+#[test]
+fn test_fetch() {
+    let client = crate::retry::Client::try_new().unwrap().max_retries(0);
 
-    let _m = mockito::mock("GET", ep).with_status(404).create();
-    let v = provider.hostname().unwrap();
-    assert_eq!(v, None);
+    let _m = mockito::mock("GET", "/v1.json").with_status(503).create();
+    vultr::VultrProvider::fetch(&client).unwrap_err();
 
-    let _m = mockito::mock("GET", ep)
+    let _m = mockito::mock("GET", "/v1.json")
         .with_status(200)
-        .with_body("")
+        .with_body("not json")
         .create();
-    let v = provider.hostname().unwrap();
-    assert_eq!(v, None);
+    vultr::VultrProvider::fetch(&client).unwrap_err();
 
     mockito::reset();
-    provider.hostname().unwrap_err();
+    vultr::VultrProvider::fetch(&client).unwrap_err();
 }
 
 #[test]
-fn test_pubkeys() {
-    let mut provider = vultr::VultrProvider::try_new().unwrap();
-    provider.client = provider.client.max_retries(0);
+fn test_hostname() {
+    let fixture = std::fs::read_to_string("./tests/fixtures/vultr/v1.json").unwrap();
+    let provider = fetch_provider(&fixture).unwrap();
+    assert_eq!(
+        provider.hostname().unwrap(),
+        Some("vultr-guest".to_string())
+    );
+
+    let provider = fetch_provider(r#"{"hostname": ""}"#).unwrap();
+    assert_eq!(provider.hostname().unwrap(), None);
+}
 
-    let _m_keys = mockito::mock("GET", "/public-keys")
-        .with_status(200)
-        .with_body("ssh-rsa AAAAB3NzaC1yc2EAAAADAQABAAABgQCsXe6CfHl45kCIzMF92VhDf2NpBWUyS1+IiTtxm5a83mT9730Hb8xim7GYeJu47kiESw2DAN8vNJ/Irg0apZ217ah2rXXjPQuWYSXuEuap8yLBSjqw8exgqVj/kzW+YqmnHASxI13eoFDxTQQGzyqbqowvxu/5gQmDwBmNAa9bT809ziB/qmpS1mD6qyyFDpR23kUwu3TkgAbwMXBDoqK+pdwfaF9uo9XaLHNEH8lD5BZuG2BeDafm2o76DhNSo83MvcCPNXKLxu3BbX/FCMFO6O8RRqony4i91fEV1b8TbXrbJz1bwEYEnJRvmjnqI/389tQFeYvplXR2WdT9PCKyEAG+j8y6XgecIcdTqV/7gFfak1mp2S7mYHZDnXixsn3MjCP/cIxxJVDitKusnj1TdFqtSXl4tqGccbg/5Sqnt/EVSK4bGwwBxv/YmE0P9cbXLxuEVI0JYzgrQvC8TtUgd8kUu2jqi1/Yj9IWm3aFsl/hhh8YwYrv/gm8PV0TxkM= root@example1\n
-                   ssh-rsa AAAAB3NzaC1yc2EAAAADAQABAAABgQDj6FBVgkTt7/DB93VVLk6304Nx7WUjLBJDSCh38zjCimHUpeo9uYDxflfu2N1CLtrSImIKBVP/JRy9g7K4zmRAH/wXw2UxYziX+hZoFIpbW3GmYQqhjx2lDvIRXJI7blhHhTUNWX5f10lFAYOLqA9J859AB1w7ND09+MS3jQgSazCx17h+QZ0qQ6kLSfnXw9PMUOE1Xba9hD1nYj14ryTVj9jrFPMFuUfXdb/G9lsDJ+cGvdE2/RMuPfDmEdo04zvZ5fQJJKvS7OyAuYev4Y+JC8MhEr756ITDZ17yq4BEMo/8rNPxZ5Von/8xnvry+8/2C3ep9rZyHtCwpRb6WT6TndV2ddXKhEIneyd1XiOcWPJguHj5vSoMN3mo8k2PvznGauvxBstvpjUSFLQu869/ZQwyMnbQi3wnkJk5CpLXePXn1J9njocJjt8+SKGijmmIAsmYosx8gmmu3H1mvq9Wi0qqWDITMm+J24AZBEPBhwVrjhLZb5MKxylF6JFJJBs= root@example2")
-    .create();
+#[test]
+fn test_pubkeys() {
+    let fixture = std::fs::read_to_string("./tests/fixtures/vultr/v1.json").unwrap();
+    let provider = fetch_provider(&fixture).unwrap();
 
     let keys = provider.ssh_keys().unwrap();
-    assert_ne!(keys, vec![]);
     assert_eq!(keys.len(), 2);
 
     assert_eq!(keys[0].options, None);
@@ -56,46 +62,86 @@ fn test_pubkeys() {
     assert_eq!(keys[1].options, None);
     assert_eq!(keys[1].comment, Some("root@example2".to_string()));
 
-    mockito::reset();
-    provider.ssh_keys().unwrap_err();
+    let provider = fetch_provider("{}").unwrap();
+    assert_eq!(provider.ssh_keys().unwrap(), vec![]);
 }
 
 #[test]
 fn test_attributes() {
-    let instance_id = "test-instance-id";
-    let hostname = "test-hostname";
-    let regioncode = "test-regioncode";
-
-    let endpoints = maplit::btreemap! {
-        "/hostname" => hostname,
-        "/instanceid" => instance_id,
-        "/region/regioncode" => regioncode,
-    };
-
-    let mut mocks = Vec::with_capacity(endpoints.len());
-    for (endpoint, body) in endpoints {
-        let m = mockito::mock("GET", endpoint)
-            .with_status(200)
-            .with_body(body)
-            .create();
-        mocks.push(m)
-    }
+    let fixture = std::fs::read_to_string("./tests/fixtures/vultr/v1.json").unwrap();
+    let provider = fetch_provider(&fixture).unwrap();
 
     let attributes = maplit::hashmap! {
-        "VULTR_INSTANCE_ID".to_string() => instance_id.to_string(),
-        "VULTR_HOSTNAME".to_string() => hostname.to_string(),
-        "VULTR_REGION_CODE".to_string() => regioncode.to_string(),
+        "VULTR_HOSTNAME".to_string() => "vultr-guest".to_string(),
+        "VULTR_INSTANCE_ID".to_string() => "a747bfz6385e".to_string(),
+        "VULTR_REGION_CODE".to_string() => "EWR".to_string(),
+        "VULTR_IPV4_PUBLIC".to_string() => "203.0.113.10".to_string(),
+        "VULTR_IPV6_PUBLIC".to_string() => "2001:db8:1000:2000::100".to_string(),
+        "VULTR_IPV4_PRIVATE".to_string() => "10.1.96.3".to_string(),
     };
-
-    let client = crate::retry::Client::try_new()
-        .unwrap()
-        .max_retries(0)
-        .return_on_404(true);
-    let provider = vultr::VultrProvider { client };
-
+    assert_eq!(provider.attributes().unwrap(), attributes);
+
+    // no private network, no IPv6
+    let provider = fetch_provider(
+        r#"{
+            "hostname": "vultr-guest",
+            "instanceid": "a747bfz6385e",
+            "interfaces": [{
+                "ipv4": {"address": "203.0.113.10", "gateway": "203.0.113.1", "netmask": "255.255.254.0"},
+                "mac": "56:00:03:c8:7a:14",
+                "network-type": "public"
+            }],
+            "region": {"regioncode": "EWR"}
+        }"#,
+    )
+    .unwrap();
     let v = provider.attributes().unwrap();
-    assert_eq!(v, attributes);
+    assert_eq!(v["VULTR_IPV4_PUBLIC"], "203.0.113.10");
+    assert!(!v.contains_key("VULTR_IPV6_PUBLIC"));
+    assert!(!v.contains_key("VULTR_IPV4_PRIVATE"));
+}
 
-    mockito::reset();
-    provider.attributes().unwrap_err();
+#[test]
+fn test_networks() {
+    let fixture = std::fs::read_to_string("./tests/fixtures/vultr/v1.json").unwrap();
+    let provider = fetch_provider(&fixture).unwrap();
+
+    let expected = vec![
+        network::Interface {
+            name: None,
+            mac_address: Some(MacAddr::from_str("56:00:03:c8:7a:14").unwrap()),
+            priority: 10,
+            nameservers: vec![],
+            ip_addresses: vec![],
+            routes: vec![],
+            bond: None,
+            vlans: vec![],
+            tunnels: vec![],
+            unmanaged: false,
+            dhcp: true,
+            mtu: None,
+            search_domains: vec![],
+        },
+        network::Interface {
+            name: None,
+            mac_address: Some(MacAddr::from_str("5a:00:03:c8:7a:14").unwrap()),
+            priority: 10,
+            nameservers: vec![],
+            ip_addresses: vec!["10.1.96.3/20".parse().unwrap()],
+            routes: vec![],
+            bond: None,
+            vlans: vec![],
+            tunnels: vec![],
+            unmanaged: false,
+            dhcp: false,
+            mtu: None,
+            search_domains: vec![],
+        },
+    ];
+    assert_eq!(provider.networks().unwrap(), expected);
+
+    let provider =
+        fetch_provider(r#"{"interfaces": [{"mac": "not-a-mac", "network-type": "public"}]}"#)
+            .unwrap();
+    provider.networks().unwrap_err();
 }
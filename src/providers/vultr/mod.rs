@@ -15,114 +15,221 @@
 //! vultr provider metadata fetcher
 //! This provider is selected via the platform ID `vultr`.
 //! The metadata endpoint is documented at https://www.vultr.com/metadata/.
+//! All metadata is fetched at once, from the `/v1.json` document.
 
-use anyhow::Result;
+use std::collections::HashMap;
+use std::net::Ipv4Addr;
+use std::str::FromStr;
+
+use anyhow::{anyhow, Context, Result};
+use ipnetwork::{IpNetwork, Ipv4Network};
 #[cfg(test)]
 use mockito;
 use openssh_keys::PublicKey;
+use pnet_base::MacAddr;
+use serde_derive::Deserialize;
 use slog_scope::error;
-use std::collections::HashMap;
 
+use crate::network;
 use crate::providers::MetadataProvider;
 use crate::retry;
 
 #[cfg(test)]
 mod mock_tests;
 
-#[derive(Clone, Debug)]
-pub struct VultrProvider {
-    client: retry::Client,
+/// Type of the public network interface.
+const PUBLIC_NETWORK: &str = "public";
+
+#[derive(Clone, Debug, Deserialize)]
+struct Ipv4Config {
+    #[serde(default)]
+    address: String,
+    #[serde(default)]
+    netmask: String,
 }
 
-impl VultrProvider {
-    pub fn try_new() -> Result<VultrProvider> {
-        let client = retry::Client::try_new()?.return_on_404(true);
+#[derive(Clone, Debug, Deserialize)]
+struct Ipv6Config {
+    #[serde(default)]
+    address: String,
+}
 
-        Ok(VultrProvider { client })
+#[derive(Clone, Debug, Deserialize)]
+struct Interface {
+    ipv4: Option<Ipv4Config>,
+    ipv6: Option<Ipv6Config>,
+    mac: String,
+    #[serde(rename = "network-type")]
+    network_type: String,
+}
+
+impl Interface {
+    fn is_public(&self) -> bool {
+        self.network_type == PUBLIC_NETWORK
     }
 
-    #[cfg(test)]
-    fn endpoint_for(name: &str) -> String {
-        let url = mockito::server_url();
-        format!("{}/{}", url, name)
+    /// IPv4 address, if any is assigned.
+    fn ipv4_address(&self) -> Option<&str> {
+        self.ipv4
+            .as_ref()
+            .map(|ipv4| ipv4.address.as_str())
+            .filter(|a| !a.is_empty())
     }
 
-    #[cfg(not(test))]
-    fn endpoint_for(name: &str) -> String {
-        format!("http://169.254.169.254/v1/{}", name)
+    /// IPv6 address, if any is assigned.
+    fn ipv6_address(&self) -> Option<&str> {
+        self.ipv6
+            .as_ref()
+            .map(|ipv6| ipv6.address.as_str())
+            .filter(|a| !a.is_empty())
     }
 
-    fn fetch_attribute(
-        &self,
-        map: &mut HashMap<String, String>,
-        key: &str,
-        endpoint: &str,
-    ) -> Result<()> {
-        let content: Option<String> = self
-            .client
-            .get(retry::Raw, Self::endpoint_for(endpoint))
-            .send()?;
-
-        if let Some(value) = content {
-            if !value.is_empty() {
-                map.insert(key.to_string(), value);
+    /// Build the network configuration of this interface.
+    ///
+    /// The public interface is configured via DHCP (and router
+    /// advertisements for IPv6), private ones need a static address.
+    fn to_network(&self) -> Result<network::Interface> {
+        let mac = MacAddr::from_str(&self.mac)
+            .with_context(|| format!("failed to parse mac address '{}'", self.mac))?;
+        let mut ip_addresses = Vec::new();
+        if !self.is_public() {
+            if let (Some(address), Some(ipv4)) = (self.ipv4_address(), self.ipv4.as_ref()) {
+                let address = Ipv4Addr::from_str(address)
+                    .with_context(|| format!("failed to parse ipv4 address '{}'", address))?;
+                let netmask = Ipv4Addr::from_str(&ipv4.netmask)
+                    .with_context(|| format!("failed to parse netmask '{}'", ipv4.netmask))?;
+                let prefix =
+                    ipnetwork::ipv4_mask_to_prefix(netmask).context("invalid network mask")?;
+                ip_addresses.push(IpNetwork::V4(
+                    Ipv4Network::new(address, prefix).context("invalid ip address or prefix")?,
+                ));
             }
         }
 
-        Ok(())
+        Ok(network::Interface {
+            name: None,
+            mac_address: Some(mac),
+            priority: 10,
+            nameservers: vec![],
+            ip_addresses,
+            routes: vec![],
+            bond: None,
+            vlans: vec![],
+            tunnels: vec![],
+            unmanaged: false,
+            dhcp: self.is_public(),
+            mtu: None,
+            search_domains: vec![],
+        })
     }
+}
 
-    fn fetch_ssh_keys(&self) -> Result<Vec<String>> {
-        let entries: Option<String> = self
-            .client
-            .get(retry::Raw, VultrProvider::endpoint_for("public-keys"))
-            .send()?;
-        let keys_list = entries.unwrap_or_default();
-
-        let mut keys = Vec::new();
-        for key in keys_list.lines() {
-            let key = key.to_string();
-            keys.push(key)
-        }
+#[derive(Clone, Debug, Deserialize)]
+struct Region {
+    regioncode: String,
+}
+
+/// Metadata document, served at `/v1.json`.
+#[derive(Clone, Debug, Deserialize)]
+struct Metadata {
+    #[serde(default)]
+    hostname: String,
+    #[serde(default)]
+    instanceid: String,
+    #[serde(default)]
+    interfaces: Vec<Interface>,
+    #[serde(rename = "public-keys", default)]
+    public_keys: Vec<String>,
+    region: Option<Region>,
+}
+
+#[derive(Clone, Debug)]
+pub struct VultrProvider {
+    metadata: Metadata,
+}
 
-        Ok(keys)
+impl VultrProvider {
+    /// Build a provider fetching metadata with the given client.
+    pub(crate) fn with_client(client: retry::Client) -> Result<VultrProvider> {
+        VultrProvider::fetch(&client)
     }
 
-    fn fetch_hostname(&self) -> Result<Option<String>> {
-        let value: Option<String> = self
-            .client
-            .get(retry::Raw, VultrProvider::endpoint_for("hostname"))
-            .send()?;
+    fn fetch(client: &retry::Client) -> Result<VultrProvider> {
+        let metadata: Metadata = client
+            .get(retry::Json, VultrProvider::endpoint_for("v1.json"))
+            .send()?
+            .ok_or_else(|| anyhow!("metadata not found"))?;
 
-        let hostname = value.unwrap_or_default();
-        if hostname.is_empty() {
-            return Ok(None);
-        }
+        Ok(VultrProvider { metadata })
+    }
+
+    #[cfg(test)]
+    fn endpoint_for(name: &str) -> String {
+        let url = mockito::server_url();
+        format!("{}/{}", url, name)
+    }
+
+    #[cfg(not(test))]
+    fn endpoint_for(name: &str) -> String {
+        format!("http://169.254.169.254/{}", name)
+    }
 
-        Ok(Some(hostname))
+    /// First interface of the given kind with an address, as picked by `f`.
+    fn first_address<F>(&self, public: bool, f: F) -> Option<String>
+    where
+        F: Fn(&Interface) -> Option<&str>,
+    {
+        self.metadata
+            .interfaces
+            .iter()
+            .filter(|iface| iface.is_public() == public)
+            .find_map(f)
+            .map(String::from)
     }
 }
 
 impl MetadataProvider for VultrProvider {
     fn attributes(&self) -> Result<HashMap<String, String>> {
-        let mut out = HashMap::with_capacity(3);
+        let mut out = HashMap::with_capacity(6);
 
-        self.fetch_attribute(&mut out, "VULTR_HOSTNAME", "hostname")?;
-        self.fetch_attribute(&mut out, "VULTR_INSTANCE_ID", "instanceid")?;
-        self.fetch_attribute(&mut out, "VULTR_REGION_CODE", "region/regioncode")?;
+        let mut add_value = |key: &str, value: Option<String>| {
+            if let Some(value) = value.filter(|v| !v.is_empty()) {
+                out.insert(key.to_string(), value);
+            }
+        };
+        add_value("VULTR_HOSTNAME", Some(self.metadata.hostname.clone()));
+        add_value("VULTR_INSTANCE_ID", Some(self.metadata.instanceid.clone()));
+        add_value(
+            "VULTR_REGION_CODE",
+            self.metadata.region.as_ref().map(|r| r.regioncode.clone()),
+        );
+        add_value(
+            "VULTR_IPV4_PUBLIC",
+            self.first_address(true, Interface::ipv4_address),
+        );
+        add_value(
+            "VULTR_IPV6_PUBLIC",
+            self.first_address(true, Interface::ipv6_address),
+        );
+        add_value(
+            "VULTR_IPV4_PRIVATE",
+            self.first_address(false, Interface::ipv4_address),
+        );
 
         Ok(out)
     }
 
     fn hostname(&self) -> Result<Option<String>> {
-        self.fetch_hostname()
+        if self.metadata.hostname.is_empty() {
+            return Ok(None);
+        }
+        Ok(Some(self.metadata.hostname.clone()))
     }
 
     fn ssh_keys(&self) -> Result<Vec<PublicKey>> {
-        let keys = self.fetch_ssh_keys()?;
-        let mut out = Vec::with_capacity(keys.len());
-        for key in keys {
-            match PublicKey::parse(&key) {
+        let mut out = Vec::with_capacity(self.metadata.public_keys.len());
+        for key in &self.metadata.public_keys {
+            match PublicKey::parse(key) {
                 Ok(pk) => out.push(pk),
                 Err(e) => error!("failed to parse SSH Public Key: {}", e),
             };
@@ -130,4 +237,12 @@ impl MetadataProvider for VultrProvider {
 
         Ok(out)
     }
+
+    fn networks(&self) -> Result<Vec<network::Interface>> {
+        self.metadata
+            .interfaces
+            .iter()
+            .map(Interface::to_network)
+            .collect()
+    }
 }
@@ -0,0 +1,267 @@
+//! Redaction of sensitive attributes
+//!
+//! Some attributes (e.g. access tokens or custom data) must never show up
+//! in logs, at any level. Their values are registered once fetched, and
+//! scrubbed from all log messages and key-value pairs.
+
+use crate::util;
+use slog::{Drain, KV};
+use std::collections::HashMap;
+use std::fmt;
+use std::sync::{Arc, Mutex};
+
+/// Placeholder replacing sensitive values.
+pub const REDACTED: &str = "<redacted>";
+
+/// Glob patterns of attribute names which are always sensitive.
+const BUILTIN_PATTERNS: &[&str] = &["*TOKEN*", "*SECRET*", "*CUSTOMDATA*"];
+
+/// Values shorter than this are not scrubbed from messages, as they would
+/// also match unrelated text.
+const MIN_REDACTED_LEN: usize = 4;
+
+#[derive(Default)]
+struct Sensitive {
+    /// Additional glob patterns of sensitive attribute names.
+    patterns: Vec<String>,
+    /// Sensitive values seen so far.
+    values: Vec<String>,
+}
+
+/// Sensitive attributes, shared between the code fetching them and the
+/// `Redactor` log drain, from any thread.
+#[derive(Clone, Default)]
+pub struct Redactions(Arc<Mutex<Sensitive>>);
+
+impl fmt::Debug for Redactions {
+    // never print the values
+    fn fmt(&self, f: &mut fmt::Formatter) -> fmt::Result {
+        f.write_str("Redactions")
+    }
+}
+
+impl Redactions {
+    /// Mark attributes matching the given glob patterns as sensitive, in
+    /// addition to the built-in ones.
+    pub fn set_sensitive_patterns(&self, patterns: Vec<String>) {
+        if let Ok(mut sensitive) = self.0.lock() {
+            sensitive.patterns = patterns;
+        }
+    }
+
+    /// Register the values of sensitive attributes, so that they are
+    /// redacted from all subsequent log records.
+    pub fn register_attributes(&self, attributes: &HashMap<String, String>) {
+        let mut sensitive = match self.0.lock() {
+            Ok(sensitive) => sensitive,
+            Err(_) => return,
+        };
+        for (name, value) in attributes {
+            if is_sensitive(&sensitive.patterns, name)
+                && value.len() >= MIN_REDACTED_LEN
+                && !sensitive.values.contains(value)
+            {
+                sensitive.values.push(value.clone());
+            }
+        }
+    }
+
+    /// Replace registered sensitive values in a message.
+    pub fn redact(&self, msg: &str) -> String {
+        match self.0.lock() {
+            Ok(sensitive) => sensitive
+                .values
+                .iter()
+                .fold(msg.to_string(), |out, value| out.replace(value, REDACTED)),
+            // better drop the message than leak a value
+            Err(_) => REDACTED.to_string(),
+        }
+    }
+
+    /// Check whether any sensitive value was registered.
+    fn is_empty(&self) -> bool {
+        self.0
+            .lock()
+            .map_or(false, |sensitive| sensitive.values.is_empty())
+    }
+}
+
+/// Check whether an attribute is sensitive, by name.
+fn is_sensitive(patterns: &[String], name: &str) -> bool {
+    BUILTIN_PATTERNS
+        .iter()
+        .any(|pattern| util::glob_match(pattern, name))
+        || patterns
+            .iter()
+            .any(|pattern| util::glob_match(pattern, name))
+}
+
+/// Log drain scrubbing sensitive values from messages and key-value pairs.
+pub struct Redactor<D> {
+    drain: D,
+    redactions: Redactions,
+}
+
+impl<D: Drain> Redactor<D> {
+    /// Scrub values registered in `redactions`, then pass records on to
+    /// `drain`.
+    pub fn new(drain: D, redactions: Redactions) -> Self {
+        Redactor { drain, redactions }
+    }
+}
+
+impl<D: Drain> Drain for Redactor<D> {
+    type Ok = D::Ok;
+    type Err = D::Err;
+
+    fn log(
+        &self,
+        record: &slog::Record,
+        values: &slog::OwnedKVList,
+    ) -> std::result::Result<Self::Ok, Self::Err> {
+        if self.redactions.is_empty() {
+            return self.drain.log(record, values);
+        }
+
+        let location = slog::RecordLocation {
+            file: record.file(),
+            line: record.line(),
+            column: record.column(),
+            function: record.function(),
+            module: record.module(),
+        };
+        let rstatic = slog::RecordStatic {
+            location: &location,
+            tag: record.tag(),
+            level: record.level(),
+        };
+        // logger values are folded into the record ones, so that they can
+        // be scrubbed too
+        let kv = RedactedKV {
+            kv: record.kv(),
+            values,
+            redactions: &self.redactions,
+        };
+        self.drain.log(
+            &slog::Record::new(
+                &rstatic,
+                &format_args!("{}", self.redactions.redact(&record.msg().to_string())),
+                slog::BorrowedKV(&kv),
+            ),
+            &slog::OwnedKVList::from(slog::OwnedKV(())),
+        )
+    }
+}
+
+/// Key-value pairs of a record and its logger, scrubbed of sensitive values.
+struct RedactedKV<'a> {
+    kv: slog::BorrowedKV<'a>,
+    values: &'a slog::OwnedKVList,
+    redactions: &'a Redactions,
+}
+
+impl<'a> KV for RedactedKV<'a> {
+    fn serialize(
+        &self,
+        record: &slog::Record,
+        serializer: &mut dyn slog::Serializer,
+    ) -> slog::Result {
+        let mut serializer = RedactingSerializer {
+            serializer,
+            redactions: self.redactions,
+        };
+        self.kv.serialize(record, &mut serializer)?;
+        self.values.serialize(record, &mut serializer)
+    }
+}
+
+/// Serializer scrubbing sensitive values, before passing them on.
+struct RedactingSerializer<'a> {
+    serializer: &'a mut dyn slog::Serializer,
+    redactions: &'a Redactions,
+}
+
+impl<'a> slog::Serializer for RedactingSerializer<'a> {
+    // all other value types are formatted through this one
+    fn emit_arguments(&mut self, key: slog::Key, val: &fmt::Arguments) -> slog::Result {
+        let value = self.redactions.redact(&val.to_string());
+        self.serializer
+            .emit_arguments(key, &format_args!("{}", value))
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    /// Drain capturing messages, along with their key-value pairs.
+    #[derive(Clone, Default)]
+    struct Capture(Arc<Mutex<Vec<String>>>);
+
+    /// Serializer appending key-value pairs to a line.
+    struct Line(String);
+
+    impl slog::Serializer for Line {
+        fn emit_arguments(&mut self, key: slog::Key, val: &fmt::Arguments) -> slog::Result {
+            self.0.push_str(&format!(", {}: {}", key, val));
+            Ok(())
+        }
+    }
+
+    impl Drain for Capture {
+        type Ok = ();
+        type Err = slog::Never;
+
+        fn log(
+            &self,
+            record: &slog::Record,
+            values: &slog::OwnedKVList,
+        ) -> std::result::Result<(), slog::Never> {
+            let mut line = Line(record.msg().to_string());
+            record.kv().serialize(record, &mut line).unwrap();
+            values.serialize(record, &mut line).unwrap();
+            self.0.lock().unwrap().push(line.0);
+            Ok(())
+        }
+    }
+
+    #[test]
+    fn test_redact() {
+        let token = "eyJ0eXAiOiJKV1QiLCJhbGciOi";
+        let attributes = maplit::hashmap! {
+            "AZURE_IDENTITY_TOKEN".to_string() => token.to_string(),
+            "AWS_VAULT_KEY".to_string() => "hunter2-vault".to_string(),
+            "AWS_FLAG_SECRET".to_string() => "no".to_string(),
+            "AWS_REGION".to_string() => "us-east-1".to_string(),
+        };
+        let redactions = Redactions::default();
+        redactions.set_sensitive_patterns(vec!["*_VAULT_*".to_string()]);
+
+        let capture = Capture::default();
+        let log = slog::Logger::root(
+            Redactor::new(capture.clone(), redactions.clone()),
+            slog::o!("vault" => "hunter2-vault"),
+        );
+        slog::info!(log, "nothing registered yet");
+
+        // values registered from another thread are redacted too
+        let worker = redactions.clone();
+        std::thread::spawn(move || worker.register_attributes(&attributes))
+            .join()
+            .unwrap();
+        slog::info!(log, "fetched token {} in us-east-1", token);
+        slog::warn!(log, "vault key rejected"; "key" => "hunter2-vault", "region" => "us-east-1");
+        let messages = capture.0.lock().unwrap().clone();
+        assert_eq!(
+            messages,
+            vec![
+                "nothing registered yet, vault: hunter2-vault",
+                "fetched token <redacted> in us-east-1, vault: <redacted>",
+                "vault key rejected, key: <redacted>, region: us-east-1, vault: <redacted>",
+            ]
+        );
+
+        // too short to be scrubbed from messages
+        assert_eq!(redactions.redact("answer: no"), "answer: no");
+    }
+}
@@ -0,0 +1,187 @@
+//! Run report
+//!
+//! A small JSON document recording what a run applied, for auditing by
+//! provisioning pipelines.
+
+use anyhow::{Context, Result};
+use serde_derive::Serialize;
+use slog::Drain;
+use std::fs;
+use std::path::Path;
+use std::sync::{Arc, Mutex};
+use std::time::{SystemTime, UNIX_EPOCH};
+
+/// Warnings recorded by a `WarningRecorder`, from any thread.
+#[derive(Clone, Debug, Default)]
+pub struct Warnings(Arc<Mutex<Vec<String>>>);
+
+impl Warnings {
+    fn push(&self, msg: String) {
+        if let Ok(mut warnings) = self.0.lock() {
+            warnings.push(msg);
+        }
+    }
+
+    /// Return the distinct warnings recorded so far, in order, and clear them.
+    pub fn take(&self) -> Vec<String> {
+        let warnings = match self.0.lock() {
+            Ok(mut warnings) => std::mem::replace(&mut *warnings, Vec::new()),
+            Err(_) => return vec![],
+        };
+        let mut out: Vec<String> = Vec::with_capacity(warnings.len());
+        for warning in warnings {
+            if !out.contains(&warning) {
+                out.push(warning);
+            }
+        }
+        out
+    }
+}
+
+/// Log drain recording warnings for the run report.
+pub struct WarningRecorder<D> {
+    drain: D,
+    warnings: Warnings,
+}
+
+impl<D: Drain> WarningRecorder<D> {
+    /// Record warnings into `warnings`, then pass records on to `drain`.
+    pub fn new(drain: D, warnings: Warnings) -> Self {
+        WarningRecorder { drain, warnings }
+    }
+}
+
+impl<D: Drain> Drain for WarningRecorder<D> {
+    type Ok = D::Ok;
+    type Err = D::Err;
+
+    fn log(
+        &self,
+        record: &slog::Record,
+        values: &slog::OwnedKVList,
+    ) -> std::result::Result<Self::Ok, Self::Err> {
+        if record.level() == slog::Level::Warning {
+            self.warnings.push(record.msg().to_string());
+        }
+        self.drain.log(record, values)
+    }
+}
+
+/// Outcome of a single output.
+#[derive(Clone, Debug, Default, PartialEq, Eq, Serialize)]
+pub struct OutputReport {
+    /// Whether the output was written.
+    pub applied: bool,
+    /// Number of items written (attributes, SSH keys, interfaces...).
+    pub count: usize,
+}
+
+impl OutputReport {
+    /// Outcome of an output with `count` items, applied if non-empty.
+    pub fn with_count(count: usize) -> Self {
+        OutputReport {
+            applied: count > 0,
+            count,
+        }
+    }
+}
+
+/// Summary of a run.
+#[derive(Clone, Debug, Default, PartialEq, Eq, Serialize)]
+pub struct RunReport {
+    pub provider: String,
+    /// Completion time, in seconds since the Unix epoch.
+    pub timestamp: u64,
+    pub attributes: OutputReport,
+    pub hostname: OutputReport,
+    pub ssh_keys: OutputReport,
+    pub network_units: OutputReport,
+    /// Non-fatal warnings encountered during the run.
+    pub warnings: Vec<String>,
+}
+
+impl RunReport {
+    pub fn new(provider: &str) -> Self {
+        RunReport {
+            provider: provider.to_string(),
+            ..RunReport::default()
+        }
+    }
+
+    /// Record completion time and warnings, then write the report as JSON.
+    pub fn finish(mut self, path: &Path, warnings: &Warnings) -> Result<()> {
+        self.timestamp = SystemTime::now()
+            .duration_since(UNIX_EPOCH)
+            .map(|d| d.as_secs())
+            .unwrap_or_default();
+        self.warnings = warnings.take();
+
+        let mut contents =
+            serde_json::to_string_pretty(&self).context("failed to serialize run report")?;
+        contents.push('\n');
+        if let Some(dir) = path.parent() {
+            fs::create_dir_all(dir)
+                .with_context(|| format!("failed to create directory {:?}", dir))?;
+        }
+        fs::write(path, contents).with_context(|| format!("failed to write file {:?}", path))
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_run_report() {
+        let warnings = Warnings::default();
+        let log = slog::Logger::root(
+            WarningRecorder::new(slog::Discard, warnings.clone()),
+            slog::o!(),
+        );
+        slog::info!(log, "not recorded");
+        slog::warn!(log, "no bond interfaces");
+        slog::warn!(log, "no bond interfaces");
+        // also from other threads
+        let worker_log = log.clone();
+        std::thread::spawn(move || slog::warn!(worker_log, "skipping network interface"))
+            .join()
+            .unwrap();
+
+        let mut report = RunReport::new("packet");
+        report.attributes = OutputReport::with_count(4);
+        report.ssh_keys = OutputReport::with_count(0);
+        report.network_units = OutputReport::with_count(2);
+
+        let dir = tempfile::tempdir().unwrap();
+        let path = dir.path().join("report.json");
+        report.finish(&path, &warnings).unwrap();
+
+        let json: serde_json::Value =
+            serde_json::from_str(&fs::read_to_string(&path).unwrap()).unwrap();
+        assert_eq!(json["provider"], "packet");
+        assert!(json["timestamp"].as_u64().unwrap() > 0);
+        assert_eq!(
+            json["attributes"],
+            serde_json::json!({"applied": true, "count": 4})
+        );
+        assert_eq!(
+            json["hostname"],
+            serde_json::json!({"applied": false, "count": 0})
+        );
+        assert_eq!(
+            json["ssh_keys"],
+            serde_json::json!({"applied": false, "count": 0})
+        );
+        assert_eq!(
+            json["network_units"],
+            serde_json::json!({"applied": true, "count": 2})
+        );
+        assert_eq!(
+            json["warnings"],
+            serde_json::json!(["no bond interfaces", "skipping network interface"])
+        );
+
+        // warnings are only reported once
+        assert!(warnings.take().is_empty());
+    }
+}
@@ -20,17 +20,230 @@
 //! deserializing responses and handles headers in a sane way.
 
 use std::borrow::Cow;
-use std::io::Read;
-use std::time::Duration;
+use std::cell::{Cell, RefCell};
+use std::fmt;
+use std::io::{self, Read};
+use std::sync::{mpsc, Arc, Mutex};
+use std::thread;
+use std::time::{Duration, Instant, SystemTime, UNIX_EPOCH};
 
-use anyhow::{anyhow, Context, Result};
+use anyhow::{anyhow, bail, Context, Result};
 use reqwest::{self, blocking, header, Method};
-use slog_scope::info;
+use slog_scope::{debug, info, warn};
 
-use crate::retry::Retry;
+use crate::retry::{set_cancel_token, set_deadline, Backoff, CancelToken, Retry, RetryAfter};
 
 use crate::retry::raw_deserializer;
 
+/// Default timeout of each request, as in the default reqwest blocking
+/// client.
+const DEFAULT_REQUEST_TIMEOUT: Duration = Duration::from_secs(30);
+
+/// Maximum length of the response body snippet included in errors.
+const ERROR_BODY_LEN: usize = 256;
+
+thread_local! {
+    /// Counters shared by clients created on this thread, if enabled.
+    static STATS: RefCell<StatsRecorder> = RefCell::new(StatsRecorder::default());
+
+    /// Maximum number of parallel sub-fetches for clients created on this
+    /// thread, see `Client::fetch_all()`.
+    static FETCH_CONCURRENCY: Cell<usize> = Cell::new(1);
+}
+
+/// Thread-local settings for retry drivers and clients, to carry over to
+/// worker threads.
+#[derive(Clone, Debug)]
+struct ThreadSettings {
+    deadline: Option<Instant>,
+    cancel_token: Option<CancelToken>,
+    stats: StatsRecorder,
+    concurrency: usize,
+}
+
+impl ThreadSettings {
+    /// Apply these settings to the current thread.
+    fn apply(self) {
+        set_deadline(self.deadline);
+        set_cancel_token(self.cancel_token);
+        set_fetch_concurrency(self.concurrency);
+        let stats = self.stats;
+        STATS.with(|s| *s.borrow_mut() = stats);
+    }
+}
+
+/// Set the maximum number of parallel sub-fetches for clients subsequently
+/// created on this thread.
+pub fn set_fetch_concurrency(concurrency: usize) {
+    FETCH_CONCURRENCY.with(|c| c.set(concurrency.max(1)));
+}
+
+/// Counters of HTTP activity.
+#[derive(Clone, Copy, Debug, Default, PartialEq, Eq)]
+pub struct Stats {
+    /// Requests sent, including retries.
+    pub requests: u64,
+    /// Requests sent again after a failed attempt.
+    pub retries: u64,
+    /// Failed attempts, including those later retried successfully.
+    pub failures: u64,
+    /// Bytes of response bodies read.
+    pub bytes_read: u64,
+}
+
+/// Start collecting counters for clients subsequently created on this thread.
+///
+/// All those clients update the same counters, see `stats()`.
+pub fn enable_stats() {
+    STATS.with(|s| {
+        let mut recorder = s.borrow_mut();
+        if recorder.0.is_none() {
+            recorder.0 = Some(Arc::new(Mutex::new(Stats::default())));
+        }
+    });
+}
+
+/// Return a snapshot of the counters collected on this thread, if enabled.
+pub fn stats() -> Option<Stats> {
+    STATS.with(|s| s.borrow().snapshot())
+}
+
+/// Handle on shared counters, doing nothing when collection is disabled.
+#[derive(Clone, Debug, Default)]
+struct StatsRecorder(Option<Arc<Mutex<Stats>>>);
+
+impl StatsRecorder {
+    fn record<F: FnOnce(&mut Stats)>(&self, update: F) {
+        if let Some(ref stats) = self.0 {
+            if let Ok(mut stats) = stats.lock() {
+                update(&mut stats);
+            }
+        }
+    }
+
+    /// Record a request attempt, starting at 0.
+    fn record_attempt(&self, attempt: u8) {
+        self.record(|s| {
+            s.requests += 1;
+            if attempt > 0 {
+                s.retries += 1;
+            }
+        });
+    }
+
+    /// Record a failed attempt, passing the result through.
+    fn record_result<R>(&self, res: Result<R>) -> Result<R> {
+        if res.is_err() {
+            self.record(|s| s.failures += 1);
+        }
+        res
+    }
+
+    fn snapshot(&self) -> Option<Stats> {
+        self.0
+            .as_ref()
+            .and_then(|stats| stats.lock().ok().map(|s| *s))
+    }
+}
+
+/// Reader adding the bytes read to the shared counters.
+struct CountingReader<'a, R> {
+    inner: R,
+    stats: &'a StatsRecorder,
+}
+
+impl<'a, R: Read> Read for CountingReader<'a, R> {
+    fn read(&mut self, buf: &mut [u8]) -> io::Result<usize> {
+        let n = self.inner.read(buf)?;
+        self.stats.record(|s| s.bytes_read += n as u64);
+        Ok(n)
+    }
+}
+
+/// Parse a header in `Name: value` format.
+pub fn parse_header(input: &str) -> Result<(header::HeaderName, header::HeaderValue)> {
+    let delim = match input.find(':') {
+        Some(index) => index,
+        None => bail!("missing ':' delimiter in header '{}'", input),
+    };
+    let (name, value) = input.split_at(delim);
+    let name = header::HeaderName::from_bytes(name.trim().as_bytes())
+        .with_context(|| format!("invalid header name in '{}'", input))?;
+    let mut value = header::HeaderValue::from_str(value[1..].trim())
+        .with_context(|| format!("invalid header value in '{}'", input))?;
+    // Custom headers may carry credentials, keep them out of logs.
+    value.set_sensitive(true);
+    Ok((name, value))
+}
+
+/// Function fetching a new session token.
+type TokenRenewer = dyn Fn() -> Result<header::HeaderValue> + Send + Sync;
+
+/// Session token sent as a header with every request.
+///
+/// The token is shared by all clones of a client, and renewed whenever a
+/// request is rejected as unauthorized (e.g. once the token expired).
+#[derive(Clone)]
+pub struct SessionToken {
+    name: header::HeaderName,
+    value: Arc<Mutex<header::HeaderValue>>,
+    renew: Arc<TokenRenewer>,
+}
+
+impl SessionToken {
+    /// Build a session token with its initial value, and the function to
+    /// call for a new one.
+    pub fn new<F>(name: header::HeaderName, value: header::HeaderValue, renew: F) -> Self
+    where
+        F: Fn() -> Result<header::HeaderValue> + Send + Sync + 'static,
+    {
+        SessionToken {
+            name,
+            value: Arc::new(Mutex::new(value)),
+            renew: Arc::new(renew),
+        }
+    }
+
+    fn current(&self) -> Option<header::HeaderValue> {
+        self.value.lock().ok().map(|v| {
+            let mut value = v.clone();
+            value.set_sensitive(true);
+            value
+        })
+    }
+
+    fn renew(&self) {
+        match (self.renew)() {
+            Ok(value) => {
+                if let Ok(mut current) = self.value.lock() {
+                    *current = value;
+                }
+            }
+            Err(e) => warn!("failed to renew session token: {}", e),
+        }
+    }
+}
+
+impl fmt::Debug for SessionToken {
+    fn fmt(&self, f: &mut fmt::Formatter) -> fmt::Result {
+        // keep the token itself out of logs
+        f.debug_struct("SessionToken")
+            .field("name", &self.name)
+            .finish()
+    }
+}
+
+/// Merge additional headers into `headers`, without overriding existing ones.
+fn merge_headers(headers: &header::HeaderMap, extra: &header::HeaderMap) -> header::HeaderMap {
+    let mut merged = headers.clone();
+    for (name, value) in extra {
+        if !headers.contains_key(name) {
+            merged.append(name, value.clone());
+        }
+    }
+    merged
+}
+
 pub trait Deserializer {
     fn deserialize<T, R>(&self, r: R) -> Result<T>
     where
@@ -72,6 +285,22 @@ impl Deserializer for Json {
     }
 }
 
+#[derive(Debug, Clone, Copy)]
+pub struct Yaml;
+
+impl Deserializer for Yaml {
+    fn deserialize<T, R>(&self, r: R) -> Result<T>
+    where
+        T: serde::de::DeserializeOwned,
+        R: Read,
+    {
+        serde_yaml::from_reader(r).context("failed yaml deserialization")
+    }
+    fn content_type(&self) -> header::HeaderValue {
+        header::HeaderValue::from_static("application/yaml")
+    }
+}
+
 #[derive(Debug, Clone, Copy)]
 pub struct Raw;
 
@@ -92,8 +321,13 @@ impl Deserializer for Raw {
 pub struct Client {
     client: blocking::Client,
     headers: header::HeaderMap,
+    extra_headers: header::HeaderMap,
     retry: Retry,
     return_on_404: bool,
+    stats: StatsRecorder,
+    concurrency: usize,
+    session_token: Option<SessionToken>,
+    timeout: Duration,
 }
 
 impl Client {
@@ -104,16 +338,38 @@ impl Client {
         Ok(Client {
             client,
             headers: header::HeaderMap::new(),
-            retry: Retry::new(),
+            extra_headers: header::HeaderMap::new(),
+            retry: Retry::new().jitter(true),
             return_on_404: false,
+            stats: STATS.with(|s| s.borrow().clone()),
+            concurrency: FETCH_CONCURRENCY.with(Cell::get),
+            session_token: None,
+            timeout: DEFAULT_REQUEST_TIMEOUT,
         })
     }
 
+    /// Return a snapshot of the counters this client updates, if enabled.
+    ///
+    /// These are shared with all clients created on the same thread.
+    #[allow(dead_code)]
+    pub fn stats(&self) -> Option<Stats> {
+        self.stats.snapshot()
+    }
+
     pub fn header(mut self, k: header::HeaderName, v: header::HeaderValue) -> Self {
         self.headers.append(k, v);
         self
     }
 
+    /// Add headers to all requests, e.g. to reach endpoints through an
+    /// authenticating proxy.
+    ///
+    /// Headers set by providers take precedence over these.
+    pub fn extra_headers(mut self, headers: header::HeaderMap) -> Self {
+        self.extra_headers = headers;
+        self
+    }
+
     #[allow(dead_code)]
     pub fn initial_backoff(mut self, initial_backoff: Duration) -> Self {
         self.retry = self.retry.initial_backoff(initial_backoff);
@@ -126,6 +382,13 @@ impl Client {
         self
     }
 
+    /// Set the backoff strategy between retries.
+    #[allow(dead_code)]
+    pub fn backoff(mut self, backoff: Backoff) -> Self {
+        self.retry = self.retry.backoff(backoff);
+        self
+    }
+
     /// Maximum number of retries to attempt.
     ///
     /// If zero, only the initial request will be performed, with no
@@ -141,6 +404,105 @@ impl Client {
         self
     }
 
+    /// Send a session token with every request, renewing it when a
+    /// request is rejected as unauthorized.
+    pub fn session_token(mut self, token: SessionToken) -> Self {
+        self.session_token = Some(token);
+        self
+    }
+
+    /// Set how long each request may take, from connecting until the
+    /// whole response is read, before it fails (and is retried).
+    ///
+    /// This defaults to 30 seconds. Requests are further bounded by the
+    /// retry deadline, if any.
+    #[allow(dead_code)]
+    pub fn timeout(mut self, timeout: Duration) -> Self {
+        self.timeout = timeout;
+        self
+    }
+
+    /// Maximum number of parallel sub-fetches in `fetch_all()`.
+    #[allow(dead_code)]
+    pub fn concurrency(mut self, concurrency: usize) -> Self {
+        self.concurrency = concurrency.max(1);
+        self
+    }
+
+    /// Run `fetch` on each item, with up to the configured concurrency in
+    /// flight at once.
+    ///
+    /// Results are in the order of `items`, regardless of concurrency. On
+    /// failure, the error of the first failed item is returned.
+    ///
+    /// Retry drivers and clients created by `fetch` share the deadline,
+    /// cancellation token, counters and concurrency of this client, even
+    /// on worker threads.
+    pub fn fetch_all<I, T, F>(&self, items: Vec<I>, fetch: F) -> Result<Vec<T>>
+    where
+        I: Send + 'static,
+        T: Send + 'static,
+        F: Fn(I) -> Result<T> + Send + Sync + 'static,
+    {
+        let workers = self.concurrency.min(items.len());
+        if workers <= 1 {
+            return items.into_iter().map(fetch).collect();
+        }
+
+        let mut results: Vec<Option<Result<T>>> = items.iter().map(|_| None).collect();
+        let queue = Arc::new(Mutex::new(items.into_iter().enumerate()));
+        let fetch = Arc::new(fetch);
+        let settings = self.thread_settings();
+        let (tx, rx) = mpsc::channel();
+        let handles: Vec<_> = (0..workers)
+            .map(|_| {
+                let queue = Arc::clone(&queue);
+                let fetch = Arc::clone(&fetch);
+                let settings = settings.clone();
+                let tx = tx.clone();
+                thread::spawn(move || {
+                    // thread-local settings don't carry over to new threads
+                    settings.apply();
+                    loop {
+                        // don't hold the lock while fetching
+                        let next = queue.lock().ok().and_then(|mut q| q.next());
+                        let (index, item) = match next {
+                            Some(next) => next,
+                            None => break,
+                        };
+                        if tx.send((index, fetch(item))).is_err() {
+                            break;
+                        }
+                    }
+                })
+            })
+            .collect();
+        drop(tx);
+
+        for (index, result) in rx {
+            results[index] = Some(result);
+        }
+        for handle in handles {
+            handle
+                .join()
+                .map_err(|_| anyhow!("metadata fetch worker panicked"))?;
+        }
+        results
+            .into_iter()
+            .map(|r| r.unwrap_or_else(|| Err(anyhow!("missing metadata fetch result"))))
+            .collect()
+    }
+
+    /// Return the settings of this client, to apply on worker threads.
+    fn thread_settings(&self) -> ThreadSettings {
+        ThreadSettings {
+            deadline: self.retry.deadline,
+            cancel_token: self.retry.cancel_token,
+            stats: self.stats.clone(),
+            concurrency: self.concurrency,
+        }
+    }
+
     pub fn get<D>(&self, d: D, url: String) -> RequestBuilder<D>
     where
         D: Deserializer,
@@ -151,8 +513,12 @@ impl Client {
             d,
             client: self.client.clone(),
             headers: self.headers.clone(),
+            extra_headers: self.extra_headers.clone(),
             retry: self.retry.clone(),
             return_on_404: self.return_on_404,
+            stats: self.stats.clone(),
+            session_token: self.session_token.clone(),
+            timeout: self.timeout,
         }
     }
 
@@ -166,8 +532,12 @@ impl Client {
             d,
             client: self.client.clone(),
             headers: self.headers.clone(),
+            extra_headers: self.extra_headers.clone(),
             retry: self.retry.clone(),
             return_on_404: self.return_on_404,
+            stats: self.stats.clone(),
+            session_token: self.session_token.clone(),
+            timeout: self.timeout,
         }
     }
 
@@ -181,8 +551,12 @@ impl Client {
             d,
             client: self.client.clone(),
             headers: self.headers.clone(),
+            extra_headers: self.extra_headers.clone(),
             retry: self.retry.clone(),
             return_on_404: self.return_on_404,
+            stats: self.stats.clone(),
+            session_token: self.session_token.clone(),
+            timeout: self.timeout,
         }
     }
 }
@@ -196,8 +570,12 @@ where
     d: D,
     client: blocking::Client,
     headers: header::HeaderMap,
+    extra_headers: header::HeaderMap,
     retry: Retry,
     return_on_404: bool,
+    stats: StatsRecorder,
+    session_token: Option<SessionToken>,
+    timeout: Duration,
 }
 
 impl<D> RequestBuilder<D>
@@ -215,91 +593,154 @@ where
     {
         let url = reqwest::Url::parse(self.url.as_str()).context("failed to parse uri")?;
         let mut req = blocking::Request::new(Method::GET, url);
-        req.headers_mut().extend(self.headers.clone().into_iter());
+        req.headers_mut()
+            .extend(merge_headers(&self.headers, &self.extra_headers).into_iter());
 
         self.retry.clone().retry(|attempt| {
-            info!("Fetching {}: Attempt #{}", req.url(), attempt + 1);
-            self.dispatch_request(&req)
+            debug!("Fetching {}: Attempt #{}", req.url(), attempt + 1);
+            self.stats.record_attempt(attempt);
+            self.stats.record_result(self.dispatch_request(&req))
         })
     }
 
-    pub fn dispatch_put<T>(self) -> Result<Option<T>>
+    /// Send the request with the given method, retrying on failures.
+    ///
+    /// The body (if any) is kept buffered, so that the same content is
+    /// sent again on each retry. Any successful response is deserialized.
+    pub fn dispatch<T>(self, method: Method) -> Result<Option<T>>
     where
         T: for<'de> serde::Deserialize<'de>,
     {
-        let url = reqwest::Url::parse(self.url.as_str()).context("failed to parse uri")?;
+        self.dispatch_with_body(method.clone(), |response| {
+            match (response.status(), self.return_on_404) {
+                (status, _) if status.is_success() => self.deserialize(response).map(Some),
+                (reqwest::StatusCode::NOT_FOUND, true) => {
+                    drain(response);
+                    Ok(None)
+                }
+                (_, _) => Err(status_error(&format!("{} failed", method), response)),
+            }
+        })
+    }
 
-        self.retry.clone().retry(|attempt| {
-            let mut builder = blocking::Client::new()
-                .put(url.clone())
-                .headers(self.headers.clone())
-                .header(header::CONTENT_TYPE, self.d.content_type());
-            if let Some(ref content) = self.body {
-                builder = builder.body(content.clone());
-            };
-            let req = builder.build().context("failed to build PUT request")?;
+    pub fn dispatch_put<T>(self) -> Result<Option<T>>
+    where
+        T: for<'de> serde::Deserialize<'de>,
+    {
+        self.dispatch(Method::PUT)
+    }
 
-            info!("Putting {}: Attempt #{}", req.url(), attempt + 1);
-            let response = self.client.execute(req).context("failed to PUT request")?;
+    pub fn dispatch_post(self) -> Result<reqwest::StatusCode> {
+        self.dispatch_with_body(Method::POST, |response| {
             let status = response.status();
             if status.is_success() {
-                self.d
-                    .deserialize(response)
-                    .map(Some)
-                    .context("failed to deserialize data")
+                drain(response);
+                Ok(status)
             } else {
-                Err(anyhow!("PUT failed: {}", status))
+                Err(status_error(&format!("{} failed", Method::POST), response))
             }
         })
     }
 
-    pub fn dispatch_post(self) -> Result<reqwest::StatusCode> {
+    fn dispatch_with_body<F, R>(&self, method: Method, handle: F) -> Result<R>
+    where
+        F: Fn(blocking::Response) -> Result<R>,
+    {
         let url = reqwest::Url::parse(self.url.as_str()).context("failed to parse uri")?;
 
         self.retry.clone().retry(|attempt| {
-            let mut builder = blocking::Client::new()
-                .post(url.clone())
-                .headers(self.headers.clone())
-                .header(header::CONTENT_TYPE, self.d.content_type());
+            let mut builder = self
+                .client
+                .request(method.clone(), url.clone())
+                .headers(merge_headers(&self.headers, &self.extra_headers))
+                .header(header::CONTENT_TYPE, self.d.content_type())
+                .timeout(self.request_timeout());
             if let Some(ref content) = self.body {
                 builder = builder.body(content.clone());
             };
-            let req = builder.build().context("failed to build POST request")?;
+            if let Some(ref token) = self.session_token {
+                if let Some(value) = token.current() {
+                    builder = builder.header(token.name.clone(), value);
+                }
+            }
+            let req = builder
+                .build()
+                .with_context(|| format!("failed to build {} request", method))?;
 
-            info!("Posting {}: Attempt #{}", req.url(), attempt + 1);
-            let status = self
+            debug!("Sending {} {}: Attempt #{}", method, req.url(), attempt + 1);
+            self.stats.record_attempt(attempt);
+            let res = self
                 .client
                 .execute(req)
-                .context("failed to POST request")?
-                .status();
-            if status.is_success() {
-                Ok(status)
-            } else {
-                Err(anyhow!("POST failed: {}", status))
-            }
+                .with_context(|| format!("failed to {} request", method))
+                .and_then(&handle);
+            self.stats.record_result(res)
         })
     }
 
+    /// Return the timeout for the next request, so that it doesn't run
+    /// past the retry deadline.
+    fn request_timeout(&self) -> Duration {
+        self.retry
+            .remaining()
+            .map_or(self.timeout, |left| left.min(self.timeout))
+    }
+
+    /// Deserialize a successful response, reading it to the end so that
+    /// the connection can be reused.
+    fn deserialize<T>(&self, resp: blocking::Response) -> Result<T>
+    where
+        T: for<'de> serde::Deserialize<'de>,
+    {
+        let mut reader = CountingReader {
+            inner: resp,
+            stats: &self.stats,
+        };
+        let res = self
+            .d
+            .deserialize(&mut reader)
+            .context("failed to deserialize data");
+        drain(reader);
+        res
+    }
+
     fn dispatch_request<T>(&self, req: &blocking::Request) -> Result<Option<T>>
     where
         T: for<'de> serde::Deserialize<'de>,
     {
-        match self.client.execute(clone_request(req)) {
+        let mut req = clone_request(req);
+        *req.timeout_mut() = Some(self.request_timeout());
+        if let Some(ref token) = self.session_token {
+            if let Some(value) = token.current() {
+                req.headers_mut().insert(token.name.clone(), value);
+            }
+        }
+
+        match self.client.execute(req) {
             Ok(resp) => match (resp.status(), self.return_on_404) {
                 (reqwest::StatusCode::OK, _) => {
                     info!("Fetch successful");
-                    self.d
-                        .deserialize(resp)
-                        .map(Some)
-                        .context("failed to deserialize data")
+                    self.deserialize(resp).map(Some)
                 }
                 (reqwest::StatusCode::NOT_FOUND, true) => {
                     info!("Fetch failed with 404: resource not found");
+                    drain(resp);
                     Ok(None)
                 }
+                (reqwest::StatusCode::UNAUTHORIZED, _) if self.session_token.is_some() => {
+                    info!("Fetch failed with 401: renewing session token");
+                    drain(resp);
+                    if let Some(ref token) = self.session_token {
+                        token.renew();
+                    }
+                    Err(anyhow!(
+                        "failed to fetch: {}",
+                        reqwest::StatusCode::UNAUTHORIZED
+                    ))
+                }
                 (s, _) => {
                     info!("Failed to fetch: {}", s);
-                    Err(anyhow!("failed to fetch: {}", s))
+                    Err(status_error("failed to fetch", resp))
                 }
             },
             Err(e) => {
@@ -310,6 +751,95 @@ where
     }
 }
 
+/// Read the rest of a response, so that its connection goes back to the
+/// pool instead of being closed.
+fn drain<R: Read>(mut resp: R) {
+    // nothing to do on errors, the connection just won't be reused
+    let _ = io::copy(&mut resp, &mut io::sink());
+}
+
+/// Build the error for an unexpected response status, with the start of
+/// the response body (if any), which often tells what went wrong.
+///
+/// If the response asks to retry later, the error tells retry drivers to
+/// wait accordingly.
+fn status_error(action: &str, mut resp: blocking::Response) -> anyhow::Error {
+    let status = resp.status();
+    let retry_after = resp
+        .headers()
+        .get(header::RETRY_AFTER)
+        .and_then(|v| parse_retry_after(v, SystemTime::now()));
+    let mut body = Vec::new();
+    // the body is only informational, ignore errors reading it
+    let _ = (&mut resp)
+        .take(ERROR_BODY_LEN as u64 + 1)
+        .read_to_end(&mut body);
+    drain(resp);
+    let truncated = body.len() > ERROR_BODY_LEN;
+    body.truncate(ERROR_BODY_LEN);
+    let body = String::from_utf8_lossy(&body);
+    let body = body.trim();
+    let msg = match (body.is_empty(), truncated) {
+        (true, _) => format!("{}: {}", action, status),
+        (false, false) => format!("{}: {}, body: {:?}", action, status, body),
+        (false, true) => format!("{}: {}, body: {:?}...", action, status, body),
+    };
+    match retry_after {
+        Some(delay) => anyhow::Error::new(RetryAfter(delay)).context(msg),
+        None => anyhow!(msg),
+    }
+}
+
+/// Parse a `Retry-After` header, either in seconds or as an HTTP date
+/// (only in the preferred IMF-fixdate format), into a delay from now.
+fn parse_retry_after(value: &header::HeaderValue, now: SystemTime) -> Option<Duration> {
+    let value = value.to_str().ok()?.trim();
+    if let Ok(secs) = value.parse::<u64>() {
+        return Some(Duration::from_secs(secs));
+    }
+    let date = parse_http_date(value)?;
+    Some(
+        date.duration_since(now)
+            .unwrap_or_else(|_| Duration::new(0, 0)),
+    )
+}
+
+/// Parse an IMF-fixdate, e.g. `Sun, 06 Nov 1994 08:49:37 GMT`.
+fn parse_http_date(value: &str) -> Option<SystemTime> {
+    const MONTHS: [&str; 12] = [
+        "Jan", "Feb", "Mar", "Apr", "May", "Jun", "Jul", "Aug", "Sep", "Oct", "Nov", "Dec",
+    ];
+
+    let fields: Vec<&str> = value.split_whitespace().collect();
+    if fields.len() != 6 || !fields[0].ends_with(',') || fields[5] != "GMT" {
+        return None;
+    }
+    let day: u64 = fields[1].parse().ok()?;
+    let month = MONTHS.iter().position(|m| *m == fields[2])? as u64 + 1;
+    let year: u64 = fields[3].parse().ok()?;
+    let time = fields[4]
+        .split(':')
+        .map(|f| f.parse().ok())
+        .collect::<Option<Vec<u64>>>()?;
+    if year < 1970 || !(1..=31).contains(&day) || time.len() != 3 {
+        return None;
+    }
+    if time[0] > 23 || time[1] > 59 || time[2] > 60 {
+        return None;
+    }
+
+    // days since the epoch, counting years from March so that leap days
+    // come last
+    let (y, m) = if month <= 2 {
+        (year - 1, month + 9)
+    } else {
+        (year, month - 3)
+    };
+    let days = y * 365 + y / 4 - y / 100 + y / 400 + (153 * m + 2) / 5 + day - 1 - 719_468;
+    let secs = days * 86_400 + time[0] * 3_600 + time[1] * 60 + time[2];
+    Some(UNIX_EPOCH + Duration::from_secs(secs))
+}
+
 /// Reqwests Request struct doesn't implement `Clone`,
 /// so we have to do it here.
 fn clone_request(req: &blocking::Request) -> blocking::Request {
@@ -319,3 +849,526 @@ fn clone_request(req: &blocking::Request) -> blocking::Request {
         .extend(req.headers().clone().into_iter());
     newreq
 }
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use serde_derive::Deserialize;
+    use std::collections::HashMap;
+
+    #[test]
+    fn test_yaml_deserialize() {
+        #[derive(Debug, Deserialize, PartialEq)]
+        struct Config {
+            version: u8,
+            ethernets: HashMap<String, Ethernet>,
+        }
+        #[derive(Debug, Deserialize, PartialEq)]
+        struct Ethernet {
+            dhcp4: bool,
+            addresses: Vec<String>,
+            nameservers: Option<Nameservers>,
+        }
+        #[derive(Debug, Deserialize, PartialEq)]
+        struct Nameservers {
+            addresses: Vec<String>,
+        }
+
+        let doc = r#"
+version: 2
+ethernets:
+  eth0:
+    dhcp4: false
+    addresses:
+      - 192.0.2.10/24
+      - "2001:db8::10/64"
+    nameservers:
+      addresses: [192.0.2.1]
+  eth1:
+    dhcp4: true
+    addresses: []
+"#;
+        let config: Config = Yaml.deserialize(doc.as_bytes()).unwrap();
+        assert_eq!(config.version, 2);
+        assert_eq!(
+            config.ethernets["eth0"],
+            Ethernet {
+                dhcp4: false,
+                addresses: vec!["192.0.2.10/24".to_string(), "2001:db8::10/64".to_string()],
+                nameservers: Some(Nameservers {
+                    addresses: vec!["192.0.2.1".to_string()],
+                }),
+            }
+        );
+        assert_eq!(
+            config.ethernets["eth1"],
+            Ethernet {
+                dhcp4: true,
+                addresses: vec![],
+                nameservers: None,
+            }
+        );
+
+        Yaml.deserialize::<Config, _>("version: [".as_bytes())
+            .unwrap_err();
+    }
+
+    #[test]
+    fn test_put_retry_after_unavailable() {
+        let ep = "/token";
+        let client = Client::try_new()
+            .unwrap()
+            .initial_backoff(Duration::from_millis(10))
+            .max_retries(1);
+
+        let m_unavailable = mockito::mock("PUT", ep)
+            .match_body("payload")
+            .with_status(503)
+            .expect(1)
+            .create();
+        let m_ok = mockito::mock("PUT", ep)
+            .match_body("payload")
+            .with_status(200)
+            .with_body("test-token")
+            .expect(1)
+            .create();
+
+        let url = format!("{}{}", mockito::server_url(), ep);
+        let token: Option<String> = client
+            .put(Raw, url, Some("payload".into()))
+            .dispatch_put()
+            .unwrap();
+        assert_eq!(token, Some("test-token".to_string()));
+
+        m_unavailable.assert();
+        m_ok.assert();
+        mockito::reset();
+    }
+
+    #[test]
+    fn test_extra_headers() {
+        let mut extra = header::HeaderMap::new();
+        for h in &["X-Debug: 1", "Metadata-Flavor: bogus"] {
+            let (name, value) = parse_header(h).unwrap();
+            extra.append(name, value);
+        }
+
+        let client = Client::try_new()
+            .unwrap()
+            .max_retries(0)
+            .extra_headers(extra)
+            .header(
+                header::HeaderName::from_static("metadata-flavor"),
+                header::HeaderValue::from_static("Google"),
+            );
+
+        let m = mockito::mock("GET", "/headers")
+            .match_header("x-debug", "1")
+            .match_header("metadata-flavor", "Google")
+            .with_status(200)
+            .with_body("ok")
+            .create();
+
+        let url = format!("{}/headers", mockito::server_url());
+        let v: Option<String> = client.get(Raw, url).send().unwrap();
+        assert_eq!(v, Some("ok".to_string()));
+        m.assert();
+
+        let merged = merge_headers(&client.headers, &client.extra_headers);
+        let flavors: Vec<_> = merged.get_all("metadata-flavor").iter().collect();
+        assert_eq!(flavors, vec!["Google"]);
+
+        mockito::reset();
+    }
+
+    #[test]
+    fn test_parse_header() {
+        let (name, value) = parse_header("Authorization:  Bearer abc ").unwrap();
+        assert_eq!(name, "authorization");
+        assert_eq!(value, "Bearer abc");
+
+        for h in &["", "no-delimiter", ": value", "bad name: value"] {
+            parse_header(h).unwrap_err();
+        }
+    }
+
+    #[test]
+    fn test_post_no_retries() {
+        let ep = "/checkin";
+        let client = Client::try_new().unwrap().max_retries(0);
+
+        let _m = mockito::mock("POST", ep).with_status(503).create();
+        let url = format!("{}{}", mockito::server_url(), ep);
+        client.post(Raw, url, None).dispatch_post().unwrap_err();
+
+        mockito::reset();
+    }
+
+    #[test]
+    fn test_status_error() {
+        let client = Client::try_new()
+            .unwrap()
+            .initial_backoff(Duration::from_millis(10))
+            .max_retries(1);
+
+        // last status and body, after all attempts
+        let m_denied = mockito::mock("GET", "/denied")
+            .with_status(403)
+            .with_body("{\"code\": \"AccessDenied\"}\n")
+            .expect(2)
+            .create();
+        let url = format!("{}/denied", mockito::server_url());
+        let err = client.get(Raw, url.clone()).send::<String>().unwrap_err();
+        m_denied.assert();
+        let msg = format!("{:#}", err);
+        assert!(
+            msg.contains("maximum number of retries (1) reached"),
+            "{}",
+            msg
+        );
+        assert!(
+            msg.contains(r#"403 Forbidden, body: "{\"code\": \"AccessDenied\"}""#),
+            "{}",
+            msg
+        );
+
+        // long bodies are truncated
+        let _m_long = mockito::mock("POST", "/long")
+            .with_status(500)
+            .with_body("x".repeat(1000))
+            .create();
+        let url = format!("{}/long", mockito::server_url());
+        let err = client
+            .clone()
+            .max_retries(0)
+            .post(Raw, url, None)
+            .dispatch_post()
+            .unwrap_err();
+        let msg = format!("{:#}", err);
+        assert!(
+            msg.ends_with(&format!("\"{}\"...", "x".repeat(ERROR_BODY_LEN))),
+            "{}",
+            msg
+        );
+
+        // no body
+        let _m_down = mockito::mock("GET", "/down").with_status(503).create();
+        let url = format!("{}/down", mockito::server_url());
+        let err = client
+            .max_retries(0)
+            .get(Raw, url)
+            .send::<String>()
+            .unwrap_err();
+        assert!(format!("{:#}", err).ends_with("failed to fetch: 503 Service Unavailable"));
+
+        // 404 is still not an error if so configured
+        let _m_missing = mockito::mock("GET", "/missing").with_status(404).create();
+        let url = format!("{}/missing", mockito::server_url());
+        let res: Option<String> = Client::try_new()
+            .unwrap()
+            .return_on_404(true)
+            .get(Raw, url)
+            .send()
+            .unwrap();
+        assert_eq!(res, None);
+
+        mockito::reset();
+    }
+
+    #[test]
+    fn test_parse_retry_after() {
+        let now = UNIX_EPOCH + Duration::from_secs(784_111_700);
+        let parse = |v: &'static str| parse_retry_after(&header::HeaderValue::from_static(v), now);
+
+        assert_eq!(parse("120"), Some(Duration::from_secs(120)));
+        assert_eq!(parse(" 0 "), Some(Duration::from_secs(0)));
+        assert_eq!(
+            parse("Sun, 06 Nov 1994 08:49:37 GMT"),
+            Some(Duration::from_secs(77))
+        );
+        assert_eq!(
+            parse("Tue, 29 Feb 2000 00:00:00 GMT"),
+            Some(Duration::from_secs(951_782_400 - 784_111_700))
+        );
+        // already past
+        assert_eq!(
+            parse("Thu, 01 Jan 1970 00:00:00 GMT"),
+            Some(Duration::from_secs(0))
+        );
+        for invalid in &[
+            "",
+            "-1",
+            "soon",
+            "Sunday, 06-Nov-94 08:49:37 GMT",
+            "Sun Nov  6 08:49:37 1994",
+            "Sun, 06 Nov 1994 08:49:37 UTC",
+            "Sun, 06 Foo 1994 08:49:37 GMT",
+            "Sun, 06 Nov 1994 08:49 GMT",
+            "Sun, 32 Nov 1994 08:49:37 GMT",
+        ] {
+            assert_eq!(parse(invalid), None, "{}", invalid);
+        }
+    }
+
+    #[test]
+    fn test_retry_after() {
+        let client = Client::try_new()
+            .unwrap()
+            .initial_backoff(Duration::from_millis(10))
+            .max_backoff(Duration::from_secs(5))
+            .max_retries(1);
+
+        let m_unavailable = mockito::mock("GET", "/busy")
+            .with_status(503)
+            .with_header("retry-after", "2")
+            .expect(1)
+            .create();
+        let m_ok = mockito::mock("GET", "/busy")
+            .with_status(200)
+            .with_body("ok")
+            .expect(1)
+            .create();
+
+        let url = format!("{}/busy", mockito::server_url());
+        let start = std::time::Instant::now();
+        let v: Option<String> = client.get(Raw, url).send().unwrap();
+        assert_eq!(v, Some("ok".to_string()));
+        assert!(start.elapsed() >= Duration::from_secs(2));
+        assert!(start.elapsed() < Duration::from_secs(5));
+
+        m_unavailable.assert();
+        m_ok.assert();
+        mockito::reset();
+    }
+
+    #[test]
+    fn test_timeout() {
+        use std::io::Write;
+        use std::net::TcpListener;
+
+        // the first connection hangs, the second one gets a response
+        let listener = TcpListener::bind("127.0.0.1:0").unwrap();
+        let addr = listener.local_addr().unwrap();
+        let server = thread::spawn(move || {
+            let (hung, _) = listener.accept().unwrap();
+            let (mut stream, _) = listener.accept().unwrap();
+            let mut buf = [0; 1024];
+            let _ = stream.read(&mut buf).unwrap();
+            stream
+                .write_all(b"HTTP/1.1 200 OK\r\ncontent-length: 2\r\n\r\nok")
+                .unwrap();
+            drop(hung);
+        });
+
+        let client = Client::try_new()
+            .unwrap()
+            .timeout(Duration::from_millis(200))
+            .initial_backoff(Duration::from_millis(10))
+            .max_retries(1);
+        let start = std::time::Instant::now();
+        let v: Option<String> = client
+            .get(Raw, format!("http://{}/hung", addr))
+            .send()
+            .unwrap();
+        assert_eq!(v, Some("ok".to_string()));
+        assert!(start.elapsed() >= Duration::from_millis(200));
+        assert!(start.elapsed() < Duration::from_secs(10));
+        server.join().unwrap();
+    }
+
+    #[test]
+    fn test_connection_reuse() {
+        use std::io::{BufRead, BufReader, Write};
+        use std::net::TcpListener;
+        use std::sync::atomic::{AtomicUsize, Ordering};
+
+        // keep-alive server counting connections, answering based on the
+        // request path
+        let listener = TcpListener::bind("127.0.0.1:0").unwrap();
+        let addr = listener.local_addr().unwrap();
+        let connections = Arc::new(AtomicUsize::new(0));
+        let counter = connections.clone();
+        thread::spawn(move || {
+            for stream in listener.incoming() {
+                let mut stream = stream.unwrap();
+                counter.fetch_add(1, Ordering::SeqCst);
+                thread::spawn(move || {
+                    let mut reader = BufReader::new(stream.try_clone().unwrap());
+                    loop {
+                        let mut request = String::new();
+                        if reader.read_line(&mut request).unwrap_or(0) == 0 {
+                            return;
+                        }
+                        let mut length = 0;
+                        loop {
+                            let mut line = String::new();
+                            reader.read_line(&mut line).unwrap();
+                            let line = line.trim_end().to_ascii_lowercase();
+                            if line.is_empty() {
+                                break;
+                            }
+                            if let Some(v) = line.strip_prefix("content-length:") {
+                                length = v.trim().parse().unwrap();
+                            }
+                        }
+                        let mut body = vec![0; length];
+                        reader.read_exact(&mut body).unwrap();
+
+                        let (status, body) = match request.split(' ').nth(1) {
+                            Some("/ok") => ("200 OK", "ok".to_string()),
+                            Some("/missing") => ("404 Not Found", "not found".to_string()),
+                            _ => ("500 Internal Server Error", "x".repeat(256 * 1024)),
+                        };
+                        let response = format!(
+                            "HTTP/1.1 {}\r\ncontent-length: {}\r\n\r\n{}",
+                            status,
+                            body.len(),
+                            body
+                        );
+                        stream.write_all(response.as_bytes()).unwrap();
+                    }
+                });
+            }
+        });
+
+        let client = Client::try_new()
+            .unwrap()
+            .max_retries(0)
+            .return_on_404(true);
+        let url = |path| format!("http://{}{}", addr, path);
+        for _ in 0..3 {
+            let v: Option<String> = client.get(Raw, url("/ok")).send().unwrap();
+            assert_eq!(v, Some("ok".to_string()));
+        }
+        let v: Option<String> = client.get(Raw, url("/missing")).send().unwrap();
+        assert_eq!(v, None);
+        client.get(Raw, url("/error")).send::<String>().unwrap_err();
+        let status = client
+            .post(Raw, url("/ok"), Some("payload".into()))
+            .dispatch_post()
+            .unwrap();
+        assert_eq!(status, reqwest::StatusCode::OK);
+        client
+            .put(Raw, url("/error"), None)
+            .dispatch_put::<String>()
+            .unwrap_err();
+        let v: Option<String> = client.clone().get(Raw, url("/ok")).send().unwrap();
+        assert_eq!(v, Some("ok".to_string()));
+
+        assert_eq!(connections.load(Ordering::SeqCst), 1);
+    }
+
+    #[test]
+    fn test_stats() {
+        let client = Client::try_new().unwrap();
+        assert_eq!(client.stats(), None);
+
+        enable_stats();
+        let client = Client::try_new()
+            .unwrap()
+            .initial_backoff(Duration::from_millis(10))
+            .max_retries(2)
+            .return_on_404(true);
+        assert_eq!(client.stats(), Some(Stats::default()));
+
+        let _m_ok = mockito::mock("GET", "/ok")
+            .with_status(200)
+            .with_body("hello")
+            .create();
+        let _m_missing = mockito::mock("GET", "/missing").with_status(404).create();
+        let _m_down = mockito::mock("GET", "/down").with_status(503).create();
+        let m_unavailable = mockito::mock("PUT", "/token")
+            .with_status(503)
+            .expect(1)
+            .create();
+        let m_token = mockito::mock("PUT", "/token")
+            .with_status(200)
+            .with_body("token")
+            .expect(1)
+            .create();
+
+        let url = |ep: &str| format!("{}{}", mockito::server_url(), ep);
+        let v: Option<String> = client.get(Raw, url("/ok")).send().unwrap();
+        assert_eq!(v, Some("hello".to_string()));
+        let v: Option<String> = client.get(Raw, url("/missing")).send().unwrap();
+        assert_eq!(v, None);
+        client.get(Raw, url("/down")).send::<String>().unwrap_err();
+        let v: Option<String> = client.put(Raw, url("/token"), None).dispatch_put().unwrap();
+        assert_eq!(v, Some("token".to_string()));
+        m_unavailable.assert();
+        m_token.assert();
+
+        let expected = Stats {
+            // 1 + 1 + 3 + 2
+            requests: 7,
+            retries: 3,
+            failures: 4,
+            bytes_read: 10,
+        };
+        assert_eq!(client.stats(), Some(expected));
+        // counters are shared by all clients on this thread
+        assert_eq!(stats(), Some(expected));
+        let other = Client::try_new().unwrap();
+        assert_eq!(other.stats(), Some(expected));
+
+        mockito::reset();
+    }
+
+    #[test]
+    fn test_fetch_all() {
+        // later items complete first when run in parallel
+        let fetch = |n: u64| {
+            thread::sleep(Duration::from_millis(8 - n));
+            Ok(n * 10)
+        };
+        for &concurrency in &[1, 4] {
+            let client = Client::try_new().unwrap().concurrency(concurrency);
+            let v = client.fetch_all((0..8).collect(), fetch).unwrap();
+            assert_eq!(v, vec![0, 10, 20, 30, 40, 50, 60, 70]);
+
+            let v = client.fetch_all(vec![], fetch).unwrap();
+            assert!(v.is_empty());
+
+            let err = client
+                .fetch_all((0..8).collect(), |n: u64| {
+                    if n % 3 == 2 {
+                        bail!("failed {}", n);
+                    }
+                    Ok(n)
+                })
+                .unwrap_err();
+            assert_eq!(err.to_string(), "failed 2");
+        }
+
+        // defaults to serial fetches
+        assert_eq!(Client::try_new().unwrap().concurrency, 1);
+        set_fetch_concurrency(4);
+        assert_eq!(Client::try_new().unwrap().concurrency, 4);
+        set_fetch_concurrency(0);
+        assert_eq!(Client::try_new().unwrap().concurrency, 1);
+    }
+
+    #[test]
+    fn test_fetch_all_settings() {
+        let deadline = Instant::now() + Duration::from_secs(60);
+        set_deadline(Some(deadline));
+        crate::retry::enable_stats();
+        let client = Client::try_new().unwrap().concurrency(2);
+        set_deadline(None);
+
+        // workers see the settings of the client
+        let settings = client
+            .fetch_all((0..4).collect(), |_: u8| {
+                let inner = Client::try_new()?;
+                Ok((
+                    inner.retry.deadline,
+                    inner.stats.0.is_some(),
+                    inner.concurrency,
+                ))
+            })
+            .unwrap();
+        for setting in settings {
+            assert_eq!(setting, (Some(deadline), true, 2));
+        }
+    }
+}
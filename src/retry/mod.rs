@@ -14,8 +14,11 @@
 
 //! Drive a functions through a finite number of retries until it succeeds.
 
+use std::cell::Cell;
+use std::fmt;
+use std::sync::atomic::{AtomicBool, Ordering};
 use std::thread;
-use std::time::Duration;
+use std::time::{Duration, Instant, SystemTime, UNIX_EPOCH};
 
 use anyhow::{Context, Result};
 
@@ -23,11 +26,197 @@ mod client;
 pub mod raw_deserializer;
 pub use self::client::*;
 
+thread_local! {
+    /// Instant after which retry drivers created on this thread give up.
+    static DEADLINE: Cell<Option<Instant>> = Cell::new(None);
+    /// Token checked by retry drivers created on this thread.
+    static CANCEL_TOKEN: Cell<Option<CancelToken>> = Cell::new(None);
+    /// State of the pseudo-random generator used for jitter.
+    static RANDOM_STATE: Cell<u64> = Cell::new(random_seed());
+}
+
+/// How often retry drivers waiting between attempts check for cancellation.
+const CANCEL_POLL_INTERVAL: Duration = Duration::from_millis(50);
+
+/// Upper bound of the delay before any retry, even without a maximum
+/// backoff.
+const MAX_DELAY: Duration = Duration::from_secs(60 * 60);
+
+/// Set a deadline for retry drivers (and clients) subsequently created on
+/// this thread, after which they give up instead of retrying.
+pub fn set_deadline(deadline: Option<Instant>) {
+    DEADLINE.with(|d| d.set(deadline));
+}
+
+/// Error of retry drivers giving up because of their deadline.
+#[derive(Clone, Debug)]
+pub struct DeadlineExceeded {
+    last_error: Option<String>,
+}
+
+impl fmt::Display for DeadlineExceeded {
+    fn fmt(&self, f: &mut fmt::Formatter) -> fmt::Result {
+        match self.last_error {
+            Some(ref e) => write!(f, "maximum runtime exceeded, last error: {}", e),
+            None => write!(f, "maximum runtime exceeded"),
+        }
+    }
+}
+
+impl std::error::Error for DeadlineExceeded {}
+
+/// Check whether an error comes from a retry driver hitting its deadline.
+pub fn is_deadline_exceeded(err: &anyhow::Error) -> bool {
+    err.downcast_ref::<DeadlineExceeded>().is_some()
+}
+
+/// Seed the jitter generator, so that instances booting at the same time
+/// don't retry in lockstep.
+fn random_seed() -> u64 {
+    let nanos = SystemTime::now()
+        .duration_since(UNIX_EPOCH)
+        .map(|d| d.as_nanos() as u64)
+        .unwrap_or(0);
+    // xorshift never leaves zero
+    (nanos ^ u64::from(std::process::id()).rotate_left(32)) | 1
+}
+
+/// Return a pseudo-random number (xorshift64), good enough to spread out
+/// retries but for nothing else.
+fn random_u64() -> u64 {
+    RANDOM_STATE.with(|state| {
+        let mut x = state.get();
+        x ^= x << 13;
+        x ^= x >> 7;
+        x ^= x << 17;
+        state.set(x);
+        x
+    })
+}
+
+/// Pick a delay between zero and the given one, from a random number.
+fn full_jitter(delay: Duration, random: u64) -> Duration {
+    let nanos = u128::from(random) % (delay.as_nanos() + 1);
+    Duration::from_nanos(nanos as u64)
+}
+
+/// Set a cancellation token for retry drivers (and clients) subsequently
+/// created on this thread.
+pub fn set_cancel_token(token: Option<CancelToken>) {
+    CANCEL_TOKEN.with(|t| t.set(token));
+}
+
+/// Flag telling retry drivers to give up, e.g. set from a signal handler.
+#[derive(Clone, Copy, Debug)]
+pub struct CancelToken(&'static AtomicBool);
+
+impl CancelToken {
+    /// Build a token backed by the given flag.
+    pub fn new(flag: &'static AtomicBool) -> Self {
+        CancelToken(flag)
+    }
+
+    /// Cancel all retry drivers holding this token.
+    #[allow(dead_code)]
+    pub fn cancel(self) {
+        self.0.store(true, Ordering::SeqCst);
+    }
+
+    /// Check whether the token was cancelled.
+    pub fn is_cancelled(self) -> bool {
+        self.0.load(Ordering::SeqCst)
+    }
+}
+
+/// Error of retry drivers giving up because they were cancelled.
+#[derive(Debug)]
+pub struct Cancelled {
+    last_error: Option<String>,
+}
+
+impl fmt::Display for Cancelled {
+    fn fmt(&self, f: &mut fmt::Formatter) -> fmt::Result {
+        match self.last_error {
+            Some(ref e) => write!(f, "operation cancelled, last error: {}", e),
+            None => write!(f, "operation cancelled"),
+        }
+    }
+}
+
+impl std::error::Error for Cancelled {}
+
+/// Check whether an error comes from a retry driver being cancelled.
+#[allow(dead_code)]
+pub fn is_cancelled(err: &anyhow::Error) -> bool {
+    err.downcast_ref::<Cancelled>().is_some()
+}
+
+/// Error asking retry drivers to wait for at least the given delay before
+/// the next attempt, e.g. from a `Retry-After` header.
+///
+/// The delay is still capped to the maximum backoff.
+#[derive(Debug)]
+pub struct RetryAfter(pub Duration);
+
+impl fmt::Display for RetryAfter {
+    fn fmt(&self, f: &mut fmt::Formatter) -> fmt::Result {
+        write!(f, "retry requested after {}s", self.0.as_secs())
+    }
+}
+
+impl std::error::Error for RetryAfter {}
+
+/// Strategy for computing the delay before each retry.
+#[derive(Clone, Copy, Debug)]
+pub enum Backoff {
+    /// Always wait for the initial backoff.
+    #[allow(dead_code)]
+    Fixed,
+    /// Wait for the initial backoff times the retry number.
+    #[allow(dead_code)]
+    Linear,
+    /// Double the delay on each retry, starting from the initial backoff.
+    Exponential,
+    /// Compute the delay from the retry number (starting at 1).
+    #[allow(dead_code)]
+    Custom(fn(u8) -> Duration),
+}
+
+impl Default for Backoff {
+    fn default() -> Self {
+        Backoff::Exponential
+    }
+}
+
+impl Backoff {
+    /// Return the delay before the given retry (starting at 1), before
+    /// applying the maximum backoff.
+    ///
+    /// This is capped to `MAX_DELAY`, also on overflow.
+    fn delay(self, initial_backoff: Duration, retry: u8) -> Duration {
+        let retry = retry.max(1);
+        let factor = match self {
+            Backoff::Fixed => Some(1),
+            Backoff::Linear => Some(u32::from(retry)),
+            Backoff::Exponential => 1u32.checked_shl(u32::from(retry) - 1),
+            Backoff::Custom(delay_fn) => return delay_fn(retry).min(MAX_DELAY),
+        };
+        factor
+            .and_then(|f| initial_backoff.checked_mul(f))
+            .map_or(MAX_DELAY, |delay| delay.min(MAX_DELAY))
+    }
+}
+
 #[derive(Clone, Debug)]
 pub struct Retry {
     initial_backoff: Duration,
     max_backoff: Duration,
     max_retries: u8,
+    backoff: Backoff,
+    deadline: Option<Instant>,
+    cancel_token: Option<CancelToken>,
+    jitter: bool,
+    random: fn() -> u64,
 }
 
 impl Default for Retry {
@@ -36,6 +225,11 @@ impl Default for Retry {
             initial_backoff: Duration::new(1, 0),
             max_backoff: Duration::new(5, 0),
             max_retries: 10,
+            backoff: Backoff::default(),
+            deadline: DEADLINE.with(Cell::get),
+            cancel_token: CANCEL_TOKEN.with(Cell::get),
+            jitter: false,
+            random: random_u64,
         }
     }
 }
@@ -71,20 +265,147 @@ impl Retry {
         self
     }
 
+    /// Set the backoff strategy.
+    ///
+    /// This defaults to exponential backoff.
+    #[allow(dead_code)]
+    pub fn backoff(mut self, backoff: Backoff) -> Self {
+        self.backoff = backoff;
+        self
+    }
+
+    /// Give up after the given instant, instead of retrying.
+    ///
+    /// This defaults to the deadline set for this thread, if any.
+    /// Attempts in progress are not interrupted, but requests sent by
+    /// clients time out at the deadline.
+    #[allow(dead_code)]
+    pub fn deadline(mut self, deadline: Option<Instant>) -> Self {
+        self.deadline = deadline;
+        self
+    }
+
+    /// Give up as soon as the given token is cancelled, including while
+    /// waiting between attempts.
+    ///
+    /// This defaults to the token set for this thread, if any.
+    #[allow(dead_code)]
+    pub fn cancel_token(mut self, token: Option<CancelToken>) -> Self {
+        self.cancel_token = token;
+        self
+    }
+
+    /// Wait for a random delay between zero and the backoff before each
+    /// retry ("full jitter"), so that many clients failing at once don't
+    /// retry in lockstep.
+    ///
+    /// This defaults to false.
+    pub fn jitter(mut self, jitter: bool) -> Self {
+        self.jitter = jitter;
+        self
+    }
+
+    /// Return the time left before the deadline, if any.
+    pub(crate) fn remaining(&self) -> Option<Duration> {
+        self.deadline
+            .map(|d| d.saturating_duration_since(Instant::now()))
+    }
+
+    fn is_cancelled(&self) -> bool {
+        self.cancel_token.map_or(false, CancelToken::is_cancelled)
+    }
+
+    /// Wait for the given delay, returning early (and false) if cancelled.
+    fn sleep(&self, delay: Duration) -> bool {
+        let token = match self.cancel_token {
+            Some(token) => token,
+            None => {
+                thread::sleep(delay);
+                return true;
+            }
+        };
+        let until = Instant::now() + delay;
+        loop {
+            if token.is_cancelled() {
+                return false;
+            }
+            let left = until.saturating_duration_since(Instant::now());
+            if left == Duration::new(0, 0) {
+                return true;
+            }
+            thread::sleep(left.min(CANCEL_POLL_INTERVAL));
+        }
+    }
+
+    /// Return the delay before the given retry (starting at 1), capped
+    /// to the maximum backoff if any.
+    fn delay_for(&self, retry: u8) -> Duration {
+        let delay = self.backoff.delay(self.initial_backoff, retry);
+        if self.max_backoff != Duration::new(0, 0) && delay > self.max_backoff {
+            self.max_backoff
+        } else {
+            delay
+        }
+    }
+
+    /// Return the time to wait before the given retry (starting at 1),
+    /// with jitter if enabled.
+    fn wait_for(&self, retry: u8) -> Duration {
+        let delay = self.delay_for(retry);
+        if self.jitter {
+            full_jitter(delay, (self.random)())
+        } else {
+            delay
+        }
+    }
+
+    /// Return the time to wait before the given retry (starting at 1),
+    /// after the given error, which may ask for a longer delay.
+    fn wait_after(&self, retry: u8, err: &anyhow::Error) -> Duration {
+        let delay = self.wait_for(retry);
+        match err.downcast_ref::<RetryAfter>() {
+            Some(&RetryAfter(requested)) if requested > delay => {
+                if self.max_backoff != Duration::new(0, 0) {
+                    requested.min(self.max_backoff)
+                } else {
+                    requested
+                }
+            }
+            _ => delay,
+        }
+    }
+
     /// Retry a function until it either succeeds once or fails all the time.
     pub fn retry<F, R>(self, try_fn: F) -> Result<R>
     where
         F: Fn(u8) -> Result<R>,
     {
-        let mut delay = self.initial_backoff;
         let mut attempts = 0;
 
+        if self.is_cancelled() {
+            return Err(Cancelled { last_error: None }.into());
+        }
+        if self.deadline.map_or(false, |d| Instant::now() >= d) {
+            return Err(DeadlineExceeded { last_error: None }.into());
+        }
+
         loop {
             let res = try_fn(attempts);
 
             // If the result is ok, there is no need to try again.
-            if res.is_ok() {
-                break res;
+            let err = match res {
+                Ok(_) => break res,
+                Err(ref e) => e,
+            };
+
+            // don't retry once cancelled, e.g. during the attempt
+            if self.is_cancelled() {
+                break res.map_err(|e| {
+                    Cancelled {
+                        last_error: Some(format!("{:#}", e)),
+                    }
+                    .into()
+                });
             }
 
             // Otherwise, perform "the retry with backoff" logic.
@@ -95,13 +416,27 @@ impl Retry {
             }
             attempts = attempts.saturating_add(1);
 
-            thread::sleep(delay);
+            // don't wait for a retry which would start past the deadline
+            let delay = self.wait_after(attempts, err);
+            if let Some(deadline) = self.deadline {
+                if delay >= deadline.saturating_duration_since(Instant::now()) {
+                    break res.map_err(|e| {
+                        DeadlineExceeded {
+                            last_error: Some(format!("{:#}", e)),
+                        }
+                        .into()
+                    });
+                }
+            }
 
-            delay = if self.max_backoff != Duration::new(0, 0) && delay * 2 > self.max_backoff {
-                self.max_backoff
-            } else {
-                delay * 2
-            };
+            if !self.sleep(delay) {
+                break res.map_err(|e| {
+                    Cancelled {
+                        last_error: Some(format!("{:#}", e)),
+                    }
+                    .into()
+                });
+            }
         }
     }
 }
@@ -154,4 +489,186 @@ mod tests {
         let total = final_res.unwrap();
         assert_eq!(total, retries);
     }
+
+    #[test]
+    fn test_deadline() {
+        let timings = Duration::from_millis(100);
+        let driver = Retry::new()
+            .initial_backoff(timings)
+            .max_backoff(timings)
+            .max_retries(5);
+
+        // the first retry would start past the deadline
+        let attempts = Cell::new(0);
+        let res: AttemptResult = driver
+            .clone()
+            .deadline(Some(Instant::now() + Duration::from_millis(50)))
+            .retry(|attempt| {
+                attempts.set(attempts.get() + 1);
+                bail!("expected error #{}", attempt)
+            });
+        let err = res.unwrap_err();
+        assert!(is_deadline_exceeded(&err));
+        assert!(format!("{:#}", err).contains("expected error #0"));
+        assert_eq!(attempts.get(), 1);
+
+        // past the deadline, nothing is attempted
+        attempts.set(0);
+        let res: AttemptResult = driver.deadline(Some(Instant::now())).retry(|_| {
+            attempts.set(attempts.get() + 1);
+            Ok(0)
+        });
+        assert!(is_deadline_exceeded(&res.unwrap_err()));
+        assert_eq!(attempts.get(), 0);
+
+        // other errors are left alone
+        let res: AttemptResult = Retry::new().max_retries(0).retry(|_| bail!("other"));
+        assert!(!is_deadline_exceeded(&res.unwrap_err()));
+    }
+
+    #[test]
+    fn test_cancel() {
+        let flag: &'static AtomicBool = Box::leak(Box::new(AtomicBool::new(false)));
+        let token = CancelToken::new(flag);
+        let driver = Retry::new()
+            .initial_backoff(Duration::from_secs(30))
+            .max_backoff(Duration::from_secs(30))
+            .max_retries(5)
+            .cancel_token(Some(token));
+
+        // cancelled while waiting for the first retry
+        let canceller = thread::spawn(move || {
+            thread::sleep(Duration::from_millis(100));
+            token.cancel();
+        });
+        let start = Instant::now();
+        let attempts = Cell::new(0);
+        let res: AttemptResult = driver.clone().retry(|attempt| {
+            attempts.set(attempts.get() + 1);
+            bail!("expected error #{}", attempt)
+        });
+        canceller.join().unwrap();
+        assert!(start.elapsed() < Duration::from_secs(5));
+        let err = res.unwrap_err();
+        assert!(is_cancelled(&err));
+        assert!(!is_deadline_exceeded(&err));
+        assert!(format!("{:#}", err).contains("expected error #0"));
+        assert_eq!(attempts.get(), 1);
+
+        // once cancelled, nothing is attempted
+        attempts.set(0);
+        let res: AttemptResult = driver.retry(|_| {
+            attempts.set(attempts.get() + 1);
+            Ok(0)
+        });
+        assert!(is_cancelled(&res.unwrap_err()));
+        assert_eq!(attempts.get(), 0);
+
+        // cancelled during an attempt, without a wait in between
+        let flag: &'static AtomicBool = Box::leak(Box::new(AtomicBool::new(false)));
+        let token = CancelToken::new(flag);
+        let driver = Retry::new()
+            .initial_backoff(Duration::new(0, 0))
+            .max_backoff(Duration::new(0, 0))
+            .max_retries(5)
+            .cancel_token(Some(token));
+        let res: AttemptResult = driver.retry(|attempt| {
+            token.cancel();
+            bail!("expected error #{}", attempt)
+        });
+        let err = res.unwrap_err();
+        assert!(is_cancelled(&err));
+        assert!(format!("{:#}", err).contains("expected error #0"));
+    }
+
+    #[test]
+    fn test_backoff_strategies() {
+        let secs = Duration::from_secs;
+        let sequence = |driver: Retry| -> Vec<Duration> {
+            (1..=6).map(|retry| driver.delay_for(retry)).collect()
+        };
+
+        let driver = Retry::new().initial_backoff(secs(1)).max_backoff(secs(5));
+        assert_eq!(
+            sequence(driver.clone()),
+            vec![secs(1), secs(2), secs(4), secs(5), secs(5), secs(5)]
+        );
+        assert_eq!(
+            sequence(driver.clone().backoff(Backoff::Fixed)),
+            vec![secs(1); 6]
+        );
+        assert_eq!(
+            sequence(driver.clone().backoff(Backoff::Linear)),
+            vec![secs(1), secs(2), secs(3), secs(4), secs(5), secs(5)]
+        );
+        assert_eq!(
+            sequence(
+                driver
+                    .clone()
+                    .backoff(Backoff::Custom(|retry| Duration::from_secs(
+                        6 - u64::from(retry)
+                    )))
+            ),
+            vec![secs(5), secs(4), secs(3), secs(2), secs(1), secs(0)]
+        );
+
+        // no maximum backoff, and no overflow on large retry numbers
+        let driver = Retry::new().initial_backoff(secs(1)).max_backoff(secs(0));
+        assert_eq!(driver.delay_for(4), secs(8));
+        assert_eq!(driver.delay_for(13), MAX_DELAY);
+        assert_eq!(driver.delay_for(u8::max_value()), MAX_DELAY);
+        let driver = driver.backoff(Backoff::Custom(|_| Duration::from_secs(u64::max_value())));
+        assert_eq!(driver.delay_for(1), MAX_DELAY);
+    }
+
+    #[test]
+    fn test_retry_after() {
+        let ms = Duration::from_millis;
+        let driver = Retry::new().initial_backoff(ms(100)).max_backoff(ms(1000));
+        let asking =
+            |delay| anyhow::Error::new(RetryAfter(delay)).context("503 Service Unavailable");
+
+        // longer than the backoff
+        assert_eq!(driver.wait_after(1, &asking(ms(500))), ms(500));
+        // shorter than the backoff
+        assert_eq!(driver.wait_after(3, &asking(ms(50))), ms(400));
+        // capped to the maximum backoff
+        assert_eq!(driver.wait_after(1, &asking(ms(60_000))), ms(1000));
+        // other errors
+        assert_eq!(driver.wait_after(2, &anyhow::anyhow!("other")), ms(200));
+    }
+
+    #[test]
+    fn test_jitter() {
+        let secs = Duration::from_secs;
+        let driver = Retry::new().initial_backoff(secs(1)).max_backoff(secs(5));
+
+        // disabled by default
+        assert_eq!(driver.wait_for(3), secs(4));
+
+        // bounds of the random range
+        let mut driver = driver.jitter(true);
+        driver.random = || 0;
+        assert_eq!(driver.wait_for(3), secs(0));
+        driver.random = u64::max_value;
+        assert!(driver.wait_for(3) <= secs(4));
+        assert_eq!(full_jitter(secs(4), 4_000_000_000), secs(4));
+        assert_eq!(full_jitter(secs(0), 42), secs(0));
+
+        // capped to the backoff on every retry, and actually spread out
+        driver.random = random_u64;
+        let waits: Vec<Duration> = (1..=200).map(|retry| driver.wait_for(retry)).collect();
+        for (retry, wait) in (1..=200).zip(&waits) {
+            assert!(*wait <= driver.delay_for(retry));
+            assert!(*wait <= secs(5));
+        }
+        assert!(waits.iter().any(|wait| *wait != waits[0]));
+
+        // no overflow without maximum backoff
+        let driver = Retry::new()
+            .initial_backoff(secs(1))
+            .max_backoff(secs(0))
+            .jitter(true);
+        assert!(driver.wait_for(u8::max_value()) <= MAX_DELAY);
+    }
 }
@@ -0,0 +1,107 @@
+//! Helpers for reading files from config-drives.
+
+use crate::retry;
+use anyhow::{anyhow, Context, Result};
+use slog_scope::debug;
+use std::fs;
+use std::io::{self, ErrorKind};
+use std::path::Path;
+use std::time::Duration;
+
+/// Default delay between attempts to read a config-drive file.
+pub const DEFAULT_READ_RETRY_INTERVAL: Duration = Duration::from_millis(500);
+
+/// How many times, and how often, failed config-drive reads are retried.
+#[derive(Clone, Copy, Debug, PartialEq, Eq)]
+pub struct ReadRetry {
+    pub retries: u8,
+    pub interval: Duration,
+}
+
+impl Default for ReadRetry {
+    fn default() -> Self {
+        ReadRetry {
+            retries: 0,
+            interval: DEFAULT_READ_RETRY_INTERVAL,
+        }
+    }
+}
+
+/// Read a file from a config-drive, retrying on read errors.
+///
+/// A missing file is an error, without retrying.
+pub(crate) fn read_file(path: &Path, retry: ReadRetry) -> Result<Vec<u8>> {
+    read_optional_file(path, retry)?.ok_or_else(|| anyhow!("file '{:?}' not found", path))
+}
+
+/// Read a file from a config-drive, retrying on read errors.
+///
+/// A missing file is reported as `None`, without retrying.
+pub(crate) fn read_optional_file(path: &Path, retry: ReadRetry) -> Result<Option<Vec<u8>>> {
+    read_with_retry(path, retry.retries, retry.interval, |p| fs::read(p))
+}
+
+fn read_with_retry<F>(
+    path: &Path,
+    retries: u8,
+    interval: Duration,
+    read: F,
+) -> Result<Option<Vec<u8>>>
+where
+    F: Fn(&Path) -> io::Result<Vec<u8>>,
+{
+    retry::Retry::new()
+        .initial_backoff(interval)
+        .max_backoff(interval)
+        .backoff(retry::Backoff::Fixed)
+        .max_retries(retries)
+        .retry(|attempt| {
+            debug!("reading '{}': attempt #{}", path.display(), attempt + 1);
+            match read(path) {
+                Ok(contents) => Ok(Some(contents)),
+                // the drive is mounted, absent files won't show up later
+                Err(e) if e.kind() == ErrorKind::NotFound => Ok(None),
+                Err(e) => Err(e).with_context(|| format!("failed to read file '{:?}'", path)),
+            }
+        })
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::cell::Cell;
+
+    #[test]
+    fn test_read_with_retry() {
+        let path = Path::new("/config-drive/meta_data.json");
+        let interval = Duration::from_millis(1);
+
+        // fails twice, then succeeds
+        let attempts = Cell::new(0);
+        let flaky = |_: &Path| {
+            attempts.set(attempts.get() + 1);
+            if attempts.get() <= 2 {
+                Err(io::Error::new(ErrorKind::Other, "I/O error"))
+            } else {
+                Ok(b"{}".to_vec())
+            }
+        };
+        let contents = read_with_retry(path, 3, interval, &flaky).unwrap();
+        assert_eq!(contents, Some(b"{}".to_vec()));
+        assert_eq!(attempts.get(), 3);
+
+        // not enough retries
+        attempts.set(0);
+        read_with_retry(path, 1, interval, &flaky).unwrap_err();
+        assert_eq!(attempts.get(), 2);
+
+        // absent files are not retried
+        attempts.set(0);
+        let absent = |_: &Path| {
+            attempts.set(attempts.get() + 1);
+            Err(io::Error::new(ErrorKind::NotFound, "not found"))
+        };
+        assert_eq!(read_with_retry(path, 3, interval, absent).unwrap(), None);
+        assert_eq!(attempts.get(), 1);
+    }
+}
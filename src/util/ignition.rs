@@ -0,0 +1,117 @@
+//! Ignition platform-id file parsing - utility functions
+//!
+//! The platform-id file is an environment-style file (e.g. `/run/ignition.env`)
+//! with a `PLATFORM_ID=<id>` entry, as written by Ignition.
+
+use anyhow::{anyhow, Context, Result};
+use slog_scope::trace;
+use std::fs::File;
+
+/// Platform key.
+const PLATFORM_ID_KEY: &str = "PLATFORM_ID";
+
+/// Get the provider for the platform recorded in an Ignition platform-id file.
+pub fn get_ignition_platform(fpath: &str) -> Result<String> {
+    let file = File::open(fpath)
+        .with_context(|| format!("Failed to open platform-id file ({})", fpath))?;
+    let platform = super::key_lookup('=', PLATFORM_ID_KEY, file)
+        .with_context(|| format!("Failed to read platform-id file ({})", fpath))?
+        .map(|v| v.trim().to_string())
+        .filter(|v| !v.is_empty())
+        .ok_or_else(|| {
+            anyhow!(
+                "Couldn't find key '{}' in platform-id file ({})",
+                PLATFORM_ID_KEY,
+                fpath
+            )
+        })?;
+    trace!("found '{}' key: {}", PLATFORM_ID_KEY, platform);
+
+    provider_for_platform(&platform)
+        .map(String::from)
+        .ok_or_else(|| anyhow!("unsupported Ignition platform '{}'", platform))
+}
+
+/// Map an Ignition platform name to the corresponding provider name.
+fn provider_for_platform(platform: &str) -> Option<&'static str> {
+    let provider = match platform {
+        "aliyun" => "aliyun",
+        "aws" | "ec2" => "aws",
+        "azure" => "azure",
+        "azurestack" => "azurestack",
+        "cloudstack" => "cloudstack",
+        "digitalocean" => "digitalocean",
+        "exoscale" => "exoscale",
+        "gcp" | "gce" => "gcp",
+        "ibmcloud" => "ibmcloud",
+        "ibmcloud-classic" => "ibmcloud-classic",
+        "linode" => "linode",
+        "openstack" => "openstack",
+        "packet" => "packet",
+        "qemu" => "qemu",
+        "scaleway" => "scaleway",
+        "vmware" => "vmware",
+        "vultr" => "vultr",
+        _ => return None,
+    };
+    Some(provider)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::io::Write;
+
+    #[test]
+    fn test_provider_for_platform() {
+        let tests = vec![
+            ("aliyun", Some("aliyun")),
+            ("aws", Some("aws")),
+            ("ec2", Some("aws")),
+            ("azure", Some("azure")),
+            ("azurestack", Some("azurestack")),
+            ("cloudstack", Some("cloudstack")),
+            ("digitalocean", Some("digitalocean")),
+            ("exoscale", Some("exoscale")),
+            ("gcp", Some("gcp")),
+            ("gce", Some("gcp")),
+            ("ibmcloud", Some("ibmcloud")),
+            ("ibmcloud-classic", Some("ibmcloud-classic")),
+            ("linode", Some("linode")),
+            ("openstack", Some("openstack")),
+            ("packet", Some("packet")),
+            ("qemu", Some("qemu")),
+            ("scaleway", Some("scaleway")),
+            ("vmware", Some("vmware")),
+            ("vultr", Some("vultr")),
+            ("metal", None),
+            ("", None),
+        ];
+        for (platform, provider) in tests {
+            assert_eq!(
+                provider_for_platform(platform),
+                provider,
+                "failed testcase: '{}'",
+                platform
+            );
+        }
+    }
+
+    #[test]
+    fn test_get_ignition_platform() {
+        let mut file = tempfile::NamedTempFile::new().unwrap();
+        writeln!(file, "IGNITION_ARGS=\nPLATFORM_ID=ec2").unwrap();
+        let fpath = file.path().to_str().unwrap();
+        assert_eq!(get_ignition_platform(fpath).unwrap(), "aws");
+
+        let mut file = tempfile::NamedTempFile::new().unwrap();
+        writeln!(file, "PLATFORM_ID=metal").unwrap();
+        let fpath = file.path().to_str().unwrap();
+        get_ignition_platform(fpath).unwrap_err();
+
+        let mut file = tempfile::NamedTempFile::new().unwrap();
+        writeln!(file, "IGNITION_ARGS=").unwrap();
+        let fpath = file.path().to_str().unwrap();
+        get_ignition_platform(fpath).unwrap_err();
+    }
+}
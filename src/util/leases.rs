@@ -0,0 +1,102 @@
+//! Helpers for reading DHCP leases recorded by systemd-networkd.
+
+use crate::retry;
+use anyhow::{anyhow, Context, Result};
+use slog_scope::{debug, trace};
+use std::fs::File;
+use std::path::Path;
+use std::time::Duration;
+
+/// Directory holding systemd-networkd DHCP leases, one file per interface index.
+const LEASES_DIR: &str = "/run/systemd/netif/leases";
+
+/// Return the lease file key for a DHCP option code.
+///
+/// systemd-networkd records some well-known options by name, and private
+/// options (224-254) as `OPTION_<code>`.
+pub fn lease_option_key(code: u8) -> String {
+    match code {
+        54 => "SERVER_ADDRESS".to_string(),
+        114 => "CAPTIVE_PORTAL".to_string(),
+        _ => format!("OPTION_{}", code),
+    }
+}
+
+/// Return the value of `key` in the DHCP lease of the given interface, if any.
+pub fn lease_option(iface_index: u32, key: &str) -> Result<Option<String>> {
+    lease_option_in(Path::new(LEASES_DIR), iface_index, key)
+}
+
+fn lease_option_in(dir: &Path, iface_index: u32, key: &str) -> Result<Option<String>> {
+    let lease_path = dir.join(iface_index.to_string());
+    if !lease_path.exists() {
+        return Ok(None);
+    }
+    debug!("found lease file - {:?}", lease_path);
+    let lease = File::open(&lease_path)
+        .with_context(|| format!("failed to open lease file ({:?})", lease_path))?;
+    let value = super::key_lookup('=', key, lease)?;
+    if value.is_none() {
+        debug!(
+            "failed to get value from existing lease file '{:?}'",
+            lease_path
+        );
+    }
+    Ok(value)
+}
+
+/// Look up `key` in the DHCP lease of any interface.
+///
+/// This waits a bit for leases to show up, as the network may still be
+/// coming up.
+fn lease_key_lookup(key: &str) -> Result<String> {
+    let interfaces = pnet_datalink::interfaces();
+    trace!("interfaces - {:?}", interfaces);
+
+    retry::Retry::new()
+        .initial_backoff(Duration::from_millis(50))
+        .max_backoff(Duration::from_millis(500))
+        .max_retries(60)
+        .retry(|_| {
+            for interface in &interfaces {
+                trace!("looking at interface {:?}", interface);
+                if let Some(v) = lease_option(interface.index, key)? {
+                    return Ok(v);
+                }
+            }
+            Err(anyhow!("failed to find '{}' in DHCP leases", key))
+        })
+}
+
+/// Look up a DHCP option in the lease of any interface, by option code.
+pub fn dhcp_option_lookup(code: u8) -> Result<String> {
+    lease_key_lookup(&lease_option_key(code))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_lease_option() {
+        let dir = Path::new("./tests/fixtures/networkd-leases");
+
+        let key = lease_option_key(245);
+        assert_eq!(key, "OPTION_245");
+        assert_eq!(
+            lease_option_in(dir, 2, &key).unwrap(),
+            Some("a83f8110".to_string())
+        );
+        assert_eq!(
+            lease_option_in(dir, 2, &lease_option_key(54)).unwrap(),
+            Some("168.63.129.16".to_string())
+        );
+        assert_eq!(
+            lease_option_in(dir, 2, &lease_option_key(114)).unwrap(),
+            Some("https://portal.example.com/provision".to_string())
+        );
+        assert_eq!(lease_option_in(dir, 2, "OPTION_224").unwrap(), None);
+        // no lease for this interface
+        assert_eq!(lease_option_in(dir, 3, &key).unwrap(), None);
+    }
+}
@@ -14,20 +14,29 @@
 
 //! utility functions
 
-use crate::retry;
 use anyhow::{anyhow, Context, Result};
-use slog_scope::{debug, trace};
-use std::fs::File;
 use std::io::{BufRead, BufReader, Read};
-use std::path::Path;
-use std::time::Duration;
+use std::path::{Path, PathBuf};
 
 mod cmdline;
 pub use self::cmdline::{get_platform, has_network_kargs};
 
+pub mod drive;
+
+mod ignition;
+pub use self::ignition::get_ignition_platform;
+
+mod leases;
+pub use self::leases::dhcp_option_lookup;
+
 mod mount;
 pub(crate) use mount::{mount_ro, unmount};
 
+mod selinux;
+pub(crate) use selinux::restorecon;
+
+pub mod signal;
+
 fn key_lookup_line(delim: char, key: &str, line: &str) -> Option<String> {
     match line.find(delim) {
         Some(index) => {
@@ -54,42 +63,113 @@ pub fn key_lookup<R: Read>(delim: char, key: &str, reader: R) -> Result<Option<S
     Ok(None)
 }
 
-pub fn dns_lease_key_lookup(key: &str) -> Result<String> {
-    let interfaces = pnet_datalink::interfaces();
-    trace!("interfaces - {:?}", interfaces);
-
-    retry::Retry::new()
-        .initial_backoff(Duration::from_millis(50))
-        .max_backoff(Duration::from_millis(500))
-        .max_retries(60)
-        .retry(|_| {
-            for interface in interfaces.clone() {
-                trace!("looking at interface {:?}", interface);
-                let lease_path = format!("/run/systemd/netif/leases/{}", interface.index);
-                let lease_path = Path::new(&lease_path);
-                if lease_path.exists() {
-                    debug!("found lease file - {:?}", lease_path);
-                    let lease = File::open(&lease_path)
-                        .with_context(|| format!("failed to open lease file ({:?})", lease_path))?;
-
-                    if let Some(v) = key_lookup('=', key, lease)? {
-                        return Ok(v);
-                    }
-
-                    debug!(
-                        "failed to get value from existing lease file '{:?}'",
-                        lease_path
-                    );
-                }
+/// Check that a metadata API version is in `YYYY-MM-DD` format.
+pub fn validate_api_version(version: &str) -> Result<()> {
+    let fields: Vec<&str> = version.split('-').collect();
+    let valid = match fields.as_slice() {
+        [year, month, day] => {
+            year.len() == 4
+                && month.len() == 2
+                && day.len() == 2
+                && fields.iter().all(|f| f.chars().all(|c| c.is_ascii_digit()))
+        }
+        _ => false,
+    };
+    if !valid {
+        return Err(anyhow!(
+            "invalid API version '{}', expected format YYYY-MM-DD",
+            version
+        ));
+    }
+    Ok(())
+}
+
+/// Parse octal file permissions, e.g. `0600`.
+pub fn parse_file_mode(mode: &str) -> Result<u32> {
+    let parsed = u32::from_str_radix(mode, 8)
+        .with_context(|| format!("invalid file mode '{}', expected octal", mode))?;
+    if parsed > 0o777 {
+        return Err(anyhow!("invalid file mode '{}', out of range", mode));
+    }
+    Ok(parsed)
+}
+
+/// Check whether `name` matches a glob `pattern`.
+///
+/// In patterns, `*` matches any sequence of characters (including none)
+/// and `?` matches a single character.
+pub fn glob_match(pattern: &str, name: &str) -> bool {
+    let pattern: Vec<char> = pattern.chars().collect();
+    let name: Vec<char> = name.chars().collect();
+    let (mut p, mut n) = (0, 0);
+    // position of the last `*` in the pattern, and of the name when reached
+    let mut backtrack: Option<(usize, usize)> = None;
+    while n < name.len() {
+        match pattern.get(p) {
+            Some('*') => {
+                backtrack = Some((p, n));
+                p += 1;
+            }
+            Some(&c) if c == '?' || c == name[n] => {
+                p += 1;
+                n += 1;
             }
-            Err(anyhow!("failed to retrieve fabric address"))
-        })
+            _ => match backtrack {
+                // let the last `*` consume one more character
+                Some((star, consumed)) => {
+                    p = star + 1;
+                    n = consumed + 1;
+                    backtrack = Some((star, consumed + 1));
+                }
+                None => return false,
+            },
+        }
+    }
+    pattern[p..].iter().all(|&c| c == '*')
+}
+
+/// Re-root a path under the given directory.
+///
+/// Absolute paths are treated as relative to `root`.
+pub fn join_root(root: &Path, path: &Path) -> PathBuf {
+    let relative = path.strip_prefix("/").unwrap_or(path);
+    root.join(relative)
 }
 
 #[cfg(test)]
 mod tests {
     use super::*;
     use std::io::Cursor;
+
+    #[test]
+    fn test_glob_match() {
+        let tests = vec![
+            ("AWS_IPV4_*", "AWS_IPV4_LOCAL", true),
+            ("AWS_IPV4_*", "AWS_IPV4_", true),
+            ("AWS_IPV4_*", "AWS_IPV6_LOCAL", false),
+            ("*_HOSTNAME", "GCP_HOSTNAME", true),
+            ("*_HOSTNAME", "GCP_HOSTNAME_2", false),
+            ("AWS_*_LOCAL", "AWS_IPV4_LOCAL", true),
+            ("AWS_IPV?_LOCAL", "AWS_IPV6_LOCAL", true),
+            ("AWS_IPV?_LOCAL", "AWS_IPV_LOCAL", false),
+            ("*A*B", "xAyAzB", true),
+            ("*", "", true),
+            ("", "", true),
+            ("", "A", false),
+            ("AWS_REGION", "AWS_REGION", true),
+            ("AWS_REGION", "AWS_REGIONS", false),
+        ];
+        for (pattern, name, expected) in tests {
+            assert_eq!(
+                glob_match(pattern, name),
+                expected,
+                "{} ~ {}",
+                pattern,
+                name
+            );
+        }
+    }
+
     #[test]
     fn key_lookup_test() {
         let tests = vec![
@@ -110,4 +190,43 @@ mod tests {
             assert_eq!(val.unwrap(), expected_val);
         }
     }
+
+    #[test]
+    fn validate_api_version_test() {
+        for version in &["2019-10-01", "2012-11-30"] {
+            validate_api_version(version).unwrap();
+        }
+        for version in &[
+            "",
+            "latest",
+            "2019-10",
+            "2019-10-1",
+            "19-10-01",
+            "2019-1a-01",
+        ] {
+            validate_api_version(version).unwrap_err();
+        }
+    }
+
+    #[test]
+    fn parse_file_mode_test() {
+        assert_eq!(parse_file_mode("0600").unwrap(), 0o600);
+        assert_eq!(parse_file_mode("644").unwrap(), 0o644);
+        for mode in &["", "0800", "rw-r--r--", "1777", "-600"] {
+            parse_file_mode(mode).unwrap_err();
+        }
+    }
+
+    #[test]
+    fn join_root_test() {
+        let root = Path::new("/tmp/root");
+        let tests = vec![
+            ("/etc/hostname", "/tmp/root/etc/hostname"),
+            ("run/metadata", "/tmp/root/run/metadata"),
+            ("/", "/tmp/root"),
+        ];
+        for (path, expected) in tests {
+            assert_eq!(join_root(root, Path::new(path)), PathBuf::from(expected));
+        }
+    }
 }
@@ -0,0 +1,94 @@
+//! Helpers for SELinux labeling.
+
+use anyhow::{bail, Context, Result};
+use slog_scope::{debug, warn};
+use std::ffi::OsStr;
+use std::io;
+use std::path::Path;
+use std::process::{Command, Output};
+
+/// Tool restoring the default SELinux context of files.
+const RESTORECON: &str = "restorecon";
+
+/// Restore the default SELinux context of a file, via `restorecon`.
+///
+/// A missing `restorecon` (e.g. on systems without SELinux) is only
+/// reported as a warning.
+pub(crate) fn restorecon(path: &Path) -> Result<()> {
+    restorecon_with(path, |program, args| {
+        Command::new(program).args(args).output()
+    })
+}
+
+/// Restore the default SELinux context of a file, running commands
+/// through the given runner.
+fn restorecon_with<F>(path: &Path, run: F) -> Result<()>
+where
+    F: FnOnce(&str, &[&OsStr]) -> io::Result<Output>,
+{
+    debug!("restoring SELinux context of {:?}", path);
+    match run(RESTORECON, &[path.as_os_str()]) {
+        Err(ref e) if e.kind() == io::ErrorKind::NotFound => {
+            warn!(
+                "{} not found, skipping SELinux relabeling of {:?}",
+                RESTORECON, path
+            );
+            Ok(())
+        }
+        Err(e) => Err(e).with_context(|| format!("failed to run {}", RESTORECON)),
+        Ok(out) if !out.status.success() => bail!(
+            "{} failed on {:?}: {}",
+            RESTORECON,
+            path,
+            String::from_utf8_lossy(&out.stderr).trim()
+        ),
+        Ok(_) => Ok(()),
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::cell::RefCell;
+    use std::ffi::OsString;
+    use std::os::unix::process::ExitStatusExt;
+    use std::process::ExitStatus;
+
+    fn output(code: i32, stderr: &str) -> Output {
+        Output {
+            // wait status, with the exit code in the second byte
+            status: ExitStatus::from_raw(code << 8),
+            stdout: vec![],
+            stderr: stderr.as_bytes().to_vec(),
+        }
+    }
+
+    #[test]
+    fn test_restorecon() {
+        let path = Path::new("/home/core/.ssh/authorized_keys.d/afterburn");
+
+        let calls = RefCell::new(Vec::new());
+        restorecon_with(path, |program, args| {
+            let mut call = vec![OsString::from(program)];
+            call.extend(args.iter().map(|a| a.to_os_string()));
+            calls.borrow_mut().push(call);
+            Ok(output(0, ""))
+        })
+        .unwrap();
+        assert_eq!(
+            calls.into_inner(),
+            vec![vec![
+                OsString::from("restorecon"),
+                OsString::from("/home/core/.ssh/authorized_keys.d/afterburn"),
+            ]]
+        );
+
+        // missing tool is not fatal
+        restorecon_with(path, |_, _| Err(io::ErrorKind::NotFound.into())).unwrap();
+
+        // but failures are
+        restorecon_with(path, |_, _| Err(io::ErrorKind::PermissionDenied.into())).unwrap_err();
+        let err = restorecon_with(path, |_, _| Ok(output(1, "invalid context\n"))).unwrap_err();
+        assert!(err.to_string().contains("invalid context"), "{}", err);
+    }
+}
@@ -0,0 +1,40 @@
+//! Termination signal handling
+//!
+//! On SIGTERM (e.g. when systemd stops a unit which timed out), pending
+//! metadata fetches give up instead of retrying, so that Afterburn exits
+//! promptly with an error. A command run via `--exec` is terminated too.
+
+use crate::retry::{self, CancelToken};
+use anyhow::{Context, Result};
+use nix::sys::signal::{self, SaFlags, SigAction, SigHandler, SigSet, Signal};
+use std::sync::atomic::{AtomicBool, Ordering};
+
+/// Set once a termination signal was received.
+static TERMINATED: AtomicBool = AtomicBool::new(false);
+
+extern "C" fn on_terminate(_: nix::libc::c_int) {
+    TERMINATED.store(true, Ordering::SeqCst);
+}
+
+/// Check whether a termination signal was received.
+pub fn is_terminated() -> bool {
+    TERMINATED.load(Ordering::SeqCst)
+}
+
+/// Install a SIGTERM handler, and cancel retries on this thread once it
+/// fires.
+///
+/// Interrupted system calls are not restarted, so that blocking reads
+/// fail instead of waiting for their own timeout.
+pub fn cancel_retries_on_sigterm() -> Result<()> {
+    let action = SigAction::new(
+        SigHandler::Handler(on_terminate),
+        SaFlags::empty(),
+        SigSet::empty(),
+    );
+    // the handler only stores to an atomic, which is async-signal-safe
+    unsafe { signal::sigaction(Signal::SIGTERM, &action) }
+        .context("failed to install SIGTERM handler")?;
+    retry::set_cancel_token(Some(CancelToken::new(&TERMINATED)));
+    Ok(())
+}